@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type AdaptiveConfig struct {
+	// NearKm switches to polling Product while rain is within this
+	// distance of any city, raining cities included; 0 never does. The
+	// nearest rain is searched up to nearestRain.maxKm only.
+	NearKm float64 `yaml:"nearKm"`
+	// Product is the CHMI product polled while rain is near, such as
+	// pseudoCAPPI at a 5m cadence; empty keeps chmi.product.
+	Product string `yaml:"product"`
+	// DryInterval is how often to poll while no city rains and less than
+	// 1% of the country shows an echo, frames in between are skipped; 0
+	// polls every frame.
+	DryInterval time.Duration `yaml:"dryInterval"`
+}
+
+func (c AdaptiveConfig) validate(cfg *Config) error {
+	if c.NearKm < 0 {
+		return errors.New("adaptive nearKm must not be negative")
+	}
+	if c.DryInterval < 0 {
+		return errors.New("adaptive dryInterval must not be negative")
+	}
+	if c.Product == "" {
+		return nil
+	}
+	if cfg.Source != "" && cfg.Source != "chmi" {
+		return fmt.Errorf("adaptive product needs the chmi source, not %s", cfg.Source)
+	}
+	_, err := cfg.CHMI.productNamed(c.Product)
+	return err
+}
+
+// pollMode is how eagerly the loop polls.
+type pollMode string
+
+const (
+	pollNormal pollMode = "normal"
+	pollNear   pollMode = "near"
+	pollDry    pollMode = "dry"
+)
+
+// Adaptive picks the poll mode from the weather of the last frame.
+type Adaptive struct {
+	m    sync.Mutex
+	cfg  AdaptiveConfig
+	mode pollMode
+}
+
+func (a *Adaptive) Configure(cfg AdaptiveConfig) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.cfg = cfg
+	if cfg.NearKm <= 0 && a.mode == pollNear || cfg.DryInterval <= 0 && a.mode == pollDry {
+		a.mode = pollNormal
+	}
+}
+
+// Mode is the poll mode, normal before the first frame.
+func (a *Adaptive) Mode() pollMode {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.mode == "" {
+		return pollNormal
+	}
+	return a.mode
+}
+
+// observe picks the mode for the cities and stats of a frame: near while
+// rain is within nearKm of a city, dry while no city rains and the share
+// of the country with an echo stays under 1%.
+func (a *Adaptive) observe(cities []*City, stats *RainStats) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	near, raining := false, false
+	for _, city := range cities {
+		if !city.Coverage {
+			continue
+		}
+		raining = raining || city.Raining()
+		if a.cfg.NearKm > 0 && (city.Raining() || city.NearestRain != nil && city.NearestRain.DistanceKm <= a.cfg.NearKm) {
+			near = true
+			break
+		}
+	}
+	mode := pollNormal
+	switch {
+	case near:
+		mode = pollNear
+	case a.cfg.DryInterval > 0 && !raining && stats != nil && stats.SummaryDBZ == 0:
+		mode = pollDry
+	}
+	if mode == a.mode || a.mode == "" && mode == pollNormal {
+		a.mode = mode
+		return
+	}
+	switch mode {
+	case pollNear:
+		log.Printf("Rain within %g km of a city, polling eagerly", a.cfg.NearKm)
+	case pollDry:
+		log.Printf("The country is dry, polling every %s", a.cfg.DryInterval)
+	default:
+		log.Println("Polling every frame again")
+	}
+	a.mode = mode
+}
+
+// pollSource is the source the loop polls in the current mode: the
+// adaptive product of the chmi source while rain is near.
+func (h *Handler) pollSource(cfg *Config, fetcher Fetcher) (Source, error) {
+	if p := cfg.Adaptive.Product; p != "" && cfg.Adaptive.NearKm > 0 && h.adaptive.Mode() == pollNear {
+		near := *cfg
+		near.CHMI.Product = p
+		cfg = &near
+	}
+	return newSource(cfg, fetcher)
+}
+
+// dryWait is how long after a poll the next one is due, every step or,
+// while the country is dry, dryInterval rounded up to whole steps.
+func (h *Handler) dryWait(cfg *Config, step time.Duration) time.Duration {
+	if h.adaptive.Mode() != pollDry || cfg.Adaptive.DryInterval <= step {
+		return step
+	}
+	return (cfg.Adaptive.DryInterval + step - 1) / step * step
+}
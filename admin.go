@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type AdminConfig struct {
+	// Listen moves the admin endpoints off the public listener to an
+	// address such as 127.0.0.1:8081 (the default) or a Unix socket
+	// unix:<path>. Empty keeps them on listen, which needs a Token.
+	Listen string `yaml:"listen"`
+	// Token is required as "Authorization: Bearer <token>" by the admin
+	// endpoints, empty lets everyone who reaches their own listener in.
+	Token string `yaml:"token"`
+	// Pprof serves the Go profiler under /debug/pprof/ with the admin
+	// endpoints.
+	Pprof bool `yaml:"pprof"`
+}
+
+func (c AdminConfig) validate() error {
+	if c.Listen != "" {
+		if err := validateListen(c.Listen); err != nil {
+			return fmt.Errorf("admin %w", err)
+		}
+	}
+	return nil
+}
+
+// requireToken refuses to serve the admin endpoints on the public
+// listener without a token, they change files and the running state. Only
+// serve checks it, the other commands open no listener.
+func (c AdminConfig) requireToken() error {
+	if c.Listen == "" && c.Token == "" {
+		return errors.New("admin endpoints on the public listener need a token, set admin token or admin listen")
+	}
+	return nil
+}
+
+// adminOnly lets requests through that carry the admin token of the
+// current config.
+func (h *Handler) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := h.Config().Admin.Token
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && (!ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ledradar admin"`)
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminRoutes adds the operational endpoints to r.
+func (h *Handler) adminRoutes(r *mux.Router, cfg AdminConfig) {
+	r.HandleFunc("/admin/refresh", h.adminOnly(h.HandleRefresh)).Methods("POST")
+	r.HandleFunc("/frames", h.adminOnly(h.HandlePostFrame)).Methods("POST")
+	r.HandleFunc("/cities/geocode", h.adminOnly(h.HandleGeocode)).Methods("POST")
+	r.HandleFunc("/admin/reload", h.adminOnly(h.HandleReload)).Methods("POST")
+	r.HandleFunc("/admin/simulate", h.adminOnly(h.HandleSimulate)).Methods("POST")
+	r.HandleFunc("/admin/simulate", h.adminOnly(h.HandleEndSimulation)).Methods("DELETE")
+	r.HandleFunc("/admin/leds/test", h.adminOnly(h.HandleLEDTest)).Methods("POST")
+	r.HandleFunc("/admin/leds/test", h.adminOnly(h.HandleEndLEDTest)).Methods("DELETE")
+	r.HandleFunc("/admin/calibrate", h.adminOnly(h.HandleCalibrate)).Methods("GET")
+	if cfg.Pprof {
+		r.HandleFunc("/debug/pprof/cmdline", h.adminOnly(pprof.Cmdline))
+		r.HandleFunc("/debug/pprof/profile", h.adminOnly(pprof.Profile))
+		r.HandleFunc("/debug/pprof/symbol", h.adminOnly(pprof.Symbol))
+		r.HandleFunc("/debug/pprof/trace", h.adminOnly(pprof.Trace))
+		r.PathPrefix("/debug/pprof/").HandlerFunc(h.adminOnly(pprof.Index))
+	}
+}
+
+// HandleRefresh polls the radar right away instead of waiting for the
+// schedule. Replicas and instances not leading have no pipeline to run.
+func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	if h.Config().Redis.Replica || !h.leader.Leading() {
+		http.Error(w, "this instance does not process frames", http.StatusConflict)
+		return
+	}
+	h.ProcessFrame()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveAdmin serves handler on the admin address.
+func serveAdmin(addr string, handler http.Handler) error {
+	ln, err := listenAddr(addr)
+	if err != nil {
+		return fmt.Errorf("admin listener: %w", err)
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// the owner and group only, the socket is what guards it
+		if err := os.Chmod(path, 0660); err != nil {
+			return err
+		}
+	}
+	log.Printf("Serving the admin endpoints on %s", ln.Addr())
+	return http.Serve(ln, handler)
+}
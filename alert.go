@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"time"
+)
+
+// AlertLevel sums up how much attention the weather over a place needs,
+// from none to severe, for the displays to show in one way.
+type AlertLevel int
+
+const (
+	AlertNone AlertLevel = iota
+	AlertLow
+	AlertModerate
+	AlertHigh
+	AlertSevere
+)
+
+// alertLevel rates a rain state: the intensity, one level more while it
+// intensifies up to high, and severe with hail or lightning around.
+func alertLevel(s *RainState) AlertLevel {
+	level := AlertLevel(s.Intensity)
+	if s.Trend == TrendIntensifying && level > AlertNone && level < AlertHigh {
+		level++
+	}
+	if s.Hail || s.Strikes10Min > 0 {
+		level = AlertSevere
+	}
+	return level
+}
+
+// LEDBehavior is how an LED shows its color.
+type LEDBehavior string
+
+const (
+	BehaviorSolid     LEDBehavior = "solid"
+	BehaviorBreathing LEDBehavior = "breathing"
+	BehaviorBlinking  LEDBehavior = "blinking"
+	// BehaviorFlashing blinks white over the color with flashPattern.
+	BehaviorFlashing LEDBehavior = "flashing"
+)
+
+func (c LEDConfig) validateBehaviors() error {
+	for level, b := range c.Behaviors {
+		if level < AlertNone || level > AlertSevere {
+			return fmt.Errorf("leds behaviors: alert levels are 0 to 4, not %d", level)
+		}
+		switch b {
+		case BehaviorSolid, BehaviorBreathing, BehaviorBlinking, BehaviorFlashing:
+		default:
+			return fmt.Errorf("leds behaviors: unknown behavior %q", b)
+		}
+	}
+	return nil
+}
+
+// behavior is the configured behavior of a level, solid if unset.
+func (c LEDConfig) behavior(level AlertLevel) LEDBehavior {
+	if b, ok := c.Behaviors[level]; ok {
+		return b
+	}
+	return BehaviorSolid
+}
+
+// animated tells whether any LED changes over time.
+func animated(behaviors []LEDBehavior) bool {
+	for _, b := range behaviors {
+		if b != BehaviorSolid {
+			return true
+		}
+	}
+	return false
+}
+
+// renderBehaviors returns the LED colors as they show at t.
+func renderBehaviors(leds []color.NRGBA, behaviors []LEDBehavior, t time.Time) []color.NRGBA {
+	out := make([]color.NRGBA, len(leds))
+	ms := t.UnixMilli()
+	// breathing swings between a fifth and full brightness every 3 s
+	breath := 0.2 + 0.8*(0.5-0.5*math.Cos(2*math.Pi*float64(ms%3000)/3000))
+	for i, c := range leds {
+		out[i] = c
+		if i >= len(behaviors) {
+			continue
+		}
+		switch behaviors[i] {
+		case BehaviorBreathing:
+			out[i] = color.NRGBA{uint8(float64(c.R) * breath), uint8(float64(c.G) * breath), uint8(float64(c.B) * breath), c.A}
+		case BehaviorBlinking:
+			if ms%1000 >= 500 {
+				out[i] = color.NRGBA{0, 0, 0, c.A}
+			}
+		case BehaviorFlashing:
+			if flashPattern(t) {
+				out[i] = color.NRGBA{255, 255, 255, 255}
+			}
+		}
+	}
+	return out
+}
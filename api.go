@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// staleness reports the age of the current data and whether it is stale.
+// Must be called with h.m held.
+func (h *Handler) staleness() (time.Duration, bool, bool) {
+	if h.FrameTime.IsZero() {
+		return 0, true, false
+	}
+	age := h.clock.Now().Sub(h.FrameTime)
+	cfg := h.config
+	return age, age > cfg.StaleAfter, cfg.StaleLimit > 0 && age > cfg.StaleLimit
+}
+
+// writeStaleness sets the staleness headers and answers 503 once the data
+// is past the configured limit. It returns false if the response is done.
+func (h *Handler) writeStaleness(w http.ResponseWriter) bool {
+	age, stale, expired := h.staleness()
+	w.Header().Set("Age", fmt.Sprint(int(age.Seconds())))
+	w.Header().Set("X-Data-Stale", fmt.Sprint(stale))
+	w.Header().Set("X-Data-Source", h.DataSource)
+	w.Header().Set("X-Frame-ID", fmt.Sprint(h.Snapshot.ID))
+	if !h.nextPoll.IsZero() {
+		w.Header().Set("X-Next-Poll", h.nextPoll.UTC().Format(time.RFC3339))
+	}
+	if expired {
+		http.Error(w, "radar data is too old", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// serveFrame writes a representation of the current frame with an ETag and
+// Last-Modified derived from the frame time, answering conditional requests
+// with 304. Must be called with h.m held.
+func (h *Handler) serveFrame(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	if !h.FrameTime.IsZero() && w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, h.FrameTime.Unix()))
+	}
+	http.ServeContent(w, r, "", h.FrameTime, bytes.NewReader(body))
+}
+
+func (h *Handler) serveJSON(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.serveFrame(w, r, "application/json", append(body, '\n'))
+}
+
+func (h *Handler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+	_, raining := h.tenantCities(r)
+	h.serveCities(w, r, raining, false)
+}
+
+type citiesResponse struct {
+	Frame      time.Time `json:"frame"`
+	FrameID    uint64    `json:"frameId"`
+	AgeSeconds int       `json:"ageSeconds"`
+	Stale      bool      `json:"stale"`
+	Source     string    `json:"source"`
+	// NextPoll is when the radar is checked for a new frame next.
+	NextPoll *time.Time `json:"nextPoll,omitempty"`
+	Cities   []*City    `json:"cities"`
+}
+
+func (h *Handler) HandleCities(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+	cities, _ := h.tenantCities(r)
+	h.serveCities(w, r, cities, true)
+}
+
+// HandleImage serves the last annotated radar image. labels=true|false
+// overrides whether city labels are drawn, format=png|jpeg|webp and
+// width re-encode and scale it, quality sets the JPEG quality.
+func (h *Handler) HandleImage(w http.ResponseWriter, r *http.Request) {
+	variant, err := parseImageVariant(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if h.Image == nil {
+		http.Error(w, "no radar frame yet", http.StatusServiceUnavailable)
+		return
+	}
+	if !h.writeStaleness(w) {
+		return
+	}
+
+	if variant.labels == nil {
+		labels := h.config.Image.Labels
+		variant.labels = &labels
+	}
+	if variant.original(h.config.Image.Labels) {
+		h.serveFrame(w, r, "image/png", h.Image)
+		return
+	}
+
+	body, err := h.images.get(h.FrameTime, variant, func() ([]byte, error) {
+		return h.renderImage(variant)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%s"`, h.FrameTime.Unix(), variant))
+	h.serveFrame(w, r, variant.contentType(), body)
+}
+
+func (h *Handler) HandleCells(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+	cells := h.Cells
+	if cells == nil {
+		cells = []*Cell{}
+	}
+	h.serveJSON(w, r, cells)
+}
+
+func (h *Handler) HandleSets(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	names := []string{}
+	for name := range h.Sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	json.NewEncoder(w).Encode(names)
+}
+
+func (h *Handler) HandleSet(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	set, ok := h.Sets[mux.Vars(r)["name"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.writeStaleness(w) {
+		return
+	}
+	h.serveCities(w, r, set.Cities, true)
+}
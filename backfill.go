@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type BackfillConfig struct {
+	// Frames is how many frames before the current one are run through
+	// the pipeline on startup, 0 disables it.
+	Frames int `yaml:"frames"`
+}
+
+// Backfill runs the n frames before the current one through the pipeline,
+// oldest first, so rain durations, trends, smoothing and cell tracks start
+// out seeded. The outputs only hear of the frames that follow.
+func (h *Handler) Backfill(n int) {
+	if n <= 0 || h.simulating() {
+		return
+	}
+	source, _ := newSource(h.Config(), h.fetcher)
+	latest := source.FrameTime(h.clock.Now())
+	log.Printf("Backfilling %d frames of %s", n, source.Name())
+
+	for i := n; i >= 1; i-- {
+		h.backfillFrame(source, source.FrameTime(latest.Add(-time.Duration(i)*source.Cadence())))
+	}
+}
+
+// backfillFrame runs the frame at t through the pipeline, keeping the
+// outputs out of it. Like every pass it holds h.process, so frames posted
+// or simulated meanwhile wait for it and still reach the outputs.
+func (h *Handler) backfillFrame(source Source, t time.Time) {
+	h.process.Lock()
+	defer h.process.Unlock()
+	if h.simulating() {
+		return
+	}
+	h.m.Lock()
+	h.backfilling = true
+	h.m.Unlock()
+	defer func() {
+		h.m.Lock()
+		h.backfilling = false
+		h.m.Unlock()
+	}()
+
+	ctx, span := tracer.Start(context.Background(), "backfill", frameAttributes(source.Name(), t))
+	frame, err := h.fetch(ctx, source, t)
+	if err != nil {
+		log.Printf("Cannot backfill %s: %s", t.Format(frameTimeFormat), err)
+		endSpan(span, err)
+		return
+	}
+	h.addEchoTop(ctx, frame)
+	img := h.Apply(ctx, source.Name(), frame)
+	if !h.store.Has(t) {
+		if err := h.store.Save(t, img); err != nil {
+			log.Println(err)
+		}
+	}
+	span.End()
+}
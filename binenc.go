@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// binaryContentTypes are the binary encodings of the JSON responses.
+var binaryContentTypes = map[string]string{
+	"msgpack": "application/msgpack",
+	"cbor":    "application/cbor",
+}
+
+// encodeBinary encodes v as MessagePack or CBOR in the shape of its JSON,
+// with the same keys and values, integers staying integers and floats
+// shrinking to 32 bits where that loses nothing. Object keys are sorted.
+func encodeBinary(format string, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "msgpack":
+		writeMsgpack(&buf, tree)
+	case "cbor":
+		writeCBOR(&buf, tree)
+	default:
+		return nil, fmt.Errorf("unknown binary format %q", format)
+	}
+	return buf.Bytes(), nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonNumber splits a decoded JSON number into an integer or a float.
+func jsonNumber(n json.Number) (int64, float64, bool) {
+	if !strings.ContainsAny(n.String(), ".eE") {
+		if i, err := n.Int64(); err == nil {
+			return i, 0, true
+		}
+	}
+	f, _ := n.Float64()
+	return 0, f, false
+}
+
+func writeMsgpack(buf *bytes.Buffer, v any) {
+	be := binary.BigEndian
+	header := func(n int, fix, b8, b16, b32 byte, fixMax int) {
+		switch {
+		case n <= fixMax:
+			buf.WriteByte(fix | byte(n))
+		case b8 != 0 && n <= math.MaxUint8:
+			buf.Write([]byte{b8, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(b16)
+			buf.Write(be.AppendUint16(nil, uint16(n)))
+		default:
+			buf.WriteByte(b32)
+			buf.Write(be.AppendUint32(nil, uint32(n)))
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		i, f, isInt := jsonNumber(v)
+		switch {
+		case !isInt && float64(float32(f)) == f:
+			buf.WriteByte(0xca)
+			buf.Write(be.AppendUint32(nil, math.Float32bits(float32(f))))
+		case !isInt:
+			buf.WriteByte(0xcb)
+			buf.Write(be.AppendUint64(nil, math.Float64bits(f)))
+		case i >= 0 && i < 128, i < 0 && i >= -32:
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			buf.Write([]byte{0xd0, byte(i)})
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			buf.WriteByte(0xd1)
+			buf.Write(be.AppendUint16(nil, uint16(i)))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			buf.WriteByte(0xd2)
+			buf.Write(be.AppendUint32(nil, uint32(i)))
+		default:
+			buf.WriteByte(0xd3)
+			buf.Write(be.AppendUint64(nil, uint64(i)))
+		}
+	case string:
+		header(len(v), 0xa0, 0xd9, 0xda, 0xdb, 31)
+		buf.WriteString(v)
+	case []any:
+		header(len(v), 0x90, 0, 0xdc, 0xdd, 15)
+		for _, e := range v {
+			writeMsgpack(buf, e)
+		}
+	case map[string]any:
+		header(len(v), 0x80, 0, 0xde, 0xdf, 15)
+		for _, k := range sortedKeys(v) {
+			writeMsgpack(buf, k)
+			writeMsgpack(buf, v[k])
+		}
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, v any) {
+	be := binary.BigEndian
+	head := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			buf.WriteByte(major<<5 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{major<<5 | 24, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(major<<5 | 25)
+			buf.Write(be.AppendUint16(nil, uint16(n)))
+		case n <= math.MaxUint32:
+			buf.WriteByte(major<<5 | 26)
+			buf.Write(be.AppendUint32(nil, uint32(n)))
+		default:
+			buf.WriteByte(major<<5 | 27)
+			buf.Write(be.AppendUint64(nil, n))
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		i, f, isInt := jsonNumber(v)
+		switch {
+		case !isInt && float64(float32(f)) == f:
+			buf.WriteByte(0xfa)
+			buf.Write(be.AppendUint32(nil, math.Float32bits(float32(f))))
+		case !isInt:
+			buf.WriteByte(0xfb)
+			buf.Write(be.AppendUint64(nil, math.Float64bits(f)))
+		case i >= 0:
+			head(0, uint64(i))
+		default:
+			head(1, uint64(-1-i))
+		}
+	case string:
+		head(3, uint64(len(v)))
+		buf.WriteString(v)
+	case []any:
+		head(4, uint64(len(v)))
+		for _, e := range v {
+			writeCBOR(buf, e)
+		}
+	case map[string]any:
+		head(5, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			writeCBOR(buf, k)
+			writeCBOR(buf, v[k])
+		}
+	}
+}
+
+// serveBinary writes v as MessagePack or CBOR. Must be called with h.m
+// held.
+func (h *Handler) serveBinary(w http.ResponseWriter, r *http.Request, format string, v any) {
+	body, err := encodeBinary(format, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.serveFrame(w, r, binaryContentTypes[format], body)
+}
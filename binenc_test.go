@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestEncodeBinary(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       any
+		msgpack string
+		cbor    string
+	}{
+		{"null", nil, "c0", "f6"},
+		{"true", true, "c3", "f5"},
+		{"false", false, "c2", "f4"},
+		{"small int", 1, "01", "01"},
+		{"negative fixint", -1, "ff", "20"},
+		{"int8", -100, "d09c", "3863"},
+		{"int16", 200, "d100c8", "18c8"},
+		{"int32", 70000, "d200011170", "1a00011170"},
+		{"int64", int64(1) << 40, "d30000010000000000", "1b0000010000000000"},
+		{"float32", 1.5, "ca3fc00000", "fa3fc00000"},
+		{"float64", 0.1, "cb3fb999999999999a", "fb3fb999999999999a"},
+		{"string", "a", "a161", "6161"},
+		{"array", []int{1, 2}, "920102", "820102"},
+		{"map, sorted keys", map[string]int{"b": 1, "a": 2}, "82a16102a16201", "a2616102616201"},
+		{"struct as its json", struct {
+			ID   int    `json:"id"`
+			Name string `json:"name,omitempty"`
+		}{ID: 3}, "81a2696403", "a162696403"},
+	}
+	for _, tt := range tests {
+		for format, want := range map[string]string{"msgpack": tt.msgpack, "cbor": tt.cbor} {
+			got, err := encodeBinary(format, tt.v)
+			if err != nil {
+				t.Errorf("%s %s: %v", tt.name, format, err)
+				continue
+			}
+			if hex.EncodeToString(got) != want {
+				t.Errorf("%s %s: got %x, want %s", tt.name, format, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeBinaryLongHeaders(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	tests := []struct {
+		format string
+		v      any
+		prefix string
+	}{
+		{"msgpack", long[:32], "d920"},
+		{"msgpack", long, "da012c"},
+		{"msgpack", make([]int, 16), "dc0010"},
+		{"cbor", long[:24], "7818"},
+		{"cbor", long, "79012c"},
+		{"cbor", make([]int, 24), "9818"},
+	}
+	for _, tt := range tests {
+		got, err := encodeBinary(tt.format, tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := hex.EncodeToString(got); len(h) < len(tt.prefix) || h[:len(tt.prefix)] != tt.prefix {
+			t.Errorf("%s: starts %.8s, want %s", tt.format, h, tt.prefix)
+		}
+	}
+}
+
+func TestEncodeBinaryUnknownFormat(t *testing.T) {
+	if _, err := encodeBinary("bson", 1); err == nil {
+		t.Error("bson: no error")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// czechBorder is a coarse outline of the Czech Republic as lon/lat pairs,
+// good to a few kilometres, which is plenty at LED resolution.
+var czechBorder = [][2]float64{
+	{12.09, 50.27}, {12.50, 50.40}, {12.95, 50.42}, {13.45, 50.60},
+	{13.90, 50.79}, {14.32, 50.88}, {14.40, 51.02}, {14.62, 50.92},
+	{14.82, 50.87}, {15.00, 51.02}, {15.22, 50.98}, {15.37, 50.78},
+	{15.80, 50.74}, {16.10, 50.66}, {16.35, 50.66}, {16.45, 50.56},
+	{16.20, 50.42}, {16.55, 50.15}, {16.90, 50.22}, {17.00, 50.42},
+	{17.25, 50.33}, {17.70, 50.30}, {17.60, 50.16}, {18.05, 50.06},
+	{18.55, 49.91}, {18.85, 49.52}, {18.55, 49.49}, {18.10, 49.07},
+	{17.90, 48.95}, {17.50, 48.82}, {17.10, 48.86}, {16.95, 48.62},
+	{16.50, 48.80}, {16.05, 48.75}, {15.60, 48.87}, {15.00, 49.01},
+	{14.95, 48.76}, {14.70, 48.58}, {14.33, 48.56}, {13.82, 48.77},
+	{13.50, 48.95}, {13.03, 49.30}, {12.65, 49.43}, {12.45, 49.70},
+	{12.55, 49.92}, {12.20, 50.10},
+}
+
+// czechBBox is the bounding box of czechBorder.
+var czechBBox = BBox{North: 51.06, West: 12.09, South: 48.55, East: 18.87}
+
+// BBox is a geographic rectangle in degrees.
+type BBox struct {
+	North float64 `yaml:"north"`
+	West  float64 `yaml:"west"`
+	South float64 `yaml:"south"`
+	East  float64 `yaml:"east"`
+}
+
+func (b BBox) IsZero() bool {
+	return b == BBox{}
+}
+
+func (b BBox) Contains(lat, lon float64) bool {
+	return lat <= b.North && lat >= b.South && lon >= b.West && lon <= b.East
+}
+
+// insideBorder reports whether the point lies within the polygon, using
+// ray casting.
+func insideBorder(border [][2]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(border)-1; i < len(border); j, i = i, i+1 {
+		xi, yi := border[i][0], border[i][1]
+		xj, yj := border[j][0], border[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
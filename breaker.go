@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker stops calls to a failing upstream. After Failures consecutive
+// failures it opens for Cooldown, then lets a single probe through
+// (half-open); the probe's outcome closes or re-opens it.
+type Breaker struct {
+	m        sync.Mutex
+	Failures int
+	Cooldown time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func (b *Breaker) Configure(failures int, cooldown time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.Failures = failures
+	b.Cooldown = cooldown
+}
+
+// Allow reports whether a call may be made now.
+func (b *Breaker) Allow() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// a probe is already in flight
+		return false
+	}
+	return true
+}
+
+func (b *Breaker) Success() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *Breaker) Failure() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.Failures > 0 && b.failures >= b.Failures) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *Breaker) State() breakerState {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.state
+}
+
+// ConsecutiveFailures is how many calls failed since the last success.
+func (b *Breaker) ConsecutiveFailures() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.failures
+}
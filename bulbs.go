@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BulbConfig drives a Tasmota or ESPHome RGB light by the rain in one
+// city, over the HTTP API of the device.
+type BulbConfig struct {
+	// Type is tasmota or esphome.
+	Type string `yaml:"type"`
+	// Host is the address of the device.
+	Host string `yaml:"host"`
+	// Light is the ID of the ESPHome light entity, e.g. rgb_bulb.
+	Light string `yaml:"light"`
+	// Username and Password of the Tasmota web admin or the ESPHome web
+	// server, if set.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// City name or ID.
+	City string `yaml:"city"`
+	// Color replaces the radar color while it rains, e.g. "#0000ff".
+	Color string `yaml:"color"`
+	// Palette colors the light, the global palette when empty.
+	Palette Palette `yaml:"palette"`
+	// Dry is what the light does without rain: off, or keep to leave it
+	// alone.
+	Dry string `yaml:"dry"`
+}
+
+func (c BulbConfig) matches(city *City) bool {
+	return strings.EqualFold(c.City, city.Name) || c.City == strconv.Itoa(city.ID)
+}
+
+func (c BulbConfig) validate() error {
+	switch c.Type {
+	case "tasmota":
+	case "esphome":
+		if c.Light == "" {
+			return fmt.Errorf("esphome bulb %s needs the id of its light", c.Host)
+		}
+	default:
+		return fmt.Errorf("bulb type must be tasmota or esphome, not %q", c.Type)
+	}
+	if c.Host == "" || c.City == "" {
+		return fmt.Errorf("%s bulb needs a host and a city", c.Type)
+	}
+	if c.Color != "" {
+		if _, err := parseHexColor(c.Color); err != nil {
+			return err
+		}
+	}
+	if c.Dry != "" && c.Dry != "off" && c.Dry != "keep" {
+		return fmt.Errorf("bulb dry must be off or keep, not %q", c.Dry)
+	}
+	return nil
+}
+
+func (c BulbConfig) base() string {
+	if strings.Contains(c.Host, "://") {
+		return strings.TrimSuffix(c.Host, "/")
+	}
+	return "http://" + c.Host
+}
+
+// bulbState is what a bulb is set to, Bri as for Hue lights.
+type bulbState struct {
+	On    bool
+	Color color.NRGBA
+	Bri   uint8
+}
+
+// tasmotaRequest sets the state with a Backlog of commands; Color turns
+// the light on but keeps the dimmer, so that follows.
+func (c BulbConfig) tasmotaRequest(s bulbState) (*http.Request, error) {
+	cmnd := "Power Off"
+	if s.On {
+		dimmer := (int(s.Bri)*100 + 127) / 254
+		cmnd = fmt.Sprintf("Backlog Color %02X%02X%02X; Dimmer %d", s.Color.R, s.Color.G, s.Color.B, dimmer)
+	}
+	q := url.Values{"cmnd": {cmnd}}
+	if c.Password != "" {
+		user := c.Username
+		if user == "" {
+			user = "admin"
+		}
+		q.Set("user", user)
+		q.Set("password", c.Password)
+	}
+	return http.NewRequest(http.MethodGet, c.base()+"/cm?"+q.Encode(), nil)
+}
+
+// esphomeRequest calls the REST API of the ESPHome web_server component.
+func (c BulbConfig) esphomeRequest(s bulbState) (*http.Request, error) {
+	path := "/light/" + url.PathEscape(c.Light) + "/turn_off"
+	if s.On {
+		q := url.Values{
+			"r":          {strconv.Itoa(int(s.Color.R))},
+			"g":          {strconv.Itoa(int(s.Color.G))},
+			"b":          {strconv.Itoa(int(s.Color.B))},
+			"brightness": {strconv.Itoa(int(s.Bri))},
+		}
+		path = "/light/" + url.PathEscape(c.Light) + "/turn_on?" + q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodPost, c.base()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	return req, nil
+}
+
+// Bulbs sets Tasmota and ESPHome lights from their cities on every
+// frame, sending only those that changed.
+type Bulbs struct {
+	m    sync.Mutex
+	cfg  []BulbConfig
+	sent map[int]bulbState
+}
+
+func (b *Bulbs) Configure(cfg []BulbConfig) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.cfg = cfg
+	b.sent = map[int]bulbState{}
+}
+
+func (b *Bulbs) Name() string {
+	return "bulbs"
+}
+
+func (b *Bulbs) Send(u *Update) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	var errs []error
+	for i, bulb := range b.cfg {
+		var city *City
+		for j := range u.Cities {
+			if bulb.matches(&u.Cities[j]) {
+				city = &u.Cities[j]
+				break
+			}
+		}
+		if city == nil {
+			continue
+		}
+
+		state := bulbState{}
+		if city.Raining() {
+			c := color.NRGBA{city.R, city.G, city.B, 255}
+			if bulb.Palette.recolors() {
+				c = bulb.Palette.color(city.DBZ)
+			}
+			if bulb.Color != "" {
+				c, _ = parseHexColor(bulb.Color)
+			}
+			state = bulbState{On: true, Color: c, Bri: hueBrightness[city.Intensity]}
+		} else if bulb.Dry == "keep" {
+			continue
+		}
+
+		if last, ok := b.sent[i]; ok && last == state {
+			continue
+		}
+		if err := bulb.set(state); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", bulb.Type, bulb.Host, err))
+			continue
+		}
+		b.sent[i] = state
+	}
+	return errors.Join(errs...)
+}
+
+func (c BulbConfig) set(s bulbState) error {
+	var req *http.Request
+	var err error
+	if c.Type == "esphome" {
+		req, err = c.esphomeRequest(s)
+	} else {
+		req, err = c.tasmotaRequest(s)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		// the URL in the error may hold the Tasmota password
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	if c.Type == "tasmota" {
+		// Tasmota answers 200 with a warning to wrong passwords
+		var result map[string]any
+		if json.NewDecoder(resp.Body).Decode(&result) == nil {
+			if warning, ok := result["WARNING"].(string); ok {
+				return errors.New(warning)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// LEDCalibration corrects the colors for one strip, which all render
+// the same RGB differently: Gamma bends the curve of the channels (2.2
+// suits most WS2812 strips), Red, Green and Blue scale them to a neutral
+// white and Brightness caps them all, both from 0 to 1. Unset values (0)
+// leave the colors as they are.
+type LEDCalibration struct {
+	Gamma      float64 `yaml:"gamma"`
+	Red        float64 `yaml:"red"`
+	Green      float64 `yaml:"green"`
+	Blue       float64 `yaml:"blue"`
+	Brightness float64 `yaml:"brightness"`
+}
+
+func (c LEDCalibration) validate() error {
+	if c.Gamma < 0 {
+		return errors.New("calibration gamma must not be negative")
+	}
+	for _, v := range []float64{c.Red, c.Green, c.Blue, c.Brightness} {
+		if v < 0 || v > 1 {
+			return errors.New("calibration red, green, blue and brightness must be from 0 to 1")
+		}
+	}
+	return nil
+}
+
+// ledCurve maps every value of the red, green and blue channels to what
+// is sent to a strip.
+type ledCurve [3][256]uint8
+
+func (c LEDCalibration) curve() *ledCurve {
+	unset := func(v float64) float64 {
+		if v == 0 {
+			return 1
+		}
+		return v
+	}
+	gamma, brightness := unset(c.Gamma), unset(c.Brightness)
+	var curve ledCurve
+	for ch, scale := range []float64{unset(c.Red), unset(c.Green), unset(c.Blue)} {
+		for v := range 256 {
+			curve[ch][v] = uint8(math.Round(255 * brightness * scale * math.Pow(float64(v)/255, gamma)))
+		}
+	}
+	return &curve
+}
+
+func (curve *ledCurve) apply(leds []color.NRGBA) []color.NRGBA {
+	out := make([]color.NRGBA, len(leds))
+	for i, c := range leds {
+		out[i] = color.NRGBA{curve[0][c.R], curve[1][c.G], curve[2][c.B], c.A}
+	}
+	return out
+}
+
+// testPatterns are what the LEDs show to calibrate them: white for the
+// white point, the channels one at a time and a ramp of grays along the
+// strip for the gamma. cycle takes turns with all of them.
+var testPatterns = []string{"white", "red", "green", "blue", "ramp"}
+
+const testPatternStep = 3 * time.Second
+
+func validTestPattern(pattern string) bool {
+	return pattern == "cycle" || slices.Contains(testPatterns, pattern)
+}
+
+// testPattern is pattern on count LEDs, since into the test.
+func testPattern(pattern string, count int, since time.Duration) []color.NRGBA {
+	if pattern == "cycle" {
+		pattern = testPatterns[int(since/testPatternStep)%len(testPatterns)]
+	}
+	leds := make([]color.NRGBA, count)
+	for i := range leds {
+		switch pattern {
+		case "white":
+			leds[i] = color.NRGBA{255, 255, 255, 255}
+		case "red":
+			leds[i] = color.NRGBA{255, 0, 0, 255}
+		case "green":
+			leds[i] = color.NRGBA{0, 255, 0, 255}
+		case "blue":
+			leds[i] = color.NRGBA{0, 0, 255, 255}
+		case "ramp":
+			v := uint8(255 * (i + 1) / count)
+			leds[i] = color.NRGBA{v, v, v, 255}
+		}
+	}
+	return leds
+}
+
+// HandleLEDTest shows a test pattern (?pattern=, cycle by default) on the
+// DDP controllers for ?seconds= (30 by default) instead of the radar, to
+// calibrate them.
+func (h *Handler) HandleLEDTest(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "cycle"
+	}
+	if !validTestPattern(pattern) {
+		http.Error(w, fmt.Sprintf("unknown pattern %q", pattern), http.StatusBadRequest)
+		return
+	}
+	seconds := 30
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		var err error
+		if seconds, err = strconv.Atoi(v); err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("invalid seconds %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if h.dryRun {
+		http.Error(w, "dry run, the LEDs are not driven", http.StatusConflict)
+		return
+	}
+	if err := h.ddp.Test(pattern, time.Duration(seconds)*time.Second); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEndLEDTest brings the radar back on the LEDs before the test
+// pattern expires.
+func (h *Handler) HandleEndLEDTest(w http.ResponseWriter, r *http.Request) {
+	h.ddp.Test("", 0)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type CellsConfig struct {
+	// MinDBZ is the reflectivity a pixel needs to belong to a cell.
+	MinDBZ    float64 `yaml:"minDbz"`
+	MinPixels int     `yaml:"minPixels"`
+	// MaxSpeed limits how far a cell may move between frames and still
+	// be considered the same cell, in km/h.
+	MaxSpeed float64 `yaml:"maxSpeed"`
+}
+
+// Cell is a connected area of strong echo.
+type Cell struct {
+	ID        int       `json:"id"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Pixels    int       `json:"pixels"`
+	AreaKm2   float64   `json:"areaKm2"`
+	MaxDBZ    float64   `json:"maxDbz"`
+	SpeedKmh  float64   `json:"speedKmh"`
+	Heading   float64   `json:"heading"`
+	Tracked   bool      `json:"tracked"`
+	FirstSeen time.Time `json:"firstSeen"`
+
+	// centroid in pixels
+	x, y float64
+}
+
+// detectCells segments the field into 4-connected areas of at least
+// cfg.MinDBZ.
+func detectCells(field *Field, proj Projection, cfg CellsConfig) []*Cell {
+	w, h := field.Width, field.Height
+	seen := make([]bool, w*h)
+	var cells []*Cell
+	var stack []int
+
+	for start := range field.DBZ {
+		if seen[start] || !(field.DBZ[start] >= float32(cfg.MinDBZ)) {
+			continue
+		}
+
+		cell := &Cell{MaxDBZ: math.Inf(-1)}
+		var sumX, sumY float64
+		stack = append(stack[:0], start)
+		seen[start] = true
+
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%w, i/w
+
+			cell.Pixels++
+			sumX += float64(x)
+			sumY += float64(y)
+			cell.MaxDBZ = math.Max(cell.MaxDBZ, float64(field.DBZ[i]))
+
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[1] < 0 || n[0] >= w || n[1] >= h {
+					continue
+				}
+				j := n[1]*w + n[0]
+				if !seen[j] && field.DBZ[j] >= float32(cfg.MinDBZ) {
+					seen[j] = true
+					stack = append(stack, j)
+				}
+			}
+		}
+
+		if cell.Pixels < cfg.MinPixels {
+			continue
+		}
+
+		cell.x = sumX / float64(cell.Pixels)
+		cell.y = sumY / float64(cell.Pixels)
+		cx, cy := int(cell.x), int(cell.y)
+		cell.Lat, cell.Lon = proj.Location(cx, cy)
+		cell.AreaKm2 = float64(cell.Pixels) * pixelAreaKm2(proj, cx, cy)
+		cells = append(cells, cell)
+	}
+
+	return cells
+}
+
+func pixelAreaKm2(proj Projection, x, y int) float64 {
+	kmX, kmY := pixelSizeKm(proj, x, y)
+	return kmX * kmY
+}
+
+// Tracker matches cells between consecutive frames by their centroids.
+type Tracker struct {
+	m      sync.Mutex
+	prev   []*Cell
+	prevAt time.Time
+	nextID int
+}
+
+func (t *Tracker) Track(frame *Frame, field *Field, cfg CellsConfig) []*Cell {
+	cells := detectCells(field, frame.Projection, cfg)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	dt := frame.Time.Sub(t.prevAt).Hours()
+	if t.prevAt.IsZero() || dt <= 0 {
+		dt = 0
+	}
+
+	matched := matchCells(cells, t.prev, dt, cfg.MaxSpeed)
+	for i, j := range matched {
+		c, old := cells[i], t.prev[j]
+		c.ID = old.ID
+		c.FirstSeen = old.FirstSeen
+		c.Tracked = true
+		c.SpeedKmh = distanceKm(old.Lat, old.Lon, c.Lat, c.Lon) / dt
+		c.Heading = bearing(old.Lat, old.Lon, c.Lat, c.Lon)
+	}
+
+	for i, c := range cells {
+		if _, ok := matched[i]; !ok {
+			t.nextID++
+			c.ID = t.nextID
+			c.FirstSeen = frame.Time
+		}
+	}
+
+	t.prev = cells
+	t.prevAt = frame.Time
+	return cells
+}
+
+// matchCells pairs cells with the prev ones dt hours earlier that are
+// within reach at maxSpeed, greedily closest pairs first. It returns the
+// index in prev per matched index in cells.
+func matchCells(cells, prev []*Cell, dt, maxSpeed float64) map[int]int {
+	type pair struct {
+		cur, prev int
+		dist      float64
+	}
+	var pairs []pair
+	if dt > 0 {
+		for i, c := range cells {
+			for j, p := range prev {
+				if d := distanceKm(p.Lat, p.Lon, c.Lat, c.Lon); d <= maxSpeed*dt {
+					pairs = append(pairs, pair{i, j, d})
+				}
+			}
+		}
+	}
+	sort.Slice(pairs, func(a, b int) bool { return pairs[a].dist < pairs[b].dist })
+
+	matched := map[int]int{}
+	prevUsed := map[int]bool{}
+	for _, p := range pairs {
+		if _, ok := matched[p.cur]; ok || prevUsed[p.prev] {
+			continue
+		}
+		matched[p.cur], prevUsed[p.prev] = p.prev, true
+	}
+	return matched
+}
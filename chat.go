@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// parseMessageTemplate parses a message template, empty keeps the
+// message of the rule.
+func parseMessageTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = "{{.Message}}"
+	}
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+func renderMessage(tmpl *template.Template, n Notification) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// notificationColor is the radar color of the city, gray when dry.
+func notificationColor(n Notification) color.NRGBA {
+	if !n.City.Raining() {
+		return color.NRGBA{128, 128, 128, 255}
+	}
+	return color.NRGBA{n.City.R, n.City.G, n.City.B, 255}
+}
+
+// cropKm is how far around the city radar crops reach.
+const cropKm = 40
+
+// renderCrop renders the radar around the city, enlarged and with the
+// city marked in the center, nil for cities off the frame.
+func renderCrop(frame *Frame, city *City) ([]byte, error) {
+	dLat := degrees(cropKm / earthRadius)
+	dLon := degrees(cropKm / (earthRadius * math.Cos(radians(city.Lat))))
+	crop := frame.Crop(BBox{North: city.Lat + dLat, West: city.Lon - dLon, South: city.Lat - dLat, East: city.Lon + dLon})
+	if crop.Image.Bounds().Empty() {
+		return nil, nil
+	}
+
+	img := imaging.Resize(crop.Image, 320, 0, imaging.NearestNeighbor)
+	scale := float64(img.Bounds().Dx()) / float64(crop.Image.Bounds().Dx())
+	x, y := crop.Projection.Pixel(city.Lat, city.Lon)
+	cx, cy := int((float64(x)+0.5)*scale), int((float64(y)+0.5)*scale)
+	fillRect(img, image.Rect(cx-4, cy-4, cx+4, cy+4), color.NRGBA{255, 255, 255, 255})
+	fillRect(img, image.Rect(cx-2, cy-2, cx+2, cy+2), color.NRGBA{0, 0, 0, 255})
+
+	var buf bytes.Buffer
+	if err := encodePNG(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// discordNotifier posts notifications as embeds to a Discord webhook.
+type discordNotifier struct {
+	url      string
+	template *template.Template
+	crop     bool
+}
+
+type discordEmbed struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Color       int    `json:"color"`
+	Timestamp   string `json:"timestamp"`
+	Image       *struct {
+		URL string `json:"url"`
+	} `json:"image,omitempty"`
+}
+
+func (d discordNotifier) Notify(n Notification) error {
+	text, err := renderMessage(d.template, n)
+	if err != nil {
+		return err
+	}
+	c := notificationColor(n)
+	embed := discordEmbed{
+		Title:       "Rain in " + n.City.Name,
+		Description: text,
+		Color:       int(c.R)<<16 | int(c.G)<<8 | int(c.B),
+		Timestamp:   n.Frame.Format(time.RFC3339),
+	}
+
+	var crop []byte
+	if d.crop && n.radar != nil {
+		if crop, err = renderCrop(n.radar, &n.City); err != nil {
+			return err
+		}
+	}
+	if crop != nil {
+		embed.Image = &struct {
+			URL string `json:"url"`
+		}{"attachment://radar.png"}
+	}
+
+	payload, err := json.Marshal(map[string]any{"embeds": []discordEmbed{embed}})
+	if err != nil {
+		return err
+	}
+	if crop == nil {
+		return postJSON(d.url, payload)
+	}
+
+	// files go along with the message as multipart form parts
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("payload_json", string(payload)); err != nil {
+		return err
+	}
+	part, err := mw.CreateFormFile("files[0]", "radar.png")
+	if err != nil {
+		return err
+	}
+	part.Write(crop)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return send(req)
+}
+
+// slackNotifier posts notifications as colored attachments to a Slack
+// incoming webhook. Those cannot upload files, so there is no crop.
+type slackNotifier struct {
+	url      string
+	template *template.Template
+}
+
+func (s slackNotifier) Notify(n Notification) error {
+	text, err := renderMessage(s.template, n)
+	if err != nil {
+		return err
+	}
+	c := notificationColor(n)
+	payload, err := json.Marshal(map[string]any{
+		"text": "Rain in " + n.City.Name,
+		"attachments": []map[string]any{{
+			"color": fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+			"text":  text,
+			"ts":    n.Frame.Unix(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, payload)
+}
+
+const telegramURL = "https://api.telegram.org"
+
+// telegramNotifier sends notifications through a Telegram bot to one or
+// more chats.
+type telegramNotifier struct {
+	token    string
+	chats    []string
+	template *template.Template
+}
+
+func (t telegramNotifier) Notify(n Notification) error {
+	text, err := renderMessage(t.template, n)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, chat := range t.chats {
+		payload, err := json.Marshal(map[string]any{
+			"chat_id":              chat,
+			"text":                 "Rain in " + n.City.Name + "\n" + text,
+			"disable_notification": n.City.Intensity < IntensityHeavy,
+		})
+		if err != nil {
+			return err
+		}
+		if err := postJSON(telegramURL+"/bot"+t.token+"/sendMessage", payload); err != nil {
+			// the URL in the error holds the bot token
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			errs = append(errs, fmt.Errorf("chat %s: %w", chat, err))
+		}
+	}
+	return errors.Join(errs...)
+}
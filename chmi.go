@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// -----------------------------------------------------------------------------
+// Pracujeme v souřadnicovém systému WGS-84
+// Abychom dokázali přepočítat stupně zeměpisné šířky a délky na pixely,
+// musíme znát souřadnice levého horního a pravého dolního okraje radarového snímku ČHMÚ
+
+const (
+	lon0 = 11.2673442
+	lat0 = 52.1670717
+	lon1 = 20.7703153
+	lat1 = 48.1
+)
+
+// statusError is returned for non-200 responses from the radar server.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("HTTP %d", int(e))
+}
+
+func (e statusError) StatusCode() int {
+	return int(e)
+}
+
+func download(url string) ([]byte, error) {
+	log.Printf("Downloading file: %s", url)
+	resp, err := http.Get(url)
+
+	if err != nil {
+		log.Printf("HTTP %s: Cannot download file", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		log.Printf("HTTP %d: Cannot download file", resp.StatusCode)
+		return nil, statusError(resp.StatusCode)
+	}
+
+	log.Printf("Succesfully downloaded")
+	return io.ReadAll(resp.Body)
+}
+
+// lonLatProjection is a plain linear mapping between the image corners.
+type lonLatProjection struct {
+	lon0, lat0, lon1, lat1 float64
+	width, height          int
+}
+
+func (p lonLatProjection) Pixel(lat, lon float64) (int, int) {
+	lonPixelSize := (p.lon1 - p.lon0) / float64(p.width)
+	latPixelSize := (p.lat0 - p.lat1) / float64(p.height)
+	return int((lon - p.lon0) / lonPixelSize), int((p.lat0 - lat) / latPixelSize)
+}
+
+func (p lonLatProjection) Location(x, y int) (float64, float64) {
+	lonPixelSize := (p.lon1 - p.lon0) / float64(p.width)
+	latPixelSize := (p.lat0 - p.lat1) / float64(p.height)
+	return p.lat0 - (float64(y)+0.5)*latPixelSize, p.lon0 + (float64(x)+0.5)*lonPixelSize
+}
+
+type chmiSource struct {
+	fetcher Fetcher
+	product Product
+}
+
+func (chmiSource) Name() string {
+	return "chmi"
+}
+
+func (s chmiSource) FrameTime(now time.Time) time.Time {
+	return now.UTC().Truncate(s.product.Cadence)
+}
+
+func (s chmiSource) Cadence() time.Duration {
+	return s.product.Cadence
+}
+
+func (s chmiSource) PublishDelay() time.Duration {
+	return s.product.Delay
+}
+
+func (s chmiSource) URL(t time.Time) string {
+	return s.product.url(t)
+}
+
+func (s chmiSource) Fetch(t time.Time) (*Frame, error) {
+	content, err := s.fetcher.Fetch(s.URL(t))
+	if err != nil {
+		return nil, err
+	}
+	return s.Decode(t, content)
+}
+
+func (s chmiSource) Decode(t time.Time, content []byte) (*Frame, error) {
+	img, err := imaging.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	bitmap := toNRGBA(img)
+
+	// other products have their own legends
+	if len(s.product.Legend) > 0 {
+		legend, err := s.product.legend()
+		if err != nil {
+			return nil, err
+		}
+		recolor(bitmap, legend)
+	}
+
+	proj := s.product.projection(bitmap.Bounds().Dx(), bitmap.Bounds().Dy())
+	return &Frame{Time: t, Image: bitmap, Projection: proj}, nil
+}
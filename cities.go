@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+type City struct {
+	ID   int
+	Name string
+	Lat  float64
+	Lon  float64
+	// Region is an optional code such as the Czech NUTS-3 region (JHM).
+	Region string `json:"region,omitempty"`
+	// Coverage is false for cities outside the radar image, which are
+	// not sampled and stay dry.
+	Coverage bool `json:"coverage"`
+	// Offset moves the sampling window away from the city location.
+	Offset *Offset `json:"-"`
+	// Notify are the notification preferences of the city, if any.
+	Notify *NotifyPrefs `json:"-"`
+	RainState
+
+	// changed is the update in which the rain state last changed
+	changed uint64
+	rain    rainTally
+	trend   trendHistory
+	samples frameSamples
+
+	// sample caches the sample pixel for the projection it was computed on
+	sample struct {
+		proj Projection
+		x, y int
+	}
+}
+
+// Offset nudges the sample point of a city, in image pixels (X right,
+// Y down) or in km (X east, Y north).
+type Offset struct {
+	X, Y float64
+	Km   bool
+}
+
+// parseOffset parses "<x>,<y>px" or "<x>,<y>km".
+func parseOffset(s string) (*Offset, error) {
+	o := &Offset{}
+	switch {
+	case strings.HasSuffix(s, "px"):
+		s = strings.TrimSuffix(s, "px")
+	case strings.HasSuffix(s, "km"):
+		s, o.Km = strings.TrimSuffix(s, "km"), true
+	default:
+		return nil, fmt.Errorf("offset %q needs a px or km unit", s)
+	}
+
+	x, y, ok := strings.Cut(s, ",")
+	var errX, errY error
+	o.X, errX = strconv.ParseFloat(strings.TrimSpace(x), 64)
+	o.Y, errY = strconv.ParseFloat(strings.TrimSpace(y), 64)
+	if !ok || errX != nil || errY != nil {
+		return nil, fmt.Errorf("invalid offset %q", s)
+	}
+	return o, nil
+}
+
+// SamplePoint is where a city with an offset was sampled.
+type SamplePoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	X   int     `json:"x"`
+	Y   int     `json:"y"`
+}
+
+// samplePixel returns the center of the sampling window of the city.
+// Frames of a source share their projection, so it is computed once.
+func (c *City) samplePixel(p Projection) (int, int) {
+	if c.sample.proj != p {
+		c.sample.x, c.sample.y = c.offsetPixel(p)
+		c.sample.proj = p
+	}
+	return c.sample.x, c.sample.y
+}
+
+func (c *City) offsetPixel(p Projection) (int, int) {
+	o := c.Offset
+	if o == nil {
+		return p.Pixel(c.Lat, c.Lon)
+	}
+	if o.Km {
+		lat := c.Lat + degrees(o.Y/earthRadius)
+		lon := c.Lon + degrees(o.X/(earthRadius*math.Cos(radians(c.Lat))))
+		return p.Pixel(lat, lon)
+	}
+	x, y := p.Pixel(c.Lat, c.Lon)
+	return x + int(math.Round(o.X)), y + int(math.Round(o.Y))
+}
+
+// RainState is the result of evaluating a city on the last frame.
+type RainState struct {
+	R uint8
+	G uint8
+	B uint8
+
+	DBZ       float64   `json:"dbz"`
+	Intensity Intensity `json:"intensity"`
+	// Hail is set when a strong echo reaches high up, see HailConfig.
+	Hail bool `json:"hail"`
+	// Trend compares the reflectivity with the last frames.
+	Trend Trend `json:"trend"`
+	// Alert rates the state for the displays, see alertLevel.
+	Alert AlertLevel `json:"alert"`
+
+	// Sample is only set for cities with an offset.
+	Sample *SamplePoint `json:"sample,omitempty"`
+
+	// Strikes10Min counts the lightning strikes around the city over the
+	// lightning window, 10 minutes by default.
+	Strikes10Min int `json:"strikes10min"`
+
+	// RainingSinceMinutes is how long the current rain has lasted, 0 while
+	// dry; RainMinutesToday adds up the rain since local midnight.
+	RainingSinceMinutes int `json:"rainingSinceMinutes"`
+	RainMinutesToday    int `json:"rainMinutesToday"`
+
+	// NearestRain is only set for dry cities.
+	NearestRain *NearestRain `json:"nearestRain,omitempty"`
+	// AdvectionMinutes is when the rain the wind carries reaches a dry
+	// city, see WindConfig.
+	AdvectionMinutes *int `json:"advectionMinutes,omitempty"`
+	// EndsInMinutes is when the rain over a raining city stops, from the
+	// wind or else the storm cells over it; unset when neither tells.
+	EndsInMinutes *int `json:"endsInMinutes,omitempty"`
+	// RainNearby is set for dry cities with a raining neighbor, see
+	// NeighborsConfig.
+	RainNearby bool `json:"rainNearby"`
+
+	Smoothed Smoothed `json:"smoothed"`
+}
+
+// Smoothed is an exponential moving average of the city's color and
+// reflectivity over recent frames, dry frames counting as zero.
+type Smoothed struct {
+	R   uint8   `json:"r"`
+	G   uint8   `json:"g"`
+	B   uint8   `json:"b"`
+	DBZ float64 `json:"dbz"`
+}
+
+func ema(prev, cur, alpha float64) float64 {
+	return alpha*cur + (1-alpha)*prev
+}
+
+func (s Smoothed) next(cur *RainState, alpha float64) Smoothed {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 1
+	}
+	next := Smoothed{
+		R:   uint8(math.Round(ema(float64(s.R), float64(cur.R), alpha))),
+		G:   uint8(math.Round(ema(float64(s.G), float64(cur.G), alpha))),
+		B:   uint8(math.Round(ema(float64(s.B), float64(cur.B), alpha))),
+		DBZ: math.Round(ema(s.DBZ, cur.DBZ, alpha)*10) / 10,
+	}
+	// let fading tails die out instead of glowing forever
+	if !cur.Raining() && next.DBZ < 1 {
+		return Smoothed{}
+	}
+	return next
+}
+
+func (s *RainState) Raining() bool {
+	return s.R|s.G|s.B != 0
+}
+
+type SamplingConfig struct {
+	// Mode is avg or max, max reports the strongest echo in the window
+	// instead of the average.
+	Mode string `yaml:"mode"`
+	// Cities overrides the mode per city ID.
+	Cities map[int]string `yaml:"cities"`
+	// Workers evaluate large city lists in parallel, 0 for one per CPU.
+	Workers int `yaml:"workers"`
+	// Combine merges the samples of the last two frames, max or mean (of
+	// the dBZ, a dry frame counting as 0), so small cells moving between
+	// scans are not missed; none or empty samples the last frame only.
+	Combine string `yaml:"combine"`
+	// CombineCities overrides Combine per city ID.
+	CombineCities map[int]string `yaml:"combineCities"`
+	// MinArea is how many 4-connected pixels with echo the window needs
+	// for a city to be wet, filtering out speckle; 0 takes any echo.
+	MinArea int `yaml:"minArea"`
+	// MinAreaCities overrides MinArea per city ID.
+	MinAreaCities map[int]int `yaml:"minAreaCities"`
+}
+
+func (s SamplingConfig) mode(id int) string {
+	if m, ok := s.Cities[id]; ok {
+		return m
+	}
+	return s.Mode
+}
+
+func (s SamplingConfig) minArea(id int) int {
+	if n, ok := s.MinAreaCities[id]; ok {
+		return n
+	}
+	return s.MinArea
+}
+
+func (s SamplingConfig) combine(id int) string {
+	if c, ok := s.CombineCities[id]; ok {
+		return c
+	}
+	return s.Combine
+}
+
+// combineWindow is how much older the frame before may be to be combined
+// with the last one, so a gap in the data does not bring back old rain.
+const combineWindow = 15 * time.Minute
+
+type colorSample struct {
+	frame   time.Time
+	r, g, b uint8
+}
+
+func (s colorSample) dbz() float64 {
+	if s.r|s.g|s.b == 0 {
+		return 0
+	}
+	return colorDBZ(s.r, s.g, s.b)
+}
+
+// frameSamples keeps the colors sampled for a city on the last two frames.
+type frameSamples struct {
+	prev, last colorSample
+}
+
+// add records the sample of frame and returns it combined with the one of
+// the frame before as mode tells. Processing a frame again keeps the one
+// before it.
+func (f *frameSamples) add(frame time.Time, r, g, b uint8, mode string) (uint8, uint8, uint8) {
+	if !f.last.frame.Equal(frame) {
+		f.prev = f.last
+	}
+	f.last = colorSample{frame, r, g, b}
+	prev := f.prev
+	if prev.frame.IsZero() || !prev.frame.Before(frame) || frame.Sub(prev.frame) > combineWindow {
+		return r, g, b
+	}
+	switch mode {
+	case "max":
+		if prev.dbz() > f.last.dbz() {
+			return prev.r, prev.g, prev.b
+		}
+	case "mean":
+		c := dbzColor((prev.dbz() + f.last.dbz()) / 2)
+		return c.R, c.G, c.B
+	}
+	return r, g, b
+}
+
+// CitySet is an additional named city list, evaluated independently of
+// the main one.
+type CitySet struct {
+	Name           string
+	Cities         []*City
+	CitiesWithRain []*City
+}
+
+// evaluateCity samples the frame around the city and updates its rain
+// state, reporting whether it is raining there.
+func evaluateCity(city *City, frame *Frame, field *Field, cfg *Config) bool {
+	x, y := city.samplePixel(frame.Projection)
+	smoothed := city.Smoothed
+	city.Coverage = image.Pt(x, y).In(frame.Image.Rect)
+	if !city.Coverage {
+		city.RainState = RainState{}
+		city.Smoothed = smoothed.next(&city.RainState, cfg.Smoothing.Alpha)
+		return false
+	}
+
+	r, g, b := getAvgColor(frame.Image, x, y)
+	if cfg.Sampling.mode(city.ID) == "max" {
+		r, g, b = getMaxColor(frame.Image, field, x, y)
+	}
+	if n := cfg.Sampling.minArea(city.ID); n > 1 && largestArea(field, x, y) < n {
+		r, g, b = 0, 0, 0
+	}
+	r, g, b = city.samples.add(frame.Time, r, g, b, cfg.Sampling.combine(city.ID))
+
+	if r|g|b == 0 {
+		city.RainState = RainState{
+			NearestRain: findNearestRain(field, frame.Projection, city.Lat, city.Lon, cfg.NearestRain),
+		}
+	} else {
+		dbz := colorDBZ(r, g, b)
+		city.RainState = RainState{R: r, G: g, B: b, DBZ: dbz, Intensity: intensityOf(dbz)}
+	}
+	if city.Offset != nil {
+		lat, lon := frame.Projection.Location(x, y)
+		city.Sample = &SamplePoint{Lat: lat, Lon: lon, X: x, Y: y}
+	}
+
+	city.Smoothed = smoothed.next(&city.RainState, cfg.Smoothing.Alpha)
+	return city.Raining()
+}
+
+// defaultCitiesFile is the default city list, built into the binary so
+// it runs without one. A file of this name overrides it.
+const defaultCitiesFile = "mesta.csv"
+
+//go:embed mesta.csv
+var embeddedCities []byte
+
+// embeddedList tells whether path is the default city list and no such
+// file exists, so the built-in list stands in for it.
+func embeddedList(path string) bool {
+	if path != defaultCitiesFile {
+		return false
+	}
+	_, err := os.Stat(path)
+	return errors.Is(err, os.ErrNotExist)
+}
+
+func loadCities(path string) ([]*City, error) {
+	if remoteList(path) {
+		cities, _, err := (&remoteCities{}).load(path)
+		return cities, err
+	}
+	if embeddedList(path) {
+		log.Printf("%s not found, using the built-in city list", path)
+		return parseCities("built-in "+path, bytes.NewReader(embeddedCities))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseCities(path, file)
+}
+
+// parseCities reads a city list, name is the file for the errors.
+func parseCities(name string, r io.Reader) ([]*City, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = ';'
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var cities []*City
+	for i, record := range records {
+		if len(record) < 4 {
+			return nil, fmt.Errorf("%s:%d: expected at least 4 fields", name, i+1)
+		}
+		city := &City{
+			ID:   cast.ToInt(record[0]),
+			Name: record[1],
+			Lat:  cast.ToFloat64(record[2]),
+			Lon:  cast.ToFloat64(record[3]),
+		}
+		if len(record) > 4 {
+			city.Region = record[4]
+		}
+		if len(record) > 5 && record[5] != "" {
+			if city.Offset, err = parseOffset(record[5]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+			}
+		}
+		if len(record) > 6 && record[6] != "" {
+			if city.Notify, err = parseNotifyPrefs(record[6]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+			}
+		}
+
+		cities = append(cities, city)
+	}
+
+	return cities, nil
+}
+
+func loadCitySets(files map[string]string) (map[string]*CitySet, error) {
+	sets := map[string]*CitySet{}
+	for name, path := range files {
+		cities, err := loadCities(path)
+		if err != nil {
+			return nil, fmt.Errorf("city set %s: %w", name, err)
+		}
+		sets[name] = &CitySet{Name: name, Cities: cities, CitiesWithRain: []*City{}}
+	}
+	return sets, nil
+}
+
+// carryRainState copies the rain state of old cities to new cities with
+// the same ID and returns the ones that are raining.
+func carryRainState(cities, old []*City) []*City {
+	byID := map[int]*City{}
+	for _, city := range old {
+		byID[city.ID] = city
+	}
+
+	citiesWithRain := []*City{}
+	for _, city := range cities {
+		if prev, ok := byID[city.ID]; ok {
+			city.RainState = prev.RainState
+			city.changed = prev.changed
+			city.rain = prev.rain
+			city.trend = prev.trend
+			city.samples = prev.samples
+			if city.Raining() {
+				citiesWithRain = append(citiesWithRain, city)
+			}
+		}
+	}
+	return citiesWithRain
+}
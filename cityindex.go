@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// indexCellDeg is the size of the cells of the city index, about 11 km
+// north to south and 7 km east to west in Czechia.
+const indexCellDeg = 0.1
+
+// cityIndex buckets a city list on a lat/lon grid, so nearest city and
+// radius lookups only look at the cities around a point.
+type cityIndex struct {
+	// first and n identify the list the index was built from
+	first *City
+	n     int
+
+	cells map[[2]int][]*City
+	// minRow, maxRow ... bound the occupied cells, maxLat the absolute
+	// latitude furthest from the equator
+	minRow, maxRow, minCol, maxCol int
+	maxLat                         float64
+}
+
+func indexCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / indexCellDeg)), int(math.Floor(lon / indexCellDeg))}
+}
+
+func newCityIndex(cities []*City) *cityIndex {
+	idx := &cityIndex{n: len(cities), cells: map[[2]int][]*City{}}
+	idx.minRow, idx.minCol = math.MaxInt, math.MaxInt
+	idx.maxRow, idx.maxCol = math.MinInt, math.MinInt
+	for _, city := range cities {
+		c := indexCell(city.Lat, city.Lon)
+		idx.cells[c] = append(idx.cells[c], city)
+		idx.minRow, idx.maxRow = min(idx.minRow, c[0]), max(idx.maxRow, c[0])
+		idx.minCol, idx.maxCol = min(idx.minCol, c[1]), max(idx.maxCol, c[1])
+		idx.maxLat = max(idx.maxLat, math.Abs(city.Lat))
+	}
+	if len(cities) > 0 {
+		idx.first = cities[0]
+	}
+	return idx
+}
+
+// cellKm is the smallest side of a cell at latitudes up to lat.
+func cellKm(lat float64) float64 {
+	lat = math.Min(math.Abs(lat)+indexCellDeg, 89)
+	return radians(indexCellDeg) * earthRadius * math.Cos(radians(lat))
+}
+
+// nearest returns the closest city to the point and its distance, nil for
+// an empty list.
+func (idx *cityIndex) nearest(lat, lon float64) (*City, float64) {
+	if idx.n == 0 {
+		return nil, 0
+	}
+	center := indexCell(lat, lon)
+	// rings further out than the occupied cells hold nothing
+	rings := max(abs(center[0]-idx.minRow), abs(center[0]-idx.maxRow), abs(center[1]-idx.minCol), abs(center[1]-idx.maxCol))
+	side := cellKm(math.Max(math.Abs(lat), idx.maxLat))
+
+	var best *City
+	bestKm := math.Inf(1)
+	for r := 0; r <= rings; r++ {
+		// every cell of ring r is at least r-1 whole cells away
+		if best != nil && float64(r-1)*side > bestKm {
+			break
+		}
+		for row := center[0] - r; row <= center[0]+r; row++ {
+			for col := center[1] - r; col <= center[1]+r; col++ {
+				if abs(row-center[0]) != r && abs(col-center[1]) != r {
+					continue
+				}
+				for _, city := range idx.cells[[2]int{row, col}] {
+					if d := distanceKm(lat, lon, city.Lat, city.Lon); d < bestKm {
+						best, bestKm = city, d
+					}
+				}
+			}
+		}
+	}
+	return best, bestKm
+}
+
+// within calls fn for every city up to km from the point.
+func (idx *cityIndex) within(lat, lon, km float64, fn func(*City)) {
+	dLat := degrees(km / earthRadius)
+	dLon := 180.0
+	if cos := math.Cos(radians(math.Min(math.Abs(lat)+dLat, 90))); cos > 0 {
+		dLon = math.Min(degrees(km/(earthRadius*cos)), 180)
+	}
+	lo, hi := indexCell(lat-dLat, lon-dLon), indexCell(lat+dLat, lon+dLon)
+	for row := max(lo[0], idx.minRow); row <= min(hi[0], idx.maxRow); row++ {
+		for col := max(lo[1], idx.minCol); col <= min(hi[1], idx.maxCol); col++ {
+			for _, city := range idx.cells[[2]int{row, col}] {
+				if distanceKm(lat, lon, city.Lat, city.Lon) <= km {
+					fn(city)
+				}
+			}
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// cityIndexes keeps an index per city list, rebuilt when the list is
+// replaced or grows.
+type cityIndexes struct {
+	m     sync.Mutex
+	lists map[string]*cityIndex
+}
+
+// snapshotIndex keys the index of the cities of the snapshot, kept apart
+// from the live main list "" under a name no set can have.
+const snapshotIndex = "\x00snapshot"
+
+// get returns the index of cities, the main list named "" and the sets
+// by their name.
+func (c *cityIndexes) get(name string, cities []*City) *cityIndex {
+	c.m.Lock()
+	defer c.m.Unlock()
+	idx := c.lists[name]
+	if idx == nil || idx.n != len(cities) || (len(cities) > 0 && idx.first != cities[0]) {
+		idx = newCityIndex(cities)
+		if c.lists == nil {
+			c.lists = map[string]*cityIndex{}
+		}
+		c.lists[name] = idx
+	}
+	return idx
+}
+
+type nearestResponse struct {
+	Frame      time.Time `json:"frame"`
+	Stale      bool      `json:"stale"`
+	Source     string    `json:"source"`
+	DistanceKm float64   `json:"distanceKm"`
+	City       *City     `json:"city"`
+}
+
+// HandleNearest snaps ?lat=&lon= to the closest city and serves its rain
+// state, from the main list or ?set=. Cities further than ?maxKm= (50 by
+// default) are not taken.
+func (h *Handler) HandleNearest(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, errLat := strconv.ParseFloat(q.Get("lat"), 64)
+	lon, errLon := strconv.ParseFloat(q.Get("lon"), 64)
+	if errLat != nil || errLon != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		http.Error(w, "lat and lon are required", http.StatusBadRequest)
+		return
+	}
+	maxKm := 50.0
+	if v := q.Get("maxKm"); v != "" {
+		var err error
+		if maxKm, err = strconv.ParseFloat(v, 64); err != nil || maxKm <= 0 {
+			http.Error(w, "invalid maxKm", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+
+	name, cities := snapshotIndex, h.Snapshot.Cities
+	if set := q.Get("set"); set != "" {
+		s, ok := h.Sets[set]
+		if !ok {
+			http.Error(w, "unknown city set", http.StatusNotFound)
+			return
+		}
+		name, cities = set, s.Cities
+	}
+	city, km := h.indexes.get(name, cities).nearest(lat, lon)
+	if city == nil || km > maxKm {
+		http.Error(w, "no city within maxKm", http.StatusNotFound)
+		return
+	}
+	_, stale, _ := h.staleness()
+	h.serveJSON(w, r, nearestResponse{
+		Frame:      h.FrameTime,
+		Stale:      stale,
+		Source:     h.DataSource,
+		DistanceKm: math.Round(km*10) / 10,
+		City:       city,
+	})
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: ledradar <command> [flags] [args]
+
+Commands:
+  serve                      run the radar loop and the HTTP API (default)
+  fetch                      download the newest frame in the source format
+  render <frame>             evaluate the cities on a downloaded frame and
+                             write the annotated image
+  render -terminal [frame]   draw it to the terminal with the cities
+  query <lat> <lon>          report the rain state at a location
+  watch [url]                follow the cities of a running instance live
+  cities validate            check the city lists referenced by the config
+  calibrate [frame]          check the configured bounds of the source
+                             against the border printed into its image
+
+Run ledradar <command> -h for the flags of a command.
+`
+
+func main() {
+	log.SetOutput(os.Stdout)
+
+	// without a command, or with flags only, behave like before and serve
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	var err error
+	switch name {
+	case "serve":
+		err = serve(args)
+	case "fetch":
+		err = fetchCommand(args)
+	case "render":
+		err = renderCommand(args)
+	case "query":
+		err = queryCommand(args)
+	case "cities":
+		err = citiesCommand(args)
+	case "watch":
+		err = watchCommand(args)
+	case "calibrate":
+		err = calibrateCommand(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// commandFlags returns the flag set of a command with the common -config
+// flag, defaulting to $LEDRADAR_CONFIG; args describes the positional
+// arguments for the usage message.
+func commandFlags(name, args string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := "ledradar.yaml"
+	if env := os.Getenv(envConfigPath); env != "" {
+		path = env
+	}
+	configPath := fs.String("config", path, "path to the config file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: ledradar %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs, configPath
+}
+
+// parseFrameTime parses a frame time in the format of stored frame names.
+func parseFrameTime(s string) (time.Time, error) {
+	return time.ParseInLocation(frameTimeFormat, s, time.UTC)
+}
+
+var frameTimeInName = regexp.MustCompile(`\d{8}\.\d{4}`)
+
+// fetchLatest downloads the newest frame of source at or before t. Slots
+// that are not published yet are skipped, going back up to three frames.
+func fetchLatest(source Source, fetcher Fetcher, t time.Time) (time.Time, []byte, error) {
+	t = source.FrameTime(t)
+	for i := 0; ; i++ {
+		content, err := fetcher.Fetch(source.URL(t))
+		var status interface{ StatusCode() int }
+		if err == nil || i == 2 || !errors.As(err, &status) || status.StatusCode() != 404 {
+			return t, content, err
+		}
+		t = source.FrameTime(t.Add(-time.Nanosecond))
+	}
+}
+
+// loadFrame decodes the frame file at name, or fetches the newest one if
+// name is empty. The frame time comes from at, the file name or the
+// modification time, in this order.
+func loadFrame(source Source, name, at string) (*Frame, error) {
+	if at == "" {
+		at = frameTimeInName.FindString(path.Base(name))
+	}
+	var t time.Time
+	if at != "" {
+		var err error
+		if t, err = parseFrameTime(at); err != nil {
+			return nil, err
+		}
+	}
+
+	if name == "" {
+		if t.IsZero() {
+			t = time.Now()
+		}
+		if source.URL(t) == "" {
+			return source.Fetch(source.FrameTime(t))
+		}
+		t, content, err := fetchLatest(source, httpFetcher{}, t)
+		if err != nil {
+			return nil, err
+		}
+		return source.Decode(t, content)
+	}
+
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if t.IsZero() {
+		if info, err := os.Stat(name); err == nil {
+			t = info.ModTime().UTC()
+		}
+	}
+	return source.Decode(t, content)
+}
+
+func fetchCommand(args []string) error {
+	fs, configPath := commandFlags("fetch", "")
+	out := fs.String("o", "", "output file, the name of the published file by default")
+	at := fs.String("time", "", "frame time as YYYYMMDD.HHMM in UTC, the newest frame by default")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	source, _ := newSource(cfg, httpFetcher{})
+	if source.URL(time.Now()) == "" {
+		return fmt.Errorf("source %s has no single file to fetch", source.Name())
+	}
+
+	t := time.Now()
+	if *at != "" {
+		if t, err = parseFrameTime(*at); err != nil {
+			return err
+		}
+	}
+	t, content, err := fetchLatest(source, httpFetcher{}, t)
+	if err != nil {
+		return err
+	}
+
+	name := *out
+	if name == "" {
+		name = path.Base(source.URL(t))
+	}
+	if err := os.WriteFile(name, content, 0644); err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+func renderCommand(args []string) error {
+	fs, configPath := commandFlags("render", "<frame>")
+	out := fs.String("o", "render.png", "output PNG file")
+	at := fs.String("time", "", "frame time as YYYYMMDD.HHMM in UTC, taken from the file name by default")
+	terminal := fs.Bool("terminal", false, "draw the image and the cities to the terminal instead, fetching the newest frame without <frame>")
+	width := fs.Int("width", terminalWidth(), "width of the -terminal image in characters")
+	fs.Parse(args)
+	if fs.NArg() != 1 && !(*terminal && fs.NArg() == 0) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	source, _ := newSource(cfg, nil)
+	frame, err := loadFrame(source, fs.Arg(0), *at)
+	if err != nil {
+		return err
+	}
+
+	h := NewHandler(*configPath, cfg)
+	h.LoadCities()
+	if *terminal {
+		h.Apply(context.Background(), source.Name(), frame)
+		fmt.Printf("%s, %s\n", source.Name(), frame.Time.Local().Format("2006-01-02 15:04"))
+		return renderTerminal(os.Stdout, h.Annotated, max(*width, 1), h.Cities)
+	}
+	return os.WriteFile(*out, h.Apply(context.Background(), source.Name(), frame), 0644)
+}
+
+func queryCommand(args []string) error {
+	fs, configPath := commandFlags("query", "<lat> <lon>")
+	frameFile := fs.String("frame", "", "frame file to use instead of fetching the newest one")
+	at := fs.String("time", "", "frame time as YYYYMMDD.HHMM in UTC")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	lat, err := strconv.ParseFloat(fs.Arg(0), 64)
+	if err != nil {
+		return fmt.Errorf("invalid latitude %q", fs.Arg(0))
+	}
+	lon, err := strconv.ParseFloat(fs.Arg(1), 64)
+	if err != nil {
+		return fmt.Errorf("invalid longitude %q", fs.Arg(1))
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	source, _ := newSource(cfg, nil)
+	frame, err := loadFrame(source, *frameFile, *at)
+	if err != nil {
+		return err
+	}
+	maskPixels(frame.Image, cfg.Mask)
+	if crop := cfg.Crop; !crop.IsZero() {
+		frame = frame.Crop(crop)
+	}
+
+	// a single frame has nothing to smooth over
+	qcfg := *cfg
+	qcfg.Smoothing.Alpha = 1
+	city := &City{Name: "query", Lat: lat, Lon: lon}
+	evaluateCity(city, frame, newField(frame.Image), &qcfg)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Frame time.Time `json:"frame"`
+		*City
+	}{frame.Time, city})
+}
+
+func citiesCommand(args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprint(os.Stderr, "Usage: ledradar cities validate [flags]\n")
+		os.Exit(2)
+	}
+	fs, configPath := commandFlags("cities validate", "")
+	fs.Parse(args[1:])
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{"": cfg.CitiesFile}
+	for name, file := range cfg.Sets {
+		files[name] = file
+	}
+
+	var problems []string
+	var primary []*City
+	for set, file := range files {
+		cities, err := loadCities(file)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if set == "" {
+			primary = cities
+		}
+		problems = append(problems, validateCities(file, cities)...)
+		fmt.Printf("%s: %d cities\n", file, len(cities))
+	}
+	problems = append(problems, validateReferences(cfg, primary)...)
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
+}
+
+// validateCities reports duplicate IDs and names and impossible
+// coordinates in one city list.
+func validateCities(file string, cities []*City) []string {
+	var problems []string
+	ids := map[int]string{}
+	names := map[string]bool{}
+
+	for _, city := range cities {
+		if other, ok := ids[city.ID]; ok {
+			problems = append(problems, fmt.Sprintf("%s: ID %d used by both %s and %s", file, city.ID, other, city.Name))
+		}
+		ids[city.ID] = city.Name
+
+		switch {
+		case city.Name == "":
+			problems = append(problems, fmt.Sprintf("%s: city %d has no name", file, city.ID))
+		case names[city.Name]:
+			problems = append(problems, fmt.Sprintf("%s: name %s is used twice, rules cannot tell them apart", file, city.Name))
+		}
+		names[city.Name] = true
+
+		if city.Lat < -90 || city.Lat > 90 || city.Lon < -180 || city.Lon > 180 {
+			problems = append(problems, fmt.Sprintf("%s: %s has invalid coordinates %g, %g", file, city.Name, city.Lat, city.Lon))
+		}
+	}
+	return problems
+}
+
+// validateReferences reports config entries naming cities missing from
+// the main list.
+func validateReferences(cfg *Config, cities []*City) []string {
+	var problems []string
+	ids := map[int]bool{}
+	names := map[string]bool{}
+	for _, city := range cities {
+		ids[city.ID] = true
+		names[strings.ToLower(city.Name)] = true
+		names[strconv.Itoa(city.ID)] = true
+	}
+
+	for id := range cfg.LEDs.Mapping {
+		if !ids[id] {
+			problems = append(problems, fmt.Sprintf("leds: unknown city ID %d", id))
+		}
+	}
+	for _, name := range sortedGroups(cfg.LEDs.Groups) {
+		for _, id := range cfg.LEDs.Groups[name].Cities {
+			if !ids[id] {
+				problems = append(problems, fmt.Sprintf("leds: unknown city ID %d in group %s", id, name))
+			}
+		}
+	}
+	for id := range cfg.Sampling.Cities {
+		if !ids[id] {
+			problems = append(problems, fmt.Sprintf("sampling: unknown city ID %d", id))
+		}
+	}
+	for id := range cfg.Sampling.CombineCities {
+		if !ids[id] {
+			problems = append(problems, fmt.Sprintf("sampling: unknown city ID %d in combineCities", id))
+		}
+	}
+	for id := range cfg.Sampling.MinAreaCities {
+		if !ids[id] {
+			problems = append(problems, fmt.Sprintf("sampling: unknown city ID %d in minAreaCities", id))
+		}
+	}
+	for id, neighbors := range cfg.Neighbors.Cities {
+		for _, n := range append([]int{id}, neighbors...) {
+			if !ids[n] {
+				problems = append(problems, fmt.Sprintf("neighbors: unknown city ID %d", n))
+			}
+		}
+	}
+	for _, rule := range cfg.Notify.Rules {
+		for _, name := range rule.Cities {
+			if !names[strings.ToLower(name)] {
+				problems = append(problems, fmt.Sprintf("notify rule %s: unknown city %s", rule.Name, name))
+			}
+		}
+	}
+	return problems
+}
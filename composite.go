@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"time"
+)
+
+type CompositeConfig struct {
+	// ResolutionKm is the pixel size of the stitched image.
+	ResolutionKm float64 `yaml:"resolutionKm"`
+	// Sources are stitched in order, a pixel coming from the first
+	// source whose BBox contains it.
+	Sources []CompositeSourceConfig `yaml:"sources"`
+}
+
+type CompositeSourceConfig struct {
+	// Source is chmi, dwd or the composite of a neighbouring country:
+	// shmu, imgw or geosphere.
+	Source string `yaml:"source"`
+	// Product is the CHMI product of a chmi source, chmi.product by
+	// default; a product with bounds brings in the composite of another
+	// country.
+	Product string `yaml:"product"`
+	// BBox is the area taken from this source.
+	BBox BBox `yaml:"bbox"`
+	// Mask drops the non-data pixels of this source, in pixels of its
+	// downloaded image.
+	Mask MaskConfig `yaml:"mask"`
+}
+
+// compositeMaxPixels keeps the stitched image within what the pipeline
+// handles comfortably.
+const compositeMaxPixels = 4096 * 4096
+
+type compositeMember struct {
+	source Source
+	cfg    CompositeSourceConfig
+}
+
+// compositeSource stitches the frames of several sources into one lon/lat
+// image covering all their bounding boxes.
+type compositeSource struct {
+	members []compositeMember
+	proj    lonLatProjection
+}
+
+func newCompositeSource(cfg *Config, fetcher Fetcher) (Source, error) {
+	c := cfg.Composite
+	if len(c.Sources) == 0 {
+		return nil, errors.New("composite needs at least one source")
+	}
+	if c.ResolutionKm <= 0 {
+		return nil, errors.New("composite resolutionKm must be positive")
+	}
+
+	s := compositeSource{}
+	var area BBox
+	for i, m := range c.Sources {
+		var member Source
+		switch m.Source {
+		case "chmi":
+			product, err := cfg.CHMI.productNamed(m.Product)
+			if err != nil {
+				return nil, err
+			}
+			member = chmiSource{fetcher, product}
+		case "dwd":
+			member = dwdSource{fetcher}
+		default:
+			product, ok, err := nationalProduct(cfg, m.Source)
+			if !ok {
+				return nil, fmt.Errorf("composite source %d: unknown radar source %q", i, m.Source)
+			}
+			if err != nil {
+				return nil, err
+			}
+			member = nationalSource{chmiSource{fetcher, product}, m.Source}
+		}
+		b := m.BBox
+		if b.North <= b.South || b.East <= b.West {
+			return nil, fmt.Errorf("composite source %d: bbox must have north above south and east of west", i)
+		}
+		if i == 0 {
+			area = b
+		}
+		area = BBox{
+			North: max(area.North, b.North), West: min(area.West, b.West),
+			South: min(area.South, b.South), East: max(area.East, b.East),
+		}
+		s.members = append(s.members, compositeMember{member, m})
+	}
+
+	const kmPerDegree = 111.32
+	mid := (area.North + area.South) / 2 * math.Pi / 180
+	width := int(math.Ceil((area.East - area.West) * kmPerDegree * math.Cos(mid) / c.ResolutionKm))
+	height := int(math.Ceil((area.North - area.South) * kmPerDegree / c.ResolutionKm))
+	if width*height > compositeMaxPixels {
+		return nil, fmt.Errorf("composite of %dx%d pixels is too large, raise resolutionKm", width, height)
+	}
+	s.proj = lonLatProjection{
+		lon0: area.West, lat0: area.North, lon1: area.East, lat1: area.South,
+		width: width, height: height,
+	}
+	return s, nil
+}
+
+func (compositeSource) Name() string {
+	return "composite"
+}
+
+// FrameTime follows the most frequent source, the others contribute
+// their newest frame at that time.
+func (s compositeSource) FrameTime(now time.Time) time.Time {
+	return now.UTC().Truncate(s.Cadence())
+}
+
+func (s compositeSource) Cadence() time.Duration {
+	cadence := s.members[0].source.Cadence()
+	for _, m := range s.members[1:] {
+		cadence = min(cadence, m.source.Cadence())
+	}
+	return cadence
+}
+
+func (s compositeSource) PublishDelay() time.Duration {
+	var delay time.Duration
+	for _, m := range s.members {
+		delay = max(delay, m.source.PublishDelay())
+	}
+	return delay
+}
+
+// URL is empty, a composite is no single file.
+func (compositeSource) URL(t time.Time) string {
+	return ""
+}
+
+func (s compositeSource) Fetch(t time.Time) (*Frame, error) {
+	return s.fetchWith(t, func(m compositeMember, t time.Time) (*Frame, error) {
+		return m.source.Fetch(t)
+	})
+}
+
+func (compositeSource) Decode(t time.Time, content []byte) (*Frame, error) {
+	return nil, errors.New("a composite cannot be decoded from one file")
+}
+
+// fetchWith gets the frame of every source with fetch and stitches them.
+// A source without its frame yet fails the composite, so it is tried
+// again; a source that is down is left out.
+func (s compositeSource) fetchWith(t time.Time, fetch func(compositeMember, time.Time) (*Frame, error)) (*Frame, error) {
+	frames := make([]*Frame, len(s.members))
+	var errs []error
+	for i, m := range s.members {
+		frame, err := fetch(m, m.source.FrameTime(t))
+		var status interface{ StatusCode() int }
+		switch {
+		case err == nil:
+			frames[i] = frame
+		case errors.As(err, &status) && status.StatusCode() == 404:
+			return nil, err
+		default:
+			log.Printf("Composite without %s: %s", m.source.Name(), err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(s.members) {
+		return nil, errors.Join(errs...)
+	}
+	return s.stitch(t, frames), nil
+}
+
+// stitch resamples the frames onto the grid of the composite.
+func (s compositeSource) stitch(t time.Time, frames []*Frame) *Frame {
+	img := image.NewNRGBA(image.Rect(0, 0, s.proj.width, s.proj.height))
+	for i, frame := range frames {
+		if frame != nil {
+			maskPixels(frame.Image, s.members[i].cfg.Mask)
+		}
+	}
+	for y := 0; y < s.proj.height; y++ {
+		for x := 0; x < s.proj.width; x++ {
+			lat, lon := s.proj.Location(x, y)
+			for i, frame := range frames {
+				if frame == nil || !s.members[i].cfg.BBox.Contains(lat, lon) {
+					continue
+				}
+				px, py := frame.Projection.Pixel(lat, lon)
+				if !(image.Point{px, py}.In(frame.Image.Rect)) {
+					continue
+				}
+				src, dst := frame.Image.PixOffset(px, py), img.PixOffset(x, y)
+				copy(img.Pix[dst:dst+4], frame.Image.Pix[src:src+4])
+				break
+			}
+		}
+	}
+	return &Frame{Time: t, Image: img, Projection: s.proj}
+}
+
+// fetchComposite downloads the sources of a composite like single
+// frames, traced one by one.
+func (h *Handler) fetchComposite(ctx context.Context, s compositeSource, t time.Time) (*Frame, error) {
+	return s.fetchWith(t, func(m compositeMember, t time.Time) (*Frame, error) {
+		return h.fetch(ctx, m.source, t)
+	})
+}
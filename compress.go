@@ -0,0 +1,180 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+type CompressionConfig struct {
+	// Encodings in order of preference, br and gzip. Empty disables
+	// compression.
+	Encodings []string `yaml:"encodings"`
+	// MinBytes is the smallest response worth compressing.
+	MinBytes int `yaml:"minBytes"`
+}
+
+// compressible lists the content types worth compressing, images other
+// than SVG are compressed already.
+func compressible(contentType string) bool {
+	t, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "json"), strings.HasSuffix(t, "xml"):
+		return true
+	}
+	return false
+}
+
+// acceptEncoding picks the first of the encodings the client accepts.
+func acceptEncoding(header string, encodings []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+	for _, enc := range encodings {
+		if ok, listed := accepted[enc]; ok || !listed && accepted["*"] {
+			return enc
+		}
+	}
+	return ""
+}
+
+var (
+	gzipWriters   sync.Pool
+	brotliWriters sync.Pool
+)
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+func newEncoder(encoding string, w io.Writer) (encoder, *sync.Pool) {
+	pool := &gzipWriters
+	if encoding == "br" {
+		pool = &brotliWriters
+	}
+	if e, ok := pool.Get().(encoder); ok {
+		e.Reset(w)
+		return e, pool
+	}
+	if encoding == "br" {
+		return brotli.NewWriterLevel(w, 5), pool
+	}
+	return gzip.NewWriter(w), pool
+}
+
+// compressWriter compresses the response once its headers show it is
+// worth it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+	decided  bool
+	enc      encoder
+	pool     *sync.Pool
+}
+
+func (c *compressWriter) decide(status int) {
+	c.decided = true
+	hdr := c.Header()
+	if !compressible(hdr.Get("Content-Type")) {
+		return
+	}
+	hdr.Add("Vary", "Accept-Encoding")
+	if status != http.StatusOK || c.encoding == "" || hdr.Get("Content-Encoding") != "" {
+		return
+	}
+	if n, err := strconv.Atoi(hdr.Get("Content-Length")); err == nil && n < c.minBytes {
+		return
+	}
+
+	hdr.Del("Content-Length")
+	hdr.Del("Accept-Ranges")
+	hdr.Set("Content-Encoding", c.encoding)
+	// the compressed body is a different representation, a weak ETag
+	// still matches conditional requests for it
+	if etag := hdr.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		hdr.Set("ETag", "W/"+etag)
+	}
+	c.enc, c.pool = newEncoder(c.encoding, c.ResponseWriter)
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.decided {
+		c.decide(status)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Flush() {
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) close() {
+	if c.enc != nil {
+		c.enc.Close()
+		c.pool.Put(c.enc)
+	}
+}
+
+// Compress negotiates gzip or brotli compression of text responses
+// through Accept-Encoding.
+func (h *Handler) Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := h.Config().Compression
+		if len(cfg.Encodings) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c := &compressWriter{ResponseWriter: w, minBytes: cfg.MinBytes}
+		// byte ranges refer to the uncompressed body
+		if r.Method != http.MethodHead && r.Header.Get("Range") == "" {
+			c.encoding = acceptEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+		}
+		defer c.close()
+		next.ServeHTTP(c, r)
+	})
+}
+
+func validEncodings(encodings []string) bool {
+	for _, enc := range encodings {
+		if !slices.Contains([]string{"br", "gzip"}, enc) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the runtime settings read from the YAML config file.
+// Every field has a default, so the service also runs without any file.
+type Config struct {
+	Listen     ListenAddrs `yaml:"listen"`
+	TLS        TLSConfig   `yaml:"tls"`
+	Admin      AdminConfig `yaml:"admin"`
+	CitiesFile string      `yaml:"cities"`
+	// CitiesRefresh is how often a city list given as a URL is checked
+	// for changes, 0 loads it once.
+	CitiesRefresh time.Duration `yaml:"citiesRefresh"`
+	Interval      time.Duration `yaml:"interval"`
+	// Schedule aligns polling to when frames are published.
+	Schedule ScheduleConfig `yaml:"schedule"`
+	Backfill BackfillConfig `yaml:"backfill"`
+	// Source selects the radar composite: chmi or dwd, with the CHMI
+	// product in CHMI, shmu, imgw or geosphere of the neighbouring
+	// countries, or composite stitching those in Composite.
+	Source    string          `yaml:"source"`
+	CHMI      CHMIConfig      `yaml:"chmi"`
+	Composite CompositeConfig `yaml:"composite"`
+	// National overrides fields of the composites of the neighbouring
+	// countries like chmi products.
+	National map[string]Product `yaml:"national"`
+	// Crop limits processing to this area right after download.
+	Crop BBox `yaml:"crop"`
+	// Mask drops the non-data pixels of the composite.
+	Mask MaskConfig `yaml:"mask"`
+	// Validate rejects broken downloads, keeping the last good frame.
+	Validate ValidateConfig `yaml:"validate"`
+	Download DownloadConfig `yaml:"download"`
+	// Sets are additional named city files served under /sets/{name}.
+	Sets map[string]string `yaml:"sets"`
+
+	// Data older than StaleAfter is flagged stale, past StaleLimit the
+	// API answers 503 instead (0 disables it).
+	StaleAfter time.Duration `yaml:"staleAfter"`
+	StaleLimit time.Duration `yaml:"staleLimit"`
+
+	Breaker BreakerConfig `yaml:"breaker"`
+	// Adaptive polls eagerly while rain is near and relaxes while dry.
+	Adaptive AdaptiveConfig `yaml:"adaptive"`
+	NATS     NATSConfig     `yaml:"nats"`
+	Kafka    KafkaConfig    `yaml:"kafka"`
+	Redis    RedisConfig    `yaml:"redis"`
+	Leader   LeaderConfig   `yaml:"leader"`
+	Notify   NotifyConfig   `yaml:"notify"`
+	Matrix   MatrixConfig   `yaml:"matrix"`
+	Outputs  OutputsConfig  `yaml:"outputs"`
+	Cells    CellsConfig    `yaml:"cells"`
+	LEDs     LEDConfig      `yaml:"leds"`
+	Image    ImageConfig    `yaml:"image"`
+	// Palette colors the LEDs, lights and images of the outputs that do
+	// not pick their own: chmi, viridis, colorblind or mono.
+	Palette Palette `yaml:"palette"`
+
+	Sampling  SamplingConfig  `yaml:"sampling"`
+	Smoothing SmoothingConfig `yaml:"smoothing"`
+	Retention RetentionConfig `yaml:"retention"`
+	EventLog  EventLogConfig  `yaml:"eventLog"`
+	Fallback  FallbackConfig  `yaml:"fallback"`
+	AccessLog AccessLogConfig `yaml:"accessLog"`
+	CORS      CORSConfig      `yaml:"cors"`
+	API       APIConfig       `yaml:"api"`
+
+	Compression CompressionConfig `yaml:"compression"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Systemd     SystemdConfig     `yaml:"systemd"`
+	Geocode     GeocodeConfig     `yaml:"geocode"`
+
+	Hail        HailConfig        `yaml:"hail"`
+	Trend       TrendConfig       `yaml:"trend"`
+	NearestRain NearestRainConfig `yaml:"nearestRain"`
+	Neighbors   NeighborsConfig   `yaml:"neighbors"`
+	Lightning   LightningConfig   `yaml:"lightning"`
+	Wind        WindConfig        `yaml:"wind"`
+
+	// Plugins are WebAssembly modules getting every update like an output
+	// and filtering the state of the cities, see plugins.go.
+	Plugins []PluginConfig `yaml:"plugins"`
+}
+
+type OutputsConfig struct {
+	// Retry applies to every output.
+	Retry    RetryConfig     `yaml:"retry"`
+	Pixoo    PixooConfig     `yaml:"pixoo"`
+	DDP      []DDPConfig     `yaml:"ddp"`
+	Hue      HueConfig       `yaml:"hue"`
+	Bulbs    []BulbConfig    `yaml:"bulbs"`
+	MQTT     MQTTConfig      `yaml:"mqtt"`
+	StatsD   StatsDConfig    `yaml:"statsd"`
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	Files    []FileConfig    `yaml:"files"`
+	Hooks    []HookConfig    `yaml:"hooks"`
+}
+
+type MatrixConfig struct {
+	// BBox is the area rendered by /matrix, the Czech Republic by default.
+	BBox BBox `yaml:"bbox"`
+}
+
+type SmoothingConfig struct {
+	// Alpha is the weight of the newest frame, 1 disables smoothing.
+	Alpha float64 `yaml:"alpha"`
+}
+
+type BreakerConfig struct {
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:        ListenAddrs{":8080"},
+		Admin:         AdminConfig{Listen: "127.0.0.1:8081"},
+		CitiesFile:    defaultCitiesFile,
+		CitiesRefresh: 10 * time.Minute,
+		Interval:      60 * time.Second,
+		Schedule: ScheduleConfig{
+			Align: true,
+			Retry: 15 * time.Second,
+		},
+		Source: "chmi",
+		CHMI:   CHMIConfig{Product: "z_max3d"},
+		Mask:   MaskConfig{Auto: true, Tolerance: 4},
+		Validate: ValidateConfig{
+			MaxCoverage: 0.9,
+			Timestamp:   true,
+		},
+		Download: DownloadConfig{Keep: 8},
+		TLS: TLSConfig{
+			Autocert: AutocertConfig{CacheDir: "certs"},
+		},
+		StaleAfter: 30 * time.Minute,
+		EventLog:   EventLogConfig{Path: "events.jsonl"},
+		Breaker: BreakerConfig{
+			Failures: 5,
+			Cooldown: 5 * time.Minute,
+		},
+		NATS: NATSConfig{
+			Subject: "ledradar",
+		},
+		Redis: RedisConfig{
+			Prefix: "ledradar",
+		},
+		Leader: LeaderConfig{
+			Mode: "off",
+			TTL:  30 * time.Second,
+		},
+		Kafka: KafkaConfig{
+			Topic:  "ledradar",
+			Format: "json",
+		},
+		Cells: CellsConfig{
+			MinDBZ:    36,
+			MinPixels: 4,
+			MaxSpeed:  150,
+		},
+		Fallback: FallbackConfig{
+			After:    30 * time.Minute,
+			Interval: 15 * time.Minute,
+		},
+		Compression: CompressionConfig{
+			Encodings: []string{"br", "gzip"},
+			MinBytes:  1024,
+		},
+		Systemd: SystemdConfig{Grace: 5 * time.Minute},
+		Geocode: GeocodeConfig{URL: "https://nominatim.openstreetmap.org/search"},
+		Tracing: TracingConfig{
+			Service:     "ledradar",
+			SampleRatio: 1,
+		},
+		CORS: CORSConfig{
+			Methods: []string{"GET", "HEAD"},
+			MaxAge:  time.Hour,
+		},
+		Retention: RetentionConfig{
+			Keep: time.Hour,
+		},
+		Sampling: SamplingConfig{
+			Mode: "avg",
+		},
+		Smoothing: SmoothingConfig{
+			Alpha: 0.5,
+		},
+		Hail: HailConfig{
+			MinDBZ:   56,
+			MinTopKm: 10,
+		},
+		Trend: TrendConfig{
+			Window:    30 * time.Minute,
+			MinChange: 4,
+		},
+		Composite: CompositeConfig{ResolutionKm: 1},
+		NearestRain: NearestRainConfig{
+			MinDBZ: 4,
+			MaxKm:  100,
+		},
+		LEDs: LEDConfig{
+			Behaviors: map[AlertLevel]LEDBehavior{AlertSevere: BehaviorFlashing},
+		},
+		Image: ImageConfig{
+			MarkerSize:  10,
+			MarkerShape: "square",
+			DryColor:    "#000000",
+			Background:  "keep",
+		},
+		Palette: PaletteCHMI,
+		Wind: WindConfig{
+			Level:   700,
+			Grid:    5,
+			Refresh: time.Hour,
+			Horizon: time.Hour,
+			Step:    5 * time.Minute,
+			MinDBZ:  20,
+		},
+		Lightning: LightningConfig{
+			RadiusKm: 20,
+			Window:   10 * time.Minute,
+			Area:     BBox{North: 52.5, West: 10.5, South: 47.5, East: 20.5},
+		},
+		Outputs: OutputsConfig{
+			Retry:  RetryConfig{Attempts: 3, Backoff: 5 * time.Second},
+			Pixoo:  PixooConfig{Size: 64},
+			MQTT:   MQTTConfig{Topic: "ledradar"},
+			StatsD: StatsDConfig{Protocol: "statsd", Prefix: "ledradar"},
+		},
+	}
+}
+
+// LoadConfig reads the config file at path on top of the defaults and
+// applies the LEDRADAR_* environment variables on top of that, see
+// applyEnv. A missing file is not an error.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		return nil, fmt.Errorf("environment: %w", err)
+	}
+
+	for name := range cfg.National {
+		if _, ok := nationalProducts[name]; !ok {
+			return nil, fmt.Errorf("%s: unknown national source %q, expected shmu, imgw or geosphere", path, name)
+		}
+	}
+	if _, err := newSource(cfg, nil); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	modes := []string{cfg.Sampling.Mode}
+	for _, mode := range cfg.Sampling.Cities {
+		modes = append(modes, mode)
+	}
+	if err := cfg.Validate.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Backfill.Frames < 0 {
+		return nil, fmt.Errorf("backfill frames must not be negative")
+	}
+	for _, mode := range modes {
+		if mode != "avg" && mode != "max" {
+			return nil, fmt.Errorf("%s: unknown sampling mode %q", path, mode)
+		}
+	}
+
+	combines := []string{cfg.Sampling.Combine}
+	for _, c := range cfg.Sampling.CombineCities {
+		combines = append(combines, c)
+	}
+	for _, c := range combines {
+		if c != "" && c != "none" && c != "max" && c != "mean" {
+			return nil, fmt.Errorf("%s: unknown sampling combine %q, expected none, max or mean", path, c)
+		}
+	}
+
+	areas := []int{cfg.Sampling.MinArea}
+	for _, n := range cfg.Sampling.MinAreaCities {
+		areas = append(areas, n)
+	}
+	for _, n := range areas {
+		if n < 0 || n > 81 {
+			return nil, fmt.Errorf("%s: sampling minArea must be from 0 to 81, the pixels of the window", path)
+		}
+	}
+
+	if cfg.Sampling.Workers < 0 {
+		return nil, fmt.Errorf("%s: sampling workers must not be negative", path)
+	}
+
+	if cfg.Smoothing.Alpha <= 0 || cfg.Smoothing.Alpha > 1 {
+		return nil, fmt.Errorf("%s: smoothing alpha must be in (0, 1]", path)
+	}
+
+	if err := cfg.Hail.validate(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Trend.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if !validEncodings(cfg.Compression.Encodings) {
+		return nil, fmt.Errorf("%s: compression encodings are br and gzip", path)
+	}
+
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		return nil, fmt.Errorf("%s: tracing sample ratio must be in [0, 1]", path)
+	}
+
+	if cfg.TLS.Cert != "" && cfg.TLS.Key == "" {
+		return nil, fmt.Errorf("%s: tls cert needs a key", path)
+	}
+
+	switch cfg.Leader.Mode {
+	case "", "off", "redis", "kubernetes":
+	default:
+		return nil, fmt.Errorf("%s: unknown leader mode %q", path, cfg.Leader.Mode)
+	}
+	if cfg.Leader.enabled() {
+		if cfg.Redis.URL == "" {
+			return nil, fmt.Errorf("%s: leader election shares results through redis, set redis.url", path)
+		}
+		if cfg.Leader.TTL < 3*time.Second {
+			return nil, fmt.Errorf("%s: leader ttl must be at least 3s", path)
+		}
+	}
+
+	if err := cfg.Listen.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Download.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Admin.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Image.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.EventLog.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Wind.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Neighbors.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.LEDs.nearbyColor(); err != nil {
+		return nil, err
+	}
+	if cfg.LEDs.Fade < 0 {
+		return nil, fmt.Errorf("%s: leds fade must not be negative", path)
+	}
+	if err := cfg.LEDs.validateGroups(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.LEDs.validateBehaviors(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if i := cfg.LEDs.Summary; i != nil && (*i < 0 || (cfg.LEDs.Count > 0 && *i >= cfg.LEDs.Count)) {
+		return nil, fmt.Errorf("%s: leds summary %d is not on the strip", path, *i)
+	}
+	if err := cfg.resolvePalettes(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.Outputs.StatsD.validate(); err != nil {
+		return nil, err
+	}
+	for _, d := range cfg.Outputs.DDP {
+		if err := d.Calibration.validate(); err != nil {
+			return nil, fmt.Errorf("%s: ddp %s: %w", path, d.Host, err)
+		}
+	}
+	if err := cfg.Outputs.Hue.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, b := range cfg.Outputs.Bulbs {
+		if err := b.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if cfg.Outputs.Retry.Attempts < 1 {
+		return nil, fmt.Errorf("%s: outputs need at least 1 attempt", path)
+	}
+	for _, w := range cfg.Outputs.Webhooks {
+		if _, err := newWebhookOutput(w); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := cfg.API.validate(cfg.Sets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, plugin := range cfg.Plugins {
+		if err := plugin.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, hook := range cfg.Outputs.Hooks {
+		if err := hook.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, f := range cfg.Outputs.Files {
+		if f.Format != "" && f.Format != "json" && f.Format != "png" {
+			return nil, fmt.Errorf("%s: unknown file output format %q", path, f.Format)
+		}
+	}
+
+	if cfg.Schedule.Align && cfg.Schedule.Retry <= 0 {
+		return nil, fmt.Errorf("%s: schedule retry must be positive", path)
+	}
+	if err := cfg.Adaptive.validate(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if cfg.Systemd.Grace <= 0 {
+		return nil, fmt.Errorf("%s: systemd grace must be positive", path)
+	}
+
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("%s: interval must be positive", path)
+	}
+	if cfg.CitiesRefresh < 0 {
+		return nil, fmt.Errorf("%s: citiesRefresh must not be negative", path)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"", filepath.Join(dir, "ledradar.yaml"), empty} {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%q: %v", path, err)
+			continue
+		}
+		// serve starts on the defaults too
+		if err := cfg.Admin.requireToken(); err != nil {
+			t.Errorf("%q: %v", path, err)
+		}
+	}
+}
+
+func TestAdminRequireToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		admin AdminConfig
+		ok    bool
+	}{
+		{"own listener", AdminConfig{Listen: "127.0.0.1:8081"}, true},
+		{"own socket with a token", AdminConfig{Listen: "unix:/run/ledradar/admin.sock", Token: "secret"}, true},
+		{"public listener with a token", AdminConfig{Token: "secret"}, true},
+		{"public listener without a token", AdminConfig{}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.admin.requireToken(); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
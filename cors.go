@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type CORSConfig struct {
+	// Origins allowed to call the API, "*" for any. Empty disables CORS.
+	Origins []string      `yaml:"origins"`
+	Methods []string      `yaml:"methods"`
+	Headers []string      `yaml:"headers"`
+	MaxAge  time.Duration `yaml:"maxAge"`
+}
+
+func (c CORSConfig) allowed(origin string) bool {
+	return slices.Contains(c.Origins, "*") || slices.Contains(c.Origins, origin)
+}
+
+// CORS adds the CORS headers for allowed origins and answers preflight
+// requests.
+func (h *Handler) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := h.Config().CORS
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(cfg.Origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !cfg.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Age, ETag, X-Data-Stale, X-Data-Source, X-Frame-ID, X-Next-Poll")
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.Methods, ", "))
+		if len(cfg.Headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.Headers, ", "))
+		}
+		if cfg.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", fmt.Sprint(int(cfg.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
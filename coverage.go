@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// radarCovers returns whether the radar configured in cfg covers a point,
+// known before any frame is in. Frames decide in the end, see
+// evaluateCity.
+func radarCovers(cfg *Config) func(lat, lon float64) bool {
+	var covers func(lat, lon float64) bool
+	switch cfg.Source {
+	case "", "chmi":
+		b := BBox{North: lat0, West: lon0, South: lat1, East: lon1}
+		if product, err := cfg.CHMI.product(); err == nil && !product.Bounds.IsZero() {
+			b = product.Bounds
+		}
+		covers = b.Contains
+	case "dwd":
+		covers = func(lat, lon float64) bool {
+			x, y := radolanProjection{}.Pixel(lat, lon)
+			return x >= 0 && y >= 0 && x < radolanSize && y < radolanSize
+		}
+	case "composite":
+		covers = func(lat, lon float64) bool {
+			for _, m := range cfg.Composite.Sources {
+				if m.BBox.Contains(lat, lon) {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		product, ok, err := nationalProduct(cfg, cfg.Source)
+		if !ok || err != nil {
+			return func(float64, float64) bool { return true }
+		}
+		covers = product.covers
+	}
+	if crop := cfg.Crop; !crop.IsZero() {
+		return func(lat, lon float64) bool {
+			return crop.Contains(lat, lon) && covers(lat, lon)
+		}
+	}
+	return covers
+}
+
+// checkCoverage flags the cities outside the radar and says which, so a
+// typo in the coordinates does not go unnoticed.
+func checkCoverage(name string, cities []*City, cfg *Config) {
+	covers := radarCovers(cfg)
+	var outside []string
+	for _, city := range cities {
+		city.Coverage = covers(city.Lat, city.Lon)
+		if !city.Coverage {
+			outside = append(outside, city.Name)
+		}
+	}
+	if len(outside) > 0 {
+		log.Printf("%d cities of %s are outside the radar and stay dry: %s", len(outside), name, strings.Join(outside, ", "))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DDPConfig is one controller speaking the Distributed Display Protocol,
+// e.g. WLED or Falcon. It receives the LEDs from Start, Count of them (0
+// means all remaining).
+type DDPConfig struct {
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	Destination uint8  `yaml:"destination"`
+	Start       int    `yaml:"start"`
+	Count       int    `yaml:"count"`
+	// Palette colors the LEDs of this controller, the global palette
+	// when empty.
+	Palette     Palette        `yaml:"palette"`
+	Calibration LEDCalibration `yaml:"calibration"`
+}
+
+const (
+	ddpFlagVersion1 = 0x40
+	ddpFlagPush     = 0x01
+	ddpTypeRGB24    = 0x0b
+	ddpMaxData      = 1440
+)
+
+// ddpPackets splits RGB data into DDP packets, setting push on the last.
+func ddpPackets(data []byte, seq, destination uint8) [][]byte {
+	var packets [][]byte
+	for offset := 0; ; offset += ddpMaxData {
+		end := min(offset+ddpMaxData, len(data))
+		flags := byte(ddpFlagVersion1)
+		if end == len(data) {
+			flags |= ddpFlagPush
+		}
+
+		packet := make([]byte, 10, 10+end-offset)
+		packet[0] = flags
+		packet[1] = seq & 0x0f
+		packet[2] = ddpTypeRGB24
+		packet[3] = destination
+		binary.BigEndian.PutUint32(packet[4:], uint32(offset))
+		binary.BigEndian.PutUint16(packet[8:], uint16(end-offset))
+		packets = append(packets, append(packet, data[offset:end]...))
+
+		if end == len(data) {
+			break
+		}
+	}
+	return packets
+}
+
+// DDP sends the LED colors to all configured controllers.
+type DDP struct {
+	m           sync.Mutex
+	controllers []DDPConfig
+	curves      []*ledCurve
+	seq         uint8
+	leds        []color.NRGBA
+	dbz         []float64
+	behaviors   []LEDBehavior
+	test        *ddpTest
+	// fades ease every controller into the colors of a new update
+	fades []ledFade
+	fade  time.Duration
+}
+
+// ddpTest is a test pattern the controllers show instead of the radar.
+type ddpTest struct {
+	pattern      string
+	start, until time.Time
+}
+
+func (d *DDP) Configure(controllers []DDPConfig, fade time.Duration) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.controllers, d.fade = controllers, fade
+	d.curves = make([]*ledCurve, len(controllers))
+	for i, c := range controllers {
+		d.curves[i] = c.Calibration.curve()
+	}
+	fades := make([]ledFade, len(controllers))
+	copy(fades, d.fades)
+	d.fades = fades
+}
+
+// Test shows pattern for duration, an empty pattern brings the radar
+// back.
+func (d *DDP) Test(pattern string, duration time.Duration) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if pattern == "" {
+		if d.test != nil {
+			d.test = nil
+			return d.sendAll(time.Now())
+		}
+		return nil
+	}
+	if len(d.controllers) == 0 {
+		return errors.New("no DDP controllers configured")
+	}
+	now := time.Now()
+	d.test = &ddpTest{pattern: pattern, start: now, until: now.Add(duration)}
+	return d.sendAll(now)
+}
+
+// testCount is how many LEDs test patterns cover: the strip, or the
+// controllers before the first update.
+func (d *DDP) testCount() int {
+	count := len(d.leds)
+	for _, c := range d.controllers {
+		count = max(count, c.Start+c.Count)
+	}
+	return max(count, 1)
+}
+
+func (d *DDP) Name() string {
+	return "ddp"
+}
+
+func (d *DDP) Send(u *Update) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := time.Now()
+	d.leds, d.dbz, d.behaviors = u.LEDs, u.LEDDBZ, u.Behaviors
+	for i, c := range d.controllers {
+		d.fades[i].retarget(recolorLEDs(d.leds, d.dbz, c.Palette), now, d.fade)
+	}
+	return d.sendAll(now)
+}
+
+// fading tells whether a controller has not shown its new colors in full
+// yet. Must be called with d.m held.
+func (d *DDP) fading() bool {
+	for _, f := range d.fades {
+		if !f.settled {
+			return true
+		}
+	}
+	return false
+}
+
+// Run plays the fades, the behaviors of the LEDs that are not solid and
+// the test patterns, showing the radar again once they expire, at 20 fps.
+func (d *DDP) Run() {
+	for t := range time.Tick(50 * time.Millisecond) {
+		d.m.Lock()
+		testing := d.test != nil
+		if testing && !t.Before(d.test.until) {
+			d.test = nil
+		}
+		if testing || animated(d.behaviors) || d.fading() {
+			if err := d.sendAll(t); err != nil {
+				log.Printf("DDP: %s", err)
+			}
+		}
+		d.m.Unlock()
+	}
+}
+
+// sendAll sends the LEDs as they show at t to every controller, in its
+// palette and calibrated for it. Must be called with d.m held.
+func (d *DDP) sendAll(t time.Time) error {
+	d.seq = d.seq%15 + 1
+	var errs []error
+	for i, c := range d.controllers {
+		var leds []color.NRGBA
+		if d.test != nil {
+			leds = testPattern(d.test.pattern, d.testCount(), t.Sub(d.test.start))
+		} else {
+			leds = renderBehaviors(d.fades[i].at(t), d.behaviors, t)
+		}
+		if err := d.send(c, d.curves[i].apply(leds)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *DDP) send(c DDPConfig, leds []color.NRGBA) error {
+	if c.Start >= len(leds) {
+		return nil
+	}
+	leds = leds[c.Start:]
+	if c.Count > 0 && c.Count < len(leds) {
+		leds = leds[:c.Count]
+	}
+
+	data := make([]byte, 0, len(leds)*3)
+	for _, led := range leds {
+		data = append(data, led.R, led.G, led.B)
+	}
+
+	port := c.Port
+	if port == 0 {
+		port = 4048
+	}
+	destination := c.Destination
+	if destination == 0 {
+		destination = 1
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(c.Host, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, packet := range ddpPackets(data, d.seq, destination) {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
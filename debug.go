@@ -0,0 +1,221 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cityDebug explains how a city was evaluated on the current frame.
+type cityDebug struct {
+	City   *City     `json:"city"`
+	Frame  time.Time `json:"frame"`
+	Source string    `json:"source"`
+	// X and Y are the center of the sampling window, Lat and Lon the
+	// center of that pixel.
+	X       int     `json:"x"`
+	Y       int     `json:"y"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	InImage bool    `json:"inImage"`
+
+	Kernel debugKernel `json:"kernel"`
+	// Pixels is the window row by row from the north-west, null outside
+	// the image.
+	Pixels [][]*debugPixel `json:"pixels"`
+	// Sampled is the color the kernel produced, what the city state is
+	// derived from.
+	Sampled   debugPixel `json:"sampled"`
+	Decisions []string   `json:"decisions"`
+	// LED is the index and color of the LED of the city.
+	LED *debugLED `json:"led,omitempty"`
+}
+
+type debugKernel struct {
+	Mode string `json:"mode"`
+	Size int    `json:"size"`
+	// Echoes counts the pixels of the window with precipitation.
+	Echoes int `json:"echoes"`
+	// MaxX and MaxY are the strongest pixel, picked in max mode.
+	MaxX *int `json:"maxX,omitempty"`
+	MaxY *int `json:"maxY,omitempty"`
+}
+
+type debugPixel struct {
+	Color string `json:"color"`
+	Alpha uint8  `json:"alpha"`
+	// DBZ is null for dry pixels.
+	DBZ *float64 `json:"dbz"`
+}
+
+type debugLED struct {
+	Index int    `json:"index"`
+	Color string `json:"color"`
+}
+
+func newDebugPixel(r, g, b, a uint8) *debugPixel {
+	p := &debugPixel{Color: fmt.Sprintf("#%02x%02x%02x", r, g, b), Alpha: a}
+	if a != 0 && r|g|b != 0 {
+		dbz := roundDBZ(colorDBZ(r, g, b))
+		p.DBZ = &dbz
+	}
+	return p
+}
+
+func roundDBZ(dbz float64) float64 {
+	return math.Round(dbz*10) / 10
+}
+
+// debugCity retraces evaluateCity for city on frame without changing the
+// city, whose state is the result of the real evaluation.
+func debugCity(city *City, frame *Frame, cfg *Config) *cityDebug {
+	img := frame.Image
+	field := newField(img)
+	x, y := city.offsetPixel(frame.Projection)
+	d := &cityDebug{City: city, Frame: frame.Time, X: x, Y: y, InImage: image.Pt(x, y).In(img.Bounds())}
+	d.Lat, d.Lon = frame.Projection.Location(x, y)
+	d.Kernel = debugKernel{Mode: cfg.Sampling.mode(city.ID), Size: 9}
+
+	for yy := y - 4; yy <= y+4; yy++ {
+		row := make([]*debugPixel, 0, 9)
+		for xx := x - 4; xx <= x+4; xx++ {
+			if !image.Pt(xx, yy).In(img.Bounds()) {
+				row = append(row, nil)
+				continue
+			}
+			c := img.NRGBAAt(xx, yy)
+			p := newDebugPixel(c.R, c.G, c.B, c.A)
+			if p.DBZ != nil {
+				d.Kernel.Echoes++
+			}
+			row = append(row, p)
+		}
+		d.Pixels = append(d.Pixels, row)
+	}
+
+	var r, g, b uint8
+	if d.Kernel.Mode == "max" {
+		r, g, b = getMaxColor(img, field, x, y)
+		if mx, my, ok := maxPixel(field, x, y); ok {
+			d.Kernel.MaxX, d.Kernel.MaxY = &mx, &my
+		}
+	} else {
+		r, g, b = getAvgColor(img, x, y)
+	}
+	d.Sampled = *newDebugPixel(r, g, b, 255)
+
+	say := func(format string, args ...any) {
+		d.Decisions = append(d.Decisions, fmt.Sprintf(format, args...))
+	}
+	if !d.InImage {
+		say("pixel %d,%d is outside the %dx%d image, the window reads as dry", x, y, img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if city.Offset != nil {
+		say("sampled at the offset %g,%g (km: %t) from the city", city.Offset.X, city.Offset.Y, city.Offset.Km)
+	}
+	switch {
+	case d.Kernel.Mode == "max" && d.Kernel.MaxX != nil:
+		say("max mode: took the strongest of %d echo pixels, at %d,%d", d.Kernel.Echoes, *d.Kernel.MaxX, *d.Kernel.MaxY)
+	case d.Kernel.Mode == "max":
+		say("max mode: no echo pixel in the window")
+	default:
+		say("avg mode: averaged the color channels over all 81 pixels, %d of them with echoes, dry ones counting as black", d.Kernel.Echoes)
+	}
+	if r|g|b == 0 {
+		say("sampled color is black: dry")
+	} else {
+		dbz := colorDBZ(r, g, b)
+		say("sampled color %s is not black: raining, the closest legend color is %.1f dBZ, %s", d.Sampled.Color, dbz, intensityOf(dbz))
+		if d.Kernel.Mode != "max" && d.Kernel.Echoes < 41 {
+			say("fewer than half of the window pixels have echoes, averaging them with the black ones darkens the color before it is matched to the legend")
+		}
+	}
+
+	alpha := cfg.Smoothing.Alpha
+	s := city.Smoothed
+	if alpha < 1 {
+		say("smoothing alpha %g: the smoothed color is %s at %.1f dBZ", alpha, fmt.Sprintf("#%02x%02x%02x", s.R, s.G, s.B), s.DBZ)
+		if !city.Raining() && s.R|s.G|s.B != 0 {
+			say("dry now, but the smoothed color still fades out rain of earlier frames")
+		}
+	}
+	if city.RainNearby {
+		say("a neighbor is raining, so rainNearby is set")
+	}
+
+	if cfg.LEDs.Points == "" {
+		led := ledColorOf(city, cfg.LEDs)
+		d.LED = &debugLED{Index: cfg.LEDs.index(city), Color: led}
+		if cfg.LEDs.Count > 0 && d.LED.Index >= cfg.LEDs.Count {
+			say("LED %d is past the strip of %d LEDs, nothing lights", d.LED.Index, cfg.LEDs.Count)
+		} else if name, ok := cfg.LEDs.group(city.ID); ok {
+			say("LED %d shows group %s, the %s of its cities", d.LED.Index, name, cmp.Or(cfg.LEDs.Groups[name].Aggregate, "max"))
+		} else if led != "#000000" {
+			say("LED %d shows %s", d.LED.Index, led)
+		} else {
+			say("LED %d is off", d.LED.Index)
+		}
+	}
+	return d
+}
+
+// ledColorOf is the LED color of city as ledColors picks it.
+func ledColorOf(city *City, cfg LEDConfig) string {
+	leds := ledColors([]City{*city}, LEDConfig{Nearby: cfg.Nearby, Mapping: map[int]int{city.ID: 0}, Count: 1})
+	c := leds[0]
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// HandleDebugCity explains the state of a city on the current frame:
+// where it was sampled, the pixels of the window, the kernel and the
+// decisions taken, from the main list or ?set=.
+func (h *Handler) HandleDebugCity(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid city id", http.StatusBadRequest)
+		return
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	cities := h.Snapshot.Cities
+	if name := r.URL.Query().Get("set"); name != "" {
+		set, ok := h.Sets[name]
+		if !ok {
+			http.Error(w, "unknown city set", http.StatusNotFound)
+			return
+		}
+		cities = set.Cities
+	}
+	var city *City
+	for _, c := range cities {
+		if c.ID == id {
+			city = c
+		}
+	}
+	if city == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if h.Frame == nil {
+		http.Error(w, "no radar frame yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	d := debugCity(city, h.Frame, h.config)
+	d.Source = h.DataSource
+	if h.DataSource == openMeteoSource {
+		d.Decisions = append([]string{"the city state comes from the Open-Meteo fallback, not from this frame"}, d.Decisions...)
+	}
+	if h.simulation != nil && h.clock.Now().Before(h.simulation.until) {
+		d.Decisions = append([]string{"a simulation overrides the city state"}, d.Decisions...)
+	}
+	h.serveJSON(w, r, d)
+}
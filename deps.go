@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Clock abstracts time so the pipeline can be driven by tests.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// Fetcher downloads a URL. Non-200 responses are reported as an error with
+// a StatusCode() int method.
+type Fetcher interface {
+	Fetch(url string) ([]byte, error)
+}
+
+// Store keeps the annotated frames.
+type Store interface {
+	Has(t time.Time) bool
+	Save(t time.Time, png []byte) error
+	Load(t time.Time) ([]byte, error)
+	// List returns all stored frames, oldest first.
+	List() ([]StoredFrame, error)
+	Delete(t time.Time) error
+}
+
+// StoredFrame aliases an unnamed struct so that implementations outside
+// this package (internal/testing) can satisfy Store without importing it.
+type StoredFrame = struct {
+	Time  time.Time
+	Size  int64
+	Saved time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type httpFetcher struct{}
+
+func (httpFetcher) Fetch(url string) ([]byte, error) {
+	return download(url)
+}
+
+const frameTimeFormat = "20060102.1504"
+
+// dirStore keeps frames as <prefix><time>.png files in a directory, the
+// prefix radar_a_mesta_ unless set.
+type dirStore struct {
+	dir    string
+	prefix string
+}
+
+func (s dirStore) filePrefix() string {
+	if s.prefix == "" {
+		return "radar_a_mesta_"
+	}
+	return s.prefix
+}
+
+// fileName is the name of the file of the frame of t.
+func (s dirStore) fileName(t time.Time) string {
+	return fmt.Sprintf("%s%s.png", s.filePrefix(), t.Format(frameTimeFormat))
+}
+
+func (s dirStore) path(t time.Time) string {
+	return filepath.Join(s.dir, s.fileName(t))
+}
+
+func (s dirStore) Has(t time.Time) bool {
+	_, err := os.Stat(s.path(t))
+	return err == nil
+}
+
+func (s dirStore) Save(t time.Time, png []byte) error {
+	return os.WriteFile(s.path(t), png, 0644)
+}
+
+func (s dirStore) Load(t time.Time) ([]byte, error) {
+	return os.ReadFile(s.path(t))
+}
+
+func (s dirStore) Delete(t time.Time) error {
+	return os.Remove(s.path(t))
+}
+
+func (s dirStore) List() ([]StoredFrame, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []StoredFrame
+	for _, file := range files {
+		name := file.Name()
+		prefix := s.filePrefix()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".png") {
+			continue
+		}
+		t, err := time.Parse(frameTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".png"))
+		if err != nil {
+			continue
+		}
+
+		fileInfo, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, StoredFrame{Time: t, Size: fileInfo.Size(), Saved: fileInfo.ModTime()})
+	}
+
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Time.Before(frames[j].Time) })
+	return frames, nil
+}
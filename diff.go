@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Colors of the /diff image, dry in both frames stays transparent.
+var (
+	diffAppeared    = color.NRGBA{0, 200, 0, 255}
+	diffDisappeared = color.NRGBA{200, 0, 0, 255}
+	diffIntensified = color.NRGBA{255, 200, 0, 255}
+	diffWeakened    = color.NRGBA{0, 120, 255, 255}
+	diffUnchanged   = color.NRGBA{96, 96, 96, 255}
+)
+
+// parseTimeParam accepts RFC 3339 or the YYYYMMDD.HHMM of stored frames.
+func parseTimeParam(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := parseFrameTime(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 or YYYYMMDD.HHMM", s)
+	}
+	return t, nil
+}
+
+// loadField decodes a stored frame, masked like a downloaded one, with
+// the city markers drawn into it left out. Frames saved with a black
+// background have no radar left to decode.
+func (h *Handler) loadField(t time.Time, proj Projection) (*Field, error) {
+	content, err := h.store.Load(t)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	bitmap := toNRGBA(img)
+	maskPixels(bitmap, h.config.Mask)
+	for _, city := range h.Cities {
+		x, y := proj.Pixel(city.Lat, city.Lon)
+		fillRect(bitmap, h.config.Image.markerRect(x, y), color.NRGBA{})
+	}
+	return newField(bitmap), nil
+}
+
+// diffImage colors every pixel by how its reflectivity changed from a to
+// b, delta dBZ or more counting as intensified or weakened.
+func diffImage(a, b *Field, delta float64) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, a.Width, a.Height))
+	for i := range a.DBZ {
+		from, to := float64(a.DBZ[i]), float64(b.DBZ[i])
+		var c color.NRGBA
+		switch {
+		case math.IsNaN(from) && math.IsNaN(to):
+			continue
+		case math.IsNaN(from):
+			c = diffAppeared
+		case math.IsNaN(to):
+			c = diffDisappeared
+		case to-from >= delta:
+			c = diffIntensified
+		case from-to >= delta:
+			c = diffWeakened
+		default:
+			c = diffUnchanged
+		}
+		img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2], img.Pix[4*i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+type geoJSON struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+type geoFeature struct {
+	Type       string         `json:"type"`
+	Geometry   geoGeometry    `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geoGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// cellChanges matches the cells of both frames: moved cells are lines
+// from their old to their new centroid, the others points where they
+// appeared or disappeared.
+func cellChanges(from, to []*Cell, dt float64, cfg CellsConfig) geoJSON {
+	doc := geoJSON{Type: "FeatureCollection", Features: []geoFeature{}}
+	point := func(c *Cell, status string) {
+		doc.Features = append(doc.Features, geoFeature{
+			Type:     "Feature",
+			Geometry: geoGeometry{"Point", []float64{c.Lon, c.Lat}},
+			Properties: map[string]any{
+				"status": status, "maxDbz": c.MaxDBZ, "areaKm2": math.Round(c.AreaKm2),
+			},
+		})
+	}
+
+	matched := matchCells(to, from, dt, cfg.MaxSpeed)
+	used := map[int]bool{}
+	for i, c := range to {
+		j, ok := matched[i]
+		if !ok {
+			point(c, "appeared")
+			continue
+		}
+		used[j] = true
+		old := from[j]
+		doc.Features = append(doc.Features, geoFeature{
+			Type:     "Feature",
+			Geometry: geoGeometry{"LineString", [][]float64{{old.Lon, old.Lat}, {c.Lon, c.Lat}}},
+			Properties: map[string]any{
+				"status":     "moved",
+				"speedKmh":   math.Round(distanceKm(old.Lat, old.Lon, c.Lat, c.Lon) / dt),
+				"heading":    math.Round(bearing(old.Lat, old.Lon, c.Lat, c.Lon)),
+				"fromMaxDbz": old.MaxDBZ,
+				"maxDbz":     c.MaxDBZ,
+				"areaKm2":    math.Round(c.AreaKm2),
+			},
+		})
+	}
+	for j, c := range from {
+		if !used[j] {
+			point(c, "disappeared")
+		}
+	}
+	return doc
+}
+
+// HandleDiff compares two stored frames, ?from= and ?to=, as a PNG where
+// rain appeared (green), disappeared (red), intensified (yellow) or
+// weakened (blue) by ?delta= dBZ, 8 by default; with format=geojson it
+// returns how the storm cells moved instead.
+func (h *Handler) HandleDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err := parseTimeParam(q.Get("from"))
+	if err != nil {
+		http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"))
+	if err != nil {
+		http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delta := 8.0
+	if v := q.Get("delta"); v != "" {
+		if delta, err = strconv.ParseFloat(v, 64); err != nil || delta <= 0 {
+			http.Error(w, "delta must be a positive number of dBZ", http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "png" && format != "geojson" {
+		http.Error(w, "format must be png or geojson", http.StatusBadRequest)
+		return
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if h.Frame == nil {
+		http.Error(w, "no radar frame yet", http.StatusServiceUnavailable)
+		return
+	}
+	proj := h.Frame.Projection
+
+	var fields [2]*Field
+	for i, t := range []time.Time{from, to} {
+		if !h.store.Has(t) {
+			http.Error(w, fmt.Sprintf("frame %s is not stored", t.Format(frameTimeFormat)), http.StatusNotFound)
+			return
+		}
+		if fields[i], err = h.loadField(t, proj); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	a, b := fields[0], fields[1]
+	if a.Width != b.Width || a.Height != b.Height {
+		http.Error(w, "frames differ in size", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"diff-%d-%d-%s-%g"`, from.Unix(), to.Unix(), format, delta))
+	if format == "geojson" {
+		cfg := h.config.Cells
+		dt := to.Sub(from).Hours()
+		doc := cellChanges(detectCells(a, proj, cfg), detectCells(b, proj, cfg), math.Abs(dt), cfg)
+		body, err := json.Marshal(doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.serveFrame(w, r, "application/geo+json", append(body, '\n'))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := encodePNG(&buf, diffImage(a, b, delta)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.serveFrame(w, r, "image/png", buf.Bytes())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+type DownloadConfig struct {
+	// Keep is how many downloads are kept in memory to ask the servers
+	// whether they changed, with a HEAD and If-None-Match and
+	// If-Modified-Since, when they are fetched again. Servers without
+	// validators send them whole; an identical file still hands back the
+	// kept copy. 0 always downloads them whole.
+	Keep int `yaml:"keep"`
+}
+
+func (c DownloadConfig) validate() error {
+	if c.Keep < 0 {
+		return errors.New("download keep must not be negative")
+	}
+	return nil
+}
+
+// cachedFile is a kept download with what the server said identifies it.
+type cachedFile struct {
+	etag, lastModified string
+	body               []byte
+	sum                [sha256.Size]byte
+}
+
+// cachingFetcher downloads with conditional requests, answering from the
+// copies of the last downloads when the server has nothing newer. Frames
+// that failed validation and are retried, echo tops and frames of the
+// backfill run again are then not downloaded twice. A kept file with
+// validators is checked with a HEAD first, so an unchanged one costs only
+// its headers.
+type cachingFetcher struct {
+	m     sync.Mutex
+	keep  int
+	files map[string]*cachedFile
+	// order has the URLs of files, least recently used first
+	order []string
+}
+
+// request asks for url, only if it changed since file when there is one.
+func (file *cachedFile) request(method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil || file == nil {
+		return req, err
+	}
+	if file.etag != "" {
+		req.Header.Set("If-None-Match", file.etag)
+	}
+	if file.lastModified != "" {
+		req.Header.Set("If-Modified-Since", file.lastModified)
+	}
+	return req, nil
+}
+
+// unchanged asks the server with a HEAD whether url is still file: it
+// answers 304 or the validators of file. Servers without validators, and
+// those refusing HEAD, are asked with the GET.
+func (file *cachedFile) unchanged(url string) bool {
+	if file.etag == "" && file.lastModified == "" {
+		return false
+	}
+	req, err := file.request("HEAD", url)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return true
+	case resp.StatusCode != http.StatusOK:
+		return false
+	case file.etag != "":
+		return resp.Header.Get("ETag") == file.etag
+	default:
+		return resp.Header.Get("Last-Modified") == file.lastModified
+	}
+}
+
+func (f *cachingFetcher) Configure(cfg DownloadConfig) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.keep = cfg.Keep
+	f.evict()
+}
+
+// evict drops the least recently used files beyond keep.
+func (f *cachingFetcher) evict() {
+	for len(f.order) > f.keep {
+		delete(f.files, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+func (f *cachingFetcher) cached(url string) *cachedFile {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.files[url]
+}
+
+func (f *cachingFetcher) store(url string, file *cachedFile) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.keep == 0 {
+		return
+	}
+	if f.files == nil {
+		f.files = map[string]*cachedFile{}
+	}
+	f.files[url] = file
+	f.order = append(slices.DeleteFunc(f.order, func(u string) bool { return u == url }), url)
+	f.evict()
+}
+
+func (f *cachingFetcher) Fetch(url string) ([]byte, error) {
+	f.m.Lock()
+	keep := f.keep
+	f.m.Unlock()
+	if keep == 0 {
+		return download(url)
+	}
+
+	last := f.cached(url)
+	if last != nil && last.unchanged(url) {
+		log.Printf("Not modified, reusing the %d bytes downloaded before", len(last.body))
+		f.store(url, last)
+		return last.body, nil
+	}
+	req, err := last.request("GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Downloading file: %s", url)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("HTTP %s: Cannot download file", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && last != nil {
+		log.Printf("Not modified, reusing the %d bytes downloaded before", len(last.body))
+		f.store(url, last)
+		return last.body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("HTTP %d: Cannot download file", resp.StatusCode)
+		return nil, statusError(resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	file := &cachedFile{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+		sum:          sha256.Sum256(body),
+	}
+	if last != nil && last.sum == file.sum {
+		// servers without validators send the same file again, it was
+		// downloaded but the copy from before is kept and handed back
+		log.Printf("Succesfully downloaded, unchanged since the last download")
+		file.body = last.body
+	} else {
+		log.Printf("Succesfully downloaded")
+	}
+	f.store(url, file)
+	return file.body, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCachingFetcher(t *testing.T) {
+	body, etag := "frame 1", `"1"`
+	// methods has the method of every request, with the answered status
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				status = http.StatusNotModified
+			}
+		}
+		methods = append(methods, fmt.Sprint(r.Method, " ", status))
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprint(w, body)
+		}
+	}))
+	defer srv.Close()
+
+	f := &cachingFetcher{}
+	f.Configure(DownloadConfig{Keep: 2})
+	fetch := func(want string, requests ...string) []byte {
+		t.Helper()
+		methods = nil
+		got, err := f.Fetch(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("fetched %q, want %q", got, want)
+		}
+		if fmt.Sprint(methods) != fmt.Sprint(requests) {
+			t.Errorf("requests %v, want %v", methods, requests)
+		}
+		return got
+	}
+
+	fetch("frame 1", "GET 200")
+	fetch("frame 1", "HEAD 304")
+	body, etag = "frame 2", `"2"`
+	fetch("frame 2", "HEAD 200", "GET 200")
+
+	// without validators every fetch downloads, the same file hands back
+	// the kept copy
+	etag = ""
+	first := fetch("frame 2", "HEAD 200", "GET 200")
+	again := fetch("frame 2", "GET 200")
+	if &first[0] != &again[0] {
+		t.Error("the same download was not answered with the kept copy")
+	}
+}
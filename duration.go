@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// maxRainGap caps the time a rainy frame is credited with, so a radar
+// outage does not count as rain.
+const maxRainGap = 30 * time.Minute
+
+// rainTally accumulates how long a city has been raining.
+type rainTally struct {
+	// since is the first frame of the current rain, zero while dry
+	since time.Time
+	// last is the previous frame
+	last time.Time
+	// minutes is the rain since local midnight day
+	day     time.Time
+	minutes float64
+}
+
+func localMidnight(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// add counts frame, crediting a rainy frame with the time since the
+// previous one, and reports the totals in s.
+func (t *rainTally) add(s *RainState, frame time.Time, raining bool) {
+	day := localMidnight(frame)
+	if !day.Equal(t.day) {
+		t.day, t.minutes = day, 0
+	}
+
+	if raining {
+		if t.since.IsZero() {
+			t.since = frame
+		}
+		from := t.last
+		if from.Before(day) {
+			from = day
+		}
+		if !t.last.IsZero() && frame.After(from) {
+			t.minutes += min(frame.Sub(from), maxRainGap).Minutes()
+		}
+	} else {
+		t.since = time.Time{}
+	}
+	if frame.After(t.last) {
+		t.last = frame
+	}
+
+	s.RainingSinceMinutes = 0
+	if !t.since.IsZero() {
+		s.RainingSinceMinutes = int(frame.Sub(t.since).Minutes())
+	}
+	s.RainMinutesToday = int(math.Round(t.minutes))
+}
+
+// restore picks up the totals reported in s for frame, as cached in Redis.
+func (t *rainTally) restore(s RainState, frame time.Time) {
+	t.since = time.Time{}
+	if s.Raining() {
+		t.since = frame.Add(-time.Duration(s.RainingSinceMinutes) * time.Minute)
+	}
+	t.last = frame
+	t.day = localMidnight(frame)
+	t.minutes = float64(s.RainMinutesToday)
+}
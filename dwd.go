@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// DWD RADOLAN RW: hourly precipitation sum on the 900×900 km national
+// composite grid, a polar stereographic projection of a sphere with true
+// scale at 60°N and 10°E as the central meridian.
+
+const (
+	radolanEarthRadius = 6370.04 // km
+	radolanX0          = -523.4622
+	radolanY0          = -4658.645
+	radolanSize        = 900
+)
+
+type radolanProjection struct{}
+
+func (radolanProjection) Pixel(lat, lon float64) (int, int) {
+	phi := lat * math.Pi / 180
+	lambda := (lon - 10) * math.Pi / 180
+	m := (1 + math.Sin(60*math.Pi/180)) / (1 + math.Sin(phi))
+
+	x := radolanEarthRadius * m * math.Cos(phi) * math.Sin(lambda)
+	y := -radolanEarthRadius * m * math.Cos(phi) * math.Cos(lambda)
+
+	// grid rows start in the south, image rows in the north
+	return int(x - radolanX0), radolanSize - 1 - int(y-radolanY0)
+}
+
+func (radolanProjection) Location(px, py int) (float64, float64) {
+	x := float64(px) + 0.5 + radolanX0
+	y := float64(radolanSize-1-py) + 0.5 + radolanY0
+
+	k := radolanEarthRadius * (1 + math.Sin(60*math.Pi/180))
+	rho2 := x*x + y*y
+	phi := math.Asin((k*k - rho2) / (k*k + rho2))
+	lambda := math.Atan2(x, -y)
+
+	return phi * 180 / math.Pi, 10 + lambda*180/math.Pi
+}
+
+var (
+	radolanGrid      = regexp.MustCompile(`GP\s*(\d+)x\s*(\d+)`)
+	radolanPrecision = regexp.MustCompile(`PR\s*E-(\d+)`)
+)
+
+// decodeRadolan converts a RADOLAN binary composite into rain rates in
+// mm/h, ordered row by row from the south-west corner. Missing values are
+// NaN.
+func decodeRadolan(data []byte) ([]float64, error) {
+	end := bytes.IndexByte(data, 0x03)
+	if end < 0 {
+		return nil, fmt.Errorf("radolan: header terminator not found")
+	}
+	header := string(data[:end])
+
+	grid := radolanGrid.FindStringSubmatch(header)
+	if grid == nil {
+		return nil, fmt.Errorf("radolan: grid size missing in header")
+	}
+	rows, _ := strconv.Atoi(grid[1])
+	cols, _ := strconv.Atoi(grid[2])
+	if rows != radolanSize || cols != radolanSize {
+		return nil, fmt.Errorf("radolan: unsupported grid %dx%d", rows, cols)
+	}
+
+	scale := 1.0
+	if pr := radolanPrecision.FindStringSubmatch(header); pr != nil {
+		exp, _ := strconv.Atoi(pr[1])
+		scale = math.Pow(10, -float64(exp))
+	}
+
+	body := data[end+1:]
+	if len(body) < rows*cols*2 {
+		return nil, fmt.Errorf("radolan: truncated data, %d bytes", len(body))
+	}
+
+	values := make([]float64, rows*cols)
+	for i := range values {
+		raw := binary.LittleEndian.Uint16(body[i*2:])
+		switch {
+		case raw&0x2000 != 0: // no data
+			values[i] = math.NaN()
+		case raw&0x4000 != 0: // negative
+			values[i] = -float64(raw&0x0fff) * scale
+		default:
+			values[i] = float64(raw&0x0fff) * scale
+		}
+	}
+
+	return values, nil
+}
+
+type dwdSource struct {
+	fetcher Fetcher
+}
+
+func (dwdSource) Name() string {
+	return "dwd"
+}
+
+// FrameTime returns the last hh:50 slot, when RW composites are produced.
+func (dwdSource) FrameTime(now time.Time) time.Time {
+	t := now.UTC().Truncate(time.Hour).Add(50 * time.Minute)
+	if t.After(now) {
+		t = t.Add(-time.Hour)
+	}
+	return t
+}
+
+func (dwdSource) Cadence() time.Duration {
+	return time.Hour
+}
+
+func (dwdSource) PublishDelay() time.Duration {
+	return 15 * time.Minute
+}
+
+func (dwdSource) URL(t time.Time) string {
+	return fmt.Sprintf("https://opendata.dwd.de/weather/radar/radolan/rw/raa01-rw_10000-%s-dwd---bin.bz2", t.Format("0601021504"))
+}
+
+func (s dwdSource) Fetch(t time.Time) (*Frame, error) {
+	content, err := s.fetcher.Fetch(s.URL(t))
+	if err != nil {
+		return nil, err
+	}
+	return s.Decode(t, content)
+}
+
+func (dwdSource) Decode(t time.Time, content []byte) (*Frame, error) {
+	data, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := decodeRadolan(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bitmap := image.NewNRGBA(image.Rect(0, 0, radolanSize, radolanSize))
+	for i, v := range values {
+		if math.IsNaN(v) || v <= 0 {
+			continue
+		}
+		x, y := i%radolanSize, radolanSize-1-i/radolanSize
+		bitmap.SetNRGBA(x, y, dbzColor(rainRateDBZ(v)))
+	}
+
+	return &Frame{Time: t, Image: bitmap, Projection: radolanProjection{}}, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// radolanFile is a RADOLAN RW file with the header and the first values
+// given, the rest being zero.
+func radolanFile(header string, values ...uint16) []byte {
+	data := append([]byte(header), 0x03)
+	body := make([]byte, radolanSize*radolanSize*2)
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(body[i*2:], v)
+	}
+	return append(data, body...)
+}
+
+func TestDecodeRadolan(t *testing.T) {
+	const header = "RW021050100000623BY1620155VS 3SW   2.28.1PR E-01INT  60GP 900x 900MF 00000001MS 74<asb,boo,ros>"
+	tests := []struct {
+		name string
+		data []byte
+		// want are the first values, NaN for no data
+		want []float64
+		err  string
+	}{
+		{
+			name: "values",
+			data: radolanFile(header, 0x0010, 0x0000, 0x2000, 0x4005, 0x1fff),
+			want: []float64{1.6, 0, math.NaN(), -0.5, 409.5},
+		},
+		{
+			name: "no precision",
+			data: radolanFile(strings.Replace(header, "PR E-01", "", 1), 0x0010),
+			want: []float64{16},
+		},
+		{
+			name: "precision e-02",
+			data: radolanFile(strings.Replace(header, "PR E-01", "PR E-02", 1), 0x0010),
+			want: []float64{0.16},
+		},
+		{name: "no terminator", data: []byte(header), err: "header terminator"},
+		{name: "no grid", data: radolanFile(strings.Replace(header, "GP 900x 900", "", 1)), err: "grid size missing"},
+		{name: "other grid", data: radolanFile(strings.Replace(header, "GP 900x 900", "GP 1100x 900", 1)), err: "unsupported grid 1100x900"},
+		{name: "truncated", data: radolanFile(header)[:len(header)+1+100], err: "truncated data, 100 bytes"},
+	}
+	for _, tt := range tests {
+		values, err := decodeRadolan(tt.data)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(values) != radolanSize*radolanSize {
+			t.Errorf("%s: got %d values", tt.name, len(values))
+			continue
+		}
+		for i, want := range tt.want {
+			if got := values[i]; math.IsNaN(want) != math.IsNaN(got) || !math.IsNaN(want) && math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s: value %d is %g, want %g", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRadolanProjection(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lon float64
+		x, y     int
+	}{
+		// the corners of the national composite as DWD gives them, the
+		// pixel centers are within 0.02° of them
+		{"south-west corner", 46.9526, 3.5889, 0, 899},
+		{"north-west corner", 54.5877, 2.0715, 0, 0},
+		{"north-east corner", 54.7405, 15.7208, 899, 0},
+		{"south-east corner", 47.0705, 14.6209, 899, 899},
+	}
+	var p radolanProjection
+	for _, tt := range tests {
+		lat, lon := p.Location(tt.x, tt.y)
+		if math.Abs(lat-tt.lat) > 0.02 || math.Abs(lon-tt.lon) > 0.02 {
+			t.Errorf("%s: pixel %d, %d is at %.4f, %.4f, want %.4f, %.4f", tt.name, tt.x, tt.y, lat, lon, tt.lat, tt.lon)
+		}
+		if x, y := p.Pixel(lat, lon); x != tt.x || y != tt.y {
+			t.Errorf("%s: %.4f, %.4f is pixel %d, %d, want %d, %d", tt.name, lat, lon, x, y, tt.x, tt.y)
+		}
+	}
+}
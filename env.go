@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables overriding config keys.
+const envPrefix = "LEDRADAR"
+
+// envConfigPath names the config file when -config is not given.
+const envConfigPath = envPrefix + "_CONFIG"
+
+// envName turns the YAML key staleAfter into STALE_AFTER.
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnv overrides the keys of cfg set in the environment, named after
+// their path with LEDRADAR_ in front: redis.url is LEDRADAR_REDIS_URL,
+// outputs.mqtt.clientId LEDRADAR_OUTPUTS_MQTT_CLIENT_ID. Strings are taken
+// as they are, lists of strings may be comma separated, anything else is
+// parsed as YAML, e.g. LEDRADAR_OUTPUTS_DDP='[{host: wled.local}]'.
+func applyEnv(cfg *Config, environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix+"_") && k != envConfigPath {
+			env[k] = v
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	if err := applyEnvFields(reflect.ValueOf(cfg).Elem(), envPrefix, env); err != nil {
+		return err
+	}
+	for k := range env {
+		log.Printf("Environment variable %s matches no config key, ignoring it", k)
+	}
+	return nil
+}
+
+// applyEnvFields sets the fields of the struct v from env, deleting the
+// variables it used.
+func applyEnvFields(v reflect.Value, prefix string, env map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + envName(key)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnvFields(fv, name, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		delete(env, name)
+
+		switch {
+		case fv.Kind() == reflect.String:
+			fv.SetString(value)
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+			list := reflect.MakeSlice(fv.Type(), 0, 0)
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = reflect.Append(list, reflect.ValueOf(s).Convert(fv.Type().Elem()))
+				}
+			}
+			fv.Set(list)
+		default:
+			// decode into a fresh value, YAML merges into maps
+			out := reflect.New(fv.Type())
+			if err := yaml.Unmarshal([]byte(value), out.Interface()); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fv.Set(out.Elem())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"url":        "URL",
+		"staleAfter": "STALE_AFTER",
+		"clientId":   "CLIENT_ID",
+		"maxKm":      "MAX_KM",
+	}
+	for key, want := range tests {
+		if got := envName(key); got != want {
+			t.Errorf("envName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		check   func(*Config) any
+		want    any
+		err     string
+	}{
+		{
+			name:    "string",
+			environ: []string{"LEDRADAR_REDIS_URL=redis://cache:6379"},
+			check:   func(c *Config) any { return c.Redis.URL },
+			want:    "redis://cache:6379",
+		},
+		{
+			name:    "string kept as it is",
+			environ: []string{"LEDRADAR_REDIS_URL= a=b "},
+			check:   func(c *Config) any { return c.Redis.URL },
+			want:    " a=b ",
+		},
+		{
+			name:    "duration",
+			environ: []string{"LEDRADAR_STALE_AFTER=10m"},
+			check:   func(c *Config) any { return c.StaleAfter },
+			want:    10 * time.Minute,
+		},
+		{
+			name:    "comma separated list",
+			environ: []string{"LEDRADAR_CORS_METHODS=GET, POST,"},
+			check:   func(c *Config) any { return c.CORS.Methods },
+			want:    []string{"GET", "POST"},
+		},
+		{
+			name:    "list of a named string type",
+			environ: []string{"LEDRADAR_LISTEN=:8080,:8443"},
+			check:   func(c *Config) any { return c.Listen },
+			want:    ListenAddrs{":8080", ":8443"},
+		},
+		{
+			name:    "yaml list",
+			environ: []string{"LEDRADAR_CORS_METHODS=[GET, PUT]"},
+			check:   func(c *Config) any { return c.CORS.Methods },
+			want:    []string{"GET", "PUT"},
+		},
+		{
+			name:    "nested struct",
+			environ: []string{"LEDRADAR_BREAKER_FAILURES=9"},
+			check:   func(c *Config) any { return c.Breaker.Failures },
+			want:    9,
+		},
+		{
+			name:    "other variables are left alone",
+			environ: []string{"LEDRADAR_CONFIG=/etc/ledradar.yaml", "LEDRADAR_NO_SUCH_KEY=1", "REDIS_URL=redis://other", "LEDRADAR"},
+			check:   func(c *Config) any { return c.Redis.URL },
+			want:    "",
+		},
+		{
+			name:    "bad value",
+			environ: []string{"LEDRADAR_BREAKER_FAILURES=many"},
+			err:     "LEDRADAR_BREAKER_FAILURES",
+		},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		err := applyEnv(cfg, tt.environ)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tt.check(cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventLogConfig struct {
+	// Path of the JSON lines file the rain starts and stops are appended
+	// to, empty disables the log.
+	Path string `yaml:"path"`
+	// Keep is how long events are kept, 0 keeps them all. Older ones are
+	// dropped when the log is loaded.
+	Keep time.Duration `yaml:"keep"`
+}
+
+func (c EventLogConfig) validate() error {
+	if c.Keep < 0 {
+		return fmt.Errorf("event log keep must not be negative")
+	}
+	return nil
+}
+
+// RainEvent is a city starting or stopping to rain. Stops carry the peak
+// and the length of the rain episode they end.
+type RainEvent struct {
+	Time    time.Time `json:"time"`
+	CityID  int       `json:"cityId"`
+	City    string    `json:"city"`
+	Raining bool      `json:"raining"`
+	// PeakDBZ is the strongest reflectivity over the city so far, at the
+	// start the one that started it.
+	PeakDBZ         float64   `json:"peakDbz"`
+	PeakIntensity   Intensity `json:"peakIntensity"`
+	DurationMinutes int       `json:"durationMinutes,omitempty"`
+}
+
+// rainEpisode is a rain under way.
+type rainEpisode struct {
+	start time.Time
+	peak  float64
+}
+
+// EventLog records the rain transitions of the main city list to a file
+// and answers queries over them.
+type EventLog struct {
+	m      sync.Mutex
+	cfg    EventLogConfig
+	events []RainEvent
+	open   map[int]*rainEpisode
+}
+
+// Configure loads the log at the configured path when it changes,
+// reopening the episodes of cities still raining at the last event.
+func (l *EventLog) Configure(cfg EventLogConfig, now time.Time) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if cfg == l.cfg && l.open != nil {
+		return nil
+	}
+	l.cfg, l.events, l.open = cfg, nil, map[int]*rainEpisode{}
+	if cfg.Path == "" {
+		return nil
+	}
+
+	events, err := readEventLog(cfg.Path)
+	if err != nil {
+		return err
+	}
+	if cfg.Keep > 0 {
+		cutoff := now.Add(-cfg.Keep)
+		kept := events[:0]
+		for _, e := range events {
+			if !e.Time.Before(cutoff) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) < len(events) {
+			if err := writeEventLog(cfg.Path, kept); err != nil {
+				return err
+			}
+		}
+		events = kept
+	}
+
+	for _, e := range events {
+		if e.Raining {
+			l.open[e.CityID] = &rainEpisode{start: e.Time, peak: e.PeakDBZ}
+		} else {
+			delete(l.open, e.CityID)
+		}
+	}
+	l.events = events
+	log.Printf("Loaded %d rain events from %s", len(events), cfg.Path)
+	return nil
+}
+
+func readEventLog(path string) ([]RainEvent, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []RainEvent
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e RainEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a crash may have left half a line
+			log.Printf("%s:%d: %s, skipping it", path, line, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// writeEventLog replaces the log, readers never see a half written file.
+func writeEventLog(path string, events []RainEvent) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	err = errors.Join(err, w.Flush(), f.Close())
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (l *EventLog) Name() string {
+	return "event log"
+}
+
+// Send tracks the peak of the running episodes and appends the
+// transitions of u. Simulated rain is left out.
+func (l *EventLog) Send(u *Update) error {
+	if u.Simulated {
+		return nil
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.cfg.Path == "" {
+		return nil
+	}
+
+	for _, city := range u.Cities {
+		if ep, ok := l.open[city.ID]; ok && city.DBZ > ep.peak {
+			ep.peak = city.DBZ
+		}
+	}
+
+	var events []RainEvent
+	for _, t := range u.Transitions {
+		e := RainEvent{Time: t.Frame, CityID: t.City.ID, City: t.City.Name, Raining: t.Raining}
+		if t.Raining {
+			l.open[e.CityID] = &rainEpisode{start: e.Time, peak: t.City.DBZ}
+			e.PeakDBZ = t.City.DBZ
+		} else if ep, ok := l.open[e.CityID]; ok {
+			e.PeakDBZ = ep.peak
+			e.DurationMinutes = int(e.Time.Sub(ep.start).Minutes())
+			delete(l.open, e.CityID)
+		}
+		e.PeakIntensity = intensityOf(e.PeakDBZ)
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err = errors.Join(err, w.Flush(), f.Close()); err != nil {
+		return err
+	}
+	l.events = append(l.events, events...)
+	return nil
+}
+
+// eventQuery selects events by city name or ID and time, from inclusive
+// and to exclusive.
+type eventQuery struct {
+	city     string
+	from, to time.Time
+}
+
+func parseEventQuery(r *http.Request) (eventQuery, error) {
+	q := eventQuery{city: r.URL.Query().Get("city")}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &q.from}, {"to", &q.to}} {
+		if s := r.URL.Query().Get(p.name); s != "" {
+			t, err := parseTimeParam(s)
+			if err != nil {
+				return q, err
+			}
+			*p.t = t
+		}
+	}
+	return q, nil
+}
+
+func (q eventQuery) matches(e RainEvent) bool {
+	if q.city != "" && !strings.EqualFold(q.city, e.City) && q.city != strconv.Itoa(e.CityID) {
+		return false
+	}
+	return !e.Time.Before(q.from) && (q.to.IsZero() || e.Time.Before(q.to))
+}
+
+// query returns the matching events, oldest first.
+func (l *EventLog) query(q eventQuery) []RainEvent {
+	l.m.Lock()
+	defer l.m.Unlock()
+	events := []RainEvent{}
+	for _, e := range l.events {
+		if q.matches(e) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// DailySummary rolls up the rain episodes of a city that started on a
+// local day.
+type DailySummary struct {
+	Date          string    `json:"date"`
+	CityID        int       `json:"cityId"`
+	City          string    `json:"city"`
+	Episodes      int       `json:"episodes"`
+	RainMinutes   int       `json:"rainMinutes"`
+	PeakDBZ       float64   `json:"peakDbz"`
+	PeakIntensity Intensity `json:"peakIntensity"`
+}
+
+// dailySummaries counts the episodes by the local day they started on,
+// with their length and peak taken from the stops ending them. Stops of
+// episodes that started before the events are left out.
+func dailySummaries(events []RainEvent) []DailySummary {
+	type key struct {
+		date string
+		city int
+	}
+	days := map[key]*DailySummary{}
+	started := map[int]*DailySummary{}
+	for _, e := range events {
+		s := started[e.CityID]
+		if e.Raining {
+			k := key{localMidnight(e.Time).Format(time.DateOnly), e.CityID}
+			if days[k] == nil {
+				days[k] = &DailySummary{Date: k.date, CityID: e.CityID, City: e.City}
+			}
+			s = days[k]
+			s.Episodes++
+			started[e.CityID] = s
+		} else if s != nil {
+			s.RainMinutes += e.DurationMinutes
+			delete(started, e.CityID)
+		} else {
+			continue
+		}
+		s.PeakDBZ = max(s.PeakDBZ, e.PeakDBZ)
+	}
+
+	summaries := make([]DailySummary, 0, len(days))
+	for _, s := range days {
+		s.PeakIntensity = intensityOf(s.PeakDBZ)
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Date != summaries[j].Date {
+			return summaries[i].Date < summaries[j].Date
+		}
+		return summaries[i].CityID < summaries[j].CityID
+	})
+	return summaries
+}
+
+type eventsResponse struct {
+	Events []RainEvent `json:"events"`
+}
+
+// HandleEventLog serves the recorded rain starts and stops, filtered by
+// ?city= (name or ID), ?from= and ?to=.
+func (h *Handler) HandleEventLog(w http.ResponseWriter, r *http.Request) {
+	if !h.eventLogEnabled(w) {
+		return
+	}
+	q, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eventsResponse{Events: h.eventLog.query(q)})
+}
+
+type dailyResponse struct {
+	Days []DailySummary `json:"days"`
+}
+
+// HandleDailyEvents serves the rain episodes per city and local day, with
+// the filters of /events/log.
+func (h *Handler) HandleDailyEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.eventLogEnabled(w) {
+		return
+	}
+	q, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dailyResponse{Days: dailySummaries(h.eventLog.query(q))})
+}
+
+func (h *Handler) eventLogEnabled(w http.ResponseWriter) bool {
+	if h.Config().EventLog.Path == "" {
+		http.Error(w, "the event log is disabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// FrameEvent is published after every processed radar frame.
+type FrameEvent struct {
+	Frame     time.Time `json:"frame"`
+	FrameID   uint64    `json:"frameId"`
+	Cities    []City    `json:"cities"`
+	Simulated bool      `json:"simulated,omitempty"`
+}
+
+// TransitionEvent is published when a city starts or stops raining.
+type TransitionEvent struct {
+	Frame   time.Time `json:"frame"`
+	City    City      `json:"city"`
+	Raining bool      `json:"raining"`
+	// Simulated is set for transitions caused by POST /admin/simulate.
+	Simulated bool `json:"simulated,omitempty"`
+}
+
+type NATSConfig struct {
+	URL     string `yaml:"url"`
+	Subject string `yaml:"subject"`
+	// Stream enables JetStream: the stream is created if needed and
+	// publishes wait for the server acknowledgement.
+	Stream string `yaml:"stream"`
+}
+
+// Publisher sends frame and transition events to NATS.
+type Publisher struct {
+	m   sync.Mutex
+	cfg NATSConfig
+	nc  *nats.Conn
+	js  nats.JetStreamContext
+}
+
+// Configure (re)connects the publisher when the NATS settings change.
+// An empty URL disables publishing.
+func (p *Publisher) Configure(cfg NATSConfig) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if cfg == p.cfg && (p.nc != nil || cfg.URL == "") {
+		return nil
+	}
+
+	if p.nc != nil {
+		p.nc.Close()
+		p.nc, p.js = nil, nil
+	}
+	p.cfg = cfg
+
+	if cfg.URL == "" {
+		return nil
+	}
+
+	nc, err := nats.Connect(cfg.URL, nats.Name("ledradar"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return err
+	}
+
+	if cfg.Stream != "" {
+		js, err := nc.JetStream()
+		if err != nil {
+			nc.Close()
+			return err
+		}
+		if _, err := js.StreamInfo(cfg.Stream); err == nats.ErrStreamNotFound {
+			_, err = js.AddStream(&nats.StreamConfig{
+				Name:     cfg.Stream,
+				Subjects: []string{cfg.Subject + ".>"},
+			})
+			if err != nil {
+				nc.Close()
+				return err
+			}
+		}
+		p.js = js
+	}
+
+	log.Printf("Publishing events to NATS %s", cfg.URL)
+	p.nc = nc
+	return nil
+}
+
+func (p *Publisher) publish(subject string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if p.js != nil {
+		_, err = p.js.Publish(subject, data)
+	} else {
+		err = p.nc.Publish(subject, data)
+	}
+	if err != nil {
+		return fmt.Errorf("publish to %s: %w", subject, err)
+	}
+	return nil
+}
+
+func (p *Publisher) Name() string {
+	return "nats"
+}
+
+func (p *Publisher) Send(u *Update) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.nc == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, t := range u.Transitions {
+		errs = append(errs, p.publish(fmt.Sprintf("%s.rain.%d", p.cfg.Subject, t.City.ID), t))
+	}
+	errs = append(errs, p.publish(p.cfg.Subject+".frame", FrameEvent{Frame: u.Frame, FrameID: u.FrameID, Cities: u.Raining(), Simulated: u.Simulated}))
+	return errors.Join(errs...)
+}
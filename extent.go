@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// The corners of the composites are constants which CHMI has moved before.
+// Calibrating them lays the reference outline of the Czech Republic over
+// the border printed into a downloaded image and searches the shift and
+// scale under which the two line up best.
+
+// ExtentCalibration is how well the configured bounds of a product fit its
+// image and the bounds that fit best. A score is the share of the outline
+// falling on the printed border, what falls next to it counting less.
+type ExtentCalibration struct {
+	Source     string    `json:"source"`
+	Frame      time.Time `json:"frame"`
+	Configured BBox      `json:"configured"`
+	Score      float64   `json:"score"`
+	Best       BBox      `json:"best"`
+	BestScore  float64   `json:"bestScore"`
+	// OffsetX, OffsetY and the scales move the outline onto the border,
+	// in pixels right and down around the middle of the image.
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+	ScaleX  float64 `json:"scaleX"`
+	ScaleY  float64 `json:"scaleY"`
+	// OK is set when no edge of the best bounds is a pixel off.
+	OK bool `json:"ok"`
+	// Config is where corrected bounds go, such as chmi.products.z_max3d.
+	Config string `json:"config"`
+}
+
+// minBorderScore is the best score below which the image is taken to show
+// no border to calibrate against.
+const minBorderScore = 0.2
+
+var errNoBorder = errors.New("no border found")
+
+// extentProduct is the product source downloads, with the config key of
+// its fields.
+func extentProduct(cfg *Config, source Source) (Product, string, error) {
+	var p Product
+	var key string
+	switch s := source.(type) {
+	case chmiSource:
+		p, key = s.product, "chmi.products."+cfg.CHMI.Product
+	case nationalSource:
+		p, key = s.product, "national."+s.name
+	default:
+		return Product{}, "", fmt.Errorf("source %s cannot be calibrated, only single image products can", source.Name())
+	}
+	if p.Grid.Type != "" && p.Grid.Type != "mercator" {
+		return Product{}, "", fmt.Errorf("the %s grid of %s is not placed by bounds", p.Grid.Type, source.Name())
+	}
+	if p.Bounds.IsZero() {
+		p.Bounds = BBox{North: lat0, West: lon0, South: lat1, East: lon1}
+	}
+	return p, key, nil
+}
+
+// borderWeights rates the pixels of img by how close they are to an opaque
+// pixel outside the legend, which the printed borders, as well as the
+// labels, are drawn in: borderReach on one, down to 1 that many pixels
+// away, so the coarse outline still finds the lines and the search the
+// best fit.
+func borderWeights(img *image.NRGBA, tolerance float64) (int, int, []uint8) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	limit := tolerance * tolerance
+	lines := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			lines[y*w+x] = p.A > 0 && (p.R|p.G|p.B == 0 || paletteDistance([3]uint8{p.R, p.G, p.B}) > limit)
+		}
+	}
+	weights := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !lines[y*w+x] {
+				continue
+			}
+			for yy := max(y-borderReach+1, 0); yy <= min(y+borderReach-1, h-1); yy++ {
+				for xx := max(x-borderReach+1, 0); xx <= min(x+borderReach-1, w-1); xx++ {
+					d := max(abs(xx-x), abs(yy-y))
+					weights[yy*w+xx] = max(weights[yy*w+xx], uint8(borderReach-d))
+				}
+			}
+		}
+	}
+	return w, h, weights
+}
+
+const borderReach = 3
+
+// extentPlane maps lon/lat to the plane the pixels of a grid are linear
+// in, and back: degrees for plain images, the Mercator ordinate for
+// mercator ones.
+func extentPlane(grid Grid) (func(lat float64) float64, func(y float64) float64) {
+	if grid.Type == "mercator" {
+		return mercatorY, func(y float64) float64 { return degrees(math.Atan(math.Sinh(y))) }
+	}
+	identity := func(v float64) float64 { return v }
+	return identity, identity
+}
+
+// outline samples czechBorder every step degrees.
+func outline(step float64) [][2]float64 {
+	var points [][2]float64
+	for i, a := range czechBorder {
+		b := czechBorder[(i+1)%len(czechBorder)]
+		n := int(math.Ceil(math.Hypot(b[0]-a[0], b[1]-a[1]) / step))
+		for j := range n {
+			t := float64(j) / float64(n)
+			points = append(points, [2]float64{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])})
+		}
+	}
+	return points
+}
+
+type extentFit struct {
+	dx, dy, sx, sy float64
+	score          float64
+}
+
+// calibrateExtent fits the bounds of p to the border printed into frame.
+func calibrateExtent(frame *Frame, p Product, tolerance float64) ExtentCalibration {
+	w, h, weights := borderWeights(frame.Image, tolerance)
+	forward, inverse := extentPlane(p.Grid)
+	b := p.Bounds
+	top, bottom := forward(b.North), forward(b.South)
+
+	// the outline in pixels of the configured bounds
+	var base [][2]float64
+	for _, pt := range outline(0.005) {
+		x := (pt[0] - b.West) / (b.East - b.West) * float64(w)
+		y := (top - forward(pt[1])) / (top - bottom) * float64(h)
+		base = append(base, [2]float64{x, y})
+	}
+	cx, cy := float64(w)/2, float64(h)/2
+	score := func(f extentFit) float64 {
+		hits := 0
+		for _, pt := range base {
+			x := int(math.Floor(cx + f.sx*(pt[0]-cx) + f.dx))
+			y := int(math.Floor(cy + f.sy*(pt[1]-cy) + f.dy))
+			if x >= 0 && y >= 0 && x < w && y < h {
+				hits += int(weights[y*w+x])
+			}
+		}
+		return float64(hits) / float64(borderReach*len(base))
+	}
+	// search around best within ±shift pixels and ±scale in steps
+	search := func(best extentFit, shift int, scale, scaleStep float64) extentFit {
+		center := best
+		for sx := -scale; sx <= scale+1e-9; sx += scaleStep {
+			for sy := -scale; sy <= scale+1e-9; sy += scaleStep {
+				for dx := -shift; dx <= shift; dx++ {
+					for dy := -shift; dy <= shift; dy++ {
+						f := extentFit{dx: center.dx + float64(dx), dy: center.dy + float64(dy), sx: center.sx + sx, sy: center.sy + sy}
+						if f.score = score(f); f.score > best.score {
+							best = f
+						}
+					}
+				}
+			}
+		}
+		return best
+	}
+
+	configured := extentFit{sx: 1, sy: 1}
+	configured.score = score(configured)
+	best := search(configured, 20, 0, 1)
+	best = search(best, 5, 0.04, 0.005)
+	best = search(best, 2, 0.005, 0.001)
+
+	// the image edges under the best fit, back in the plane of the bounds
+	edge := func(u, c, s, d float64, size int, lo, hi float64) float64 {
+		return lo + (c+(u-c-d)/s)/float64(size)*(hi-lo)
+	}
+	fitted := BBox{
+		West:  edge(0, cx, best.sx, best.dx, w, b.West, b.East),
+		East:  edge(float64(w), cx, best.sx, best.dx, w, b.West, b.East),
+		North: inverse(edge(0, cy, best.sy, best.dy, h, top, bottom)),
+		South: inverse(edge(float64(h), cy, best.sy, best.dy, h, top, bottom)),
+	}
+	round := func(v float64) float64 { return math.Round(v*1e7) / 1e7 }
+	fitted = BBox{North: round(fitted.North), West: round(fitted.West), South: round(fitted.South), East: round(fitted.East)}
+
+	// how far the edges of the image move, in pixels
+	off := 0.0
+	for _, u := range []float64{0, float64(w)} {
+		off = math.Max(off, math.Abs(cx+best.sx*(u-cx)+best.dx-u))
+	}
+	for _, v := range []float64{0, float64(h)} {
+		off = math.Max(off, math.Abs(cy+best.sy*(v-cy)+best.dy-v))
+	}
+	return ExtentCalibration{
+		Frame:      frame.Time,
+		Configured: b,
+		Score:      configured.score,
+		Best:       fitted,
+		BestScore:  best.score,
+		OffsetX:    best.dx,
+		OffsetY:    best.dy,
+		ScaleX:     math.Round(best.sx*1e4) / 1e4,
+		ScaleY:     math.Round(best.sy*1e4) / 1e4,
+		OK:         off < 1 || best.score <= configured.score,
+	}
+}
+
+// calibrate downloads the newest frame of the configured source, or
+// decodes the file name, and fits the bounds to it.
+func calibrate(cfg *Config, fetcher Fetcher, name string) (ExtentCalibration, error) {
+	source, err := newSource(cfg, fetcher)
+	if err != nil {
+		return ExtentCalibration{}, err
+	}
+	product, key, err := extentProduct(cfg, source)
+	if err != nil {
+		return ExtentCalibration{}, err
+	}
+	var frame *Frame
+	if name == "" {
+		t, content, err := fetchLatest(source, fetcher, time.Now())
+		if err != nil {
+			return ExtentCalibration{}, err
+		}
+		frame, err = source.Decode(t, content)
+	} else {
+		frame, err = loadFrame(source, name, "")
+	}
+	if err != nil {
+		return ExtentCalibration{}, err
+	}
+	c := calibrateExtent(frame, product, cfg.Mask.Tolerance)
+	c.Source, c.Config = source.Name(), key
+	if c.BestScore < minBorderScore {
+		return c, fmt.Errorf("%w in the image of %s, the best fit covers %.0f%% of it", errNoBorder, c.Source, 100*c.BestScore)
+	}
+	return c, nil
+}
+
+func calibrateCommand(args []string) error {
+	fs, configPath := commandFlags("calibrate", "[frame]")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	c, err := calibrate(cfg, httpFetcher{}, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	}
+
+	fmt.Printf("%s, frame %s\n", c.Source, c.Frame.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("configured %s: %.0f%% of the border matches\n", bboxText(c.Configured), 100*c.Score)
+	if c.OK {
+		fmt.Println("the bounds fit the image")
+		return nil
+	}
+	fmt.Printf("best fit   %s: %.0f%% of the border matches\n", bboxText(c.Best), 100*c.BestScore)
+	fmt.Printf("shifted %+.0f px right, %+.0f px down, scaled %.4f × %.4f\n", c.OffsetX, c.OffsetY, c.ScaleX, c.ScaleY)
+	fmt.Printf("\nto correct them, set in the config\n\n")
+	keys := strings.Split(c.Config, ".")
+	for i, key := range keys {
+		fmt.Printf("%s%s:\n", strings.Repeat("  ", i), key)
+	}
+	fmt.Printf("%sbounds: %s\n", strings.Repeat("  ", len(keys)), bboxText(c.Best))
+	return errors.New("the configured bounds do not fit the image")
+}
+
+func bboxText(b BBox) string {
+	return fmt.Sprintf("{north: %g, west: %g, south: %g, east: %g}", b.North, b.West, b.South, b.East)
+}
+
+// HandleCalibrate fits the bounds of the configured source to its newest
+// frame, see calibrateCommand.
+func (h *Handler) HandleCalibrate(w http.ResponseWriter, r *http.Request) {
+	c, err := calibrate(h.Config(), h.fetcher, "")
+	if errors.Is(err, errNoBorder) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
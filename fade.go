@@ -0,0 +1,49 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"time"
+)
+
+// ledFade eases the LEDs from the colors they showed to new ones over
+// duration, so the map fades into every frame instead of snapping.
+type ledFade struct {
+	from, to []color.NRGBA
+	start    time.Time
+	duration time.Duration
+	// settled is set once the new colors were shown in full
+	settled bool
+}
+
+// retarget starts fading to leds from the colors showing at now, so a
+// fade cut short by the next frame goes on from where it was.
+func (f *ledFade) retarget(leds []color.NRGBA, now time.Time, duration time.Duration) {
+	f.from = f.at(now)
+	f.to, f.start, f.duration, f.settled = leds, now, duration, false
+}
+
+// at returns the colors showing at now, easing in and out.
+func (f *ledFade) at(now time.Time) []color.NRGBA {
+	p := 1.0
+	if f.duration > 0 {
+		p = math.Min(float64(now.Sub(f.start))/float64(f.duration), 1)
+	}
+	if p >= 1 {
+		f.settled = true
+		return f.to
+	}
+	e := 0.5 - 0.5*math.Cos(math.Pi*math.Max(p, 0))
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + e*(float64(b)-float64(a))))
+	}
+	out := make([]color.NRGBA, len(f.to))
+	for i, c := range f.to {
+		var from color.NRGBA
+		if i < len(f.from) {
+			from = f.from[i]
+		}
+		out[i] = color.NRGBA{mix(from.R, c.R), mix(from.G, c.G), mix(from.B, c.B), c.A}
+	}
+	return out
+}
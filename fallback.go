@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type FallbackConfig struct {
+	// After is how long the radar may be unavailable before cities are
+	// filled from Open-Meteo, 0 disables the fallback.
+	After    time.Duration `yaml:"after"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+const openMeteoSource = "open-meteo"
+
+type openMeteoCurrent struct {
+	Current struct {
+		Precipitation float64 `json:"precipitation"`
+	} `json:"current"`
+}
+
+// fetchOpenMeteo returns the current precipitation rate in mm/h for each
+// coordinate. Open-Meteo reports the sum over the preceding 15 minutes.
+func fetchOpenMeteo(fetcher Fetcher, coords [][2]float64) ([]float64, error) {
+	var rates []float64
+	for start := 0; start < len(coords); start += 100 {
+		chunk := coords[start:min(start+100, len(coords))]
+		lats := make([]string, len(chunk))
+		lons := make([]string, len(chunk))
+		for i, c := range chunk {
+			lats[i] = fmt.Sprintf("%.4f", c[0])
+			lons[i] = fmt.Sprintf("%.4f", c[1])
+		}
+
+		url := fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%s&longitude=%s&current=precipitation",
+			strings.Join(lats, ","), strings.Join(lons, ","))
+		body, err := fetcher.Fetch(url)
+		if err != nil {
+			return nil, err
+		}
+
+		// a single location comes back as an object, several as an array
+		var results []openMeteoCurrent
+		if len(chunk) == 1 {
+			var one openMeteoCurrent
+			err = json.Unmarshal(body, &one)
+			results = []openMeteoCurrent{one}
+		} else {
+			err = json.Unmarshal(body, &results)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(results) != len(chunk) {
+			return nil, fmt.Errorf("open-meteo returned %d locations, expected %d", len(results), len(chunk))
+		}
+
+		for _, r := range results {
+			rates = append(rates, r.Current.Precipitation*4)
+		}
+	}
+	return rates, nil
+}
+
+// rateState builds a rain state from a rain rate, colored like the radar.
+func rateState(mmh float64) RainState {
+	if mmh <= 0 {
+		return RainState{}
+	}
+	dbz := rainRateDBZ(mmh)
+	c := dbzColor(dbz)
+	if c.A == 0 {
+		return RainState{}
+	}
+	return RainState{R: c.R, G: c.G, B: c.B, DBZ: float64(4 * int(dbz/4)), Intensity: intensityOf(dbz)}
+}
+
+// fallback fills the cities from Open-Meteo once the radar has been
+// unavailable for longer than configured.
+func (h *Handler) fallback() {
+	now := h.clock.Now()
+
+	h.m.RLock()
+	cfg := h.config
+	radarOK, fallbackAt := h.radarOK, h.fallbackAt
+	var coords [][2]float64
+	index := map[[2]float64]int{}
+	add := func(cities []*City) {
+		for _, city := range cities {
+			key := [2]float64{city.Lat, city.Lon}
+			if _, ok := index[key]; !ok {
+				index[key] = len(coords)
+				coords = append(coords, key)
+			}
+		}
+	}
+	add(h.Cities)
+	for _, set := range h.Sets {
+		add(set.Cities)
+	}
+	h.m.RUnlock()
+
+	if cfg.Fallback.After <= 0 || now.Sub(radarOK) < cfg.Fallback.After || now.Sub(fallbackAt) < cfg.Fallback.Interval {
+		return
+	}
+
+	log.Printf("Radar unavailable since %s, falling back to Open-Meteo", radarOK.Format(time.RFC3339))
+	rates, err := fetchOpenMeteo(h.fetcher, coords)
+	if err != nil {
+		log.Printf("Open-Meteo fallback failed: %s", err)
+		return
+	}
+
+	alpha := h.Config().Smoothing.Alpha
+	eval := func(city *City) bool {
+		smoothed := city.Smoothed
+		city.RainState = rateState(rates[index[[2]float64{city.Lat, city.Lon}]])
+		// the model covers every city
+		city.Coverage = true
+		city.Smoothed = smoothed.next(&city.RainState, alpha)
+		return city.Raining()
+	}
+	filters := h.filterCities(now, eval)
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.fallbackAt = now
+	snap := *h.Snapshot
+	snap.FrameTime, snap.Cells, snap.DataSource = now, nil, openMeteoSource
+
+	transitions := h.updateCities(now, filters, eval)
+	h.publish(snap)
+	h.dispatch(context.Background(), now, nil, transitions)
+}
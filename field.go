@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// Field is the reflectivity of every pixel of a frame in dBZ, row by row.
+// Pixels without echo are NaN.
+type Field struct {
+	Width, Height int
+	DBZ           []float32
+}
+
+// nanDBZ marks pixels without echo.
+var nanDBZ = float32(math.NaN())
+
+func (f *Field) At(x, y int) float32 {
+	if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+		return nanDBZ
+	}
+	return f.DBZ[y*f.Width+x]
+}
+
+// newField decodes the legend colors of img back into reflectivity.
+func newField(img *image.NRGBA) *Field {
+	f := &Field{}
+	fillField(f, img, map[[3]uint8]float32{})
+	return f
+}
+
+// fillField decodes img into f, reusing its slice, with cache holding
+// the reflectivity of colors seen before.
+func fillField(f *Field, img *image.NRGBA, cache map[[3]uint8]float32) {
+	b := img.Bounds()
+	f.Width, f.Height = b.Dx(), b.Dy()
+	if n := f.Width * f.Height; cap(f.DBZ) >= n {
+		f.DBZ = f.DBZ[:n]
+	} else {
+		f.DBZ = make([]float32, n)
+	}
+
+	// most pixels repeat their neighbor, skip the map for them
+	var last [3]uint8
+	lastDBZ := nanDBZ
+	for y := 0; y < f.Height; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		out := f.DBZ[y*f.Width : (y+1)*f.Width]
+		for x := range out {
+			p := row[4*x : 4*x+4]
+			if p[3] == 0 {
+				out[x] = nanDBZ
+				continue
+			}
+			key := [3]uint8{p[0], p[1], p[2]}
+			if key != last {
+				dbz, ok := cache[key]
+				if !ok {
+					dbz = float32(colorDBZ(p[0], p[1], p[2]))
+					if math.IsInf(float64(dbz), -1) {
+						dbz = nanDBZ
+					}
+					cache[key] = dbz
+				}
+				last, lastDBZ = key, dbz
+			}
+			out[x] = lastDBZ
+		}
+	}
+}
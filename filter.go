@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// filterCities applies the ?sort=, ?min=, ?region= and ?limit= query
+// parameters, returning a new slice.
+func filterCities(r *http.Request, cities []*City) ([]*City, error) {
+	q := r.URL.Query()
+
+	min := IntensityNone
+	if v := q.Get("min"); v != "" {
+		var err error
+		if min, err = parseIntensity(v); err != nil {
+			return nil, err
+		}
+	}
+
+	regions := map[string]bool{}
+	if v := q.Get("region"); v != "" {
+		for _, region := range strings.Split(v, ",") {
+			regions[strings.ToUpper(strings.TrimSpace(region))] = true
+		}
+	}
+
+	out := []*City{}
+	for _, city := range cities {
+		if city.Intensity < min {
+			continue
+		}
+		if len(regions) > 0 && !regions[strings.ToUpper(city.Region)] {
+			continue
+		}
+		out = append(out, city)
+	}
+
+	switch q.Get("sort") {
+	case "":
+	case "intensity":
+		sort.SliceStable(out, func(i, j int) bool { return out[i].DBZ > out[j].DBZ })
+	case "name":
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	case "id":
+		sort.SliceStable(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	default:
+		return nil, fmt.Errorf("unknown sort %q", q.Get("sort"))
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", v)
+		}
+		if limit < len(out) {
+			out = out[:limit]
+		}
+	}
+
+	return out, nil
+}
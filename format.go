@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseFormat picks the representation from ?format= or the Accept
+// header, defaulting to JSON.
+func responseFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv"
+	case strings.Contains(accept, "application/xml"), strings.Contains(accept, "text/xml"):
+		return "xml"
+	}
+	if f := binaryFormat(accept); f != "" {
+		return f
+	}
+	return "json"
+}
+
+// binaryFormat is msgpack or cbor when the Accept header asks for them.
+func binaryFormat(accept string) string {
+	switch {
+	case strings.Contains(accept, "application/msgpack"), strings.Contains(accept, "application/x-msgpack"):
+		return "msgpack"
+	case strings.Contains(accept, "application/cbor"):
+		return "cbor"
+	}
+	return ""
+}
+
+var csvHeader = []string{"id", "name", "lat", "lon", "region", "raining", "r", "g", "b", "dbz", "intensity"}
+
+func citiesCSV(cities []*City) []byte {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(csvHeader)
+	for _, city := range cities {
+		writer.Write([]string{
+			strconv.Itoa(city.ID),
+			city.Name,
+			strconv.FormatFloat(city.Lat, 'f', -1, 64),
+			strconv.FormatFloat(city.Lon, 'f', -1, 64),
+			city.Region,
+			strconv.FormatBool(city.Raining()),
+			strconv.Itoa(int(city.R)),
+			strconv.Itoa(int(city.G)),
+			strconv.Itoa(int(city.B)),
+			strconv.FormatFloat(city.DBZ, 'f', -1, 64),
+			city.Intensity.String(),
+		})
+	}
+	writer.Flush()
+	return buf.Bytes()
+}
+
+type xmlCities struct {
+	XMLName    xml.Name  `xml:"cities"`
+	Frame      time.Time `xml:"frame,attr"`
+	FrameID    uint64    `xml:"frameId,attr"`
+	AgeSeconds int       `xml:"ageSeconds,attr"`
+	Stale      bool      `xml:"stale,attr"`
+	Source     string    `xml:"source,attr"`
+	Cities     []xmlCity `xml:"city"`
+}
+
+type xmlCity struct {
+	ID        int       `xml:"id,attr"`
+	Name      string    `xml:"name,attr"`
+	Lat       float64   `xml:"lat,attr"`
+	Lon       float64   `xml:"lon,attr"`
+	Region    string    `xml:"region,attr,omitempty"`
+	Raining   bool      `xml:"raining,attr"`
+	R         uint8     `xml:"r,attr"`
+	G         uint8     `xml:"g,attr"`
+	B         uint8     `xml:"b,attr"`
+	DBZ       float64   `xml:"dbz,attr"`
+	Intensity Intensity `xml:"intensity,attr"`
+}
+
+// serveCities writes cities in the negotiated format. JSON, MessagePack
+// and CBOR keep the shape of the endpoint: a bare array or the
+// citiesResponse envelope.
+// Must be called with h.m held.
+func (h *Handler) serveCities(w http.ResponseWriter, r *http.Request, cities []*City, envelope bool) {
+	cities, err := filterCities(r, cities)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	age, stale, _ := h.staleness()
+	format := responseFormat(r)
+	w.Header().Add("Vary", "Accept")
+	if format != "json" && !h.FrameTime.IsZero() {
+		w.Header().Set("ETag", fmt.Sprintf(`"%d-%s"`, h.FrameTime.Unix(), format))
+	}
+
+	var body any = cities
+	if envelope {
+		body = citiesResponse{
+			Frame:      h.FrameTime,
+			FrameID:    h.Snapshot.ID,
+			AgeSeconds: int(age.Seconds()),
+			Stale:      stale,
+			Source:     h.DataSource,
+			NextPoll:   h.nextPollTime(),
+			Cities:     cities,
+		}
+	}
+
+	switch format {
+	case "json":
+		h.serveJSON(w, r, body)
+	case "msgpack", "cbor":
+		h.serveBinary(w, r, format, body)
+	case "csv":
+		h.serveFrame(w, r, "text/csv; charset=utf-8; header=present", citiesCSV(cities))
+	case "xml":
+		doc := xmlCities{Frame: h.FrameTime, FrameID: h.Snapshot.ID, AgeSeconds: int(age.Seconds()), Stale: stale, Source: h.DataSource}
+		for _, city := range cities {
+			doc.Cities = append(doc.Cities, xmlCity{
+				ID: city.ID, Name: city.Name, Lat: city.Lat, Lon: city.Lon, Region: city.Region,
+				Raining: city.Raining(), R: city.R, G: city.G, B: city.B,
+				DBZ: city.DBZ, Intensity: city.Intensity,
+			})
+		}
+		body, err := xml.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.serveFrame(w, r, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusNotAcceptable)
+	}
+}
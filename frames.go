@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// uploadSource names the frames posted to /frames.
+const uploadSource = "upload"
+
+// parseUploadProduct reads where a posted image lies from ?north=, ?west=,
+// ?south= and ?east=, in degrees, and ?grid=mercator for web map overlays.
+func parseUploadProduct(r *http.Request) (Product, error) {
+	q := r.URL.Query()
+	var b BBox
+	for _, f := range []struct {
+		name string
+		v    *float64
+	}{{"north", &b.North}, {"west", &b.West}, {"south", &b.South}, {"east", &b.East}} {
+		v := q.Get(f.name)
+		if v == "" {
+			return Product{}, fmt.Errorf("%s is required", f.name)
+		}
+		var err error
+		if *f.v, err = strconv.ParseFloat(v, 64); err != nil {
+			return Product{}, fmt.Errorf("invalid %s %q", f.name, v)
+		}
+	}
+	if b.North <= b.South || b.East <= b.West {
+		return Product{}, fmt.Errorf("north must be above south and east of west")
+	}
+	p := Product{Bounds: b}
+	switch grid := q.Get("grid"); grid {
+	case "":
+	case "mercator":
+		p.Grid.Type = grid
+	default:
+		return Product{}, fmt.Errorf("unknown grid %q, expected mercator", grid)
+	}
+	return p, nil
+}
+
+// HandlePostFrame runs a radar image of another source through the
+// pipeline as the newest frame: a PNG in the colors of the CHMI legend
+// spanning the ?north=, ?west=, ?south= and ?east= of the request, of
+// ?time= (RFC 3339, now by default), which must be newer than the current
+// frame. It is sent to the outputs like a downloaded frame, saved apart
+// from them as radar_upload_<time>.png, so it never takes the slot of a
+// frame of the source, and answered with the cities as GET /cities serves
+// them.
+func (h *Handler) HandlePostFrame(w http.ResponseWriter, r *http.Request) {
+	if h.Config().Redis.Replica || !h.leader.Leading() {
+		http.Error(w, "this instance does not process frames", http.StatusConflict)
+		return
+	}
+	product, err := parseUploadProduct(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	frameTime := h.clock.Now().Truncate(time.Minute)
+	if v := r.URL.Query().Get("time"); v != "" {
+		if frameTime, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid time %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	frame, err := chmiSource{product: product}.Decode(frameTime, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.process.Lock()
+	if h.simulating() {
+		h.process.Unlock()
+		http.Error(w, "a simulation is running", http.StatusConflict)
+		return
+	}
+	h.m.RLock()
+	current := h.FrameTime
+	h.m.RUnlock()
+	if !frameTime.After(current) {
+		h.process.Unlock()
+		http.Error(w, fmt.Sprintf("the frame of %s is not newer than the current one of %s", frameTime.Format(time.RFC3339), current.Format(time.RFC3339)), http.StatusConflict)
+		return
+	}
+	img := h.Apply(r.Context(), uploadSource, frame)
+	err = h.uploads.Save(frameTime, img)
+	h.process.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Processed the posted frame %s", frameTime.Format(frameTimeFormat))
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	h.serveCities(w, r, h.Snapshot.Cities, true)
+}
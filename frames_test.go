@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ledtesting "meteoradar/internal/testing"
+)
+
+func TestPostFrameTime(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 34, 0, 0, time.UTC)
+	frameTime := start.Truncate(10 * time.Minute)
+	product, err := defaultConfig().CHMI.productNamed("z_max3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Mask.Auto = false
+	cfg.Validate.Timestamp = false
+	clock := ledtesting.NewClock(start)
+	fetcher := ledtesting.NewFetcher()
+	fetcher.Respond(product.url(frameTime), radarPNG(t, 0))
+	uploads := ledtesting.NewStore(clock)
+	h := NewHandler("", cfg)
+	h.clock, h.fetcher, h.store, h.uploads = clock, fetcher, ledtesting.NewStore(clock), uploads
+	p := praha
+	h.Cities = []*City{&p}
+	h.ProcessFrame()
+
+	tests := []struct {
+		time   time.Time
+		status int
+	}{
+		{time: frameTime.Add(-10 * time.Minute), status: http.StatusConflict},
+		{time: frameTime, status: http.StatusConflict},
+		{time: frameTime.Add(time.Minute), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		url := fmt.Sprintf("/frames?north=%g&west=%g&south=%g&east=%g&time=%s", lat0, lon0, lat1, lon1, tt.time.Format(time.RFC3339))
+		w := httptest.NewRecorder()
+		h.HandlePostFrame(w, httptest.NewRequest("POST", url, bytes.NewReader(radarPNG(t, 40, praha))))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.time, w.Code, tt.status, w.Body)
+		}
+		if uploads.Has(tt.time) != (tt.status == http.StatusOK) {
+			t.Errorf("%s: saved %v", tt.time, uploads.Has(tt.time))
+		}
+	}
+	if !h.Snapshot.FrameTime.Equal(frameTime.Add(time.Minute)) || h.Snapshot.DataSource != uploadSource {
+		t.Errorf("published %s of %q, want the posted frame", h.Snapshot.FrameTime, h.Snapshot.DataSource)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GeocodeConfig struct {
+	// URL of a Nominatim search endpoint.
+	URL string `yaml:"url"`
+	// Countries limits results to these ISO 3166-1 codes, e.g. [cz].
+	Countries []string `yaml:"countries"`
+}
+
+// geocodeInterval keeps to the Nominatim usage policy of one request per
+// second.
+const geocodeInterval = time.Second
+
+type geocodeResult struct {
+	Name string
+	Lat  float64
+	Lon  float64
+}
+
+// Geocoder resolves place names through Nominatim, caching the answers
+// and spacing the requests.
+type Geocoder struct {
+	m     sync.Mutex
+	cfg   GeocodeConfig
+	cache map[string]*geocodeResult
+	last  time.Time
+}
+
+func (g *Geocoder) Configure(cfg GeocodeConfig) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if cfg.URL != g.cfg.URL || strings.Join(cfg.Countries, ",") != strings.Join(g.cfg.Countries, ",") {
+		g.cache = map[string]*geocodeResult{}
+	}
+	g.cfg = cfg
+}
+
+// errNotFound is returned for names Nominatim does not know.
+var errNotFound = errors.New("place not found")
+
+func (g *Geocoder) Lookup(name string) (*geocodeResult, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	g.m.Lock()
+	if res, ok := g.cache[key]; ok {
+		g.m.Unlock()
+		if res == nil {
+			return nil, errNotFound
+		}
+		return res, nil
+	}
+	cfg := g.cfg
+	if cfg.URL == "" {
+		g.m.Unlock()
+		return nil, errors.New("geocoding is disabled")
+	}
+	// take the next free slot, so lookups waiting on each other do not
+	// hold the lock
+	slot := g.last.Add(geocodeInterval)
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	g.last = slot
+	g.m.Unlock()
+	time.Sleep(time.Until(slot))
+
+	res, err := geocode(cfg, name)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	g.m.Lock()
+	defer g.m.Unlock()
+	// answers for a config replaced meanwhile are not cached
+	if g.cfg.URL == cfg.URL && slices.Equal(g.cfg.Countries, cfg.Countries) {
+		g.cache[key] = res
+	}
+	return res, err
+}
+
+// geocode asks Nominatim for name.
+func geocode(cfg GeocodeConfig, name string) (*geocodeResult, error) {
+	q := url.Values{"q": {name}, "format": {"jsonv2"}, "limit": {"1"}}
+	if len(cfg.Countries) > 0 {
+		q.Set("countrycodes", strings.Join(cfg.Countries, ","))
+	}
+	req, err := http.NewRequest("GET", cfg.URL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ledradar")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode)
+	}
+
+	var places []struct {
+		Name string `json:"name"`
+		Lat  string `json:"lat"`
+		Lon  string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return nil, err
+	}
+	if len(places) == 0 {
+		return nil, errNotFound
+	}
+
+	res := &geocodeResult{Name: places[0].Name}
+	res.Lat, _ = strconv.ParseFloat(places[0].Lat, 64)
+	res.Lon, _ = strconv.ParseFloat(places[0].Lon, 64)
+	if res.Name == "" {
+		res.Name = strings.TrimSpace(name)
+	}
+	return res, nil
+}
+
+// appendCity adds a line for city to a city file, keeping it loadable
+// when the last line lacks a newline. The built-in list is written out
+// to the file first.
+func appendCity(path string, city *City) error {
+	if embeddedList(path) {
+		if err := os.WriteFile(path, embeddedCities, 0644); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil && err != io.EOF {
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	w := csv.NewWriter(f)
+	w.Comma = ';'
+	w.Write([]string{
+		strconv.Itoa(city.ID),
+		city.Name,
+		strconv.FormatFloat(city.Lat, 'f', -1, 64),
+		strconv.FormatFloat(city.Lon, 'f', -1, 64),
+	})
+	w.Flush()
+	return w.Error()
+}
+
+type geocodeRequest struct {
+	Name string `json:"name"`
+	// ID defaults to the highest ID of the list + 1.
+	ID int `json:"id"`
+	// Set adds the city to a city set instead of the main list.
+	Set string `json:"set"`
+}
+
+// HandleGeocode resolves the name of a geocodeRequest and adds the city
+// to the city file and the running list, where it is evaluated from the
+// next frame on.
+func (h *Handler) HandleGeocode(w http.ResponseWriter, r *http.Request) {
+	var req geocodeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	place, err := h.geocoder.Lookup(req.Name)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("%q not found", req.Name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Geocoding %q failed: %s", req.Name, err)
+		http.Error(w, "geocoding failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	list, path := &h.Cities, h.config.CitiesFile
+	if req.Set != "" {
+		set, ok := h.Sets[req.Set]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown city set %q", req.Set), http.StatusNotFound)
+			return
+		}
+		list, path = &set.Cities, h.config.Sets[req.Set]
+	}
+
+	if remoteList(path) {
+		http.Error(w, fmt.Sprintf("the city list is served from %s, add the city there", path), http.StatusConflict)
+		return
+	}
+
+	id := max(req.ID, 1)
+	for _, c := range *list {
+		if (req.ID != 0 && c.ID == req.ID) || strings.EqualFold(c.Name, place.Name) {
+			http.Error(w, fmt.Sprintf("%s is already listed as %d", c.Name, c.ID), http.StatusConflict)
+			return
+		}
+		if req.ID == 0 {
+			id = max(id, c.ID+1)
+		}
+	}
+	if h.Frame != nil {
+		x, y := h.Frame.Projection.Pixel(place.Lat, place.Lon)
+		if x < 0 || y < 0 || x >= h.Frame.Image.Bounds().Dx() || y >= h.Frame.Image.Bounds().Dy() {
+			http.Error(w, fmt.Sprintf("%s is outside the radar image", place.Name), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	city := &City{ID: id, Name: place.Name, Lat: place.Lat, Lon: place.Lon}
+	city.Coverage = radarCovers(h.config)(city.Lat, city.Lon)
+	if err := appendCity(path, city); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	*list = append(*list, city)
+	if req.Set == "" {
+		h.republish()
+	}
+	log.Printf("Added %s (%d) at %.5f, %.5f to %s", city.Name, city.ID, city.Lat, city.Lon, path)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(city)
+}
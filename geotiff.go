@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// gridReference places the pixels of a projection on a regular grid of
+// its coordinate reference system, as GeoTIFF describes it.
+type gridReference struct {
+	// keys are the GeoKeys of the CRS, the values of double keys indexes
+	// into doubles
+	keys    []geoKey
+	doubles []float64
+	// originX, originY are the coordinates of the outer corner of pixel
+	// 0, 0, scaleX and scaleY the pixel size, Y growing up.
+	originX, originY float64
+	scaleX, scaleY   float64
+}
+
+type geoKey struct {
+	id, value uint16
+	double    bool
+}
+
+// referencedProjection is a projection with a known grid reference.
+type referencedProjection interface {
+	gridReference() gridReference
+}
+
+// GeoKey IDs and values, see the OGC GeoTIFF standard.
+const (
+	gtModelType        = 1024
+	gtRasterType       = 1025
+	geographicType     = 2048
+	geogGeodeticDatum  = 2050
+	geogAngularUnits   = 2054
+	geogEllipsoid      = 2056
+	geogSemiMajorAxis  = 2057
+	geogSemiMinorAxis  = 2058
+	projectedCSType    = 3072
+	projection         = 3074
+	projCoordTrans     = 3075
+	projLinearUnits    = 3076
+	projNatOriginLat   = 3081
+	projFalseEasting   = 3082
+	projFalseNorthing  = 3083
+	projScaleAtOrigin  = 3092
+	projStraightVertLn = 3095
+
+	modelTypeProjected   = 1
+	modelTypeGeographic  = 2
+	rasterPixelIsArea    = 1
+	userDefined          = 32767
+	epsgWGS84            = 4326
+	ctPolarStereographic = 15
+	unitMetre            = 9001
+	unitDegree           = 9102
+)
+
+func (p lonLatProjection) gridReference() gridReference {
+	return gridReference{
+		keys: []geoKey{
+			{gtModelType, modelTypeGeographic, false},
+			{gtRasterType, rasterPixelIsArea, false},
+			{geographicType, epsgWGS84, false},
+		},
+		originX: p.lon0,
+		originY: p.lat0,
+		scaleX:  (p.lon1 - p.lon0) / float64(p.width),
+		scaleY:  (p.lat0 - p.lat1) / float64(p.height),
+	}
+}
+
+// gridReference describes the RADOLAN polar stereographic grid on its
+// sphere, true at 60°N and centered on 10°E, in metres.
+func (radolanProjection) gridReference() gridReference {
+	ref := gridReference{
+		keys: []geoKey{
+			{gtModelType, modelTypeProjected, false},
+			{gtRasterType, rasterPixelIsArea, false},
+			{geographicType, userDefined, false},
+			{geogGeodeticDatum, userDefined, false},
+			{geogAngularUnits, unitDegree, false},
+			{geogEllipsoid, userDefined, false},
+			{projectedCSType, userDefined, false},
+			{projection, userDefined, false},
+			{projCoordTrans, ctPolarStereographic, false},
+			{projLinearUnits, unitMetre, false},
+		},
+		originX: radolanX0 * 1000,
+		originY: (radolanY0 + radolanSize) * 1000,
+		scaleX:  1000,
+		scaleY:  1000,
+	}
+	for _, p := range []struct {
+		key   uint16
+		value float64
+	}{
+		{geogSemiMajorAxis, radolanEarthRadius * 1000},
+		{geogSemiMinorAxis, radolanEarthRadius * 1000},
+		{projNatOriginLat, 60},
+		{projFalseEasting, 0},
+		{projFalseNorthing, 0},
+		{projScaleAtOrigin, 1},
+		{projStraightVertLn, 10},
+	} {
+		ref.keys = append(ref.keys, geoKey{p.key, uint16(len(ref.doubles)), true})
+		ref.doubles = append(ref.doubles, p.value)
+	}
+	return ref
+}
+
+func (p offsetProjection) gridReference() gridReference {
+	inner, ok := p.Projection.(referencedProjection)
+	if !ok {
+		return gridReference{}
+	}
+	ref := inner.gridReference()
+	ref.originX += float64(p.dx) * ref.scaleX
+	ref.originY -= float64(p.dy) * ref.scaleY
+	return ref
+}
+
+// TIFF tag types.
+const (
+	tiffASCII  = 2
+	tiffShort  = 3
+	tiffLong   = 4
+	tiffDouble = 12
+)
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+// tiffRowsPerStrip keeps the strips of a frame around 64 kB.
+const tiffRowsPerStrip = 16
+
+// encodeGeoTIFF writes the field as a single band float32 GeoTIFF in dBZ,
+// deflated, pixels without echo being NaN.
+func encodeGeoTIFF(field *Field, ref gridReference, t time.Time) ([]byte, error) {
+	le := binary.LittleEndian
+	var body bytes.Buffer
+	body.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0})
+
+	var offsets, counts []uint32
+	row := make([]byte, 4*field.Width)
+	for y := 0; y < field.Height; y += tiffRowsPerStrip {
+		offsets = append(offsets, uint32(body.Len()))
+		start := body.Len()
+		zw := zlib.NewWriter(&body)
+		for yy := y; yy < min(y+tiffRowsPerStrip, field.Height); yy++ {
+			for x, v := range field.DBZ[yy*field.Width : (yy+1)*field.Width] {
+				le.PutUint32(row[4*x:], math.Float32bits(v))
+			}
+			zw.Write(row)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		counts = append(counts, uint32(body.Len()-start))
+	}
+
+	shorts := func(v ...uint16) []byte {
+		b := make([]byte, 2*len(v))
+		for i, s := range v {
+			le.PutUint16(b[2*i:], s)
+		}
+		return b
+	}
+	longs := func(v ...uint32) []byte {
+		b := make([]byte, 4*len(v))
+		for i, l := range v {
+			le.PutUint32(b[4*i:], l)
+		}
+		return b
+	}
+	doubles := func(v ...float64) []byte {
+		b := make([]byte, 8*len(v))
+		for i, d := range v {
+			le.PutUint64(b[8*i:], math.Float64bits(d))
+		}
+		return b
+	}
+	ascii := func(s string) []byte {
+		return append([]byte(s), 0)
+	}
+
+	keys := append([]geoKey(nil), ref.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].id < keys[j].id })
+	directory := []uint16{1, 1, 0, uint16(len(keys))}
+	for _, k := range keys {
+		var location uint16
+		if k.double {
+			location = 34736
+		}
+		directory = append(directory, k.id, location, 1, k.value)
+	}
+
+	entries := []tiffEntry{
+		{256, tiffLong, 1, longs(uint32(field.Width))},
+		{257, tiffLong, 1, longs(uint32(field.Height))},
+		{258, tiffShort, 1, shorts(32)},
+		// Adobe deflate
+		{259, tiffShort, 1, shorts(8)},
+		// black is zero
+		{262, tiffShort, 1, shorts(1)},
+		{273, tiffLong, uint32(len(offsets)), longs(offsets...)},
+		{277, tiffShort, 1, shorts(1)},
+		{278, tiffLong, 1, longs(tiffRowsPerStrip)},
+		{279, tiffLong, uint32(len(counts)), longs(counts...)},
+		{284, tiffShort, 1, shorts(1)},
+		{306, tiffASCII, 20, ascii(t.UTC().Format("2006:01:02 15:04:05"))},
+		// IEEE floating point
+		{339, tiffShort, 1, shorts(3)},
+		{33550, tiffDouble, 3, doubles(ref.scaleX, ref.scaleY, 0)},
+		{33922, tiffDouble, 6, doubles(0, 0, 0, ref.originX, ref.originY, 0)},
+		{34735, tiffShort, uint32(len(directory)), shorts(directory...)},
+	}
+	if len(ref.doubles) > 0 {
+		entries = append(entries, tiffEntry{34736, tiffDouble, uint32(len(ref.doubles)), doubles(ref.doubles...)})
+	}
+	// GDAL_NODATA
+	entries = append(entries, tiffEntry{42113, tiffASCII, 4, ascii("nan")})
+
+	// values that do not fit the entry go after the directory
+	if body.Len()%2 == 1 {
+		body.WriteByte(0)
+	}
+	ifd := uint32(body.Len())
+	extra := ifd + 2 + 12*uint32(len(entries)) + 4
+	var dir, values bytes.Buffer
+	dir.Write(shorts(uint16(len(entries))))
+	for _, e := range entries {
+		dir.Write(shorts(e.tag, e.typ))
+		dir.Write(longs(e.count))
+		if len(e.data) <= 4 {
+			dir.Write(append(e.data, make([]byte, 4-len(e.data))...))
+			continue
+		}
+		dir.Write(longs(extra + uint32(values.Len())))
+		values.Write(e.data)
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	dir.Write(longs(0))
+	body.Write(dir.Bytes())
+	body.Write(values.Bytes())
+
+	out := body.Bytes()
+	le.PutUint32(out[4:], ifd)
+	return out, nil
+}
+
+// HandleGeoTIFF serves the reflectivity of the current frame, or of a
+// stored one with ?time=, as a GeoTIFF in the CRS of the radar source.
+func (h *Handler) HandleGeoTIFF(w http.ResponseWriter, r *http.Request) {
+	var at time.Time
+	if v := r.URL.Query().Get("time"); v != "" {
+		var err error
+		if at, err = parseTimeParam(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if h.Frame == nil {
+		http.Error(w, "no radar frame yet", http.StatusServiceUnavailable)
+		return
+	}
+	proj, ok := h.Frame.Projection.(referencedProjection)
+	if !ok {
+		http.Error(w, "the projection of the radar source is not known", http.StatusNotImplemented)
+		return
+	}
+
+	field := newField(h.Frame.Image)
+	t := h.Frame.Time
+	if !at.IsZero() && !at.Equal(t) {
+		if !h.store.Has(at) {
+			http.Error(w, fmt.Sprintf("frame %s is not stored", at.Format(frameTimeFormat)), http.StatusNotFound)
+			return
+		}
+		var err error
+		if field, err = h.loadField(at, h.Frame.Projection); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t = at
+	}
+
+	body, err := encodeGeoTIFF(field, proj.gridReference(), t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"tiff-%d"`, t.Unix()))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.tiff"`, t.Format(frameTimeFormat)))
+	h.serveFrame(w, r, "image/tiff", body)
+}
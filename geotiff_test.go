@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// readTIFF indexes the tags of the first directory of a little endian
+// TIFF by their raw values.
+func readTIFF(t *testing.T, data []byte) map[uint16][]byte {
+	t.Helper()
+	le := binary.LittleEndian
+	if !bytes.HasPrefix(data, []byte{'I', 'I', 42, 0}) {
+		t.Fatalf("not a little endian tiff: % x", data[:4])
+	}
+	ifd := le.Uint32(data[4:])
+	n := int(le.Uint16(data[ifd:]))
+	sizes := map[uint16]uint32{tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffDouble: 8}
+	tags := map[uint16][]byte{}
+	for i := 0; i < n; i++ {
+		e := data[int(ifd)+2+12*i:]
+		tag, typ, count := le.Uint16(e), le.Uint16(e[2:]), le.Uint32(e[4:])
+		size := sizes[typ] * count
+		if size <= 4 {
+			tags[tag] = e[8 : 8+size]
+		} else {
+			offset := le.Uint32(e[8:])
+			tags[tag] = data[offset : offset+size]
+		}
+	}
+	return tags
+}
+
+func tiffValues(b []byte, typ uint16) []float64 {
+	le := binary.LittleEndian
+	var out []float64
+	switch typ {
+	case tiffShort:
+		for i := 0; i+2 <= len(b); i += 2 {
+			out = append(out, float64(le.Uint16(b[i:])))
+		}
+	case tiffLong:
+		for i := 0; i+4 <= len(b); i += 4 {
+			out = append(out, float64(le.Uint32(b[i:])))
+		}
+	case tiffDouble:
+		for i := 0; i+8 <= len(b); i += 8 {
+			out = append(out, math.Float64frombits(le.Uint64(b[i:])))
+		}
+	}
+	return out
+}
+
+func TestEncodeGeoTIFF(t *testing.T) {
+	chmi := lonLatProjection{lon0, lat0, lon1, lat1, 598, 378}
+	tests := []struct {
+		name   string
+		proj   referencedProjection
+		width  int
+		height int
+		// scale and tie are the ModelPixelScale and the model corner of
+		// the ModelTiepoint
+		scale []float64
+		tie   []float64
+		// doubles are the double GeoKeys, empty for none
+		doubles []float64
+	}{
+		{
+			name:  "chmi",
+			proj:  chmi,
+			width: 3, height: 2,
+			scale: []float64{(lon1 - lon0) / 598, (lat0 - lat1) / 378, 0},
+			tie:   []float64{lon0, lat0},
+		},
+		{
+			name:  "cropped chmi",
+			proj:  offsetProjection{Projection: chmi, dx: 10, dy: 20},
+			width: 3, height: 2,
+			scale: []float64{(lon1 - lon0) / 598, (lat0 - lat1) / 378, 0},
+			tie:   []float64{lon0 + 10*(lon1-lon0)/598, lat0 - 20*(lat0-lat1)/378},
+		},
+		{
+			name:  "radolan",
+			proj:  radolanProjection{},
+			width: 1, height: tiffRowsPerStrip + 1,
+			scale:   []float64{1000, 1000, 0},
+			tie:     []float64{radolanX0 * 1000, (radolanY0 + radolanSize) * 1000},
+			doubles: []float64{radolanEarthRadius * 1000, radolanEarthRadius * 1000, 60, 0, 0, 1, 10},
+		},
+	}
+	at := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	for _, tt := range tests {
+		field := &Field{Width: tt.width, Height: tt.height, DBZ: make([]float32, tt.width*tt.height)}
+		for i := range field.DBZ {
+			field.DBZ[i] = float32(i)
+		}
+		field.DBZ[0] = nanDBZ
+
+		data, err := encodeGeoTIFF(field, tt.proj.gridReference(), at)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		tags := readTIFF(t, data)
+
+		if w := tiffValues(tags[256], tiffLong); len(w) != 1 || int(w[0]) != tt.width {
+			t.Errorf("%s: width %v", tt.name, w)
+		}
+		if h := tiffValues(tags[257], tiffLong); len(h) != 1 || int(h[0]) != tt.height {
+			t.Errorf("%s: height %v", tt.name, h)
+		}
+		if s := string(tags[306]); s != "2024:06:01 12:30:00\x00" {
+			t.Errorf("%s: datetime %q", tt.name, s)
+		}
+		if s := tiffValues(tags[33550], tiffDouble); !floatsNear(s, tt.scale) {
+			t.Errorf("%s: pixel scale %v, want %v", tt.name, s, tt.scale)
+		}
+		if tie := tiffValues(tags[33922], tiffDouble); len(tie) != 6 || !floatsNear(tie[3:5], tt.tie) {
+			t.Errorf("%s: tiepoint %v, want %v", tt.name, tie, tt.tie)
+		}
+		if d := tiffValues(tags[34736], tiffDouble); !floatsNear(d, tt.doubles) {
+			t.Errorf("%s: double geokeys %v, want %v", tt.name, d, tt.doubles)
+		}
+		if dir := tiffValues(tags[34735], tiffShort); len(dir) < 4 || int(dir[3])*4+4 != len(dir) {
+			t.Errorf("%s: geokey directory %v", tt.name, dir)
+		}
+
+		// the strips inflate back to the field
+		offsets, counts := tiffValues(tags[273], tiffLong), tiffValues(tags[279], tiffLong)
+		if want := (tt.height + tiffRowsPerStrip - 1) / tiffRowsPerStrip; len(offsets) != want || len(counts) != want {
+			t.Fatalf("%s: %d offsets and %d counts, want %d", tt.name, len(offsets), len(counts), want)
+		}
+		var pixels []byte
+		for i := range offsets {
+			zr, err := zlib.NewReader(bytes.NewReader(data[int(offsets[i]) : int(offsets[i])+int(counts[i])]))
+			if err != nil {
+				t.Fatalf("%s: strip %d: %v", tt.name, i, err)
+			}
+			strip, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%s: strip %d: %v", tt.name, i, err)
+			}
+			pixels = append(pixels, strip...)
+		}
+		if len(pixels) != 4*len(field.DBZ) {
+			t.Fatalf("%s: %d bytes of pixels, want %d", tt.name, len(pixels), 4*len(field.DBZ))
+		}
+		for i, want := range field.DBZ {
+			got := math.Float32frombits(binary.LittleEndian.Uint32(pixels[4*i:]))
+			if got != want && !(math.IsNaN(float64(got)) && math.IsNaN(float64(want))) {
+				t.Errorf("%s: pixel %d is %g, want %g", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func floatsNear(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9*math.Max(1, math.Abs(b[i])) {
+			return false
+		}
+	}
+	return true
+}
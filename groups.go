@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// LEDGroup shows several cities, such as the towns of a district, on one
+// LED.
+type LEDGroup struct {
+	// LED is the index of the LED, which the group takes over from any
+	// city mapped to it.
+	LED int `yaml:"led"`
+	// Aggregate is max, the strongest echo over the cities (the default),
+	// or mean, their reflectivity averaged weighted by Areas.
+	Aggregate string `yaml:"aggregate"`
+	Cities    []int  `yaml:"cities"`
+	// Areas weighs the cities in the mean, e.g. in km² of the land around
+	// them; unlisted cities weigh 1.
+	Areas map[int]float64 `yaml:"areas"`
+}
+
+func (g LEDGroup) area(id int) float64 {
+	if a, ok := g.Areas[id]; ok {
+		return a
+	}
+	return 1
+}
+
+func (c LEDConfig) validateGroups() error {
+	grouped := map[int]string{}
+	leds := map[int]string{}
+	for _, name := range sortedGroups(c.Groups) {
+		g := c.Groups[name]
+		switch g.Aggregate {
+		case "", "max", "mean":
+		default:
+			return fmt.Errorf("leds group %s: unknown aggregate %q, expected max or mean", name, g.Aggregate)
+		}
+		if g.LED < 0 || (c.Count > 0 && g.LED >= c.Count) {
+			return fmt.Errorf("leds group %s: LED %d is not on the strip", name, g.LED)
+		}
+		if other, ok := leds[g.LED]; ok {
+			return fmt.Errorf("leds groups %s and %s share LED %d", other, name, g.LED)
+		}
+		leds[g.LED] = name
+		if len(g.Cities) == 0 {
+			return fmt.Errorf("leds group %s has no cities", name)
+		}
+		for _, id := range g.Cities {
+			if other, ok := grouped[id]; ok {
+				return fmt.Errorf("leds group %s: city %d is already in group %s", name, id, other)
+			}
+			grouped[id] = name
+		}
+		for id, a := range g.Areas {
+			if grouped[id] != name {
+				return fmt.Errorf("leds group %s: area of city %d, which is not in the group", name, id)
+			}
+			if a <= 0 {
+				return fmt.Errorf("leds group %s: area of city %d must be positive", name, id)
+			}
+		}
+	}
+	if len(c.Groups) > 0 && c.Points != "" {
+		return errors.New("leds groups cannot be combined with points")
+	}
+	return nil
+}
+
+func sortedGroups(groups map[string]LEDGroup) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// group is the name of the group city id is in, if any.
+func (c LEDConfig) group(id int) (string, bool) {
+	for name, g := range c.Groups {
+		for _, member := range g.Cities {
+			if member == id {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// GroupState is the rain over a group of cities as its LED shows it.
+type GroupState struct {
+	Name      string `json:"name"`
+	LED       int    `json:"led"`
+	Aggregate string `json:"aggregate"`
+	Cities    []int  `json:"cities"`
+	// Raining counts the raining cities, Share is their part in the area
+	// of the group.
+	Raining int     `json:"raining"`
+	Share   float64 `json:"share"`
+	RainState
+}
+
+// aggregateGroup folds the states of the cities of g into one: those of
+// the city with the strongest smoothed echo for max, the reflectivities
+// averaged by area and shown in the color of the legend for mean. The
+// alert is the highest and the strikes add up either way. Cities missing
+// from the list are left out.
+func aggregateGroup(name string, g LEDGroup, city func(id int) *City) GroupState {
+	s := GroupState{Name: name, LED: g.LED, Aggregate: g.Aggregate, Cities: g.Cities}
+	if s.Aggregate == "" {
+		s.Aggregate = "max"
+	}
+	var strongest *City
+	var area, rainArea, dbz, smoothed float64
+	var alert AlertLevel
+	var strikes int
+	nearby := false
+	for _, id := range g.Cities {
+		c := city(id)
+		if c == nil {
+			continue
+		}
+		a := g.area(id)
+		area += a
+		if c.Raining() {
+			s.Raining++
+			rainArea += a
+		}
+		dbz += a * c.DBZ
+		smoothed += a * c.Smoothed.DBZ
+		alert = max(alert, c.Alert)
+		strikes += c.Strikes10Min
+		nearby = nearby || c.RainNearby || c.Raining()
+		if strongest == nil || c.Smoothed.DBZ > strongest.Smoothed.DBZ {
+			strongest = c
+		}
+	}
+	if strongest == nil {
+		return s
+	}
+	s.Share = math.Round(rainArea/area*1000) / 1000
+
+	if s.Aggregate == "max" {
+		s.RainState = RainState{
+			R: strongest.R, G: strongest.G, B: strongest.B,
+			DBZ: strongest.DBZ, Intensity: strongest.Intensity, Hail: strongest.Hail, Trend: strongest.Trend,
+			Smoothed: strongest.Smoothed,
+		}
+	} else {
+		mean := math.Round(dbz/area*10) / 10
+		c := dbzColor(mean)
+		s.RainState = RainState{R: c.R, G: c.G, B: c.B, Intensity: intensityOf(mean)}
+		if s.RainState.Raining() {
+			s.DBZ = mean
+		}
+		sm := math.Round(smoothed/area*10) / 10
+		c = dbzColor(sm)
+		s.Smoothed = Smoothed{R: c.R, G: c.G, B: c.B}
+		if c.R|c.G|c.B != 0 {
+			s.Smoothed.DBZ = sm
+		}
+	}
+	s.Alert = alert
+	s.Strikes10Min = strikes
+	s.RainNearby = nearby && s.Smoothed.R|s.Smoothed.G|s.Smoothed.B == 0
+	return s
+}
+
+// ledCity is a city, or the aggregate of a group, with the LED it lights.
+type ledCity struct {
+	led int
+	City
+}
+
+// ledCities are the cities not in a group with their LEDs, followed by
+// one aggregate city per group.
+func (c LEDConfig) ledCities(cities []City) []ledCity {
+	if len(c.Groups) == 0 {
+		out := make([]ledCity, len(cities))
+		for i := range cities {
+			out[i] = ledCity{c.index(&cities[i]), cities[i]}
+		}
+		return out
+	}
+	grouped := map[int]bool{}
+	for _, g := range c.Groups {
+		for _, id := range g.Cities {
+			grouped[id] = true
+		}
+	}
+	byID := map[int]*City{}
+	var out []ledCity
+	for i := range cities {
+		city := &cities[i]
+		byID[city.ID] = city
+		if !grouped[city.ID] {
+			out = append(out, ledCity{c.index(city), *city})
+		}
+	}
+	for _, name := range sortedGroups(c.Groups) {
+		g := c.Groups[name]
+		s := aggregateGroup(name, g, func(id int) *City { return byID[id] })
+		out = append(out, ledCity{g.LED, City{ID: -1, Name: name, Coverage: true, RainState: s.RainState}})
+	}
+	return out
+}
+
+// HandleGroups serves the configured LED groups with the aggregate state
+// their LEDs show.
+func (h *Handler) HandleGroups(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+	byID := map[int]*City{}
+	for _, city := range h.Snapshot.Cities {
+		byID[city.ID] = city
+	}
+	groups := []GroupState{}
+	for _, name := range sortedGroups(h.config.LEDs.Groups) {
+		g := h.config.LEDs.Groups[name]
+		groups = append(groups, aggregateGroup(name, g, func(id int) *City { return byID[id] }))
+	}
+	h.serveJSON(w, r, groups)
+}
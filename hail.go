@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+)
+
+type HailConfig struct {
+	// Enabled downloads the CHMI echo top product next to the
+	// reflectivity for every frame.
+	Enabled bool `yaml:"enabled"`
+	// Hail is probable where a sampling window has an echo of MinDBZ
+	// reaching up to MinTopKm.
+	MinDBZ   float64 `yaml:"minDbz"`
+	MinTopKm float64 `yaml:"minTopKm"`
+}
+
+// echoTopProduct is the CHMI echo top product, configured overrides
+// included.
+func echoTopProduct(cfg *Config) (Product, error) {
+	return CHMIConfig{Product: "echotop", Products: cfg.CHMI.Products}.product()
+}
+
+// addEchoTop downloads the echo top heights of frame for hail detection.
+// Without them cities are evaluated as usual, just without hail.
+func (h *Handler) addEchoTop(ctx context.Context, frame *Frame) {
+	cfg := h.Config()
+	if !cfg.Hail.Enabled {
+		return
+	}
+	product, err := echoTopProduct(cfg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ctx, span := tracer.Start(ctx, "echotop")
+	tops, err := h.fetch(ctx, chmiSource{h.fetcher, product}, frame.Time)
+	endSpan(span, err)
+	if err != nil {
+		log.Printf("Cannot get echo top: %s, skipping hail detection", err)
+		return
+	}
+	frame.EchoTop = tops
+}
+
+// hailLikely reports whether the window around x, y has an echo of at
+// least MinDBZ and an echo top of at least MinTopKm. tops holds the echo
+// top frame decoded like reflectivity, 4 dBZ per km.
+func hailLikely(field, tops *Field, x, y int, cfg HailConfig) bool {
+	if tops == nil {
+		return false
+	}
+	maxDBZ, maxTop := math.Inf(-1), math.Inf(-1)
+	for xx := -4; xx <= 4; xx++ {
+		for yy := -4; yy <= 4; yy++ {
+			// NaN compares false, dry pixels are skipped
+			if dbz := float64(field.At(x+xx, y+yy)); dbz > maxDBZ {
+				maxDBZ = dbz
+			}
+			if top := float64(tops.At(x+xx, y+yy)) / 4; top > maxTop {
+				maxTop = top
+			}
+		}
+	}
+	return maxDBZ >= cfg.MinDBZ && maxTop >= cfg.MinTopKm
+}
+
+func (c HailConfig) validate(cfg *Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	if cfg.Source != "" && cfg.Source != "chmi" {
+		return fmt.Errorf("hail detection needs the chmi source")
+	}
+	product, err := cfg.CHMI.product()
+	if err != nil {
+		return err
+	}
+	if product.Unit != "dbz" {
+		return fmt.Errorf("hail detection needs a reflectivity product, not %s", cfg.CHMI.Product)
+	}
+	_, err = echoTopProduct(cfg)
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HookConfig runs a local command on an event, with what happened in
+// RADAR_HOOK_* environment variables and as JSON on stdin. They are not
+// LEDRADAR_*, which would override the config of a ledradar command run
+// by the hook.
+type HookConfig struct {
+	// On is rain-start or rain-stop, run once per city that starts or
+	// stops raining, or frame, run after every processed frame.
+	On string `yaml:"on"`
+	// Command is run by sh -c.
+	Command string `yaml:"command"`
+	// Cities limits rain-start and rain-stop to the cities of these names
+	// or IDs, all by default.
+	Cities []string `yaml:"cities"`
+	// Timeout stops a command running longer, 30s by default.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const defaultHookTimeout = 30 * time.Second
+
+func (c HookConfig) validate() error {
+	switch c.On {
+	case "rain-start", "rain-stop", "frame":
+	default:
+		return fmt.Errorf("hook %q: unknown event %q, expected rain-start, rain-stop or frame", c.Command, c.On)
+	}
+	if c.Command == "" {
+		return errors.New("hook needs a command")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("hook %q: timeout must not be negative", c.Command)
+	}
+	return nil
+}
+
+// hookOutput runs the command of a hook for the events of every update.
+type hookOutput struct {
+	cfg   HookConfig
+	retry RetryConfig
+}
+
+func (o hookOutput) Name() string {
+	name := fmt.Sprintf("hook %s %s", o.cfg.On, o.cfg.Command)
+	if len(o.cfg.Cities) > 0 {
+		name += " for " + strings.Join(o.cfg.Cities, ",")
+	}
+	if o.cfg.Timeout != 0 {
+		name += " within " + o.cfg.Timeout.String()
+	}
+	return name
+}
+
+// retriesItself makes deliver run the hook once, the commands of the
+// cities are retried one by one.
+func (hookOutput) retriesItself() {}
+
+func (o hookOutput) matches(city City) bool {
+	if len(o.cfg.Cities) == 0 {
+		return true
+	}
+	for _, c := range o.cfg.Cities {
+		if strings.EqualFold(c, city.Name) || c == strconv.Itoa(city.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o hookOutput) Send(u *Update) error {
+	frame := []string{
+		"RADAR_HOOK_EVENT=" + o.cfg.On,
+		"RADAR_HOOK_FRAME=" + u.Frame.UTC().Format(time.RFC3339),
+		"RADAR_HOOK_FRAME_ID=" + strconv.FormatUint(u.FrameID, 10),
+		"RADAR_HOOK_SOURCE=" + u.Source,
+		"RADAR_HOOK_SIMULATED=" + strconv.FormatBool(u.Simulated),
+	}
+	if o.cfg.On == "frame" {
+		var names []string
+		for _, city := range u.Raining() {
+			names = append(names, city.Name)
+		}
+		env := append(frame,
+			"RADAR_HOOK_RAINING="+strconv.Itoa(len(names)),
+			"RADAR_HOOK_RAINING_CITIES="+strings.Join(names, ","),
+		)
+		return o.runRetrying(env, newUpdatePayload(u))
+	}
+
+	var errs []error
+	for _, t := range u.Transitions {
+		if t.Raining != (o.cfg.On == "rain-start") || !o.matches(t.City) {
+			continue
+		}
+		c := t.City
+		env := append(slices.Clone(frame),
+			"RADAR_HOOK_CITY="+c.Name,
+			"RADAR_HOOK_CITY_ID="+strconv.Itoa(c.ID),
+			"RADAR_HOOK_REGION="+c.Region,
+			"RADAR_HOOK_LAT="+strconv.FormatFloat(c.Lat, 'f', -1, 64),
+			"RADAR_HOOK_LON="+strconv.FormatFloat(c.Lon, 'f', -1, 64),
+			"RADAR_HOOK_DBZ="+strconv.FormatFloat(c.DBZ, 'f', -1, 64),
+			"RADAR_HOOK_INTENSITY="+c.Intensity.String(),
+			fmt.Sprintf("RADAR_HOOK_COLOR=#%02x%02x%02x", c.R, c.G, c.B),
+		)
+		if err := o.runRetrying(env, t); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runRetrying runs the command as often as the retry config of the
+// outputs allows until it succeeds.
+func (o hookOutput) runRetrying(env []string, data any) error {
+	backoff := o.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := o.run(env, data)
+		if err == nil || attempt >= o.retry.Attempts {
+			return err
+		}
+		log.Printf("Output %s failed: %s, retrying in %s", o.Name(), err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// run runs the command with env added to ours and data as JSON on stdin.
+func (o hookOutput) run(env []string, data any) error {
+	input, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	timeout := o.cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", o.cfg.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
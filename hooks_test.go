@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookNames(t *testing.T) {
+	hooks := []HookConfig{
+		{On: "rain-start", Command: "siren"},
+		{On: "rain-stop", Command: "siren"},
+		{On: "rain-start", Command: "siren", Cities: []string{"Brno"}},
+		{On: "rain-start", Command: "siren", Cities: []string{"Praha"}},
+		{On: "rain-start", Command: "siren", Cities: []string{"Praha"}, Timeout: time.Second},
+	}
+	seen := map[string]bool{}
+	for _, c := range hooks {
+		name := hookOutput{cfg: c}.Name()
+		if seen[name] {
+			t.Errorf("%+v: name %q is taken", c, name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestHookSend(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	env := filepath.Join(dir, "env")
+	// Brno fails the first time
+	command := `echo "$RADAR_HOOK_CITY" >> ` + log + `; env > ` + env + `; ` +
+		`[ "$RADAR_HOOK_CITY" != Brno ] || [ -e ` + dir + `/failed ] || { touch ` + dir + `/failed; exit 1; }`
+	o := hookOutput{HookConfig{On: "rain-start", Command: command}, RetryConfig{Attempts: 3}}
+
+	now := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	u := &Update{Frame: now, Source: "chmi", Transitions: []TransitionEvent{
+		{Frame: now, City: praha, Raining: true},
+		{Frame: now, City: brno, Raining: true},
+		{Frame: now, City: City{ID: 3, Name: "Ostrava"}, Raining: false},
+	}}
+	deliver(o, u, o.retry)
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the failed command runs again
+	if got, want := strings.Fields(string(data)), []string{"Praha", "Brno", "Brno"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ran for %v, want %v", got, want)
+	}
+
+	// a ledradar run by the hook keeps its config
+	data, err = os.ReadFile(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, strings.Split(string(data), "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("the environment of the hook overrides the config")
+	}
+	if !strings.Contains(string(data), "RADAR_HOOK_SOURCE=chmi\n") {
+		t.Errorf("no RADAR_HOOK_SOURCE in the environment of the hook")
+	}
+}
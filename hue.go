@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HueConfig drives lights of a Philips Hue bridge, or of a deCONZ
+// gateway, which speaks the same API, by the rain in selected cities.
+type HueConfig struct {
+	// Bridge is the address of the bridge, empty disables the output.
+	Bridge string `yaml:"bridge"`
+	// Username is the API key the bridge hands out after its link button
+	// is pressed.
+	Username string      `yaml:"username"`
+	Lights   []HueTarget `yaml:"lights"`
+	// Palette colors the lights, the global palette when empty.
+	Palette Palette `yaml:"palette"`
+}
+
+// HueTarget binds a light or a group (room, zone) to a city.
+type HueTarget struct {
+	// City name or ID.
+	City  string `yaml:"city"`
+	Light string `yaml:"light"`
+	Group string `yaml:"group"`
+	// Color replaces the radar color while it rains, e.g. "#0000ff".
+	Color string `yaml:"color"`
+	// Dry is what the light does without rain: off, or keep to leave it
+	// alone.
+	Dry string `yaml:"dry"`
+}
+
+func (t HueTarget) path() string {
+	if t.Group != "" {
+		return "groups/" + t.Group + "/action"
+	}
+	return "lights/" + t.Light + "/state"
+}
+
+func (t HueTarget) matches(city *City) bool {
+	return strings.EqualFold(t.City, city.Name) || t.City == strconv.Itoa(city.ID)
+}
+
+func (c HueConfig) validate() error {
+	if c.Bridge == "" {
+		return nil
+	}
+	if c.Username == "" {
+		return errors.New("hue needs the username of the bridge")
+	}
+	for _, t := range c.Lights {
+		if (t.Light == "") == (t.Group == "") {
+			return fmt.Errorf("hue light for %s needs either a light or a group", t.City)
+		}
+		if t.Color != "" {
+			if _, err := parseHexColor(t.Color); err != nil {
+				return err
+			}
+		}
+		if t.Dry != "" && t.Dry != "off" && t.Dry != "keep" {
+			return fmt.Errorf("hue dry must be off or keep, not %q", t.Dry)
+		}
+	}
+	return nil
+}
+
+// hueState is what a light or group is set to.
+type hueState struct {
+	On  bool
+	Bri uint8
+	XY  [2]float64
+}
+
+// body is the light state or group action request for s.
+func (s hueState) body() map[string]any {
+	if !s.On {
+		return map[string]any{"on": false}
+	}
+	return map[string]any{"on": true, "bri": s.Bri, "xy": s.XY}
+}
+
+// hueBrightness is the brightness per intensity, dimmest for light rain.
+var hueBrightness = map[Intensity]uint8{
+	IntensityLight:    64,
+	IntensityModerate: 127,
+	IntensityHeavy:    191,
+	IntensitySevere:   254,
+}
+
+// Hue sets the color and brightness of its lights from their cities on
+// every frame, sending only those that changed so the bridge's rate
+// limit is kept.
+type Hue struct {
+	m    sync.Mutex
+	cfg  HueConfig
+	sent map[string]hueState
+}
+
+func (b *Hue) Configure(cfg HueConfig) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.cfg = cfg
+	b.sent = map[string]hueState{}
+}
+
+func (b *Hue) Name() string {
+	return "hue"
+}
+
+func (b *Hue) Send(u *Update) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	var errs []error
+	for _, target := range b.cfg.Lights {
+		var city *City
+		for i := range u.Cities {
+			if target.matches(&u.Cities[i]) {
+				city = &u.Cities[i]
+				break
+			}
+		}
+		if city == nil {
+			continue
+		}
+
+		state := hueState{}
+		if city.Raining() {
+			c := color.NRGBA{city.R, city.G, city.B, 255}
+			if b.cfg.Palette.recolors() {
+				c = b.cfg.Palette.color(city.DBZ)
+			}
+			if target.Color != "" {
+				c, _ = parseHexColor(target.Color)
+			}
+			state = hueState{On: true, Bri: hueBrightness[city.Intensity], XY: hueXY(c)}
+		} else if target.Dry == "keep" {
+			continue
+		}
+
+		path := target.path()
+		if last, ok := b.sent[path]; ok && last == state {
+			continue
+		}
+		if err := b.put(path, state); err != nil {
+			errs = append(errs, fmt.Errorf("hue %s: %w", path, err))
+			continue
+		}
+		b.sent[path] = state
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Hue) put(path string, state hueState) error {
+	base := b.cfg.Bridge
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	body, err := json.Marshal(state.body())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(base, "/")+"/api/"+b.cfg.Username+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+
+	// the bridge answers 200 with a list of errors
+	var results []struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error != nil {
+			return errors.New(r.Error.Description)
+		}
+	}
+	return nil
+}
+
+// hueXY converts an sRGB color to the CIE xy coordinates lights take.
+func hueXY(c color.NRGBA) [2]float64 {
+	linear := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f > 0.04045 {
+			return math.Pow((f+0.055)/1.055, 2.4)
+		}
+		return f / 12.92
+	}
+	r, g, b := linear(c.R), linear(c.G), linear(c.B)
+	x := r*0.4124 + g*0.3576 + b*0.1805
+	y := r*0.2126 + g*0.7152 + b*0.0722
+	z := r*0.0193 + g*0.1192 + b*0.9505
+	if sum := x + y + z; sum > 0 {
+		return [2]float64{math.Round(x/sum*10000) / 10000, math.Round(y/sum*10000) / 10000}
+	}
+	return [2]float64{0.3127, 0.3290} // white point
+}
+
+// parseHexColor parses #rrggbb.
+func parseHexColor(s string) (color.NRGBA, error) {
+	var r, g, b uint8
+	if len(s) != 7 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{r, g, b, 255}, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+)
+
+// imageVariant is a rendering of the annotated frame requested on /image.
+type imageVariant struct {
+	labels  *bool
+	format  string // png, jpeg or webp
+	width   int    // 0 keeps the size
+	quality int    // JPEG only
+}
+
+func parseImageVariant(r *http.Request) (imageVariant, error) {
+	q := r.URL.Query()
+	v := imageVariant{format: "png", quality: 80}
+
+	if s := q.Get("labels"); s != "" {
+		labels, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid labels")
+		}
+		v.labels = &labels
+	}
+	if s := q.Get("format"); s != "" {
+		switch s {
+		case "png", "jpeg", "webp":
+			v.format = s
+		case "jpg":
+			v.format = "jpeg"
+		default:
+			return v, fmt.Errorf("format must be png, jpeg or webp")
+		}
+	}
+	if s := q.Get("width"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 16 || n > 4096 {
+			return v, fmt.Errorf("width must be between 16 and 4096")
+		}
+		v.width = n
+	}
+	if s := q.Get("quality"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return v, fmt.Errorf("quality must be between 1 and 100")
+		}
+		v.quality = n
+	}
+	return v, nil
+}
+
+// original reports whether the variant is the image saved for the frame.
+func (v imageVariant) original(labels bool) bool {
+	return *v.labels == labels && v.format == "png" && v.width == 0
+}
+
+func (v imageVariant) String() string {
+	s := fmt.Sprintf("%s-%d-labels-%t", v.format, v.width, *v.labels)
+	if v.format == "jpeg" {
+		s += fmt.Sprintf("-q%d", v.quality)
+	}
+	return s
+}
+
+func (v imageVariant) contentType() string {
+	return "image/" + v.format
+}
+
+// renderImage renders a variant of the current frame. Must be called with
+// h.m held.
+func (h *Handler) renderImage(v imageVariant) ([]byte, error) {
+	var img *image.NRGBA
+	if h.Annotated != nil {
+		img = h.Annotated
+		// in the palette of the saved image, labels on top as there
+		if p := h.config.Image.Palette; p.recolors() {
+			img = p.recolor(img)
+		}
+		if *v.labels {
+			img = drawLabels(img, h.Frame, h.Snapshot.Cities, h.config.Image)
+		}
+	} else {
+		// replicas only have the encoded image, labels as it was saved
+		decoded, err := png.Decode(bytes.NewReader(h.Image))
+		if err != nil {
+			return nil, err
+		}
+		img = toNRGBA(decoded)
+	}
+
+	if v.width > 0 && v.width != img.Bounds().Dx() {
+		img = imaging.Resize(img, v.width, 0, imaging.Box)
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch v.format {
+	case "jpeg":
+		// no alpha in JPEG, dry is black like on the LEDs
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: v.quality})
+	case "webp":
+		err = nativewebp.Encode(&buf, img, nil)
+	default:
+		err = encodePNG(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// maxImageVariants bounds how many renderings of a frame are kept.
+const maxImageVariants = 16
+
+// imageVariants caches the renderings of the current frame, clients
+// polling for the same variant only get it encoded once.
+type imageVariants struct {
+	m      sync.Mutex
+	frame  time.Time
+	images map[string][]byte
+}
+
+func (c *imageVariants) get(frame time.Time, v imageVariant, render func() ([]byte, error)) ([]byte, error) {
+	key := v.String()
+	c.m.Lock()
+	if !c.frame.Equal(frame) || len(c.images) >= maxImageVariants {
+		c.frame, c.images = frame, map[string][]byte{}
+	}
+	img, ok := c.images[key]
+	c.m.Unlock()
+	if ok {
+		return img, nil
+	}
+
+	img, err := render()
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	if c.frame.Equal(frame) {
+		c.images[key] = img
+	}
+	c.m.Unlock()
+	return img, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	ledtesting "meteoradar/internal/testing"
+)
+
+func TestImageVariantPalette(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	legend := dbzColor(40)
+	bitmap := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(bitmap, bitmap.Bounds(), image.NewUniform(legend), image.Point{}, draw.Src)
+
+	tests := []struct {
+		query  string
+		decode func(io.Reader) (image.Image, error)
+		// tolerance is how far a lossy format may stray from the color
+		tolerance int
+	}{
+		{"?width=32&labels=false", png.Decode, 0},
+		{"?format=jpeg&labels=false", jpeg.Decode, 8},
+		{"?format=webp&width=48&labels=false", nativewebp.Decode, 0},
+	}
+	for _, palette := range []Palette{PaletteCHMI, PaletteViridis, PaletteMono} {
+		cfg := defaultConfig()
+		cfg.Image.Palette = palette
+		h := NewHandler("", cfg)
+		h.clock = ledtesting.NewClock(now)
+		saved := bitmap
+		if palette.recolors() {
+			saved = palette.recolor(bitmap)
+		}
+		var buf bytes.Buffer
+		if err := encodePNG(&buf, saved); err != nil {
+			t.Fatal(err)
+		}
+		h.Snapshot = &Snapshot{FrameTime: now, Frame: &Frame{Time: now, Image: bitmap}, Image: buf.Bytes(), Annotated: bitmap}
+		want := palette.Map(legend)
+
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			h.HandleImage(w, httptest.NewRequest("GET", "/image"+tt.query, nil))
+			if w.Code != 200 {
+				t.Fatalf("%s %s: %d %s", palette, tt.query, w.Code, w.Body)
+			}
+			img, err := tt.decode(w.Body)
+			if err != nil {
+				t.Fatalf("%s %s: %v", palette, tt.query, err)
+			}
+			b := img.Bounds()
+			got := color.NRGBAModel.Convert(img.At(b.Dx()/2, b.Dy()/2)).(color.NRGBA)
+			if d := max(channelDiff(got.R, want.R), channelDiff(got.G, want.G), channelDiff(got.B, want.B)); d > tt.tolerance {
+				t.Errorf("%s %s: got %v, want %v", palette, tt.query, got, want)
+			}
+		}
+	}
+}
+
+func channelDiff(a, b uint8) int {
+	return max(int(a)-int(b), int(b)-int(a))
+}
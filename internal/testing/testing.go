@@ -0,0 +1,161 @@
+// Package testing provides fake implementations of the clock, fetcher and
+// store interfaces used by the ledradar pipeline.
+package testing
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a manually driven clock. Sleep advances it instantly.
+type Clock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *Clock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// StatusError mimics a non-200 HTTP response.
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", int(e))
+}
+
+func (e StatusError) StatusCode() int {
+	return int(e)
+}
+
+// Fetcher serves canned responses by URL. Unknown URLs answer 404.
+type Fetcher struct {
+	m         sync.Mutex
+	responses map[string][]byte
+	errors    map[string]error
+	requests  []string
+}
+
+func NewFetcher() *Fetcher {
+	return &Fetcher{responses: map[string][]byte{}, errors: map[string]error{}}
+}
+
+func (f *Fetcher) Respond(url string, body []byte) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.responses[url] = body
+}
+
+func (f *Fetcher) Fail(url string, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.errors[url] = err
+}
+
+func (f *Fetcher) Fetch(url string) ([]byte, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.requests = append(f.requests, url)
+
+	if err, ok := f.errors[url]; ok {
+		return nil, err
+	}
+	if body, ok := f.responses[url]; ok {
+		return body, nil
+	}
+	return nil, StatusError(http.StatusNotFound)
+}
+
+// Requests returns all URLs fetched so far.
+func (f *Fetcher) Requests() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// Store keeps frames in memory.
+type Store struct {
+	m      sync.Mutex
+	clock  interface{ Now() time.Time }
+	frames map[time.Time][]byte
+	saved  map[time.Time]time.Time
+}
+
+func NewStore(clock interface{ Now() time.Time }) *Store {
+	return &Store{clock: clock, frames: map[time.Time][]byte{}, saved: map[time.Time]time.Time{}}
+}
+
+func (s *Store) Has(t time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.frames[t]
+	return ok
+}
+
+func (s *Store) Save(t time.Time, png []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.frames[t] = png
+	s.saved[t] = s.clock.Now()
+	return nil
+}
+
+func (s *Store) Load(t time.Time) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	png, ok := s.frames[t]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return png, nil
+}
+
+func (s *Store) Delete(t time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.frames[t]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.frames, t)
+	delete(s.saved, t)
+	return nil
+}
+
+// List returns the stored frames, oldest first.
+func (s *Store) List() ([]Frame, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var frames []Frame
+	for t, png := range s.frames {
+		frames = append(frames, Frame{Time: t, Size: int64(len(png)), Saved: s.saved[t]})
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Time.Before(frames[j].Time) })
+	return frames, nil
+}
+
+// Frame is identical to ledradar's StoredFrame.
+type Frame = struct {
+	Time  time.Time
+	Size  int64
+	Saved time.Time
+}
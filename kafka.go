@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+)
+
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+	// Format of the message values: json or avro, the Avro single-object
+	// encoding of kafkaSchema.
+	Format string `yaml:"format"`
+}
+
+// kafkaRecord is one message, keyed by city ID: the result of a city on
+// a frame, or a transition when it starts or stops raining.
+type kafkaRecord struct {
+	Type      string    `json:"type"`
+	Frame     time.Time `json:"frame"`
+	CityID    int       `json:"cityId"`
+	City      string    `json:"city"`
+	Raining   bool      `json:"raining"`
+	DBZ       float64   `json:"dbz"`
+	Intensity Intensity `json:"intensity"`
+	R         uint8     `json:"r"`
+	G         uint8     `json:"g"`
+	B         uint8     `json:"b"`
+	Simulated bool      `json:"simulated"`
+}
+
+const kafkaSchema = `{
+	"type": "record",
+	"name": "CityRain",
+	"namespace": "ledradar",
+	"fields": [
+		{"name": "type", "type": {"type": "enum", "name": "RecordType", "symbols": ["result", "transition"]}},
+		{"name": "frame", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "cityId", "type": "int"},
+		{"name": "city", "type": "string"},
+		{"name": "raining", "type": "boolean"},
+		{"name": "dbz", "type": "double"},
+		{"name": "intensity", "type": "string"},
+		{"name": "r", "type": "int"},
+		{"name": "g", "type": "int"},
+		{"name": "b", "type": "int"},
+		{"name": "simulated", "type": "boolean", "default": false}
+	]
+}`
+
+var kafkaCodec = sync.OnceValues(func() (*goavro.Codec, error) {
+	return goavro.NewCodec(kafkaSchema)
+})
+
+func newKafkaRecord(typ string, u *Update, city *City) kafkaRecord {
+	return kafkaRecord{
+		Type: typ, Frame: u.Frame, CityID: city.ID, City: city.Name,
+		Raining: city.Raining(), DBZ: city.DBZ, Intensity: city.Intensity,
+		R: city.R, G: city.G, B: city.B, Simulated: u.Simulated,
+	}
+}
+
+func (r kafkaRecord) avro() ([]byte, error) {
+	codec, err := kafkaCodec()
+	if err != nil {
+		return nil, err
+	}
+	return codec.SingleFromNative(nil, map[string]any{
+		"type":      r.Type,
+		"frame":     r.Frame,
+		"cityId":    int32(r.CityID),
+		"city":      r.City,
+		"raining":   r.Raining,
+		"dbz":       r.DBZ,
+		"intensity": r.Intensity.String(),
+		"r":         int32(r.R),
+		"g":         int32(r.G),
+		"b":         int32(r.B),
+		"simulated": r.Simulated,
+	})
+}
+
+// Kafka writes city results and transitions to a Kafka topic.
+type Kafka struct {
+	m      sync.Mutex
+	cfg    KafkaConfig
+	writer *kafka.Writer
+}
+
+// Configure replaces the writer when the settings change. No brokers
+// disables the output.
+func (k *Kafka) Configure(cfg KafkaConfig) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	if slices.Equal(cfg.Brokers, k.cfg.Brokers) && cfg.Topic == k.cfg.Topic && cfg.Format == k.cfg.Format {
+		return nil
+	}
+	if cfg.Format != "" && cfg.Format != "json" && cfg.Format != "avro" {
+		return fmt.Errorf("unknown kafka format %q", cfg.Format)
+	}
+
+	if k.writer != nil {
+		k.writer.Close()
+		k.writer = nil
+	}
+	k.cfg = cfg
+
+	if len(cfg.Brokers) == 0 {
+		return nil
+	}
+	if cfg.Topic == "" {
+		return fmt.Errorf("kafka needs a topic")
+	}
+
+	k.writer = &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+		WriteTimeout: 10 * time.Second,
+	}
+	log.Printf("Publishing events to Kafka topic %s", cfg.Topic)
+	return nil
+}
+
+func (k *Kafka) Name() string {
+	return "kafka"
+}
+
+// Send writes the result of every city on the frame and the rain
+// transitions.
+func (k *Kafka) Send(u *Update) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	if k.writer == nil {
+		return nil
+	}
+
+	records := make([]kafkaRecord, 0, len(u.Cities)+len(u.Transitions))
+	for _, t := range u.Transitions {
+		records = append(records, newKafkaRecord("transition", u, &t.City))
+	}
+	for i := range u.Cities {
+		records = append(records, newKafkaRecord("result", u, &u.Cities[i]))
+	}
+
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, r := range records {
+		var value []byte
+		var err error
+		if k.cfg.Format == "avro" {
+			value, err = r.avro()
+		} else {
+			value, err = json.Marshal(r)
+		}
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(strconv.Itoa(r.CityID)), Value: value})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return k.writer.WriteMessages(ctx, msgs...)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+type ImageConfig struct {
+	// Labels draws city names and dBZ values next to the markers.
+	Labels bool `yaml:"labels"`
+	// MarkerSize is the width of the city markers in pixels, 0 draws
+	// none; MarkerShape is square, circle or ring.
+	MarkerSize  int    `yaml:"markerSize"`
+	MarkerShape string `yaml:"markerShape"`
+	// DryColor marks dry cities, e.g. "#000000"; empty leaves them
+	// unmarked.
+	DryColor string `yaml:"dryColor"`
+	// Background is keep for the radar around the markers or black to
+	// black it out.
+	Background string `yaml:"background"`
+	// Palette colors the served images, the global palette when empty.
+	Palette Palette `yaml:"palette"`
+}
+
+var labelFace = sync.OnceValue(func() font.Face {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		log.Fatal(err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: 10, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return face
+})
+
+// drawLabels returns a copy of img with the name of every city, and its
+// reflectivity when raining, written to the right of its marker.
+func drawLabels(img *image.NRGBA, frame *Frame, cities []*City, cfg ImageConfig) *image.NRGBA {
+	out := imaging.Clone(img)
+	face := labelFace()
+
+	for _, city := range cities {
+		text := city.Name
+		if city.Raining() {
+			text = fmt.Sprintf("%s %.0f dBZ", city.Name, city.DBZ)
+		}
+		x, y := frame.Projection.Pixel(city.Lat, city.Lon)
+		dot := fixed.P(x+cfg.MarkerSize/2+3, y+4)
+
+		// dark shadow first so the text stays readable over any color
+		for _, s := range []struct {
+			c      color.Color
+			dx, dy int
+		}{{color.Black, 1, 1}, {color.White, 0, 0}} {
+			d := font.Drawer{
+				Dst:  out,
+				Src:  image.NewUniform(s.c),
+				Face: face,
+				Dot:  dot.Add(fixed.P(s.dx, s.dy)),
+			}
+			d.DrawString(text)
+		}
+	}
+	return out
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LeaderConfig elects the one instance that processes frames, the others
+// serve the results it shares through Redis.
+type LeaderConfig struct {
+	// Mode is off, redis (a key with a TTL) or kubernetes (a Lease).
+	Mode string `yaml:"mode"`
+	// Identity of this instance, the hostname by default.
+	Identity string `yaml:"identity"`
+	// TTL after which a silent leader is replaced.
+	TTL time.Duration `yaml:"ttl"`
+	// Lease and Namespace name the Kubernetes Lease, the namespace of the
+	// pod by default.
+	Lease     string `yaml:"lease"`
+	Namespace string `yaml:"namespace"`
+}
+
+func (c LeaderConfig) enabled() bool {
+	return c.Mode != "" && c.Mode != "off"
+}
+
+// elector campaigns for leadership.
+type elector interface {
+	// Acquire takes or renews the leadership for ttl.
+	Acquire(ctx context.Context, ttl time.Duration) (bool, error)
+}
+
+// Leader tracks whether this instance is the elected leader. Without an
+// election it always is.
+type Leader struct {
+	m       sync.Mutex
+	elector elector
+	leading bool
+}
+
+func (l *Leader) Leading() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.elector == nil || l.leading
+}
+
+// Elect sets up the election; changing the mode needs a restart.
+func (l *Leader) Elect(cfg LeaderConfig, r *Redis) error {
+	identity := cfg.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	var e elector
+	switch cfg.Mode {
+	case "", "off":
+		return nil
+	case "redis":
+		e = redisElector{redis: r, identity: identity}
+	case "kubernetes":
+		k, err := newKubernetesElector(cfg, identity)
+		if err != nil {
+			return err
+		}
+		e = k
+	default:
+		return fmt.Errorf("unknown leader mode %q", cfg.Mode)
+	}
+
+	l.m.Lock()
+	l.elector = e
+	l.m.Unlock()
+	go l.run(e, identity, cfg.TTL)
+	return nil
+}
+
+// run renews the leadership three times per TTL.
+func (l *Leader) run(e elector, identity string, ttl time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+		leading, err := e.Acquire(ctx, ttl)
+		cancel()
+		if err != nil {
+			log.Printf("Leader election: %s", err)
+			leading = false
+		}
+
+		l.m.Lock()
+		if leading != l.leading {
+			if leading {
+				log.Printf("%s is now the leader, processing frames", identity)
+			} else {
+				log.Printf("%s is no longer the leader, following", identity)
+			}
+		}
+		l.leading = leading
+		l.m.Unlock()
+
+		time.Sleep(ttl / 3)
+	}
+}
+
+// acquireLeader sets the key to the identity unless another instance
+// holds it and extends the TTL of our own.
+var acquireLeader = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+
+type redisElector struct {
+	redis    *Redis
+	identity string
+}
+
+func (e redisElector) Acquire(ctx context.Context, ttl time.Duration) (bool, error) {
+	client, prefix := e.redis.get()
+	if client == nil {
+		return false, fmt.Errorf("redis leader election needs a Redis url")
+	}
+	n, err := acquireLeader.Run(ctx, client, []string{prefix + ":leader"}, e.identity, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// kubernetesElector holds a coordination.k8s.io Lease through the API
+// server, with the credentials of the pod.
+type kubernetesElector struct {
+	url      string
+	token    string
+	identity string
+	client   *http.Client
+}
+
+func newKubernetesElector(cfg LeaderConfig, identity string) (*kubernetesElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return nil, fmt.Errorf("kubernetes leader election only works inside a cluster")
+	}
+	token, err := os.ReadFile(serviceAccount + "token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccount + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccount + "namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	lease := cfg.Lease
+	if lease == "" {
+		lease = "ledradar"
+	}
+
+	return &kubernetesElector{
+		url:      fmt.Sprintf("https://%s:%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", host, port, namespace, lease),
+		token:    strings.TrimSpace(string(token)),
+		identity: identity,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// k8sLease is the part of a Lease object the election uses.
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+const k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (e *kubernetesElector) do(ctx context.Context, method, url string, body any, out any) (int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 && out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
+
+func (e *kubernetesElector) Acquire(ctx context.Context, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	var lease k8sLease
+	status, err := e.do(ctx, http.MethodGet, e.url, nil, &lease)
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		renewed, _ := time.Parse(k8sMicroTime, lease.Spec.RenewTime)
+		expired := now.After(renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second))
+		if lease.Spec.HolderIdentity != e.identity && !expired {
+			return false, nil
+		}
+		if lease.Spec.HolderIdentity != e.identity {
+			lease.Spec.HolderIdentity = e.identity
+			lease.Spec.AcquireTime = now.Format(k8sMicroTime)
+			lease.Spec.LeaseTransitions++
+		}
+	case http.StatusNotFound:
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name = e.url[strings.LastIndex(e.url, "/")+1:]
+		lease.Spec.HolderIdentity = e.identity
+		lease.Spec.AcquireTime = now.Format(k8sMicroTime)
+	default:
+		return false, fmt.Errorf("lease %s: HTTP %d", e.url, status)
+	}
+	lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+	lease.Spec.RenewTime = now.Format(k8sMicroTime)
+
+	method, url := http.MethodPut, e.url
+	if status == http.StatusNotFound {
+		method, url = http.MethodPost, e.url[:strings.LastIndex(e.url, "/")]
+	}
+	status, err = e.do(ctx, method, url, lease, nil)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case status < 300:
+		return true, nil
+	case status == http.StatusConflict:
+		// another instance updated the lease first
+		return false, nil
+	}
+	return false, fmt.Errorf("lease %s: HTTP %d", e.url, status)
+}
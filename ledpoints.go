@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image/color"
+	"os"
+
+	"github.com/spf13/cast"
+)
+
+// ledPoint is an LED bound to a coordinate of its own instead of a city,
+// sampled on every frame.
+type ledPoint struct {
+	index    int
+	lat, lon float64
+	state    RainState
+}
+
+// loadLEDPoints reads index;lat;lon lines.
+func loadLEDPoints(path string) ([]*ledPoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comma = ';'
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var points []*ledPoint
+	seen := map[int]bool{}
+	for i, record := range records {
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected index;lat;lon", path, i+1)
+		}
+		p := &ledPoint{
+			index: cast.ToInt(record[0]),
+			lat:   cast.ToFloat64(record[1]),
+			lon:   cast.ToFloat64(record[2]),
+		}
+		if p.index < 0 || seen[p.index] {
+			return nil, fmt.Errorf("%s:%d: invalid or duplicate LED index %d", path, i+1, p.index)
+		}
+		seen[p.index] = true
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// carryLEDPoints copies the state of old points to new points with the
+// same index, so LEDs keep fading after a reload.
+func carryLEDPoints(points, old []*ledPoint) {
+	byIndex := map[int]*ledPoint{}
+	for _, p := range old {
+		byIndex[p.index] = p
+	}
+	for _, p := range points {
+		if prev, ok := byIndex[p.index]; ok {
+			p.state = prev.state
+		}
+	}
+}
+
+// sampleLEDPoints samples the frame at every LED point like a city, less
+// the nearest rain. Must be called with h.m held.
+func (h *Handler) sampleLEDPoints(frame *Frame, field *Field) {
+	now := h.clock.Now()
+	for _, p := range h.ledPoints {
+		x, y := frame.Projection.Pixel(p.lat, p.lon)
+		r, g, b := getAvgColor(frame.Image, x, y)
+		if h.config.Sampling.Mode == "max" {
+			r, g, b = getMaxColor(frame.Image, field, x, y)
+		}
+
+		smoothed := p.state.Smoothed
+		p.state = RainState{}
+		if r|g|b != 0 {
+			dbz := colorDBZ(r, g, b)
+			p.state = RainState{R: r, G: g, B: b, DBZ: dbz, Intensity: intensityOf(dbz)}
+		}
+		p.state.Smoothed = smoothed.next(&p.state, h.config.Smoothing.Alpha)
+		if h.lightning.Enabled() {
+			p.state.Strikes10Min = h.lightning.Count(p.lat, p.lon, now)
+		}
+		p.state.Alert = alertLevel(&p.state)
+	}
+}
+
+// followCities gives every LED point the state of its nearest city, for
+// updates without a radar frame such as the fallback. Must be called with
+// h.m held.
+func (h *Handler) followCities() {
+	idx := h.indexes.get("", h.Cities)
+	for _, p := range h.ledPoints {
+		if nearest, _ := idx.nearest(p.lat, p.lon); nearest != nil {
+			p.state = nearest.RainState
+		}
+	}
+}
+
+// pointColors returns the color of every LED from the points, like
+// ledColors for cities.
+func pointColors(points []*ledPoint, cfg LEDConfig) []color.NRGBA {
+	count := cfg.Count
+	if count == 0 {
+		for _, p := range points {
+			count = max(count, p.index+1)
+		}
+	}
+
+	leds := make([]color.NRGBA, count)
+	for _, p := range points {
+		if p.index < count {
+			s := p.state.Smoothed
+			leds[p.index] = color.NRGBA{s.R, s.G, s.B, 255}
+		}
+	}
+	return leds
+}
+
+func pointReflectivity(points []*ledPoint, count int) []float64 {
+	dbz := make([]float64, count)
+	for _, p := range points {
+		if p.index < count {
+			dbz[p.index] = p.state.Smoothed.DBZ
+		}
+	}
+	return dbz
+}
+
+func pointBehaviors(points []*ledPoint, count int, cfg LEDConfig) []LEDBehavior {
+	behaviors := make([]LEDBehavior, count)
+	for i := range behaviors {
+		behaviors[i] = BehaviorSolid
+	}
+	for _, p := range points {
+		if p.index < count {
+			behaviors[p.index] = cfg.behavior(p.state.Alert)
+		}
+	}
+	return behaviors
+}
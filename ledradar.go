@@ -2,237 +2,799 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
-	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/gorilla/mux"
-	"github.com/spf13/cast"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// -----------------------------------------------------------------------------
-// Pracujeme v souřadnicovém systému WGS-84
-// Abychom dokázali přepočítat stupně zeměpisné šířky a délky na pixely,
-// musíme znát souřadnice levého horního a pravého dolního okraje radarového snímku ČHMÚ
-
-const (
-	lon0 = 11.2673442
-	lat0 = 52.1670717
-	lon1 = 20.7703153
-	lat1 = 48.1
-)
-
-type City struct {
-	ID   int
-	Name string
-	Lat  float64
-	Lon  float64
-	R    uint8
-	G    uint8
-	B    uint8
-}
-
 type Handler struct {
 	m              sync.RWMutex
+	configPath     string
+	config         *Config
 	Cities         []*City
 	CitiesWithRain []*City
+	// Snapshot is the published frame, DataSource in it names where the
+	// city state comes from, the radar source or the fallback.
+	*Snapshot
+	images     imageVariants
+	Sets       map[string]*CitySet
+	radarOK    time.Time
+	fallbackAt time.Time
+	breaker    Breaker
+	adaptive   Adaptive
+	publisher  Publisher
+	kafka      Kafka
+	redis      Redis
+	mqtt       MQTT
+	dispatcher Dispatcher
+	// simulation overrides the radar data until it expires
+	simulation *simulation
+	// backfilling keeps frames of the startup backfill from the outputs
+	backfilling bool
+	nextPoll    time.Time
+	leader      Leader
+	rules       Rules
+	pixoo       Pixoo
+	ddp         DDP
+	hue         Hue
+	bulbs       Bulbs
+	eventLog    EventLog
+	indexes     cityIndexes
+	statsd      StatsD
+	geocoder    Geocoder
+	ledPoints   []*ledPoint
+	retention   Retention
+	tracker     Tracker
+	lightning   Lightning
+	buffers     frameBuffers
+	stamps      frameStamps
+	wind        Wind
+	tenants     Tenants
+	plugins     Plugins
+	// process serializes the pipeline between the loop and
+	// POST /admin/refresh
+	process sync.Mutex
+	// pollSeq counts city updates, pollWake is closed on the next one
+	pollSeq  uint64
+	pollWake chan struct{}
+	// downloads is the fetcher unless replaced for tests
+	downloads cachingFetcher
+	reports   frameReports
+	// remoteCities keeps the main city list when it is given as a URL
+	remoteCities remoteCities
+	// snapshots counts the published snapshots
+	snapshots uint64
+	// dryRun logs what the outputs would get instead of sending it
+	dryRun bool
+
+	clock   Clock
+	fetcher Fetcher
+	store   Store
+	// uploads keeps the posted frames apart from those of the source
+	uploads Store
 }
 
-func downloadRadar(dateTxt string) []byte {
-	url := fmt.Sprintf("https://www.chmi.cz/files/portal/docs/meteo/rad/inca-cz/data/czrad-z_max3d/pacz2gmaps3.z_max3d.%s.0.png", dateTxt)
-	log.Printf("Downloading file: %s", url)
-	resp, err := http.Get(url)
-
-	if err != nil {
-	        log.Printf("HTTP %s: Cannot download file", err)
-		return nil
-	}
-
-	if  resp.StatusCode != 200 {
-		log.Printf("HTTP %d: Cannot download file", resp.StatusCode)
-		return nil
+func NewHandler(configPath string, cfg *Config) *Handler {
+	clock := systemClock{}
+	h := &Handler{
+		configPath: configPath,
+		config:     cfg,
+		Snapshot:   &Snapshot{},
+		radarOK:    clock.Now(),
+		clock:      clock,
+		store:      dirStore{dir: "."},
+		uploads:    dirStore{dir: ".", prefix: "radar_upload_"},
+		// polls and streams before the first frame wait on it too
+		pollWake: make(chan struct{}),
 	}
-
-	log.Printf("Succesfully downloaded")
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	return body
+	h.fetcher = &h.downloads
+	return h
 }
 
 func rgbText(r, g, b uint8, text string) string {
 	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm%s\x1b[0m", r, g, b, text)
 }
 
+// getAvgColor averages the 9x9 window around x, y, pixels outside the
+// image counting as black.
 func getAvgColor(bitmap *image.NRGBA, x, y int) (uint8, uint8, uint8) {
-	var totalR, totalG, totalB, total uint32
+	var totalR, totalG, totalB uint32
+	const total = 81
+
+	window := image.Rect(x-4, y-4, x+5, y+5).Intersect(bitmap.Rect)
+	for yy := window.Min.Y; yy < window.Max.Y; yy++ {
+		i := bitmap.PixOffset(window.Min.X, yy)
+		for xx := window.Min.X; xx < window.Max.X; xx, i = xx+1, i+4 {
+			totalR += uint32(bitmap.Pix[i])
+			totalG += uint32(bitmap.Pix[i+1])
+			totalB += uint32(bitmap.Pix[i+2])
+		}
+	}
+
+	return uint8(totalR / total), uint8(totalG / total), uint8(totalB / total)
+}
+
+// getMaxColor returns the color of the strongest echo in the same window
+// getAvgColor averages over, so small intense cells are not diluted.
+func getMaxColor(bitmap *image.NRGBA, field *Field, x, y int) (uint8, uint8, uint8) {
+	bx, by, ok := maxPixel(field, x, y)
+	if !ok {
+		return 0, 0, 0
+	}
+	c := bitmap.NRGBAAt(bx, by)
+	return c.R, c.G, c.B
+}
+
+// maxPixel finds the strongest echo in the window around x, y.
+func maxPixel(field *Field, x, y int) (int, int, bool) {
+	best := float32(math.Inf(-1))
+	bx, by := -1, -1
 
 	for xx := -4; xx <= 4; xx++ {
 		for yy := -4; yy <= 4; yy++ {
-			r, g, b, _ := bitmap.At(x+xx, y+yy).RGBA()
-			totalR += r / 257
-			totalG += g / 257
-			totalB += b / 257
-			total++
+			if dbz := field.At(x+xx, y+yy); dbz > best {
+				best, bx, by = dbz, x+xx, y+yy
+			}
 		}
 	}
+	return bx, by, bx >= 0
+}
 
-	return uint8(totalR / total), uint8(totalG / total), uint8(totalB / total)
+// largestArea counts the pixels of the largest 4-connected area with echo
+// in the window around x, y.
+func largestArea(field *Field, x, y int) int {
+	var seen [9][9]bool
+	largest := 0
+	for sy := 0; sy < 9; sy++ {
+		for sx := 0; sx < 9; sx++ {
+			if seen[sy][sx] || math.IsNaN(float64(field.At(x+sx-4, y+sy-4))) {
+				continue
+			}
+			area := 0
+			stack := [][2]int{{sx, sy}}
+			seen[sy][sx] = true
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				area++
+				for _, n := range [4][2]int{{p[0] - 1, p[1]}, {p[0] + 1, p[1]}, {p[0], p[1] - 1}, {p[0], p[1] + 1}} {
+					if n[0] < 0 || n[1] < 0 || n[0] >= 9 || n[1] >= 9 || seen[n[1]][n[0]] {
+						continue
+					}
+					if !math.IsNaN(float64(field.At(x+n[0]-4, y+n[1]-4))) {
+						seen[n[1]][n[0]] = true
+						stack = append(stack, n)
+					}
+				}
+			}
+			largest = max(largest, area)
+		}
+	}
+	return largest
 }
 
 func (h *Handler) LoadCities() {
-	file, err := os.Open("mesta.csv")
+	cities, err := h.loadCityList(h.config.CitiesFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
+	h.Cities = cities
+	h.republish()
+	checkCoverage(h.config.CitiesFile, cities, h.config)
 
-	reader := csv.NewReader(file)
-	reader.Comma = ';'
-	records, err := reader.ReadAll()
+	h.Sets, err = loadCitySets(h.config.Sets)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for name, set := range h.Sets {
+		checkCoverage("set "+name, set.Cities, h.config)
+	}
+	if err := checkSetChannels(h.config.Notify, cities, h.Sets); err != nil {
+		log.Fatal(err)
+	}
+
+	if h.config.LEDs.Points != "" {
+		if h.ledPoints, err = loadLEDPoints(h.config.LEDs.Points); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Reload re-reads the config file and the city lists and swaps them in.
+// The last detected rain state is carried over to cities with the same ID,
+// so clients keep seeing data until the next frame is processed.
+func (h *Handler) Reload() error {
+	cfg, err := LoadConfig(h.configPath)
+	if err != nil {
+		return err
+	}
+	// the admin listener stays as it was started until a restart
+	admin := cfg.Admin
+	admin.Listen = h.Config().Admin.Listen
+	if err := admin.requireToken(); err != nil {
+		return err
+	}
+
+	cities, err := h.loadCityList(cfg.CitiesFile)
+	if err != nil {
+		return err
+	}
 
-	for _, record := range records {
-		city := &City{
-			ID:   cast.ToInt(record[0]),
-			Name: record[1],
-			Lat:  cast.ToFloat64(record[2]),
-			Lon:  cast.ToFloat64(record[3]),
+	sets, err := loadCitySets(cfg.Sets)
+	if err != nil {
+		return err
+	}
+	checkCoverage(cfg.CitiesFile, cities, cfg)
+	for name, set := range sets {
+		checkCoverage("set "+name, set.Cities, cfg)
+	}
+	if err := checkSetChannels(cfg.Notify, cities, sets); err != nil {
+		return err
+	}
+
+	var points []*ledPoint
+	if cfg.LEDs.Points != "" {
+		if points, err = loadLEDPoints(cfg.LEDs.Points); err != nil {
+			return err
 		}
+	}
 
-		h.Cities = append(h.Cities, city)
+	if err := h.rules.Configure(cfg.Notify); err != nil {
+		return err
 	}
+	closePlugins, err := h.plugins.Configure(cfg.Plugins)
+	if err != nil {
+		return err
+	}
+
+	if err := h.publisher.Configure(cfg.NATS); err != nil {
+		log.Printf("NATS: %s", err)
+	}
+
+	if err := h.kafka.Configure(cfg.Kafka); err != nil {
+		log.Printf("Kafka: %s", err)
+	}
+
+	if cfg.Leader != h.Config().Leader {
+		log.Println("Leader election changed, restart required to apply it")
+		cfg.Leader = h.Config().Leader
+	}
+	if !reflect.DeepEqual(cfg.Tracing, h.Config().Tracing) {
+		log.Println("Tracing changed, restart required to apply it")
+		cfg.Tracing = h.Config().Tracing
+	}
+	if cfg.Redis.Replica != h.Config().Redis.Replica {
+		log.Println("Redis replica mode changed, restart required to apply it")
+		cfg.Redis.Replica = h.Config().Redis.Replica
+	}
+	if err := h.redis.Configure(cfg.Redis); err != nil {
+		log.Printf("Redis: %s", err)
+	}
+
+	// a dry run does not connect, a second client of the same ID would
+	// disconnect the instance in production
+	if !h.dryRun {
+		if err := h.mqtt.Configure(cfg.Outputs.MQTT); err != nil {
+			log.Printf("MQTT: %s", err)
+		}
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if !slices.Equal(cfg.Listen, h.config.Listen) {
+		log.Printf("Listen addresses changed to %s, restart required to apply them", strings.Join(cfg.Listen, ", "))
+	}
+	if cfg.Admin.Listen != h.config.Admin.Listen || cfg.Admin.Pprof != h.config.Admin.Pprof {
+		log.Println("Admin listener changed, restart required to apply it")
+		cfg.Admin.Listen, cfg.Admin.Pprof = h.config.Admin.Listen, h.config.Admin.Pprof
+	}
+
+	h.config = cfg
+	h.downloads.Configure(cfg.Download)
+	h.pixoo.Configure(cfg.Outputs.Pixoo)
+	h.ddp.Configure(cfg.Outputs.DDP, cfg.LEDs.Fade)
+	h.hue.Configure(cfg.Outputs.Hue)
+	h.bulbs.Configure(cfg.Outputs.Bulbs)
+	h.statsd.Configure(cfg.Outputs.StatsD)
+	h.retention.Configure(cfg.Retention)
+	if err := h.eventLog.Configure(cfg.EventLog, h.clock.Now()); err != nil {
+		log.Printf("Event log: %s", err)
+	}
+	h.lightning.Configure(cfg.Lightning)
+	h.wind.Configure(cfg.Wind)
+	h.geocoder.Configure(cfg.Geocode)
+	h.breaker.Configure(cfg.Breaker.Failures, cfg.Breaker.Cooldown)
+	h.adaptive.Configure(cfg.Adaptive)
+	h.CitiesWithRain = carryRainState(cities, h.Cities)
+	h.Cities = cities
+	h.republish()
+	for name, set := range sets {
+		if old, ok := h.Sets[name]; ok {
+			set.CitiesWithRain = carryRainState(set.Cities, old.Cities)
+		}
+	}
+	h.Sets = sets
+	carryLEDPoints(points, h.ledPoints)
+	h.ledPoints = points
+	h.dispatcher.Configure(h.outputs(cfg), cfg.Outputs.Retry)
+	closePlugins()
+
+	log.Printf("Configuration reloaded, %d cities, %d extra sets", len(cities), len(sets))
+	return nil
 }
 
-func (h *Handler) BackgroundLoop() {
-	for {
-		log.Println("Starting background loop")
-		func() {
-			// delete old radar_a_mesta_*.png files
-			files, err := os.ReadDir(".")
-			if err != nil {
-				log.Println(err)
-			}
-			for _, file := range files {
-				if !strings.HasPrefix(file.Name(), "radar_a_mesta_") {
-					continue
-				}
+func (h *Handler) Config() *Config {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	return h.config
+}
 
-				// if file is older than 1 hour, delete it
-				fileInfo, err := file.Info()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+// ProcessFrame runs one pass of the pipeline: prune old frames, fetch the
+// current one unless it is already stored and evaluate all cities.
+func (h *Handler) ProcessFrame() {
+	h.process.Lock()
+	defer h.process.Unlock()
+	if h.simulating() {
+		log.Println("Simulation running, skipping")
+		return
+	}
+	if err := h.retention.Apply(h.clock.Now(), h.store, h.uploads); err != nil {
+		log.Println(err)
+	}
 
-				if time.Since(fileInfo.ModTime()) < time.Hour {
-					continue
-				}
+	source, _ := h.pollSource(h.Config(), h.fetcher)
+	frameTime := source.FrameTime(h.clock.Now())
 
-				log.Printf("Deleting old file %s", file.Name())
+	if h.store.Has(frameTime) {
+		log.Println("Already exists")
+		return
+	}
 
-				err = os.Remove(file.Name())
-				if err != nil {
-					log.Println(err)
-				}
-			}
+	report := h.reports.begin(source.Name(), frameTime, h.clock.Now())
+	var failure error
+	defer func() { report.finish(h.clock.Now(), failure) }()
+
+	if !h.breaker.Allow() {
+		log.Printf("Circuit breaker for %s is open, skipping", source.Name())
+		failure = fmt.Errorf("circuit breaker for %s is open", source.Name())
+		h.fallback()
+		return
+	}
 
-			date := time.Now().UTC()
+	ctx, span := tracer.Start(context.Background(), "frame", frameAttributes(source.Name(), frameTime))
+	defer span.End()
+	started := h.clock.Now()
+	defer func() { h.statsd.Timing("frame", h.clock.Now().Sub(started)) }()
+
+	frame, err := h.fetch(ctx, source, frameTime)
+	// only transport errors and 5xx count against the source; a missing
+	// frame just means it has not been published yet
+	var status interface{ StatusCode() int }
+	if err != nil && (!errors.As(err, &status) || status.StatusCode() >= 500) {
+		h.breaker.Failure()
+	} else {
+		h.breaker.Success()
+	}
+	if errors.Is(err, errInvalidFrame) {
+		h.m.RLock()
+		last := h.FrameTime
+		h.m.RUnlock()
+		log.Printf("Rejecting frame %s: %s, keeping the frame of %s", frameTime.Format(frameTimeFormat), err, last.Format(frameTimeFormat))
+		failure = err
+		endSpan(span, err)
+		h.fallback()
+		return
+	}
+	if err != nil {
+		log.Printf("Cannot get radar data: %s, skipping", err)
+		failure = err
+		endSpan(span, err)
+		h.fallback()
+		return
+	}
 
-			format := "20060102.1504"
-			formattedDate := date.Format(format)
-			dateTxt := formattedDate[:len(format)-1] + "0"
+	h.addEchoTop(ctx, frame)
+	h.wind.Refresh(h.fetcher, frame, h.clock.Now())
+	img := h.Apply(ctx, source.Name(), frame)
+	_, save := tracer.Start(ctx, "save")
+	saved := h.clock.Now()
+	err = h.store.Save(frameTime, img)
+	h.since("save", saved)
+	endSpan(save, err)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-			p := fmt.Sprintf("radar_a_mesta_%s.png", dateTxt)
-			if _, err := os.Stat(p); err == nil {
-				log.Println("Already exists")
-				return
-			}
+// Apply evaluates all cities on a fetched frame, hands the result to the
+// outputs and returns the annotated image as PNG.
+func (h *Handler) Apply(ctx context.Context, sourceName string, frame *Frame) []byte {
+	ctx, span := tracer.Start(ctx, "detect", frameAttributes(sourceName, frame.Time))
+	defer span.End()
+	defer h.since("detect", h.clock.Now())
 
-			content := downloadRadar(dateTxt)
-			if content == nil {
-				log.Println("Cannot download radar data, skipping")
-				return
+	maskPixels(frame.Image, h.Config().Mask)
+	if crop := h.Config().Crop; !crop.IsZero() {
+		frame = frame.Crop(crop)
+	}
+	frameTime := frame.Time
+	h.buffers.Lock()
+	defer h.buffers.Unlock()
+	bitmap := h.buffers.bitmap(frame.Image)
+	field := h.buffers.decodeField(frame.Image)
+	cells := h.tracker.Track(frame, field, h.Config().Cells)
+	area := h.buffers.statsArea(frame, h.Config())
+	stats := rainStats(frame, field, area)
+	var tops *Field
+	if frame.EchoTop != nil {
+		tops = newField(frame.EchoTop.Image)
+	}
+
+	cfg := h.Config()
+	filters := h.filterCities(frameTime, func(city *City) bool {
+		return evaluateCity(city, frame, field, cfg)
+	})
+
+	h.m.Lock()
+	h.radarOK = h.clock.Now()
+
+	transitions := h.updateCities(frameTime, filters, func(city *City) bool {
+		raining := evaluateCity(city, frame, field, h.config)
+		if !city.Coverage {
+			return false
+		}
+		if eta, ok := h.wind.Arrival(field, frame.Projection, city.Lat, city.Lon); ok && !raining {
+			minutes := int(eta.Minutes())
+			city.AdvectionMinutes = &minutes
+		}
+		if raining {
+			city.EndsInMinutes = rainEnd(city, cells, func() (time.Duration, bool) {
+				return h.wind.End(field, frame.Projection, city.Lat, city.Lon)
+			})
+		}
+		if h.config.Hail.Enabled {
+			x, y := city.samplePixel(frame.Projection)
+			city.Hail = hailLikely(field, tops, x, y, h.config.Hail)
+		}
+		return raining
+	})
+	regions, names := h.buffers.regionPixels(frame, area, h.Cities)
+	stats.Regions = regionHistograms(field, regions, names)
+	h.sampleLEDPoints(frame, field)
+	h.adaptive.observe(h.Cities, stats)
+	h.reports.current().evaluated(len(h.Cities), len(h.CitiesWithRain))
+
+	drawMarkers(bitmap, frame, h.Cities, h.config.Image)
+
+	span.SetAttributes(
+		attribute.Int("radar.cities", len(h.Cities)),
+		attribute.Int("radar.raining", len(h.CitiesWithRain)),
+		attribute.Int("radar.cells", len(cells)),
+	)
+	imageCfg := h.config.Image
+	labelled, _ := snapshotCities(h.Cities, nil)
+	h.m.Unlock()
+
+	// readers keep the last snapshot while the image is encoded
+	img := bitmap
+	if p := imageCfg.Palette; p.recolors() {
+		img = p.recolor(bitmap)
+	}
+	if imageCfg.Labels {
+		img = drawLabels(img, frame, labelled, imageCfg)
+	}
+	_, encode := tracer.Start(ctx, "encode")
+	var buf bytes.Buffer
+	if err := encodePNG(&buf, img); err != nil {
+		log.Fatal(err)
+	}
+	encode.End()
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.publish(Snapshot{
+		FrameTime:  frameTime,
+		Frame:      frame,
+		Image:      buf.Bytes(),
+		Annotated:  bitmap,
+		Cells:      cells,
+		Stats:      stats,
+		DataSource: sourceName,
+	})
+	h.reports.current().published(h.Snapshot.ID)
+	if !h.backfilling {
+		h.dispatch(ctx, frameTime, frame, transitions)
+	}
+	return h.Image
+}
+
+// updateCities re-evaluates every city with eval, which reports whether
+// it is raining, applies what the plugins changed of them in filters and
+// returns the rain transitions of the main city list. Must be called with
+// h.m held.
+func (h *Handler) updateCities(frameTime time.Time, filters cityFilters, eval func(*City) bool) []TransitionEvent {
+	wasRaining := map[int]bool{}
+	for _, city := range h.CitiesWithRain {
+		wasRaining[city.ID] = true
+	}
+	h.CitiesWithRain = []*City{}
+	var transitions []TransitionEvent
+	h.pollSeq++
+
+	now := h.clock.Now()
+	update := func(city *City) cityResult {
+		before := city.RainState
+		raining := filters.apply(city, eval(city))
+		if h.lightning.Enabled() {
+			city.Strikes10Min = h.lightning.Count(city.Lat, city.Lon, now)
+		}
+		city.rain.add(&city.RainState, frameTime, raining)
+		city.trend.add(&city.RainState, frameTime, h.config.Trend)
+		city.Alert = alertLevel(&city.RainState)
+		changed := city.R != before.R || city.G != before.G || city.B != before.B || city.Intensity != before.Intensity
+		return cityResult{raining, changed}
+	}
+
+	results := evalCities(h.Cities, h.config.Sampling.Workers, update)
+	for i, city := range h.Cities {
+		raining := results[i].raining
+		if results[i].changed {
+			city.changed = h.pollSeq
+		}
+		if raining {
+			r, g, b := city.R, city.G, city.B
+			log.Printf("💦  It's raining in %s (%d) %s  R=%d G=%d B=%d", city.Name, city.ID, rgbText(r, g, b, "■"), r, g, b)
+			h.CitiesWithRain = append(h.CitiesWithRain, city)
+			if !wasRaining[city.ID] {
+				transitions = append(transitions, TransitionEvent{Frame: frameTime, City: *city, Raining: true})
 			}
+		} else if wasRaining[city.ID] {
+			transitions = append(transitions, TransitionEvent{Frame: frameTime, City: *city, Raining: false})
+		}
+	}
 
-			img, err := imaging.Decode(bytes.NewReader(content))
-			if err != nil {
-				log.Fatal(err)
+	for _, set := range h.Sets {
+		set.CitiesWithRain = []*City{}
+		results := evalCities(set.Cities, h.config.Sampling.Workers, update)
+		for i, city := range set.Cities {
+			if results[i].changed {
+				city.changed = h.pollSeq
 			}
-			bitmap := imaging.Clone(img)
-
-			lonPixelSize := (lon1 - lon0) / float64(bitmap.Bounds().Dx())
-			latPixelSize := (lat0 - lat1) / float64(bitmap.Bounds().Dy())
-
-			h.m.Lock()
-			defer h.m.Unlock()
-			h.CitiesWithRain = []*City{}
-
-			for _, city := range h.Cities {
-				x := int((city.Lon - lon0) / lonPixelSize)
-				y := int((lat0 - city.Lat) / latPixelSize)
-				r, g, b := getAvgColor(bitmap, x, y)
-
-				if r+g+b > 0 {
-					draw.Draw(bitmap, image.Rect(x-5, y-5, x+5, y+5), &image.Uniform{color.RGBA{r, g, b, 255}}, image.Point{}, draw.Src)
-					log.Printf("💦  It's raining in %s (%d) %s  R=%d G=%d B=%d", city.Name, city.ID, rgbText(r, g, b, "■"), r, g, b)
-					city.R = r
-					city.G = g
-					city.B = b
-					h.CitiesWithRain = append(h.CitiesWithRain, city)
-				} else {
-					draw.Draw(bitmap, image.Rect(x-5, y-5, x+5, y+5), &image.Uniform{color.RGBA{0, 0, 0, 255}}, image.Point{}, draw.Src)
-				}
+			if results[i].raining {
+				set.CitiesWithRain = append(set.CitiesWithRain, city)
 			}
+		}
+	}
 
-			if len(h.CitiesWithRain) == 0 {
-				log.Println("It looks like it's not raining!")
-			}
+	markRainNearby(h.Cities, h.indexes.get("", h.Cities), h.config.Neighbors)
+	for name, set := range h.Sets {
+		markRainNearby(set.Cities, h.indexes.get(name, set.Cities), h.config.Neighbors)
+	}
 
-			file, err := os.Create(fmt.Sprintf("radar_a_mesta_%s.png", dateTxt))
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
+	if len(h.CitiesWithRain) == 0 {
+		log.Println("It looks like it's not raining!")
+	}
+	return transitions
+}
 
-			err = imaging.Encode(file, bitmap, imaging.PNG)
-			if err != nil {
-				log.Fatal(err)
+type cityResult struct {
+	raining, changed bool
+}
+
+// parallelCities is the list size from which evalCities spreads the
+// work, shorter lists are done before goroutines would start.
+const parallelCities = 256
+
+// evalCities runs update over the cities on up to workers goroutines, 0
+// for one per CPU. Evaluating a city only changes that city.
+func evalCities(cities []*City, workers int, update func(*City) cityResult) []cityResult {
+	results := make([]cityResult, len(cities))
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers == 1 || len(cities) < parallelCities {
+		for i, city := range cities {
+			results[i] = update(city)
+		}
+		return results
+	}
+
+	var wg sync.WaitGroup
+	chunk := (len(cities) + workers - 1) / workers
+	for start := 0; start < len(cities); start += chunk {
+		end := min(start+chunk, len(cities))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				results[i] = update(cities[i])
 			}
 		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// dispatch hands the new city state to the outputs, radar is nil for
+// data from the fallback. The outputs trace their delivery as children of
+// the span in ctx. Must be called with h.m held.
+func (h *Handler) dispatch(ctx context.Context, frameTime time.Time, radar *Frame, transitions []TransitionEvent) {
+	h.send(ctx, h.update(frameTime, radar, transitions))
+}
 
-		time.Sleep(60 * time.Second)
+// send hands u to the outputs. Must be called with h.m held.
+func (h *Handler) send(ctx context.Context, u *Update) {
+	u.span = trace.SpanContextFromContext(ctx)
+	u.report = h.reports.current()
+	h.dispatcher.Dispatch(u)
+}
+
+func (h *Handler) HandleReload(w http.ResponseWriter, r *http.Request) {
+	if err := h.Reload(); err != nil {
+		log.Printf("Reload failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *Handler) HandleGet(w http.ResponseWriter, r *http.Request) {
-	h.m.RLock()
-	defer h.m.RUnlock()
-	json.NewEncoder(w).Encode(h.CitiesWithRain)
+func (h *Handler) WatchSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Println("SIGHUP received, reloading configuration")
+		if err := h.Reload(); err != nil {
+			log.Printf("Reload failed: %s", err)
+		}
+	}
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
+// serve runs the radar loop and the HTTP API.
+func serve(args []string) error {
+	fs, configPath := commandFlags("serve", "")
+	dryRun := fs.Bool("dry-run", false, "log what the outputs would send, the LEDs, MQTT, webhooks and the rest, instead of sending it")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Admin.requireToken(); err != nil {
+		return err
+	}
 
-	handler := &Handler{}
+	if cfg.Tracing.enabled() {
+		shutdown, err := setupTracing(cfg.Tracing)
+		if err != nil {
+			return err
+		}
+		defer shutdown(context.Background())
+	}
+
+	handler := NewHandler(*configPath, cfg)
+	handler.dryRun = *dryRun
+	if *dryRun {
+		log.Println("Dry run, the outputs only log what they would send")
+	}
+	handler.breaker.Configure(cfg.Breaker.Failures, cfg.Breaker.Cooldown)
+	handler.adaptive.Configure(cfg.Adaptive)
+	if err := handler.publisher.Configure(cfg.NATS); err != nil {
+		log.Printf("NATS: %s", err)
+	}
+	if err := handler.kafka.Configure(cfg.Kafka); err != nil {
+		log.Printf("Kafka: %s", err)
+	}
+	if err := handler.redis.Configure(cfg.Redis); err != nil {
+		return err
+	}
+	if err := handler.leader.Elect(cfg.Leader, &handler.redis); err != nil {
+		return err
+	}
+	if err := handler.rules.Configure(cfg.Notify); err != nil {
+		return err
+	}
+	if _, err := handler.plugins.Configure(cfg.Plugins); err != nil {
+		return err
+	}
+	handler.downloads.Configure(cfg.Download)
+	handler.pixoo.Configure(cfg.Outputs.Pixoo)
+	handler.ddp.Configure(cfg.Outputs.DDP, cfg.LEDs.Fade)
+	handler.hue.Configure(cfg.Outputs.Hue)
+	handler.bulbs.Configure(cfg.Outputs.Bulbs)
+	handler.statsd.Configure(cfg.Outputs.StatsD)
+	handler.retention.Configure(cfg.Retention)
+	if err := handler.eventLog.Configure(cfg.EventLog, handler.clock.Now()); err != nil {
+		log.Printf("Event log: %s", err)
+	}
+	handler.lightning.Configure(cfg.Lightning)
+	handler.wind.Configure(cfg.Wind)
+	handler.geocoder.Configure(cfg.Geocode)
+	// a dry run does not connect, a second client of the same ID would
+	// disconnect the instance in production
+	if !handler.dryRun {
+		if err := handler.mqtt.Configure(cfg.Outputs.MQTT); err != nil {
+			log.Printf("MQTT: %s", err)
+		}
+	}
+	handler.dispatcher.Configure(handler.outputs(cfg), cfg.Outputs.Retry)
 	handler.LoadCities()
 
-	go handler.BackgroundLoop()
+	// with an election the instances not leading follow the leader
+	if cfg.Redis.Replica || cfg.Leader.enabled() {
+		go handler.redis.Follow(handler)
+	}
+	if !cfg.Redis.Replica {
+		if !cfg.Leader.enabled() {
+			handler.redis.Restore(handler)
+		}
+		go handler.BackgroundLoop()
+	}
+	go handler.WatchSignals()
+	go handler.RefreshCities()
+	go handler.Watchdog(cfg.Systemd.Grace, !cfg.Redis.Replica)
+	if !*dryRun {
+		go handler.pixoo.Run()
+		go handler.ddp.Run()
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", handler.HandleGet).Methods("GET")
+	r.HandleFunc("/cities", handler.HandleCities).Methods("GET")
+	r.HandleFunc("/cities/search", handler.HandleSearch).Methods("GET")
+	r.HandleFunc("/image", handler.HandleImage).Methods("GET")
+	r.HandleFunc("/cells", handler.HandleCells).Methods("GET")
+	r.HandleFunc("/stats", handler.HandleStats).Methods("GET")
+	r.HandleFunc("/poll", handler.HandlePoll).Methods("GET")
+	r.HandleFunc("/events", handler.HandleEvents).Methods("GET")
+	r.HandleFunc("/events/log", handler.HandleEventLog).Methods("GET")
+	r.HandleFunc("/events/daily", handler.HandleDailyEvents).Methods("GET")
+	r.HandleFunc("/nearest", handler.HandleNearest).Methods("GET")
+	r.HandleFunc("/status", handler.HandleStatus).Methods("GET")
+	// uptime monitors check with HEAD
+	r.HandleFunc("/status.html", handler.HandleStatusPage).Methods("GET", "HEAD")
+	r.HandleFunc("/status.json", handler.HandleHealthJSON).Methods("GET", "HEAD")
+	r.HandleFunc("/willrain/{cityId}", handler.HandleWillRain).Methods("GET")
+	r.HandleFunc("/sets", handler.HandleSets).Methods("GET")
+	r.HandleFunc("/sets/{name}", handler.HandleSet).Methods("GET")
+	r.HandleFunc("/matrix", handler.HandleMatrix).Methods("GET")
+	r.HandleFunc("/state.bin", handler.HandleState).Methods("GET")
+	r.HandleFunc("/groups", handler.HandleGroups).Methods("GET")
+	r.HandleFunc("/map.svg", handler.HandleMapSVG).Methods("GET")
+	r.HandleFunc("/diff", handler.HandleDiff).Methods("GET")
+	r.HandleFunc("/frame.tiff", handler.HandleGeoTIFF).Methods("GET")
+	r.HandleFunc("/debug/city/{id}", handler.HandleDebugCity).Methods("GET")
+	if cfg.Admin.Listen == "" {
+		handler.adminRoutes(r, cfg.Admin)
+	} else {
+		admin := mux.NewRouter()
+		handler.adminRoutes(admin, cfg.Admin)
+		go func() {
+			log.Fatal(serveAdmin(cfg.Admin.Listen, handler.AccessLog(admin)))
+		}()
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	var h http.Handler = handler.AccessLog(handler.CORS(handler.Tenants(handler.Compress(r))))
+	if cfg.Tracing.enabled() {
+		r.Use(nameRoutes)
+		h = Trace(h)
+	}
+	return listenAndServe(cfg, h)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+
+	ledtesting "meteoradar/internal/testing"
+)
+
+// the fakes must keep up with the interfaces of deps.go
+var (
+	_ Clock   = (*ledtesting.Clock)(nil)
+	_ Fetcher = (*ledtesting.Fetcher)(nil)
+	_ Store   = (*ledtesting.Store)(nil)
+)
+
+var (
+	praha = City{ID: 1, Name: "Praha", Lat: 50.0755, Lon: 14.4378}
+	brno  = City{ID: 2, Name: "Brno", Lat: 49.1951, Lon: 16.6068}
+)
+
+// radarPNG is a CHMI sized radar image with an echo of dbz around each of
+// the cities.
+func radarPNG(t *testing.T, dbz float64, cities ...City) []byte {
+	t.Helper()
+	const width, height = 598, 378
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	proj := lonLatProjection{lon0, lat0, lon1, lat1, width, height}
+	for _, city := range cities {
+		cx, cy := proj.Pixel(city.Lat, city.Lon)
+		for y := cy - 6; y <= cy+6; y++ {
+			for x := cx - 6; x <= cx+6; x++ {
+				img.SetNRGBA(x, y, dbzColor(dbz))
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessFrame(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 34, 0, 0, time.UTC)
+	frameTime := start.Truncate(10 * time.Minute)
+	product, err := defaultConfig().CHMI.productNamed("z_max3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := product.url(frameTime)
+
+	tests := []struct {
+		name string
+		// respond is the body of the frame, nil answers 404
+		respond []byte
+		raining []int
+		stored  bool
+	}{
+		{name: "rain in Praha", respond: radarPNG(t, 40, praha), raining: []int{1}, stored: true},
+		{name: "rain everywhere", respond: radarPNG(t, 52, praha, brno), raining: []int{1, 2}, stored: true},
+		{name: "dry", respond: radarPNG(t, 0), stored: true},
+		{name: "not published yet"},
+		{name: "broken image", respond: []byte("\x89PNG\r\n\x1a\nnot really")},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.Mask.Auto = false
+		cfg.Validate.Timestamp = false
+		clock := ledtesting.NewClock(start)
+		fetcher := ledtesting.NewFetcher()
+		store := ledtesting.NewStore(clock)
+		if tt.respond != nil {
+			fetcher.Respond(url, tt.respond)
+		}
+
+		h := NewHandler("", cfg)
+		h.clock, h.fetcher, h.store, h.uploads = clock, fetcher, store, ledtesting.NewStore(clock)
+		p, b := praha, brno
+		h.Cities = []*City{&p, &b}
+
+		h.ProcessFrame()
+
+		// the fake clock stands still, so do the timings
+		if r := h.reports.latest(); r == nil || r.DurationMs != 0 || r.StagesMs["download"] != 0 {
+			t.Errorf("%s: report %+v, want it timed on the fake clock", tt.name, r)
+		}
+		if got := fetcher.Requests(); len(got) != 1 || got[0] != url {
+			t.Errorf("%s: fetched %v, want %s", tt.name, got, url)
+		}
+		if store.Has(frameTime) != tt.stored {
+			t.Errorf("%s: stored %v, want %v", tt.name, store.Has(frameTime), tt.stored)
+		}
+		if !tt.stored {
+			if h.Snapshot.Frame != nil {
+				t.Errorf("%s: published a frame", tt.name)
+			}
+			continue
+		}
+		if !h.Snapshot.FrameTime.Equal(frameTime) || h.Snapshot.DataSource != "chmi" {
+			t.Errorf("%s: published %s of %q, want %s of chmi", tt.name, h.Snapshot.FrameTime, h.Snapshot.DataSource, frameTime)
+		}
+		var raining []int
+		for _, city := range h.Snapshot.CitiesWithRain {
+			raining = append(raining, city.ID)
+		}
+		if len(raining) != len(tt.raining) {
+			t.Errorf("%s: raining %v, want %v", tt.name, raining, tt.raining)
+		} else {
+			for i := range raining {
+				if raining[i] != tt.raining[i] {
+					t.Errorf("%s: raining %v, want %v", tt.name, raining, tt.raining)
+					break
+				}
+			}
+		}
+		if saved, _ := store.Load(frameTime); !bytes.Equal(saved, h.Snapshot.Image) {
+			t.Errorf("%s: stored image differs from the published one", tt.name)
+		}
+
+		// the frame is not fetched again until the next slot
+		clock.Advance(5 * time.Minute)
+		h.ProcessFrame()
+		if got := fetcher.Requests(); len(got) != 1 {
+			t.Errorf("%s: fetched %v again", tt.name, got[1:])
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"slices"
+	"time"
+)
+
+// LEDConfig maps cities to pixel indices of the LED strip, shared by all
+// LED output drivers.
+type LEDConfig struct {
+	// Mapping overrides the LED index per city ID; unlisted cities use
+	// their ID.
+	Mapping map[int]int `yaml:"mapping"`
+	// Groups show several cities on one LED each, by name.
+	Groups map[string]LEDGroup `yaml:"groups"`
+	// Count is the strip length, 0 means highest mapped index + 1.
+	Count int `yaml:"count"`
+	// Points is a file of index;lat;lon lines binding every LED to a
+	// coordinate, replacing the cities, Mapping and Groups.
+	Points string `yaml:"points"`
+	// Nearby is the color, e.g. #201000, of dry cities with rain nearby;
+	// empty leaves them dark.
+	Nearby string `yaml:"nearby"`
+	// Behaviors maps alert levels to how the LEDs show them, e.g.
+	// {3: breathing, 4: flashing}; unlisted levels are solid.
+	Behaviors map[AlertLevel]LEDBehavior `yaml:"behaviors"`
+	// Summary is the index of an LED showing how stormy the country is,
+	// in the color of the reflectivity over 1% of it; nil has none.
+	Summary *int `yaml:"summary"`
+	// Fade eases the DDP controllers into the colors of every update over
+	// this long, at 20 fps; 0 switches them at once.
+	Fade time.Duration `yaml:"fade"`
+}
+
+func (c LEDConfig) nearbyColor() (*color.NRGBA, error) {
+	if c.Nearby == "" {
+		return nil, nil
+	}
+	nearby, err := parseHexColor(c.Nearby)
+	if err != nil {
+		return nil, fmt.Errorf("leds nearby: %w", err)
+	}
+	return &nearby, nil
+}
+
+func (c LEDConfig) index(city *City) int {
+	if name, ok := c.group(city.ID); ok {
+		return c.Groups[name].LED
+	}
+	if i, ok := c.Mapping[city.ID]; ok {
+		return i
+	}
+	return city.ID
+}
+
+// ledColors returns the color of every LED: the smoothed radar color of
+// its city or group, so LEDs fade in and out over a few frames, or the
+// nearby color once it faded out while rain is nearby.
+func ledColors(cities []City, cfg LEDConfig) []color.NRGBA {
+	nearby, _ := cfg.nearbyColor()
+	shown := cfg.ledCities(cities)
+	count := cfg.Count
+	if count == 0 {
+		for _, c := range shown {
+			count = max(count, c.led+1)
+		}
+	}
+
+	leds := make([]color.NRGBA, count)
+	for i := range shown {
+		city, idx := &shown[i].City, shown[i].led
+		if idx < 0 || idx >= count {
+			continue
+		}
+		leds[idx] = color.NRGBA{city.Smoothed.R, city.Smoothed.G, city.Smoothed.B, 255}
+		if nearby != nil && city.RainNearby && city.Smoothed.R|city.Smoothed.G|city.Smoothed.B == 0 {
+			leds[idx] = *nearby
+		}
+	}
+	return leds
+}
+
+// ledReflectivity is the smoothed reflectivity behind every LED, NaN for
+// LEDs showing another color than the rain, which palettes keep.
+func ledReflectivity(cities []City, count int, cfg LEDConfig) []float64 {
+	nearby, _ := cfg.nearbyColor()
+	dbz := make([]float64, count)
+	shown := cfg.ledCities(cities)
+	for i := range shown {
+		city, idx := &shown[i].City, shown[i].led
+		if idx >= 0 && idx < count {
+			dbz[idx] = city.Smoothed.DBZ
+			if nearby != nil && city.RainNearby && city.Smoothed.R|city.Smoothed.G|city.Smoothed.B == 0 {
+				dbz[idx] = math.NaN()
+			}
+		}
+	}
+	return dbz
+}
+
+// recolorLEDs shows the LEDs in the colors of a palette by the
+// reflectivity behind them.
+func recolorLEDs(leds []color.NRGBA, dbz []float64, p Palette) []color.NRGBA {
+	if !p.recolors() {
+		return leds
+	}
+	out := slices.Clone(leds)
+	for i := range out {
+		if i < len(dbz) && !math.IsNaN(dbz[i]) {
+			out[i] = p.color(dbz[i])
+		}
+	}
+	return out
+}
+
+// ledBehaviors is the behavior of every LED for the alert level of its
+// city or group, which the drivers play with renderBehaviors.
+func ledBehaviors(cities []City, count int, cfg LEDConfig) []LEDBehavior {
+	behaviors := make([]LEDBehavior, count)
+	for i := range behaviors {
+		behaviors[i] = BehaviorSolid
+	}
+	shown := cfg.ledCities(cities)
+	for i := range shown {
+		if idx := shown[i].led; idx >= 0 && idx < count {
+			behaviors[idx] = cfg.behavior(shown[i].Alert)
+		}
+	}
+	return behaviors
+}
+
+// flashPattern is a double white blink every two seconds.
+func flashPattern(t time.Time) bool {
+	p := t.UnixMilli() % 2000
+	return p < 100 || (p >= 200 && p < 300)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type LightningConfig struct {
+	// URL of the Blitzortung WebSocket feed, empty disables it.
+	URL string `yaml:"url"`
+	// Strikes within RadiusKm of a city over the last Window are counted.
+	RadiusKm float64       `yaml:"radiusKm"`
+	Window   time.Duration `yaml:"window"`
+	// Area drops strikes outside of it, the feed is worldwide.
+	Area BBox `yaml:"area"`
+}
+
+type Strike struct {
+	Time     time.Time
+	Lat, Lon float64
+}
+
+// decodeBlitzortung undoes the LZW-style compression of the feed
+// messages, the port of the decoder in the Blitzortung map scripts.
+func decodeBlitzortung(s string) string {
+	in := []rune(s)
+	if len(in) == 0 {
+		return ""
+	}
+
+	dict := map[rune]string{}
+	next := rune(256)
+	c := string(in[0])
+	prev := c
+	var out []byte
+	out = append(out, c...)
+
+	for _, code := range in[1:] {
+		var entry string
+		switch e, ok := dict[code]; {
+		case code < 256:
+			entry = string(code)
+		case ok:
+			entry = e
+		default:
+			entry = prev + c
+		}
+		out = append(out, entry...)
+		c = string([]rune(entry)[0])
+		dict[next] = prev + c
+		next++
+		prev = entry
+	}
+	return string(out)
+}
+
+// Lightning keeps the recent strikes of the Blitzortung feed.
+type Lightning struct {
+	m       sync.Mutex
+	cfg     LightningConfig
+	strikes []Strike
+	stop    chan struct{}
+}
+
+// Configure (re)connects to the feed when the URL changes.
+func (l *Lightning) Configure(cfg LightningConfig) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	restart := cfg.URL != l.cfg.URL
+	l.cfg = cfg
+	if !restart {
+		return
+	}
+
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.strikes = nil
+	if cfg.URL == "" {
+		return
+	}
+
+	l.stop = make(chan struct{})
+	go l.run(cfg.URL, l.stop)
+}
+
+// run reads the feed until stop is closed, reconnecting on errors.
+func (l *Lightning) run(url string, stop chan struct{}) {
+	for {
+		if err := l.read(url, stop); err != nil {
+			log.Printf("Blitzortung %s: %s", url, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func (l *Lightning) read(url string, stop chan struct{}) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"a":111}`)); err != nil {
+		return err
+	}
+	log.Printf("Receiving lightning strikes from %s", url)
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		var s struct {
+			Time int64   `json:"time"`
+			Lat  float64 `json:"lat"`
+			Lon  float64 `json:"lon"`
+		}
+		if err := json.Unmarshal([]byte(decodeBlitzortung(string(msg))), &s); err != nil {
+			continue
+		}
+		l.add(Strike{Time: time.Unix(0, s.Time), Lat: s.Lat, Lon: s.Lon})
+	}
+}
+
+func (l *Lightning) add(s Strike) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if !l.cfg.Area.IsZero() && !l.cfg.Area.Contains(s.Lat, s.Lon) {
+		return
+	}
+	l.prune(time.Now())
+	l.strikes = append(l.strikes, s)
+}
+
+// prune drops strikes older than the window. Must be called with l.m held.
+func (l *Lightning) prune(now time.Time) {
+	cutoff := now.Add(-l.cfg.Window)
+	i := 0
+	for i < len(l.strikes) && l.strikes[i].Time.Before(cutoff) {
+		i++
+	}
+	l.strikes = l.strikes[i:]
+}
+
+func (l *Lightning) Enabled() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.stop != nil
+}
+
+// Count returns the strikes within the radius of a point over the window.
+func (l *Lightning) Count(lat, lon float64, now time.Time) int {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.prune(now)
+	n := 0
+	for _, s := range l.strikes {
+		if distanceKm(lat, lon, s.Lat, s.Lon) <= l.cfg.RadiusKm {
+			n++
+		}
+	}
+	return n
+}
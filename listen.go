@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ListenAddrs are the addresses the API is served on, host:port or a
+// Unix socket unix:<path>. YAML takes one address or a list.
+type ListenAddrs []string
+
+func (a *ListenAddrs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*a = ListenAddrs{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a ListenAddrs) validate() error {
+	if len(a) == 0 {
+		return errors.New("listen needs an address")
+	}
+	for _, addr := range a {
+		if err := validateListen(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateListen(addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return errors.New("listen unix: needs a socket path")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// port is the port of the first TCP address, empty for sockets only.
+func (a ListenAddrs) port() string {
+	for _, addr := range a {
+		if _, port, err := net.SplitHostPort(addr); err == nil && !strings.HasPrefix(addr, "unix:") {
+			return port
+		}
+	}
+	return ""
+}
+
+// listenAddr listens on a TCP address or a Unix socket unix:<path>,
+// removing a socket left over by an earlier run first.
+func listenAddr(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+func (c ImageConfig) validate() error {
+	if c.MarkerSize < 0 || c.MarkerSize > 100 {
+		return fmt.Errorf("image markerSize must be 0 to 100 pixels")
+	}
+	switch c.MarkerShape {
+	case "", "square", "circle", "ring":
+	default:
+		return fmt.Errorf("image markerShape must be square, circle or ring, not %q", c.MarkerShape)
+	}
+	if c.DryColor != "" {
+		if _, err := parseHexColor(c.DryColor); err != nil {
+			return fmt.Errorf("image dryColor: %w", err)
+		}
+	}
+	switch c.Background {
+	case "", "keep", "black":
+	default:
+		return fmt.Errorf("image background must be keep or black, not %q", c.Background)
+	}
+	return nil
+}
+
+// markerRect is the square a marker of the city at x, y covers.
+func (c ImageConfig) markerRect(x, y int) image.Rectangle {
+	min := image.Pt(x-c.MarkerSize/2, y-c.MarkerSize/2)
+	return image.Rectangle{min, min.Add(image.Pt(c.MarkerSize, c.MarkerSize))}
+}
+
+// drawMarker paints the marker of the city at x, y in c.
+func (c ImageConfig) drawMarker(img *image.NRGBA, x, y int, col color.NRGBA) {
+	r := c.markerRect(x, y)
+	if c.MarkerShape == "" || c.MarkerShape == "square" {
+		fillRect(img, r, col)
+		return
+	}
+
+	radius := float64(c.MarkerSize) / 2
+	inner := -1.0
+	if c.MarkerShape == "ring" {
+		inner = radius - math.Max(1, math.Round(radius/3))
+	}
+	cx, cy := float64(r.Min.X+r.Max.X)/2, float64(r.Min.Y+r.Max.Y)/2
+	r = r.Intersect(img.Rect)
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			if d := math.Hypot(float64(px)+0.5-cx, float64(py)+0.5-cy); d <= radius && d > inner {
+				img.SetNRGBA(px, py, col)
+			}
+		}
+	}
+}
+
+// drawMarkers styles the annotated frame: the background blacked out if
+// so configured, then a marker in the radar color of every raining city
+// and in the dry color of the others.
+func drawMarkers(img *image.NRGBA, frame *Frame, cities []*City, cfg ImageConfig) {
+	if cfg.Background == "black" {
+		fillRect(img, img.Rect, color.NRGBA{0, 0, 0, 255})
+	}
+	if cfg.MarkerSize == 0 {
+		return
+	}
+	dry, err := parseHexColor(cfg.DryColor)
+	for _, city := range cities {
+		x, y := frame.Projection.Pixel(city.Lat, city.Lon)
+		switch {
+		case city.Raining():
+			cfg.drawMarker(img, x, y, color.NRGBA{city.R, city.G, city.B, 255})
+		case err == nil:
+			cfg.drawMarker(img, x, y, dry)
+		}
+	}
+}
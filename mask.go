@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// MaskConfig keeps the legend, timestamps and borders printed into the
+// composite out of the city results.
+type MaskConfig struct {
+	// Auto drops opaque pixels whose color is farther than Tolerance from
+	// every color of the reflectivity legend.
+	Auto      bool    `yaml:"auto"`
+	Tolerance float64 `yaml:"tolerance"`
+	// Areas are always dropped, in pixels of the downloaded image.
+	Areas []MaskArea `yaml:"areas"`
+}
+
+type MaskArea struct {
+	X      int `yaml:"x"`
+	Y      int `yaml:"y"`
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+}
+
+func (a MaskArea) rect() image.Rectangle {
+	return image.Rect(a.X, a.Y, a.X+a.Width, a.Y+a.Height)
+}
+
+// maskPixels clears the non-data pixels of img, so they read as no echo.
+func maskPixels(img *image.NRGBA, cfg MaskConfig) {
+	for _, area := range cfg.Areas {
+		fillRect(img, area.rect(), color.NRGBA{})
+	}
+	if !cfg.Auto {
+		return
+	}
+
+	limit := cfg.Tolerance * cfg.Tolerance
+	data := map[[3]uint8]bool{}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4]
+		if p[3] == 0 || p[0]|p[1]|p[2] == 0 {
+			continue
+		}
+		key := [3]uint8{p[0], p[1], p[2]}
+		ok, seen := data[key]
+		if !seen {
+			ok = paletteDistance(key) <= limit
+			data[key] = ok
+		}
+		if !ok {
+			copy(p, []uint8{0, 0, 0, 0})
+		}
+	}
+}
+
+// paletteDistance is the squared distance of c to the closest legend color.
+func paletteDistance(c [3]uint8) float64 {
+	best := math.MaxFloat64
+	for _, l := range chmiPalette {
+		dr := float64(c[0]) - float64(l.R)
+		dg := float64(c[1]) - float64(l.G)
+		db := float64(c[2]) - float64(l.B)
+		best = math.Min(best, dr*dr+dg*dg+db*db)
+	}
+	return best
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"strconv"
+)
+
+// renderMatrix downsamples the frame within box to a w×h grid, averaging
+// all source pixels covered by each cell. With mask set, cells whose
+// center lies outside the Czech border are left black.
+func renderMatrix(frame *Frame, box BBox, w, h int, mask bool) []color.NRGBA {
+	bounds := frame.Image.Bounds()
+	cellLat := (box.North - box.South) / float64(h)
+	cellLon := (box.East - box.West) / float64(w)
+	out := make([]color.NRGBA, w*h)
+
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			north := box.North - float64(j)*cellLat
+			west := box.West + float64(i)*cellLon
+			if mask && !insideBorder(czechBorder, north-cellLat/2, west+cellLon/2) {
+				continue
+			}
+
+			x0, y0 := frame.Projection.Pixel(north, west)
+			x1, y1 := frame.Projection.Pixel(north-cellLat, west+cellLon)
+			if x1 < x0 {
+				x0, x1 = x1, x0
+			}
+			if y1 < y0 {
+				y0, y1 = y1, y0
+			}
+			x1, y1 = max(x1, x0+1), max(y1, y0+1)
+
+			var r, g, b, n int
+			for y := max(y0, bounds.Min.Y); y < min(y1, bounds.Max.Y); y++ {
+				for x := max(x0, bounds.Min.X); x < min(x1, bounds.Max.X); x++ {
+					c := frame.Image.NRGBAAt(x, y)
+					r += int(c.R)
+					g += int(c.G)
+					b += int(c.B)
+					n++
+				}
+			}
+			if n > 0 {
+				out[j*w+i] = color.NRGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+			}
+		}
+	}
+
+	return out
+}
+
+func matrixSize(r *http.Request, key string) (int, bool) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return 16, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n > 0 && n <= 256
+}
+
+// HandleMatrix serves the current frame downsampled for LED matrices as
+// raw rgb888, rgb565 (big endian), JSON, MessagePack or CBOR.
+func (h *Handler) HandleMatrix(w http.ResponseWriter, r *http.Request) {
+	width, okW := matrixSize(r, "w")
+	height, okH := matrixSize(r, "h")
+	if !okW || !okH {
+		http.Error(w, "w and h must be between 1 and 256", http.StatusBadRequest)
+		return
+	}
+
+	h.m.RLock()
+	frame := h.Frame
+	box := h.config.Matrix.BBox
+	h.m.RUnlock()
+
+	if frame == nil {
+		http.Error(w, "no radar frame yet", http.StatusServiceUnavailable)
+		return
+	}
+	if box.IsZero() {
+		box = czechBBox
+	}
+
+	pixels := renderMatrix(frame, box, width, height, r.URL.Query().Get("mask") == "border")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = binaryFormat(r.Header.Get("Accept"))
+	}
+	switch format {
+	case "", "rgb888":
+		buf := make([]byte, 0, len(pixels)*3)
+		for _, c := range pixels {
+			buf = append(buf, c.R, c.G, c.B)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf)
+	case "rgb565":
+		buf := make([]byte, 0, len(pixels)*2)
+		for _, c := range pixels {
+			v := uint16(c.R>>3)<<11 | uint16(c.G>>2)<<5 | uint16(c.B>>3)
+			buf = append(buf, byte(v>>8), byte(v))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf)
+	case "json", "msgpack", "cbor":
+		rows := make([][][3]uint8, height)
+		for j := range rows {
+			rows[j] = make([][3]uint8, width)
+			for i := range rows[j] {
+				c := pixels[j*width+i]
+				rows[j][i] = [3]uint8{c.R, c.G, c.B}
+			}
+		}
+		doc := map[string]any{
+			"w":      width,
+			"h":      height,
+			"frame":  frame.Time,
+			"pixels": rows,
+		}
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(doc)
+			return
+		}
+		body, err := encodeBinary(format, doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", binaryContentTypes[format])
+		w.Write(body)
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type MQTTConfig struct {
+	// Broker such as tcp://localhost:1883, empty disables the output.
+	Broker   string `yaml:"broker"`
+	Topic    string `yaml:"topic"`
+	ClientID string `yaml:"clientId"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	QoS      byte   `yaml:"qos"`
+}
+
+// MQTT publishes the frame, the state of every city (retained) and rain
+// transitions to an MQTT broker.
+type MQTT struct {
+	m      sync.Mutex
+	cfg    MQTTConfig
+	client mqtt.Client
+}
+
+// Configure reconnects when the settings change.
+func (q *MQTT) Configure(cfg MQTTConfig) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if cfg == q.cfg {
+		return nil
+	}
+	if q.client != nil {
+		q.client.Disconnect(250)
+		q.client = nil
+	}
+	q.cfg = cfg
+
+	if cfg.Broker == "" {
+		return nil
+	}
+	if cfg.QoS > 2 {
+		return fmt.Errorf("invalid mqtt qos %d", cfg.QoS)
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "ledradar"
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	q.client = mqtt.NewClient(opts)
+	// with connect retry the token only completes once connected
+	q.client.Connect()
+	log.Printf("Publishing to MQTT %s", cfg.Broker)
+	return nil
+}
+
+func (q *MQTT) Name() string {
+	return "mqtt"
+}
+
+func (q *MQTT) publish(topic string, retained bool, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t := q.client.Publish(topic, q.cfg.QoS, retained, data)
+	if !t.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("publish to %s timed out", topic)
+	}
+	return t.Error()
+}
+
+func (q *MQTT) Send(u *Update) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.client == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, t := range u.Transitions {
+		errs = append(errs, q.publish(fmt.Sprintf("%s/rain/%d", q.cfg.Topic, t.City.ID), false, t))
+	}
+	for _, city := range u.Cities {
+		errs = append(errs, q.publish(fmt.Sprintf("%s/city/%d", q.cfg.Topic, city.ID), true, city))
+	}
+	errs = append(errs, q.publish(q.cfg.Topic+"/frame", true, FrameEvent{Frame: u.Frame, FrameID: u.FrameID, Cities: u.Raining(), Simulated: u.Simulated}))
+	return errors.Join(errs...)
+}
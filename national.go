@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Radar composites of the neighbouring countries, for cities along the
+// border the Czech radars see poorly. They are image products like those
+// of CHMI, each with the URL scheme and the map projection of its service.
+
+// nationalProducts are the built-in composites: SHMÚ (Slovakia) publishes
+// a web map overlay in Mercator, IMGW (Poland) a stereographic grid around
+// the middle of the country and GeoSphere (Austria) the Austria Lambert
+// grid. Their colors are matched to the nearest color of the CHMI legend.
+var nationalProducts = map[string]Product{
+	"shmu": {
+		URL:        "https://www.shmu.sk/data/dataradary/data.cmax/cmax.kruh.{time}.0.png",
+		TimeFormat: "20060102.1504",
+		Cadence:    5 * time.Minute,
+		Delay:      5 * time.Minute,
+		Unit:       "dbz",
+		Legend:     paletteLegend(4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 60),
+		Bounds:     BBox{North: 50.7, West: 13.6, South: 46.0, East: 23.8},
+		Grid:       Grid{Type: "mercator"},
+	},
+	"imgw": {
+		URL:        "https://danepubliczne.imgw.pl/datastore/getfiledown/Oper/Polrad/Produkty/POLCOMP/COMPO_CMAX_250.comp.cmax/{time}dBZ.cmax.png",
+		TimeFormat: "2006010215040000",
+		Cadence:    10 * time.Minute,
+		Delay:      10 * time.Minute,
+		Unit:       "dbz",
+		Legend:     paletteLegend(4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 60),
+		Grid:       Grid{Type: "stereographic", Lat0: 52, Lon0: 19, West: -450, North: 450, PixelKm: 1},
+		Width:      900,
+		Height:     900,
+	},
+	"geosphere": {
+		URL:        "https://static.geosphere.at/prod/radar/cmax/{time}.png",
+		TimeFormat: "20060102T1504",
+		Cadence:    5 * time.Minute,
+		Delay:      5 * time.Minute,
+		Unit:       "dbz",
+		Legend:     paletteLegend(4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 60),
+		Grid:       Grid{Type: "lambert", Lat0: 47.5, Lon0: 13 + 1.0/3, Parallels: [2]float64{49, 46}, West: -350, North: 250, PixelKm: 1},
+		Width:      700,
+		Height:     450,
+	},
+}
+
+// nationalProduct resolves the composite of a neighbouring country with
+// the configured fields laid over the built-in ones, ok is false for
+// names that are not one.
+func nationalProduct(cfg *Config, name string) (Product, bool, error) {
+	p, ok := nationalProducts[name]
+	if !ok {
+		return Product{}, false, nil
+	}
+	p, err := resolveProduct("national source "+name, p, cfg.National[name])
+	return p, true, err
+}
+
+// nationalSource downloads the composite of a neighbouring country.
+type nationalSource struct {
+	chmiSource
+	name string
+}
+
+func (s nationalSource) Name() string {
+	return s.name
+}
+
+// Grid places an image that is not a plain lon/lat image on the map.
+type Grid struct {
+	// Type is mercator (the image spans Bounds like a web map overlay),
+	// lambert (conformal conic with the standard Parallels) or
+	// stereographic, both around Lat0 and Lon0 on a sphere.
+	Type      string     `yaml:"type"`
+	Lat0      float64    `yaml:"lat0"`
+	Lon0      float64    `yaml:"lon0"`
+	Parallels [2]float64 `yaml:"parallels"`
+	// West and North are the projected km of the upper left corner of
+	// a lambert or stereographic image, PixelKm the size of its pixels.
+	West    float64 `yaml:"west"`
+	North   float64 `yaml:"north"`
+	PixelKm float64 `yaml:"pixelKm"`
+}
+
+func (g Grid) validate() error {
+	switch g.Type {
+	case "", "mercator":
+		return nil
+	case "lambert":
+		if g.Parallels[0] == -g.Parallels[1] {
+			return errors.New("grid lambert needs standard parallels on one side of the equator")
+		}
+	case "stereographic":
+	default:
+		return fmt.Errorf("unknown grid type %q, expected mercator, lambert or stereographic", g.Type)
+	}
+	if g.PixelKm <= 0 {
+		return fmt.Errorf("grid %s needs a positive pixelKm", g.Type)
+	}
+	return nil
+}
+
+// projection places an image of width × height pixels of p on the map.
+func (p Product) projection(width, height int) Projection {
+	b := p.Bounds
+	if b.IsZero() {
+		b = BBox{North: lat0, West: lon0, South: lat1, East: lon1}
+	}
+	switch p.Grid.Type {
+	case "mercator":
+		return mercatorProjection{b, width, height}
+	case "lambert":
+		return gridProjection{p.Grid, newLambert(p.Grid)}
+	case "stereographic":
+		return gridProjection{p.Grid, stereographic{radians(p.Grid.Lat0), p.Grid.Lon0}}
+	}
+	return lonLatProjection{lon0: b.West, lat0: b.North, lon1: b.East, lat1: b.South, width: width, height: height}
+}
+
+// covers tells whether a point is on the images of p, known before any
+// frame is in when the size of the images is.
+func (p Product) covers(lat, lon float64) bool {
+	if p.Width == 0 || p.Height == 0 {
+		if p.Bounds.IsZero() {
+			return BBox{North: lat0, West: lon0, South: lat1, East: lon1}.Contains(lat, lon)
+		}
+		return p.Bounds.Contains(lat, lon)
+	}
+	x, y := p.projection(p.Width, p.Height).Pixel(lat, lon)
+	return x >= 0 && y >= 0 && x < p.Width && y < p.Height
+}
+
+// mercatorProjection is linear in longitude and in the Mercator ordinate
+// of the latitude between the image edges.
+type mercatorProjection struct {
+	bounds        BBox
+	width, height int
+}
+
+func mercatorY(lat float64) float64 {
+	return math.Log(math.Tan(math.Pi/4 + radians(lat)/2))
+}
+
+func (p mercatorProjection) Pixel(lat, lon float64) (int, int) {
+	top, bottom := mercatorY(p.bounds.North), mercatorY(p.bounds.South)
+	x := (lon - p.bounds.West) / (p.bounds.East - p.bounds.West) * float64(p.width)
+	y := (top - mercatorY(lat)) / (top - bottom) * float64(p.height)
+	return int(math.Floor(x)), int(math.Floor(y))
+}
+
+func (p mercatorProjection) Location(x, y int) (float64, float64) {
+	top, bottom := mercatorY(p.bounds.North), mercatorY(p.bounds.South)
+	lon := p.bounds.West + (float64(x)+0.5)/float64(p.width)*(p.bounds.East-p.bounds.West)
+	my := top - (float64(y)+0.5)/float64(p.height)*(top-bottom)
+	return degrees(math.Atan(math.Sinh(my))), lon
+}
+
+// planeProjection maps the sphere to km on a plane, y to the north.
+type planeProjection interface {
+	forward(lat, lon float64) (x, y float64)
+	inverse(x, y float64) (lat, lon float64)
+}
+
+// gridProjection is a grid of square pixels on a planeProjection.
+type gridProjection struct {
+	grid  Grid
+	plane planeProjection
+}
+
+func (p gridProjection) Pixel(lat, lon float64) (int, int) {
+	x, y := p.plane.forward(lat, lon)
+	return int(math.Floor((x - p.grid.West) / p.grid.PixelKm)), int(math.Floor((p.grid.North - y) / p.grid.PixelKm))
+}
+
+func (p gridProjection) Location(px, py int) (float64, float64) {
+	x := p.grid.West + (float64(px)+0.5)*p.grid.PixelKm
+	y := p.grid.North - (float64(py)+0.5)*p.grid.PixelKm
+	return p.plane.inverse(x, y)
+}
+
+// lambert is the Lambert conformal conic projection of a sphere.
+type lambert struct {
+	n, f, rho0, lon0 float64
+}
+
+func newLambert(g Grid) lambert {
+	phi1, phi2 := radians(g.Parallels[0]), radians(g.Parallels[1])
+	t := func(phi float64) float64 { return math.Tan(math.Pi/4 + phi/2) }
+	n := math.Sin(phi1)
+	if phi1 != phi2 {
+		n = math.Log(math.Cos(phi1)/math.Cos(phi2)) / math.Log(t(phi2)/t(phi1))
+	}
+	f := math.Cos(phi1) * math.Pow(t(phi1), n) / n
+	return lambert{n: n, f: f, rho0: earthRadius * f / math.Pow(t(radians(g.Lat0)), n), lon0: g.Lon0}
+}
+
+func (l lambert) forward(lat, lon float64) (float64, float64) {
+	rho := earthRadius * l.f / math.Pow(math.Tan(math.Pi/4+radians(lat)/2), l.n)
+	theta := l.n * radians(lon-l.lon0)
+	return rho * math.Sin(theta), l.rho0 - rho*math.Cos(theta)
+}
+
+func (l lambert) inverse(x, y float64) (float64, float64) {
+	dy := l.rho0 - y
+	rho := math.Copysign(math.Hypot(x, dy), l.n)
+	theta := math.Atan2(x, dy)
+	if l.n < 0 {
+		theta = math.Atan2(-x, -dy)
+	}
+	lat := 2*math.Atan(math.Pow(earthRadius*l.f/rho, 1/l.n)) - math.Pi/2
+	return degrees(lat), l.lon0 + degrees(theta/l.n)
+}
+
+// stereographic is the oblique stereographic projection of a sphere
+// touching it at lat0 (in radians) and lon0.
+type stereographic struct {
+	lat0, lon0 float64
+}
+
+func (s stereographic) forward(lat, lon float64) (float64, float64) {
+	phi, dlon := radians(lat), radians(lon-s.lon0)
+	k := 2 / (1 + math.Sin(s.lat0)*math.Sin(phi) + math.Cos(s.lat0)*math.Cos(phi)*math.Cos(dlon))
+	x := earthRadius * k * math.Cos(phi) * math.Sin(dlon)
+	y := earthRadius * k * (math.Cos(s.lat0)*math.Sin(phi) - math.Sin(s.lat0)*math.Cos(phi)*math.Cos(dlon))
+	return x, y
+}
+
+func (s stereographic) inverse(x, y float64) (float64, float64) {
+	rho := math.Hypot(x, y)
+	if rho == 0 {
+		return degrees(s.lat0), s.lon0
+	}
+	c := 2 * math.Atan(rho/(2*earthRadius))
+	lat := math.Asin(math.Cos(c)*math.Sin(s.lat0) + y*math.Sin(c)*math.Cos(s.lat0)/rho)
+	dlon := math.Atan2(x*math.Sin(c), rho*math.Cos(s.lat0)*math.Cos(c)-y*math.Sin(s.lat0)*math.Sin(c))
+	return degrees(lat), s.lon0 + degrees(dlon)
+}
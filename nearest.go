@@ -0,0 +1,73 @@
+package main
+
+import "math"
+
+type NearestRainConfig struct {
+	MinDBZ float64 `yaml:"minDbz"`
+	// MaxKm limits the search radius, 0 disables the search.
+	MaxKm float64 `yaml:"maxKm"`
+}
+
+// NearestRain describes the closest precipitation to a dry city.
+type NearestRain struct {
+	DistanceKm float64 `json:"distanceKm"`
+	Bearing    float64 `json:"bearing"`
+	Direction  string  `json:"direction"`
+}
+
+var compassPoints = []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+
+func compassDirection(bearing float64) string {
+	return compassPoints[int(math.Round(bearing/45))%len(compassPoints)]
+}
+
+func pixelSizeKm(proj Projection, x, y int) (float64, float64) {
+	lat, lon := proj.Location(x, y)
+	latX, lonX := proj.Location(x+1, y)
+	latY, lonY := proj.Location(x, y+1)
+	return distanceKm(lat, lon, latX, lonX), distanceKm(lat, lon, latY, lonY)
+}
+
+// findNearestRain scans the square around the city for the closest pixel
+// of at least cfg.MinDBZ.
+func findNearestRain(field *Field, proj Projection, lat, lon float64, cfg NearestRainConfig) *NearestRain {
+	if cfg.MaxKm <= 0 {
+		return nil
+	}
+
+	cx, cy := proj.Pixel(lat, lon)
+	kmX, kmY := pixelSizeKm(proj, cx, cy)
+	rx, ry := int(cfg.MaxKm/kmX)+1, int(cfg.MaxKm/kmY)+1
+
+	// compare on the local plane, only the winner needs the great circle
+	bestPlane := math.Inf(1)
+	bx, by := -1, -1
+	for y := max(cy-ry, 0); y <= min(cy+ry, field.Height-1); y++ {
+		dy := float64(y-cy) * kmY
+		for x := max(cx-rx, 0); x <= min(cx+rx, field.Width-1); x++ {
+			if !(field.DBZ[y*field.Width+x] >= float32(cfg.MinDBZ)) {
+				continue
+			}
+			dx := float64(x-cx) * kmX
+			if d := dx*dx + dy*dy; d < bestPlane {
+				bestPlane, bx, by = d, x, y
+			}
+		}
+	}
+	if bx < 0 {
+		return nil
+	}
+
+	bestLat, bestLon := proj.Location(bx, by)
+	best := distanceKm(lat, lon, bestLat, bestLon)
+	if best > cfg.MaxKm {
+		return nil
+	}
+
+	b := bearing(lat, lon, bestLat, bestLon)
+	return &NearestRain{
+		DistanceKm: math.Round(best*10) / 10,
+		Bearing:    math.Round(b),
+		Direction:  compassDirection(b),
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "fmt"
+
+type NeighborsConfig struct {
+	// RadiusKm makes cities this close to each other neighbors, 0 leaves
+	// only the listed ones.
+	RadiusKm float64 `yaml:"radiusKm"`
+	// Cities lists neighbors by city ID, both ways, e.g. {3: [4, 7]}.
+	Cities map[int][]int `yaml:"cities"`
+}
+
+func (c NeighborsConfig) validate() error {
+	if c.RadiusKm < 0 {
+		return fmt.Errorf("neighbors radiusKm must not be negative")
+	}
+	return nil
+}
+
+func (c NeighborsConfig) enabled() bool {
+	return c.RadiusKm > 0 || len(c.Cities) > 0
+}
+
+// markRainNearby flags the dry cities with a raining neighbor, in the
+// same list only; idx indexes that list.
+func markRainNearby(cities []*City, idx *cityIndex, cfg NeighborsConfig) {
+	if !cfg.enabled() {
+		return
+	}
+	listed := map[int][]int{}
+	for id, others := range cfg.Cities {
+		for _, other := range others {
+			listed[id] = append(listed[id], other)
+			listed[other] = append(listed[other], id)
+		}
+	}
+	raining := map[int]bool{}
+	for _, city := range cities {
+		if city.Raining() {
+			raining[city.ID] = true
+		}
+	}
+	if len(raining) == 0 {
+		return
+	}
+
+	for _, city := range cities {
+		if city.Raining() {
+			continue
+		}
+		for _, id := range listed[city.ID] {
+			if id != city.ID && raining[id] {
+				city.RainNearby = true
+				break
+			}
+		}
+		if !city.RainNearby && cfg.RadiusKm > 0 {
+			idx.within(city.Lat, city.Lon, cfg.RadiusKm, func(other *City) {
+				if other != city && other.Raining() {
+					city.RainNearby = true
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notification is a single alert produced by a rule.
+type Notification struct {
+	Rule    string    `json:"rule"`
+	Frame   time.Time `json:"frame"`
+	City    City      `json:"city"`
+	Message string    `json:"message"`
+	// Simulated is set for rules matched on POST /admin/simulate data.
+	Simulated bool `json:"simulated,omitempty"`
+
+	// radar is the frame the rule matched on, nil for fallback data
+	radar *Frame
+}
+
+// Notifier delivers notifications to one channel.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// ChannelConfig is a channel of a type or, with the type left out, a
+// service URL such as tgram://<bot token>/<chat>, see notifierSchemes.
+type ChannelConfig struct {
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+	// Token and User are the Pushover application token and user key,
+	// Token is also sent as the ntfy access token when set.
+	Token string `yaml:"token"`
+	User  string `yaml:"user"`
+	// Topic is the ntfy topic, URL the ntfy server (https://ntfy.sh).
+	Topic string `yaml:"topic"`
+	// Template is a text/template of the Notification for the Discord
+	// and Slack message, the rule's message by default.
+	Template string `yaml:"template"`
+	// Crop attaches the radar around the city to Discord messages.
+	Crop bool `yaml:"crop"`
+}
+
+func newNotifier(cfg ChannelConfig) (Notifier, error) {
+	switch cfg.Type {
+	case "":
+		return newURLNotifier(cfg)
+	case "log":
+		return logNotifier{}, nil
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook channel needs an url")
+		}
+		return webhookNotifier{url: cfg.URL}, nil
+	case "pushover":
+		if cfg.Token == "" || cfg.User == "" {
+			return nil, fmt.Errorf("pushover channel needs a token and user")
+		}
+		return pushoverNotifier{token: cfg.Token, user: cfg.User}, nil
+	case "ntfy":
+		if cfg.Topic == "" {
+			return nil, fmt.Errorf("ntfy channel needs a topic")
+		}
+		server := cfg.URL
+		if server == "" {
+			server = "https://ntfy.sh"
+		}
+		return ntfyNotifier{url: strings.TrimSuffix(server, "/") + "/" + cfg.Topic, token: cfg.Token}, nil
+	case "discord", "slack":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("%s channel needs a webhook url", cfg.Type)
+		}
+		tmpl, err := parseMessageTemplate(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Type == "slack" {
+			return slackNotifier{url: cfg.URL, template: tmpl}, nil
+		}
+		return discordNotifier{url: cfg.URL, template: tmpl, crop: cfg.Crop}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %q", cfg.Type)
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(n Notification) error {
+	log.Printf("🔔  %s", n.Message)
+	return nil
+}
+
+// webhookNotifier POSTs the notification as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Notify(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return postJSON(w.url, body)
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return send(req)
+}
+
+func send(req *http.Request) error {
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
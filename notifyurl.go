@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// notifierScheme builds a notifier from the part of a service URL after
+// scheme://, the other keys of the channel (template, crop) still apply.
+type notifierScheme func(target string, cfg ChannelConfig) (Notifier, error)
+
+// notifierSchemes are the service URLs a channel may be given instead of a
+// type, in the style of Apprise.
+var notifierSchemes = map[string]notifierScheme{
+	"log":     func(string, ChannelConfig) (Notifier, error) { return logNotifier{}, nil },
+	"json":    webhookScheme("http"),
+	"jsons":   webhookScheme("https"),
+	"pover":   pushoverScheme,
+	"ntfy":    ntfyScheme("http"),
+	"ntfys":   ntfyScheme("https"),
+	"tgram":   telegramScheme,
+	"discord": discordScheme,
+	"slack":   slackScheme,
+	"mailto":  mailScheme(false),
+	"mailtos": mailScheme(true),
+}
+
+// newURLNotifier dispatches a service URL such as tgram://<bot token>/<chat>
+// on its scheme.
+func newURLNotifier(cfg ChannelConfig) (Notifier, error) {
+	scheme, target, ok := strings.Cut(cfg.URL, "://")
+	if !ok {
+		return nil, fmt.Errorf("channel needs a type or a service url")
+	}
+	build, ok := notifierSchemes[strings.ToLower(scheme)]
+	if !ok {
+		return nil, fmt.Errorf("unknown service url scheme %q", scheme)
+	}
+	n, err := build(target, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s url: %w", scheme, err)
+	}
+	return n, nil
+}
+
+// parseTarget parses target as the authority and path of an URL. The
+// error leaves the URL out, it may hold a password.
+func parseTarget(target string) (*url.URL, error) {
+	u, err := url.Parse("//" + target)
+	if err != nil {
+		return nil, fmt.Errorf("malformed url")
+	}
+	return u, nil
+}
+
+// pathParts are the non-empty segments of the path of u.
+func pathParts(u *url.URL) []string {
+	var parts []string
+	for _, p := range strings.Split(u.Path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// webhookScheme posts the JSON notification to json://host/path.
+func webhookScheme(protocol string) notifierScheme {
+	return func(target string, _ ChannelConfig) (Notifier, error) {
+		u, err := parseTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("needs a host")
+		}
+		u.Scheme = protocol
+		return webhookNotifier{url: u.String()}, nil
+	}
+}
+
+// pushoverScheme reads pover://<user key>@<application token>.
+func pushoverScheme(target string, _ ChannelConfig) (Notifier, error) {
+	user, token, ok := strings.Cut(strings.TrimSuffix(target, "/"), "@")
+	if !ok || user == "" || token == "" {
+		return nil, fmt.Errorf("needs a user key and an application token")
+	}
+	return pushoverNotifier{token: token, user: user}, nil
+}
+
+// ntfyScheme reads ntfy://[<token>@]<host>/<topic>, a bare ntfy://<topic>
+// publishing on https://ntfy.sh.
+func ntfyScheme(protocol string) notifierScheme {
+	return func(target string, _ ChannelConfig) (Notifier, error) {
+		u, err := parseTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		var token string
+		if u.User != nil {
+			token = u.User.Username()
+			if password, ok := u.User.Password(); ok {
+				token = password
+			}
+		}
+		parts := pathParts(u)
+		switch {
+		case len(parts) == 0 && u.Host != "":
+			return ntfyNotifier{url: "https://ntfy.sh/" + u.Host, token: token}, nil
+		case len(parts) == 1 && u.Host != "":
+			return ntfyNotifier{url: protocol + "://" + u.Host + "/" + parts[0], token: token}, nil
+		}
+		return nil, fmt.Errorf("needs a topic")
+	}
+}
+
+// telegramScheme reads tgram://<bot token>/<chat>[/<chat>...]. The token
+// has a colon in it, so it is not parsed as a host.
+func telegramScheme(target string, cfg ChannelConfig) (Notifier, error) {
+	token, rest, _ := strings.Cut(target, "/")
+	var chats []string
+	for _, c := range strings.Split(rest, "/") {
+		if c != "" {
+			chats = append(chats, c)
+		}
+	}
+	if token == "" || len(chats) == 0 {
+		return nil, fmt.Errorf("needs a bot token and a chat")
+	}
+	tmpl, err := parseMessageTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	return telegramNotifier{token: token, chats: chats, template: tmpl}, nil
+}
+
+// discordScheme reads discord://<webhook id>/<webhook token>.
+func discordScheme(target string, cfg ChannelConfig) (Notifier, error) {
+	parts := strings.Split(strings.Trim(target, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("needs a webhook id and token")
+	}
+	tmpl, err := parseMessageTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	return discordNotifier{url: "https://discord.com/api/webhooks/" + parts[0] + "/" + parts[1], template: tmpl, crop: cfg.Crop}, nil
+}
+
+// slackScheme reads slack://<T...>/<B...>/<token>, the path of an
+// incoming webhook.
+func slackScheme(target string, cfg ChannelConfig) (Notifier, error) {
+	parts := strings.Split(strings.Trim(target, "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("needs the three parts of a webhook path")
+	}
+	tmpl, err := parseMessageTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	return slackNotifier{url: "https://hooks.slack.com/services/" + strings.Join(parts, "/"), template: tmpl}, nil
+}
+
+// mailScheme reads mailto://[<user>:<password>@]<smtp host>[:port]
+// [?to=<address>,...&from=<address>]; mailtos connects with TLS right
+// away.
+func mailScheme(implicitTLS bool) notifierScheme {
+	return func(target string, cfg ChannelConfig) (Notifier, error) {
+		u, err := parseTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("needs an smtp host")
+		}
+		m := mailNotifier{host: u.Hostname(), port: u.Port(), implicitTLS: implicitTLS}
+		if m.port == "" {
+			m.port = "587"
+			if implicitTLS {
+				m.port = "465"
+			}
+		}
+		if u.User != nil {
+			m.user = u.User.Username()
+			m.password, _ = u.User.Password()
+		}
+
+		q := u.Query()
+		m.from = q.Get("from")
+		if m.from == "" {
+			m.from = "ledradar@" + m.host
+			if strings.Contains(m.user, "@") {
+				m.from = m.user
+			}
+		}
+		for _, to := range strings.Split(q.Get("to"), ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				m.to = append(m.to, to)
+			}
+		}
+		if len(m.to) == 0 {
+			m.to = []string{m.from}
+		}
+
+		if m.template, err = parseMessageTemplate(cfg.Template); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// localKm returns the position of (lat, lon) relative to the origin in km,
+// x pointing east and y north. Good enough within a few hundred km.
+func localKm(originLat, originLon, lat, lon float64) (float64, float64) {
+	return (lon - originLon) * 111.32 * math.Cos(radians(originLat)), (lat - originLat) * 110.57
+}
+
+// cellArrival extrapolates the cell along its current motion and returns
+// when its edge first reaches the point, or false if it does not within
+// the horizon.
+func cellArrival(cell *Cell, lat, lon float64, horizon time.Duration) (time.Duration, bool) {
+	px, py := localKm(lat, lon, cell.Lat, cell.Lon)
+	radius := math.Sqrt(cell.AreaKm2 / math.Pi)
+
+	// already over the point
+	if px*px+py*py <= radius*radius {
+		return 0, true
+	}
+	if !cell.Tracked || cell.SpeedKmh <= 0 {
+		return 0, false
+	}
+
+	// solve |p + v t| = radius for the smallest t >= 0
+	h := radians(cell.Heading)
+	vx, vy := cell.SpeedKmh*math.Sin(h), cell.SpeedKmh*math.Cos(h)
+	a := vx*vx + vy*vy
+	b := 2 * (px*vx + py*vy)
+	c := px*px + py*py - radius*radius
+	disc := b*b - 4*a*c
+	if disc < 0 {
+		return 0, false
+	}
+	t := (-b - math.Sqrt(disc)) / (2 * a)
+	if t < 0 {
+		return 0, false
+	}
+
+	eta := time.Duration(t * float64(time.Hour))
+	return eta, eta <= horizon
+}
+
+// cellExit returns when the trailing edge of a tracked cell over the
+// point passes it, false if the cell is not over the point or does not
+// move.
+func cellExit(cell *Cell, lat, lon float64) (time.Duration, bool) {
+	px, py := localKm(lat, lon, cell.Lat, cell.Lon)
+	radius := math.Sqrt(cell.AreaKm2 / math.Pi)
+	if px*px+py*py > radius*radius || !cell.Tracked || cell.SpeedKmh <= 0 {
+		return 0, false
+	}
+
+	// the larger root of |p + v t| = radius, c <= 0 so there is one
+	h := radians(cell.Heading)
+	vx, vy := cell.SpeedKmh*math.Sin(h), cell.SpeedKmh*math.Cos(h)
+	a := vx*vx + vy*vy
+	b := 2 * (px*vx + py*vy)
+	c := px*px + py*py - radius*radius
+	t := (-b + math.Sqrt(b*b-4*a*c)) / (2 * a)
+	return time.Duration(t * float64(time.Hour)), true
+}
+
+// rainEnd estimates when the rain over a raining city stops: when the
+// wind brings dry air, or else when the storm cells over it have passed.
+func rainEnd(city *City, cells []*Cell, wind func() (time.Duration, bool)) *int {
+	end, ok := wind()
+	if !ok {
+		for _, cell := range cells {
+			if t, over := cellExit(cell, city.Lat, city.Lon); over && (!ok || t > end) {
+				end, ok = t, true
+			}
+		}
+	}
+	if !ok {
+		return nil
+	}
+	minutes := int(math.Ceil(end.Minutes()))
+	return &minutes
+}
+
+type willRainResponse struct {
+	CityID     int       `json:"cityId"`
+	Name       string    `json:"name"`
+	Frame      time.Time `json:"frame"`
+	Within     string    `json:"within"`
+	WillRain   bool      `json:"willRain"`
+	Confidence float64   `json:"confidence"`
+	ETAMinutes *int      `json:"etaMinutes,omitempty"`
+	// EndsInMinutes is when the rain stops, for raining cities.
+	EndsInMinutes *int   `json:"endsInMinutes,omitempty"`
+	Reason        string `json:"reason"`
+}
+
+// willRain combines the current state of the city with the extrapolated
+// storm cells and the wind nowcast.
+func willRain(city *City, cells []*Cell, within time.Duration) willRainResponse {
+	res := willRainResponse{CityID: city.ID, Name: city.Name, Within: within.String()}
+
+	if city.Raining() {
+		zero := 0
+		res.WillRain, res.Confidence, res.ETAMinutes, res.Reason = true, 0.95, &zero, "raining now"
+		res.EndsInMinutes = city.EndsInMinutes
+		return res
+	}
+
+	best := time.Duration(-1)
+	for _, cell := range cells {
+		if eta, ok := cellArrival(cell, city.Lat, city.Lon, within); ok && (best < 0 || eta < best) {
+			best = eta
+		}
+	}
+	reason := "approaching storm cell"
+	// the wind also carries rain too weak or scattered for a cell
+	if a := city.AdvectionMinutes; a != nil {
+		if eta := time.Duration(*a) * time.Minute; eta <= within && (best < 0 || eta < best) {
+			best, reason = eta, "rain carried by the wind"
+		}
+	}
+	if best >= 0 {
+		minutes := int(best.Minutes())
+		res.WillRain, res.ETAMinutes, res.Reason = true, &minutes, reason
+		// extrapolation gets less reliable with lead time
+		res.Confidence = math.Round((0.9-0.5*best.Seconds()/within.Seconds())*100) / 100
+		return res
+	}
+
+	// no cell on the way; the closer any rain is, the less sure we are
+	res.Reason = "no precipitation approaching"
+	res.Confidence = 0.9
+	if nr := city.NearestRain; nr != nil {
+		reach := 40 * within.Hours() // typical speed of showers, km
+		if nr.DistanceKm < reach {
+			res.Reason = "rain nearby, not moving towards the city"
+			res.Confidence = math.Round((0.5+0.4*nr.DistanceKm/reach)*100) / 100
+		}
+	}
+	return res
+}
+
+func (h *Handler) HandleWillRain(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["cityId"])
+	if err != nil {
+		http.Error(w, "invalid city id", http.StatusBadRequest)
+		return
+	}
+
+	within := 30 * time.Minute
+	if v := r.URL.Query().Get("within"); v != "" {
+		if within, err = time.ParseDuration(v); err != nil || within <= 0 || within > 3*time.Hour {
+			http.Error(w, "within must be a duration up to 3h", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	var city *City
+	for _, c := range h.Snapshot.Cities {
+		if c.ID == id {
+			city = c
+		}
+	}
+	if city == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.writeStaleness(w) {
+		return
+	}
+
+	res := willRain(city, h.Cells, within)
+	res.Frame = h.FrameTime
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image/color"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Update is the result of a processed frame as handed to the outputs.
+type Update struct {
+	Frame time.Time
+	// FrameID is the ID of the snapshot the update was made from.
+	FrameID uint64
+	Source  string
+	// Radar is the frame the cities were evaluated on, nil for data from
+	// the fallback.
+	Radar *Frame
+	// Image is the annotated frame as PNG.
+	Image       []byte
+	Cities      []City
+	Sets        map[string][]City
+	Cells       []*Cell
+	Transitions []TransitionEvent
+	LEDs        []color.NRGBA
+	// Behaviors is how every LED shows its color.
+	Behaviors []LEDBehavior
+	// LEDDBZ is the reflectivity behind every LED the palettes color
+	// them by, NaN for LEDs they leave alone.
+	LEDDBZ []float64
+	// Now is when the update was made.
+	Now time.Time
+	// Simulated is set while POST /admin/simulate overrides the radar.
+	Simulated bool
+
+	// span is the trace the update was made in.
+	span trace.SpanContext
+	// report collects how the outputs did, nil outside the loop.
+	report *frameReport
+}
+
+// Raining returns the cities with rain.
+func (u *Update) Raining() []City {
+	cities := []City{}
+	for _, city := range u.Cities {
+		if city.Raining() {
+			cities = append(cities, city)
+		}
+	}
+	return cities
+}
+
+// markSimulated flags u and its transitions as caused by a simulation.
+func (u *Update) markSimulated() {
+	u.Simulated = true
+	transitions := slices.Clone(u.Transitions)
+	for i := range transitions {
+		transitions[i].Simulated = true
+	}
+	u.Transitions = transitions
+}
+
+// update captures the current state for the outputs. Must be called with
+// h.m held.
+func (h *Handler) update(frameTime time.Time, radar *Frame, transitions []TransitionEvent) *Update {
+	u := &Update{
+		Frame:       frameTime,
+		FrameID:     h.Snapshot.ID,
+		Source:      h.DataSource,
+		Radar:       radar,
+		Image:       h.Image,
+		Cities:      make([]City, len(h.Cities)),
+		Sets:        map[string][]City{},
+		Cells:       h.Cells,
+		Transitions: transitions,
+		Now:         h.clock.Now(),
+		Simulated:   h.DataSource == simulationSource,
+	}
+	if u.Simulated {
+		u.markSimulated()
+	}
+	for i, city := range h.Cities {
+		u.Cities[i] = *city
+	}
+	for name, set := range h.Sets {
+		cities := make([]City, len(set.Cities))
+		for i, city := range set.Cities {
+			cities[i] = *city
+		}
+		u.Sets[name] = cities
+	}
+	if h.ledPoints != nil {
+		if radar == nil {
+			h.followCities()
+		}
+		u.LEDs = pointColors(h.ledPoints, h.config.LEDs)
+		u.Behaviors = pointBehaviors(h.ledPoints, len(u.LEDs), h.config.LEDs)
+		u.LEDDBZ = pointReflectivity(h.ledPoints, len(u.LEDs))
+	} else {
+		u.LEDs = ledColors(u.Cities, h.config.LEDs)
+		u.Behaviors = ledBehaviors(u.Cities, len(u.LEDs), h.config.LEDs)
+		u.LEDDBZ = ledReflectivity(u.Cities, len(u.LEDs), h.config.LEDs)
+	}
+	if i := h.config.LEDs.Summary; i != nil && h.Stats != nil && radar != nil {
+		for len(u.LEDs) <= *i {
+			u.LEDs = append(u.LEDs, color.NRGBA{})
+			u.Behaviors = append(u.Behaviors, BehaviorSolid)
+			u.LEDDBZ = append(u.LEDDBZ, 0)
+		}
+		u.LEDs[*i] = h.Stats.summaryColor()
+		u.LEDDBZ[*i] = h.Stats.SummaryDBZ
+	}
+	return u
+}
+
+// Output is a driver every update is sent to.
+type Output interface {
+	// Name identifies the output in logs, unique among the outputs.
+	Name() string
+	Send(u *Update) error
+}
+
+// outputs lists the outputs enabled in cfg.
+func (h *Handler) outputs(cfg *Config) []Output {
+	var outputs []Output
+	if len(cfg.Notify.Rules) > 0 {
+		outputs = append(outputs, &h.rules)
+	}
+	if cfg.NATS.URL != "" {
+		outputs = append(outputs, &h.publisher)
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		outputs = append(outputs, &h.kafka)
+	}
+	if cfg.Redis.URL != "" {
+		outputs = append(outputs, &h.redis)
+	}
+	if cfg.Outputs.MQTT.Broker != "" {
+		outputs = append(outputs, &h.mqtt)
+	}
+	if cfg.Outputs.Pixoo.Host != "" {
+		outputs = append(outputs, &h.pixoo)
+	}
+	if len(cfg.Outputs.DDP) > 0 {
+		outputs = append(outputs, &h.ddp)
+	}
+	if cfg.Outputs.Hue.Bridge != "" {
+		outputs = append(outputs, &h.hue)
+	}
+	if len(cfg.Outputs.Bulbs) > 0 {
+		outputs = append(outputs, &h.bulbs)
+	}
+	if cfg.EventLog.Path != "" {
+		outputs = append(outputs, &h.eventLog)
+	}
+	if cfg.Outputs.StatsD.Address != "" {
+		outputs = append(outputs, &h.statsd)
+	}
+	for _, c := range cfg.Outputs.Webhooks {
+		// the templates were checked when the config was loaded
+		o, _ := newWebhookOutput(c)
+		outputs = append(outputs, o)
+	}
+	for _, c := range cfg.Outputs.Files {
+		outputs = append(outputs, fileOutput{c})
+	}
+	for _, c := range cfg.Outputs.Hooks {
+		outputs = append(outputs, hookOutput{c, cfg.Outputs.Retry})
+	}
+	outputs = append(outputs, h.plugins.outputs()...)
+	if h.dryRun {
+		for i, o := range outputs {
+			outputs[i] = dryRunOutput{o}
+		}
+	}
+	return outputs
+}
+
+// dryRunOutput logs what an output would get instead of sending it.
+type dryRunOutput struct {
+	Output
+}
+
+func (o dryRunOutput) Send(u *Update) error {
+	var changes []string
+	for _, t := range u.Transitions {
+		if t.Raining {
+			changes = append(changes, "+"+t.City.Name)
+		} else {
+			changes = append(changes, "-"+t.City.Name)
+		}
+	}
+	log.Printf("Dry run: %s would get frame %s with %d cities raining and %d LEDs, transitions [%s]",
+		o.Name(), u.Frame.Format(frameTimeFormat), len(u.Raining()), len(u.LEDs), strings.Join(changes, " "))
+	return nil
+}
+
+type RetryConfig struct {
+	// Attempts is how often a failing output is tried per update.
+	Attempts int `yaml:"attempts"`
+	// Backoff is the wait before the first retry, doubled for each next.
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// outputQueue is how many updates an output may fall behind before new
+// ones are dropped.
+const outputQueue = 8
+
+// Dispatcher fans updates out to the outputs. Every output has its own
+// goroutine and queue, so a slow or failing one does not hold up the
+// others.
+type Dispatcher struct {
+	m       sync.Mutex
+	workers map[string]*outputWorker
+}
+
+type outputWorker struct {
+	m     sync.Mutex
+	out   Output
+	retry RetryConfig
+	queue chan *Update
+}
+
+// Configure starts workers for new outputs and stops those of outputs
+// that are gone, outputs with the same name keep their queue.
+func (d *Dispatcher) Configure(outputs []Output, retry RetryConfig) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	workers := map[string]*outputWorker{}
+	for _, out := range outputs {
+		name := out.Name()
+		if _, ok := workers[name]; ok {
+			log.Printf("Duplicate output %s, skipping", name)
+			continue
+		}
+		w, ok := d.workers[name]
+		if ok {
+			delete(d.workers, name)
+		} else {
+			w = &outputWorker{queue: make(chan *Update, outputQueue)}
+			go w.run()
+		}
+		w.m.Lock()
+		w.out, w.retry = out, retry
+		w.m.Unlock()
+		workers[name] = w
+	}
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.workers = workers
+}
+
+// Dispatch queues u for every output.
+func (d *Dispatcher) Dispatch(u *Update) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	for name, w := range d.workers {
+		select {
+		case w.queue <- u:
+			u.report.output(name, OutputReport{State: "queued"})
+		default:
+			log.Printf("Output %s is falling behind, dropping frame %s", name, u.Frame.Format(frameTimeFormat))
+			u.report.output(name, OutputReport{State: "dropped"})
+		}
+	}
+}
+
+func (w *outputWorker) run() {
+	for u := range w.queue {
+		w.m.Lock()
+		out, retry := w.out, w.retry
+		w.m.Unlock()
+		deliver(out, u, retry)
+	}
+}
+
+// selfRetrying is an output retrying the parts of an update that failed
+// by itself, deliver sends it once.
+type selfRetrying interface {
+	retriesItself()
+}
+
+// deliver sends u, retrying with a growing backoff.
+func deliver(out Output, u *Update, retry RetryConfig) {
+	if _, ok := out.(selfRetrying); ok {
+		retry.Attempts = 1
+	}
+	_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), u.span), "output "+out.Name(),
+		frameAttributes(u.Source, u.Frame))
+	backoff := retry.Backoff
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := safeSend(out, u)
+		if err == nil {
+			u.report.output(out.Name(), OutputReport{State: "sent", Attempts: attempt, DurationMs: milliseconds(time.Since(start))})
+			span.End()
+			return
+		}
+		if attempt >= retry.Attempts {
+			log.Printf("Output %s failed: %s, giving up on frame %s", out.Name(), err, u.Frame.Format(frameTimeFormat))
+			u.report.output(out.Name(), OutputReport{State: "failed", Attempts: attempt, DurationMs: milliseconds(time.Since(start)), Error: err.Error()})
+			endSpan(span, err)
+			return
+		}
+		log.Printf("Output %s failed: %s, retrying in %s", out.Name(), err, backoff)
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error())))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// safeSend keeps a panicking output from taking the service down.
+func safeSend(out Output, u *Update) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return out.Send(u)
+}
+
+// updatePayload is what the webhook and file outputs write.
+type updatePayload struct {
+	Frame       time.Time         `json:"frame"`
+	Source      string            `json:"source"`
+	Cities      []City            `json:"cities"`
+	Transitions []TransitionEvent `json:"transitions"`
+	Simulated   bool              `json:"simulated,omitempty"`
+}
+
+func newUpdatePayload(u *Update) updatePayload {
+	transitions := u.Transitions
+	if transitions == nil {
+		transitions = []TransitionEvent{}
+	}
+	return updatePayload{Frame: u.Frame, Source: u.Source, Cities: u.Cities, Transitions: transitions, Simulated: u.Simulated}
+}
+
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Template is a text/template of the body, executed on the update
+	// payload or, with PerTransition, on the TransitionEvent. Empty posts
+	// the payload as JSON. The json function encodes a value as JSON.
+	Template string `yaml:"template"`
+	// Headers are added to the requests, their values are templates
+	// like Template. Content-Type is application/json unless set here.
+	Headers map[string]string `yaml:"headers"`
+	// PerTransition posts once for every city starting or stopping to
+	// rain instead of once per frame.
+	PerTransition bool `yaml:"perTransition"`
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhookOutput posts every update, as JSON or rendered by the templates.
+type webhookOutput struct {
+	cfg     WebhookConfig
+	body    *template.Template
+	headers map[string]*template.Template
+}
+
+func newWebhookOutput(cfg WebhookConfig) (webhookOutput, error) {
+	o := webhookOutput{cfg: cfg, headers: map[string]*template.Template{}}
+	var err error
+	if cfg.Template != "" {
+		if o.body, err = template.New("body").Funcs(webhookFuncs).Parse(cfg.Template); err != nil {
+			return o, fmt.Errorf("webhook %s: invalid template: %w", cfg.URL, err)
+		}
+	}
+	for name, value := range cfg.Headers {
+		if o.headers[name], err = template.New(name).Funcs(webhookFuncs).Parse(value); err != nil {
+			return o, fmt.Errorf("webhook %s: invalid header %s: %w", cfg.URL, name, err)
+		}
+	}
+	return o, nil
+}
+
+// Name tells webhooks to the same URL apart by the rest of their config,
+// the dispatcher keeps one output per name.
+func (o webhookOutput) Name() string {
+	name := "webhook " + o.cfg.URL
+	if o.cfg.PerTransition {
+		name += " per transition"
+	}
+	if o.cfg.Template == "" && len(o.cfg.Headers) == 0 {
+		return name
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%q", o.cfg.Template)
+	headers := make([]string, 0, len(o.cfg.Headers))
+	for k := range o.cfg.Headers {
+		headers = append(headers, k)
+	}
+	slices.Sort(headers)
+	for _, k := range headers {
+		fmt.Fprintf(h, " %q=%q", k, o.cfg.Headers[k])
+	}
+	return fmt.Sprintf("%s #%08x", name, h.Sum32())
+}
+
+func (o webhookOutput) Send(u *Update) error {
+	if !o.cfg.PerTransition {
+		return o.post(newUpdatePayload(u))
+	}
+	var errs []error
+	for _, t := range u.Transitions {
+		errs = append(errs, o.post(t))
+	}
+	return errors.Join(errs...)
+}
+
+func (o webhookOutput) post(data any) error {
+	var body []byte
+	if o.body == nil {
+		var err error
+		if body, err = json.Marshal(data); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := o.body.Execute(&buf, data); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, tmpl := range o.headers {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, data); err != nil {
+			return err
+		}
+		req.Header.Set(name, value.String())
+	}
+	return send(req)
+}
+
+type FileConfig struct {
+	Path string `yaml:"path"`
+	// Format is json (the city results) or png (the annotated frame).
+	Format string `yaml:"format"`
+}
+
+// fileOutput replaces a file with the latest update.
+type fileOutput struct {
+	cfg FileConfig
+}
+
+func (o fileOutput) Name() string {
+	return "file " + o.cfg.Path
+}
+
+func (o fileOutput) Send(u *Update) error {
+	var data []byte
+	switch o.cfg.Format {
+	case "png":
+		if u.Image == nil {
+			return nil
+		}
+		data = u.Image
+	case "", "json":
+		var err error
+		if data, err = json.MarshalIndent(newUpdatePayload(u), "", "  "); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", o.cfg.Format)
+	}
+
+	// readers never see a half written file
+	tmp, err := os.CreateTemp(filepath.Dir(o.cfg.Path), ".ledradar-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Chmod(0644))
+	if err = errors.Join(err, tmp.Close()); err == nil {
+		err = os.Rename(tmp.Name(), o.cfg.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// chmiPalette is the CHMI reflectivity legend, one color per 4 dBZ step
+// starting at 4 dBZ.
+var chmiPalette = []color.NRGBA{
+	{56, 0, 112, 255},
+	{48, 0, 168, 255},
+	{0, 0, 252, 255},
+	{0, 108, 192, 255},
+	{0, 160, 0, 255},
+	{0, 188, 0, 255},
+	{52, 216, 0, 255},
+	{156, 220, 0, 255},
+	{224, 220, 0, 255},
+	{252, 176, 0, 255},
+	{252, 132, 0, 255},
+	{252, 88, 0, 255},
+	{252, 0, 0, 255},
+	{160, 0, 0, 255},
+	{252, 252, 252, 255},
+}
+
+// dbzColor returns the legend color for a reflectivity, transparent below
+// the lowest class.
+func dbzColor(dbz float64) color.NRGBA {
+	i := int(math.Floor(dbz/4)) - 1
+	if i < 0 {
+		return color.NRGBA{}
+	}
+	if i >= len(chmiPalette) {
+		i = len(chmiPalette) - 1
+	}
+	return chmiPalette[i]
+}
+
+// Palette selects the colors rain is shown in: chmi (the radar legend),
+// viridis, colorblind (cividis, safe for red-green color blindness) or
+// mono (brightness by reflectivity).
+type Palette string
+
+const (
+	PaletteCHMI       Palette = "chmi"
+	PaletteViridis    Palette = "viridis"
+	PaletteColorblind Palette = "colorblind"
+	PaletteMono       Palette = "mono"
+)
+
+// paletteColors are the colors of the palettes for the classes of
+// chmiPalette.
+var paletteColors = map[Palette][]color.NRGBA{
+	PaletteViridis: {
+		{68, 1, 84, 255}, {70, 26, 106, 255}, {69, 50, 125, 255}, {62, 71, 134, 255},
+		{55, 91, 140, 255}, {46, 109, 142, 255}, {39, 127, 141, 255}, {33, 145, 140, 255},
+		{37, 162, 133, 255}, {48, 178, 124, 255}, {79, 193, 107, 255}, {117, 206, 84, 255},
+		{162, 217, 55, 255}, {207, 225, 43, 255}, {253, 231, 37, 255},
+	},
+	PaletteColorblind: {
+		{0, 34, 78, 255}, {19, 46, 86, 255}, {37, 59, 95, 255}, {56, 71, 103, 255},
+		{73, 84, 109, 255}, {90, 97, 113, 255}, {107, 110, 116, 255}, {124, 123, 120, 255},
+		{142, 138, 117, 255}, {161, 153, 115, 255}, {179, 168, 112, 255}, {198, 183, 105, 255},
+		{217, 200, 93, 255}, {236, 217, 82, 255}, {255, 234, 70, 255},
+	},
+}
+
+func (p Palette) validate() error {
+	switch p {
+	case "", PaletteCHMI, PaletteViridis, PaletteColorblind, PaletteMono:
+		return nil
+	}
+	return fmt.Errorf("unknown palette %q, expected chmi, viridis, colorblind or mono", p)
+}
+
+// resolvePalettes validates the palettes and gives the outputs without one
+// the global palette.
+func (cfg *Config) resolvePalettes() error {
+	if cfg.Palette == "" {
+		cfg.Palette = PaletteCHMI
+	}
+	o := &cfg.Outputs
+	palettes := []*Palette{&cfg.Image.Palette, &o.Pixoo.Palette, &o.Hue.Palette}
+	for i := range o.DDP {
+		palettes = append(palettes, &o.DDP[i].Palette)
+	}
+	for i := range o.Bulbs {
+		palettes = append(palettes, &o.Bulbs[i].Palette)
+	}
+	if err := cfg.Palette.validate(); err != nil {
+		return err
+	}
+	for _, p := range palettes {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		*p = p.or(cfg.Palette)
+	}
+	return nil
+}
+
+// or is p, def when p is unset.
+func (p Palette) or(def Palette) Palette {
+	if p == "" {
+		return def
+	}
+	return p
+}
+
+// recolors tells whether p shows other colors than the radar legend.
+func (p Palette) recolors() bool {
+	return p != "" && p != PaletteCHMI
+}
+
+// color is the color of a reflectivity, black below the lowest class.
+func (p Palette) color(dbz float64) color.NRGBA {
+	if !(dbz >= 4) {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	if p == PaletteMono {
+		v := uint8(min(255, 40+dbz*215/60))
+		return color.NRGBA{v, v, v, 255}
+	}
+	colors, ok := paletteColors[p]
+	if !ok {
+		colors = chmiPalette
+	}
+	return colors[min(int(dbz/4)-1, len(colors)-1)]
+}
+
+// Map recolors a radar legend color, leaving black alone.
+func (p Palette) Map(c color.NRGBA) color.NRGBA {
+	if !p.recolors() || c.R|c.G|c.B == 0 {
+		return c
+	}
+	m := p.color(colorDBZ(c.R, c.G, c.B))
+	m.A = c.A
+	return m
+}
+
+// recolor copies img with the legend colors in p, other colors such as
+// those of markers are kept.
+func (p Palette) recolor(img *image.NRGBA) *image.NRGBA {
+	out := copyNRGBA(nil, img)
+	mapped := map[[3]uint8][3]uint8{}
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		px := out.Pix[i : i+4]
+		if px[3] == 0 || px[0]|px[1]|px[2] == 0 {
+			continue
+		}
+		key := [3]uint8{px[0], px[1], px[2]}
+		to, seen := mapped[key]
+		if !seen {
+			to = key
+			if paletteDistance(key) <= legendTolerance {
+				c := p.Map(color.NRGBA{key[0], key[1], key[2], 255})
+				to = [3]uint8{c.R, c.G, c.B}
+			}
+			mapped[key] = to
+		}
+		px[0], px[1], px[2] = to[0], to[1], to[2]
+	}
+	return out
+}
+
+// legendTolerance is the squared distance up to which a color is taken
+// for a legend color, leaving room for resampling.
+const legendTolerance = 16 * 16
+
+// rainRateDBZ converts a rain rate in mm/h to reflectivity using the
+// Marshall-Palmer relation Z = 200 R^1.6.
+func rainRateDBZ(mmh float64) float64 {
+	if mmh <= 0 {
+		return math.Inf(-1)
+	}
+	return 10 * math.Log10(200*math.Pow(mmh, 1.6))
+}
+
+// colorDBZ maps a sampled color back to reflectivity using the closest
+// legend entry. Black means no echo.
+func colorDBZ(r, g, b uint8) float64 {
+	if r == 0 && g == 0 && b == 0 {
+		return math.Inf(-1)
+	}
+
+	best, bestDist := 0, math.MaxFloat64
+	for i, c := range chmiPalette {
+		dr := float64(r) - float64(c.R)
+		dg := float64(g) - float64(c.G)
+		db := float64(b) - float64(c.B)
+		if d := dr*dr + dg*dg + db*db; d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return float64(4 * (best + 1))
+}
+
+// Intensity is a coarse precipitation class derived from reflectivity.
+type Intensity int
+
+const (
+	IntensityNone Intensity = iota
+	IntensityLight
+	IntensityModerate
+	IntensityHeavy
+	IntensitySevere
+)
+
+var intensityNames = []string{"none", "light", "moderate", "heavy", "severe"}
+
+func intensityOf(dbz float64) Intensity {
+	switch {
+	case dbz >= 52:
+		return IntensitySevere
+	case dbz >= 40:
+		return IntensityHeavy
+	case dbz >= 28:
+		return IntensityModerate
+	case dbz >= 4:
+		return IntensityLight
+	}
+	return IntensityNone
+}
+
+func (i Intensity) String() string {
+	if i < 0 || int(i) >= len(intensityNames) {
+		return "none"
+	}
+	return intensityNames[i]
+}
+
+func parseIntensity(s string) (Intensity, error) {
+	for i, name := range intensityNames {
+		if strings.EqualFold(s, name) {
+			return Intensity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown intensity %q", s)
+}
+
+func (i Intensity) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+func (i *Intensity) UnmarshalText(text []byte) error {
+	v, err := parseIntensity(string(text))
+	*i = v
+	return err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// toNRGBA converts a decoded image without going through the color
+// interfaces for the formats radar PNGs come in.
+func toNRGBA(img image.Image) *image.NRGBA {
+	switch src := img.(type) {
+	case *image.NRGBA:
+		if src.Rect.Min == (image.Point{}) {
+			return src
+		}
+	case *image.Paletted:
+		palette := make([]color.NRGBA, len(src.Palette))
+		for i, c := range src.Palette {
+			palette[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
+		}
+		b := src.Bounds()
+		dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+b.Dx()]
+			out := dst.Pix[y*dst.Stride:]
+			for x, i := range row {
+				c := palette[i]
+				out[4*x], out[4*x+1], out[4*x+2], out[4*x+3] = c.R, c.G, c.B, c.A
+			}
+		}
+		return dst
+	}
+	return imaging.Clone(img)
+}
+
+// copyNRGBA copies src into dst, allocating dst if it is missing or of a
+// different size.
+func copyNRGBA(dst, src *image.NRGBA) *image.NRGBA {
+	b := src.Bounds()
+	if dst == nil || dst.Bounds() != b {
+		dst = image.NewNRGBA(b)
+	}
+	if src.Stride == dst.Stride {
+		copy(dst.Pix, src.Pix)
+		return dst
+	}
+	for y := 0; y < b.Dy(); y++ {
+		copy(dst.Pix[y*dst.Stride:y*dst.Stride+4*b.Dx()], src.Pix[y*src.Stride:])
+	}
+	return dst
+}
+
+// fillRect paints r, clipped to img, with c.
+func fillRect(img *image.NRGBA, r image.Rectangle, c color.NRGBA) {
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := img.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+	}
+}
+
+// frameBuffers are reused from frame to frame so the pipeline does not
+// allocate a bitmap and a field for every frame. The mutex serializes
+// the frames using them.
+type frameBuffers struct {
+	sync.Mutex
+	// the annotated bitmap of the previous frame may still be served,
+	// so they alternate
+	bitmaps [2]*image.NRGBA
+	next    int
+	field   Field
+	// colors decode to the same reflectivity on every frame
+	dbz map[[3]uint8]float32
+	// area marks the pixels /stats counts, for frames and configs giving
+	// areaKey
+	area    []bool
+	areaKey string
+	// regions are the indexes into regionNames of the pixels of area,
+	// for the cities giving regionsKey
+	regions     []int
+	regionNames []string
+	regionsKey  string
+}
+
+// bitmap returns a copy of img to annotate.
+func (b *frameBuffers) bitmap(img *image.NRGBA) *image.NRGBA {
+	b.bitmaps[b.next] = copyNRGBA(b.bitmaps[b.next], img)
+	bitmap := b.bitmaps[b.next]
+	b.next ^= 1
+	return bitmap
+}
+
+// decodeField fills the reused field from img.
+func (b *frameBuffers) decodeField(img *image.NRGBA) *Field {
+	if b.dbz == nil {
+		b.dbz = map[[3]uint8]float32{}
+	}
+	fillField(&b.field, img, b.dbz)
+	return &b.field
+}
+
+// statsArea marks the pixels of frame the rain stats are taken over, row
+// by row: those inside the Czech border for the chmi source, those the
+// radar covers for the others, within the crop and outside the mask areas
+// either way. The marks are reused while frames cover the same area.
+func (b *frameBuffers) statsArea(frame *Frame, cfg *Config) []bool {
+	w, h := frame.Image.Bounds().Dx(), frame.Image.Bounds().Dy()
+	var corners [4]float64
+	corners[0], corners[1] = frame.Projection.Location(0, 0)
+	corners[2], corners[3] = frame.Projection.Location(w-1, h-1)
+	key := fmt.Sprint(w, h, corners, cfg.Source, cfg.CHMI, cfg.National, cfg.Crop, cfg.Composite.Sources, cfg.Mask.Areas)
+	if len(b.area) == w*h && key == b.areaKey {
+		return b.area
+	}
+
+	covers := radarCovers(cfg)
+	if cfg.Source == "" || cfg.Source == "chmi" {
+		covers = func(lat, lon float64) bool {
+			return czechBBox.Contains(lat, lon) && insideBorder(czechBorder, lat, lon) && (cfg.Crop.IsZero() || cfg.Crop.Contains(lat, lon))
+		}
+	}
+	b.area, b.areaKey = make([]bool, w*h), key
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			lat, lon := frame.Projection.Location(x, y)
+			b.area[y*w+x] = covers(lat, lon)
+		}
+	}
+	// the mask areas are in pixels of the downloaded image
+	var origin image.Point
+	if p, ok := frame.Projection.(offsetProjection); ok {
+		origin = image.Pt(p.dx, p.dy)
+	}
+	for _, a := range cfg.Mask.Areas {
+		r := a.rect().Sub(origin).Intersect(image.Rect(0, 0, w, h))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				b.area[y*w+x] = false
+			}
+		}
+	}
+	b.regionsKey = ""
+	return b.area
+}
+
+// regionRadiusKm is how far from its cities a region reaches in the
+// histograms of the regions.
+const regionRadiusKm = 30
+
+// regionPixels assigns the pixels of area to the region of the nearest
+// city with one within regionRadiusKm, -1 for none, and names the regions
+// by index. The assignment is reused while area and the cities stay.
+func (b *frameBuffers) regionPixels(frame *Frame, area []bool, cities []*City) ([]int, []string) {
+	var sig strings.Builder
+	var regional []*City
+	for _, city := range cities {
+		if city.Region != "" {
+			regional = append(regional, city)
+			fmt.Fprintf(&sig, "%s %g %g;", city.Region, city.Lat, city.Lon)
+		}
+	}
+	key := b.areaKey + "|" + sig.String()
+	if len(b.regions) == len(area) && key == b.regionsKey {
+		return b.regions, b.regionNames
+	}
+
+	index := map[string]int{}
+	b.regionNames = nil
+	for _, city := range regional {
+		if _, ok := index[city.Region]; !ok {
+			index[city.Region] = len(b.regionNames)
+			b.regionNames = append(b.regionNames, city.Region)
+		}
+	}
+	w := frame.Image.Bounds().Dx()
+	idx := newCityIndex(regional)
+	b.regions, b.regionsKey = make([]int, len(area)), key
+	for i, in := range area {
+		b.regions[i] = -1
+		if !in {
+			continue
+		}
+		lat, lon := frame.Projection.Location(i%w, i/w)
+		best := math.Inf(1)
+		idx.within(lat, lon, regionRadiusKm, func(city *City) {
+			if d := distanceKm(lat, lon, city.Lat, city.Lon); d < best {
+				best, b.regions[i] = d, index[city.Region]
+			}
+		})
+	}
+	return b.regions, b.regionNames
+}
+
+var pngEncoder = png.Encoder{
+	// frames are re-encoded every interval, on small boards the default
+	// compression level dominates the processing time
+	CompressionLevel: png.BestSpeed,
+	BufferPool:       &pngBuffers{},
+}
+
+type pngBuffers struct {
+	pool sync.Pool
+}
+
+func (p *pngBuffers) Get() *png.EncoderBuffer {
+	b, _ := p.pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *pngBuffers) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+func encodePNG(w io.Writer, img image.Image) error {
+	return pngEncoder.Encode(w, img)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type PixooConfig struct {
+	// Host is the device address, empty disables the driver.
+	Host string `yaml:"host"`
+	Size int    `yaml:"size"`
+	BBox BBox   `yaml:"bbox"`
+	Mask bool   `yaml:"mask"`
+	// Palette colors the image, the global palette when empty.
+	Palette Palette `yaml:"palette"`
+	// Refresh re-sends the last image periodically, 0 only pushes new
+	// frames.
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// Pixoo pushes the downsampled radar image to a Divoom Pixoo over its
+// local HTTP API.
+type Pixoo struct {
+	m     sync.Mutex
+	cfg   PixooConfig
+	frame *Frame
+	picID int
+	sent  time.Time
+}
+
+func (p *Pixoo) Configure(cfg PixooConfig) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if cfg.Size == 0 {
+		cfg.Size = 64
+	}
+	if cfg.BBox.IsZero() {
+		cfg.BBox = czechBBox
+	}
+	p.cfg = cfg
+}
+
+func (p *Pixoo) Name() string {
+	return "pixoo"
+}
+
+// Send pushes the radar frame of u, updates from the fallback have none.
+func (p *Pixoo) Send(u *Update) error {
+	if u.Radar == nil {
+		return nil
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.frame = u.Radar
+	return p.push()
+}
+
+// Run re-sends the last frame according to the refresh setting.
+func (p *Pixoo) Run() {
+	for range time.Tick(10 * time.Second) {
+		p.m.Lock()
+		if p.cfg.Refresh > 0 && time.Since(p.sent) >= p.cfg.Refresh {
+			if err := p.push(); err != nil {
+				log.Printf("Pixoo %s: %s", p.cfg.Host, err)
+			}
+		}
+		p.m.Unlock()
+	}
+}
+
+func (p *Pixoo) command(cmd map[string]any) error {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return postJSON(fmt.Sprintf("http://%s/post", p.cfg.Host), body)
+}
+
+// push must be called with p.m held.
+func (p *Pixoo) push() error {
+	if p.cfg.Host == "" || p.frame == nil {
+		return nil
+	}
+	p.sent = time.Now()
+
+	size := p.cfg.Size
+	pixels := renderMatrix(p.frame, p.cfg.BBox, size, size, p.cfg.Mask)
+	data := make([]byte, 0, len(pixels)*3)
+	for _, c := range pixels {
+		c = p.cfg.Palette.Map(c)
+		data = append(data, c.R, c.G, c.B)
+	}
+
+	// the device refuses picture IDs it has seen, so restart the sequence
+	// now and then
+	if p.picID == 0 || p.picID >= 1000 {
+		if err := p.command(map[string]any{"Command": "Draw/ResetHttpGifId"}); err != nil {
+			return err
+		}
+		p.picID = 1
+	}
+
+	err := p.command(map[string]any{
+		"Command":   "Draw/SendHttpGif",
+		"PicNum":    1,
+		"PicWidth":  size,
+		"PicOffset": 0,
+		"PicID":     p.picID,
+		"PicSpeed":  1000,
+		"PicData":   base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return err
+	}
+	p.picID++
+	return nil
+}
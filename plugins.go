@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// -----------------------------------------------------------------------------
+// WebAssembly plugins extend the daemon without a fork. A plugin is a
+// wasip1 reactor module, e.g. built with GOOS=wasip1 GOARCH=wasm go build
+// -buildmode=c-shared, exporting
+//
+//	alloc(size u32) u32                   memory for the host to write JSON to
+//	configure(ptr, len u32) i32           optional, gets config as JSON
+//	on_update(ptr, len u32) i32           optional, an output getting every update
+//	filter_city(ptr, len u32) u64         optional, may change the state of a city
+//
+// on_update gets the update as the file output writes it and returns 0 on
+// success. filter_city gets {"frame": ..., "city": ...} for every city
+// evaluated and returns ptr<<32|len of {"dbz": ..., "raining": ...}, both
+// optional, or 0 to leave the city alone. The host does not free what it
+// allocates, plugins may reuse it on the next alloc. From the module
+// "ledradar" the plugins import
+//
+//	log(ptr, len u32)                     writes a message to the log
+//	send(addr_ptr, addr_len, data_ptr, data_len u32) i32
+//
+// send writes data to udp://host:port or tcp://host:port or posts it to
+// an http(s) URL, returning 0 on success. Stdout and stderr go to the log.
+
+type PluginConfig struct {
+	// Path is the .wasm module, Name identifies the plugin in logs and
+	// /status, the file name by default.
+	Path string `yaml:"path"`
+	Name string `yaml:"name"`
+	// Config is handed to configure as JSON.
+	Config map[string]any `yaml:"config"`
+	// Timeout stops a call running longer, 5s by default.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const defaultPluginTimeout = 5 * time.Second
+
+func (c PluginConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return strings.TrimSuffix(filepath.Base(c.Path), ".wasm")
+}
+
+func (c PluginConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("plugin needs a path")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("plugin %s: timeout must not be negative", c.name())
+	}
+	// a missing module fails the config check instead of the reload
+	if _, err := os.Stat(c.Path); err != nil {
+		return fmt.Errorf("plugin %s: %w", c.name(), err)
+	}
+	return nil
+}
+
+// plugin is one loaded module. Modules run one call at a time.
+type plugin struct {
+	m        sync.Mutex
+	cfg      PluginConfig
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	mod      api.Module
+}
+
+// pluginLog writes what a plugin prints to the log, line by line.
+type pluginLog string
+
+func (name pluginLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Printf("Plugin %s: %s", name, line)
+	}
+	return len(p), nil
+}
+
+func loadPlugin(cfg PluginConfig) (*plugin, error) {
+	wasm, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	p := &plugin{cfg: cfg, runtime: r}
+	if err := p.init(ctx, wasm); err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: %w", cfg.name(), err)
+	}
+	return p, nil
+}
+
+func (p *plugin) init(ctx context.Context, wasm []byte) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		return err
+	}
+	name := p.cfg.name()
+	_, err := p.runtime.NewHostModuleBuilder("ledradar").
+		NewFunctionBuilder().WithFunc(func(_ context.Context, m api.Module, ptr, n uint32) {
+		if msg, ok := m.Memory().Read(ptr, n); ok {
+			log.Printf("Plugin %s: %s", name, msg)
+		}
+	}).Export("log").
+		NewFunctionBuilder().WithFunc(func(_ context.Context, m api.Module, addrPtr, addrLen, dataPtr, dataLen uint32) int32 {
+		addr, ok1 := m.Memory().Read(addrPtr, addrLen)
+		data, ok2 := m.Memory().Read(dataPtr, dataLen)
+		if !ok1 || !ok2 {
+			return -1
+		}
+		if err := pluginSend(string(addr), bytes.Clone(data)); err != nil {
+			log.Printf("Plugin %s: sending to %s: %s", name, addr, err)
+			return -1
+		}
+		return 0
+	}).Export("send").
+		Instantiate(ctx)
+	if err != nil {
+		return err
+	}
+	if p.compiled, err = p.runtime.CompileModule(ctx, wasm); err != nil {
+		return err
+	}
+	if _, ok := p.compiled.ExportedFunctions()["alloc"]; !ok {
+		return errors.New("the module does not export alloc")
+	}
+	return p.instantiate(ctx)
+}
+
+// instantiate starts the module, again after a call ran out of time.
+func (p *plugin) instantiate(ctx context.Context) error {
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStdout(pluginLog(p.cfg.name())).
+		WithStderr(pluginLog(p.cfg.name())).
+		WithSysWalltime()
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, cfg)
+	if err != nil {
+		return err
+	}
+	p.mod = mod
+	if p.cfg.Config == nil || mod.ExportedFunction("configure") == nil {
+		return nil
+	}
+	data, err := json.Marshal(p.cfg.Config)
+	if err != nil {
+		return err
+	}
+	res, err := p.call("configure", data)
+	if err == nil && int32(res) != 0 {
+		err = fmt.Errorf("configure failed with %d", int32(res))
+	}
+	return err
+}
+
+func (p *plugin) exports(fn string) bool {
+	_, ok := p.compiled.ExportedFunctions()[fn]
+	return ok
+}
+
+// call writes data into the module and calls fn with it. Must be called
+// with p.m held.
+func (p *plugin) call(fn string, data []byte) (uint64, error) {
+	timeout := p.cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultPluginTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if p.mod.IsClosed() {
+		if err := p.instantiate(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := p.mod.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	ptr := uint32(res[0])
+	if !p.mod.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("alloc returned %d, outside the memory", ptr)
+	}
+	res, err = p.mod.ExportedFunction(fn).Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	return res[0], nil
+}
+
+// read returns the result at ptr<<32|len in the memory of the module.
+// Must be called with p.m held.
+func (p *plugin) read(res uint64) ([]byte, error) {
+	data, ok := p.mod.Memory().Read(uint32(res>>32), uint32(res))
+	if !ok {
+		return nil, errors.New("result outside the memory")
+	}
+	return data, nil
+}
+
+func (p *plugin) close() {
+	p.runtime.Close(context.Background())
+}
+
+// pluginSend is the send host function.
+func pluginSend(addr string, data []byte) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		conn, err := net.DialTimeout(u.Scheme, u.Host, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write(data)
+		return err
+	case "http", "https":
+		req, err := http.NewRequest(http.MethodPost, addr, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return send(req)
+	}
+	return fmt.Errorf("unsupported address %q", addr)
+}
+
+// pluginOutput hands every update to a plugin exporting on_update.
+type pluginOutput struct {
+	p *plugin
+}
+
+func (o pluginOutput) Name() string {
+	return "plugin " + o.p.cfg.name()
+}
+
+func (o pluginOutput) Send(u *Update) error {
+	data, err := json.Marshal(newUpdatePayload(u))
+	if err != nil {
+		return err
+	}
+	o.p.m.Lock()
+	defer o.p.m.Unlock()
+	res, err := o.p.call("on_update", data)
+	if err != nil {
+		return err
+	}
+	if status := int32(res); status != 0 {
+		return fmt.Errorf("on_update failed with %d", status)
+	}
+	return nil
+}
+
+// Plugins are the loaded plugins.
+type Plugins struct {
+	m       sync.RWMutex
+	plugins []*plugin
+}
+
+// Configure loads the plugins of cfg, replacing the loaded ones once all
+// of them loaded. The old ones are kept on errors. The replaced ones stay
+// open for the outputs still sending to them until closeOld is called, once
+// the dispatcher has the new ones.
+func (ps *Plugins) Configure(cfg []PluginConfig) (closeOld func(), err error) {
+	var loaded []*plugin
+	for _, c := range cfg {
+		p, err := loadPlugin(c)
+		if err != nil {
+			for _, p := range loaded {
+				p.close()
+			}
+			return nil, err
+		}
+		loaded = append(loaded, p)
+	}
+
+	ps.m.Lock()
+	old := ps.plugins
+	ps.plugins = loaded
+	ps.m.Unlock()
+	return func() {
+		for _, p := range old {
+			p.m.Lock()
+			p.close()
+			p.m.Unlock()
+		}
+	}, nil
+}
+
+// outputs are the plugins exporting on_update.
+func (ps *Plugins) outputs() []Output {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	var outputs []Output
+	for _, p := range ps.plugins {
+		if p.exports("on_update") {
+			outputs = append(outputs, pluginOutput{p})
+		}
+	}
+	return outputs
+}
+
+type filterRequest struct {
+	Frame time.Time `json:"frame"`
+	City  *City     `json:"city"`
+}
+
+type filterResult struct {
+	DBZ     *float64 `json:"dbz"`
+	Raining *bool    `json:"raining"`
+}
+
+// filters reports whether a plugin exports filter_city.
+func (ps *Plugins) filters() bool {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	for _, p := range ps.plugins {
+		if p.exports("filter_city") {
+			return true
+		}
+	}
+	return false
+}
+
+// filter lets the plugins exporting filter_city change the state of a
+// city after it was evaluated, one after another, and returns all they
+// changed. Failing plugins leave it as it was.
+func (ps *Plugins) filter(frame time.Time, city *City) filterResult {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	var changed filterResult
+	for _, p := range ps.plugins {
+		if !p.exports("filter_city") {
+			continue
+		}
+		result, err := p.filterCity(frame, city)
+		if err != nil {
+			log.Printf("Plugin %s: filtering %s failed: %s", p.cfg.name(), city.Name, err)
+			continue
+		}
+		if result.DBZ != nil {
+			// the rain follows the new reflectivity unless told otherwise
+			city.setDBZ(*result.DBZ)
+			changed.DBZ, changed.Raining = result.DBZ, nil
+		}
+		if result.Raining != nil {
+			changed.Raining = result.Raining
+		}
+	}
+	return changed
+}
+
+// cityFilters are what the plugins changed of the cities, see
+// filterCities.
+type cityFilters map[*City]filterResult
+
+// filterCities runs the plugins exporting filter_city over copies of the
+// cities and those of every set, evaluated by eval as updateCities will.
+// Their calls may take up to the timeout of each plugin, so it is called
+// before h.m is taken for updateCities and only holds it to copy. Cities
+// a reload replaced meanwhile go unfiltered for that frame.
+func (h *Handler) filterCities(frame time.Time, eval func(*City) bool) cityFilters {
+	if !h.plugins.filters() {
+		return nil
+	}
+	var cities []*City
+	var copies []City
+	h.m.RLock()
+	h.eachCity(func(_ string, city *City) {
+		cities, copies = append(cities, city), append(copies, *city)
+	})
+	h.m.RUnlock()
+
+	filters := cityFilters{}
+	for i, city := range cities {
+		c := &copies[i]
+		eval(c)
+		if result := h.plugins.filter(frame, c); result.DBZ != nil || result.Raining != nil {
+			filters[city] = result
+		}
+	}
+	return filters
+}
+
+// apply changes city as the plugins changed its copy, returning whether it
+// rains then.
+func (f cityFilters) apply(city *City, raining bool) bool {
+	result, ok := f[city]
+	if !ok {
+		return raining
+	}
+	if result.DBZ != nil {
+		city.setDBZ(*result.DBZ)
+		raining = city.Raining()
+	}
+	if result.Raining != nil {
+		raining = *result.Raining
+	}
+	return raining
+}
+
+func (p *plugin) filterCity(frame time.Time, city *City) (filterResult, error) {
+	var result filterResult
+	data, err := json.Marshal(filterRequest{frame, city})
+	if err != nil {
+		return result, err
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	res, err := p.call("filter_city", data)
+	if err != nil || res == 0 {
+		return result, err
+	}
+	out, err := p.read(res)
+	if err != nil {
+		return result, err
+	}
+	return result, json.Unmarshal(out, &result)
+}
+
+// setDBZ gives the city the legend color and intensity of a reflectivity,
+// dry below the lowest class.
+func (s *RainState) setDBZ(dbz float64) {
+	col := dbzColor(dbz)
+	if col.A == 0 {
+		s.R, s.G, s.B, s.DBZ, s.Intensity = 0, 0, 0, 0, IntensityNone
+		return
+	}
+	s.R, s.G, s.B, s.DBZ, s.Intensity = col.R, col.G, col.B, dbz, intensityOf(dbz)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type pollResponse struct {
+	// Token is passed as since on the next poll.
+	Token   string    `json:"token"`
+	Frame   time.Time `json:"frame"`
+	FrameID uint64    `json:"frameId"`
+	Source  string    `json:"source"`
+	// Cities lists only the cities whose rain state changed since the
+	// token, all of them for the first poll.
+	Cities []*City `json:"cities"`
+}
+
+// HandlePoll answers as soon as the city state is newer than the since
+// token, waiting up to timeout (55s by default) for the next update.
+func (h *Handler) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := 55 * time.Second
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > 5*time.Minute {
+			http.Error(w, "timeout must be a duration of at most 5m", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	h.m.RLock()
+	wake := h.pollWake
+	seq := h.Snapshot.pollSeq
+	h.m.RUnlock()
+
+	if since == seq {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+
+	snap := h.Snapshot
+	resp := pollResponse{
+		Token:   strconv.FormatUint(snap.pollSeq, 10),
+		Frame:   snap.FrameTime,
+		FrameID: snap.ID,
+		Source:  snap.DataSource,
+		Cities:  []*City{},
+	}
+	// a token from before a restart is ahead of the counter
+	all := since == 0 || since > snap.pollSeq
+	cities, _ := h.tenantCities(r)
+	for _, city := range cities {
+		if all || city.changed > since {
+			resp.Cities = append(resp.Cities, city)
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%d"`, snap.pollSeq, since))
+	h.serveJSON(w, r, resp)
+}
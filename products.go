@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"time"
+)
+
+const chmiDataURL = "https://www.chmi.cz/files/portal/docs/meteo/rad/inca-cz/data/"
+
+// Product is one of the CHMI radar products.
+type Product struct {
+	// URL has {time} replaced by the frame time in UTC, in TimeFormat
+	// (a Go layout, 20060102.1504 by default).
+	URL        string        `yaml:"url"`
+	TimeFormat string        `yaml:"timeFormat"`
+	Cadence    time.Duration `yaml:"cadence"`
+	// Delay is how long after its frame time a frame is usually
+	// published, 5m by default.
+	Delay time.Duration `yaml:"delay"`
+	// Unit of the legend values: dbz, mmh (rain rate, or the total of a
+	// 1 h sum) or km (echo top height).
+	Unit string `yaml:"unit"`
+	// Legend maps the image colors to values. It can only be left empty
+	// for dbz products in the colors of chmiPalette.
+	Legend []LegendEntry `yaml:"legend"`
+	// Bounds is the area the image covers in lon/lat, the CHMI composite
+	// by default; set it for the composite of another country.
+	Bounds BBox `yaml:"bounds"`
+	// Grid places images that are not plain lon/lat images on the map.
+	Grid Grid `yaml:"grid"`
+	// Width and Height are the size of the image in pixels, downloads of
+	// another size are rejected; 0 accepts any.
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+}
+
+type LegendEntry struct {
+	Color string  `yaml:"color"` // #rrggbb
+	Value float64 `yaml:"value"`
+}
+
+type CHMIConfig struct {
+	Product string `yaml:"product"`
+	// Products adds products or overrides fields of the built-in ones.
+	Products map[string]Product `yaml:"products"`
+}
+
+// paletteLegend pairs the colors of chmiPalette with values.
+func paletteLegend(values ...float64) []LegendEntry {
+	legend := make([]LegendEntry, len(values))
+	for i, v := range values {
+		c := chmiPalette[i]
+		legend[i] = LegendEntry{Color: fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B), Value: v}
+	}
+	return legend
+}
+
+var chmiProducts = map[string]Product{
+	"z_max3d": {
+		URL:     chmiDataURL + "czrad-z_max3d/pacz2gmaps3.z_max3d.{time}.0.png",
+		Cadence: 10 * time.Minute,
+		Unit:    "dbz",
+	},
+	"pseudoCAPPI": {
+		URL:     chmiDataURL + "czrad-z_cappi020/pacz2gmaps3.z_cappi020.{time}.0.png",
+		Cadence: 10 * time.Minute,
+		Unit:    "dbz",
+	},
+	"echotop": {
+		URL:     chmiDataURL + "czrad-etop_max3d/pacz2gmaps3.etop_max3d.{time}.0.png",
+		Cadence: 10 * time.Minute,
+		Unit:    "km",
+		Legend:  paletteLegend(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15),
+	},
+	"merge1h": {
+		URL:     chmiDataURL + "czrad-merge1h/pacz2gmaps3.merge1h.{time}.0.png",
+		Cadence: time.Hour,
+		Unit:    "mmh",
+		Legend:  paletteLegend(0.1, 0.2, 0.5, 1, 2, 3, 5, 7, 10, 15, 20, 30, 40, 60, 80),
+	},
+}
+
+// product returns the selected product, with the configured fields laid
+// over the built-in ones.
+func (c CHMIConfig) product() (Product, error) {
+	return c.productNamed(c.Product)
+}
+
+// productNamed resolves a product like product, for another name.
+func (c CHMIConfig) productNamed(name string) (Product, error) {
+	if name == "" {
+		name = "z_max3d"
+	}
+	p, builtin := chmiProducts[name]
+	o, configured := c.Products[name]
+	if !builtin && !configured {
+		return Product{}, fmt.Errorf("unknown CHMI product %q", name)
+	}
+	return resolveProduct("CHMI product "+name, p, o)
+}
+
+// resolveProduct lays the configured fields of o over p and checks the
+// result, what names it in errors.
+func resolveProduct(what string, p, o Product) (Product, error) {
+	if o.URL != "" {
+		p.URL = o.URL
+	}
+	if o.TimeFormat != "" {
+		p.TimeFormat = o.TimeFormat
+	}
+	if p.TimeFormat == "" {
+		p.TimeFormat = "20060102.1504"
+	}
+	if o.Cadence != 0 {
+		p.Cadence = o.Cadence
+	}
+	if o.Delay != 0 {
+		p.Delay = o.Delay
+	}
+	if p.Delay == 0 {
+		p.Delay = 5 * time.Minute
+	}
+	if o.Unit != "" {
+		p.Unit = o.Unit
+	}
+	if p.Unit == "" {
+		p.Unit = "dbz"
+	}
+	if o.Legend != nil {
+		p.Legend = o.Legend
+	}
+	if !o.Bounds.IsZero() {
+		p.Bounds = o.Bounds
+	}
+	if o.Grid.Type != "" {
+		p.Grid = o.Grid
+	}
+	if o.Width != 0 || o.Height != 0 {
+		p.Width, p.Height = o.Width, o.Height
+	}
+
+	if !strings.Contains(p.URL, "{time}") {
+		return Product{}, fmt.Errorf("%s: url needs a {time} placeholder", what)
+	}
+	if p.Cadence <= 0 {
+		return Product{}, fmt.Errorf("%s: cadence must be positive", what)
+	}
+	if b := p.Bounds; !b.IsZero() && (b.North <= b.South || b.East <= b.West) {
+		return Product{}, fmt.Errorf("%s: bounds must have north above south and east of west", what)
+	}
+	if p.Delay < 0 {
+		return Product{}, fmt.Errorf("%s: delay must not be negative", what)
+	}
+	if err := p.Grid.validate(); err != nil {
+		return Product{}, fmt.Errorf("%s: %w", what, err)
+	}
+	if p.Width < 0 || p.Height < 0 {
+		return Product{}, fmt.Errorf("%s: width and height must not be negative", what)
+	}
+	if p.Unit != "dbz" && len(p.Legend) == 0 {
+		return Product{}, fmt.Errorf("%s: unit %s needs a legend", what, p.Unit)
+	}
+	if _, err := p.legend(); err != nil {
+		return Product{}, fmt.Errorf("%s: %w", what, err)
+	}
+	return p, nil
+}
+
+func (p Product) url(t time.Time) string {
+	return strings.ReplaceAll(p.URL, "{time}", t.UTC().Format(p.TimeFormat))
+}
+
+type legendColor struct {
+	c   color.NRGBA
+	dbz float64
+}
+
+// legend resolves the legend colors and converts the values to dBZ.
+func (p Product) legend() ([]legendColor, error) {
+	var toDBZ func(float64) float64
+	switch p.Unit {
+	case "dbz":
+		toDBZ = func(v float64) float64 { return v }
+	case "mmh":
+		toDBZ = rainRateDBZ
+	case "km":
+		// deeper convection reads as stronger: 10 km tops are heavy,
+		// 13 km severe
+		toDBZ = func(v float64) float64 { return 4 * v }
+	default:
+		return nil, fmt.Errorf("unknown unit %q", p.Unit)
+	}
+
+	legend := make([]legendColor, len(p.Legend))
+	for i, e := range p.Legend {
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(e.Color, "#%02x%02x%02x", &r, &g, &b); err != nil {
+			return nil, fmt.Errorf("invalid legend color %q", e.Color)
+		}
+		legend[i] = legendColor{color.NRGBA{r, g, b, 255}, toDBZ(e.Value)}
+	}
+	return legend, nil
+}
+
+// recolor maps every pixel of img through the legend into the
+// reflectivity palette the rest of the pipeline expects.
+func recolor(img *image.NRGBA, legend []legendColor) {
+	cache := map[color.NRGBA]color.NRGBA{}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		c := color.NRGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], 255}
+		if img.Pix[i+3] == 0 || c.R|c.G|c.B == 0 {
+			continue
+		}
+		out, ok := cache[c]
+		if !ok {
+			best, bestDist := 0, math.MaxFloat64
+			for j, l := range legend {
+				dr := float64(c.R) - float64(l.c.R)
+				dg := float64(c.G) - float64(l.c.G)
+				db := float64(c.B) - float64(l.c.B)
+				if d := dr*dr + dg*dg + db*db; d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			out = dbzColor(legend[best].dbz)
+			cache[c] = out
+		}
+		copy(img.Pix[i:i+4], []uint8{out.R, out.G, out.B, out.A})
+	}
+}
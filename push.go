@@ -0,0 +1,58 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const pushoverURL = "https://api.pushover.net/1/messages.json"
+
+// pushoverNotifier sends notifications through the Pushover API.
+type pushoverNotifier struct {
+	token, user string
+}
+
+func (p pushoverNotifier) Notify(n Notification) error {
+	form := url.Values{
+		"token":     {p.token},
+		"user":      {p.user},
+		"title":     {"Rain in " + n.City.Name},
+		"message":   {n.Message},
+		"timestamp": {strconv.FormatInt(n.Frame.Unix(), 10)},
+	}
+	if n.City.Intensity >= IntensityHeavy {
+		form.Set("priority", "1")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, pushoverURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return send(req)
+}
+
+// ntfyNotifier publishes notifications to an ntfy topic.
+type ntfyNotifier struct {
+	url, token string
+}
+
+func (t ntfyNotifier) Notify(n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, t.url, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+	// headers are ASCII only, ntfy decodes RFC 2047 words
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", "Rain in "+n.City.Name))
+	req.Header.Set("Tags", "umbrella")
+	if n.City.Intensity >= IntensityHeavy {
+		req.Header.Set("Priority", "high")
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return send(req)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisConfig struct {
+	// URL such as redis://localhost:6379/0, empty disables Redis.
+	URL string `yaml:"url"`
+	// Prefix of the cache keys and the name of the channel.
+	Prefix string `yaml:"prefix"`
+	// Replica serves the state cached by a worker instead of processing
+	// frames itself.
+	Replica bool `yaml:"replica"`
+}
+
+// redisSnapshot is the city state of a frame as cached and published.
+type redisSnapshot struct {
+	Frame  time.Time         `json:"frame"`
+	Source string            `json:"source"`
+	Cities []City            `json:"cities"`
+	Sets   map[string][]City `json:"sets"`
+	Cells  []*Cell           `json:"cells"`
+}
+
+// applySnapshot takes over the state processed by a worker.
+func (h *Handler) applySnapshot(s redisSnapshot, image []byte) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	states := map[*City]RainState{}
+	collect := func(cities []*City, snap []City) {
+		byID := map[int]RainState{}
+		for _, c := range snap {
+			byID[c.ID] = c.RainState
+		}
+		for _, city := range cities {
+			if st, ok := byID[city.ID]; ok {
+				states[city] = st
+			}
+		}
+	}
+	collect(h.Cities, s.Cities)
+	for name, set := range h.Sets {
+		collect(set.Cities, s.Sets[name])
+	}
+
+	snap := *h.Snapshot
+	snap.FrameTime, snap.DataSource, snap.Cells, snap.Image = s.Frame, s.Source, s.Cells, image
+	// the leader filtered the states already
+	h.updateCities(s.Frame, nil, func(city *City) bool {
+		city.RainState = states[city]
+		city.rain.restore(city.RainState, s.Frame)
+		return city.Raining()
+	})
+	h.publish(snap)
+}
+
+// Redis publishes every frame and caches the latest one for replicas.
+type Redis struct {
+	m      sync.Mutex
+	cfg    RedisConfig
+	client *redis.Client
+}
+
+func (r *Redis) Configure(cfg RedisConfig) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if cfg == r.cfg {
+		return nil
+	}
+	if r.client != nil {
+		r.client.Close()
+		r.client = nil
+	}
+	r.cfg = cfg
+
+	if cfg.URL == "" {
+		return nil
+	}
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return err
+	}
+	r.client = redis.NewClient(opts)
+	log.Printf("Using Redis %s", opts.Addr)
+	return nil
+}
+
+func (r *Redis) get() (*redis.Client, string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.client, r.cfg.Prefix
+}
+
+func (r *Redis) Name() string {
+	return "redis"
+}
+
+// Send caches the state and the annotated image and announces the new
+// frame on the channel.
+func (r *Redis) Send(u *Update) error {
+	client, prefix := r.get()
+	if client == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(redisSnapshot{
+		Frame:  u.Frame,
+		Source: u.Source,
+		Cities: u.Cities,
+		Sets:   u.Sets,
+		Cells:  u.Cells,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, prefix+":state", data, 0)
+		p.Set(ctx, prefix+":image", u.Image, 0)
+		p.Publish(ctx, prefix, data)
+		return nil
+	})
+	return err
+}
+
+// load fetches the cached state into h.
+func (r *Redis) load(ctx context.Context, client *redis.Client, prefix string, h *Handler) error {
+	values, err := client.MGet(ctx, prefix+":state", prefix+":image").Result()
+	if err != nil {
+		return err
+	}
+	state, _ := values[0].(string)
+	image, _ := values[1].(string)
+	if state == "" {
+		return nil
+	}
+
+	var s redisSnapshot
+	if err := json.Unmarshal([]byte(state), &s); err != nil {
+		return err
+	}
+	h.applySnapshot(s, []byte(image))
+	log.Printf("Loaded frame %s from Redis", s.Frame.Format(frameTimeFormat))
+	return nil
+}
+
+// Restore loads the last cached frame on startup, so a restarted worker
+// keeps the rain durations it tracked.
+func (r *Redis) Restore(h *Handler) {
+	client, prefix := r.get()
+	if client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.load(ctx, client, prefix, h); err != nil {
+		log.Printf("Redis: %s", err)
+	}
+}
+
+// Follow keeps h in sync with the frames published by the worker.
+func (r *Redis) Follow(h *Handler) {
+	client, prefix := r.get()
+	if client == nil {
+		log.Println("Redis replica mode needs a Redis url")
+		return
+	}
+	ctx := context.Background()
+
+	sub := client.Subscribe(ctx, prefix)
+	defer sub.Close()
+	if err := r.load(ctx, client, prefix, h); err != nil {
+		log.Printf("Redis: %s", err)
+	}
+
+	for range sub.Channel() {
+		// the leader already has its own state
+		if !h.Config().Redis.Replica && h.leader.Leading() {
+			continue
+		}
+		// the message has the state but not the image, load both
+		if err := r.load(ctx, client, prefix, h); err != nil {
+			log.Printf("Redis: %s", err)
+		}
+	}
+}
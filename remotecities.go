@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteList tells city lists given as an http(s) URL from files.
+func remoteList(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteCities keeps a city list downloaded from a URL with its ETag, so
+// refreshes only download it again once it changed.
+type remoteCities struct {
+	m    sync.Mutex
+	url  string
+	etag string
+	body []byte
+}
+
+// load returns the list at url and whether it changed since the last
+// load. An unchanged list is parsed again from the kept copy, so callers
+// always get cities of their own.
+func (rc *remoteCities) load(url string) ([]*City, bool, error) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	if url != rc.url {
+		rc.url, rc.etag, rc.body = url, "", nil
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("User-Agent", "ledradar")
+	if rc.etag != "" {
+		req.Header.Set("If-None-Match", rc.etag)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		cities, err := parseCities(url, bytes.NewReader(rc.body))
+		return cities, false, err
+	case http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, err
+		}
+		// a broken list keeps the last good one
+		cities, err := parseCities(url, bytes.NewReader(body))
+		if err != nil {
+			return nil, false, err
+		}
+		changed := !bytes.Equal(body, rc.body)
+		rc.etag, rc.body = resp.Header.Get("ETag"), body
+		return cities, changed, nil
+	default:
+		return nil, false, statusError(resp.StatusCode)
+	}
+}
+
+// loadCityList loads the main city list, from a file or a URL.
+func (h *Handler) loadCityList(path string) ([]*City, error) {
+	if !remoteList(path) {
+		return loadCities(path)
+	}
+	cities, _, err := h.remoteCities.load(path)
+	return cities, err
+}
+
+// RefreshCities downloads a city list given as a URL again every
+// citiesRefresh and swaps it in when it changed, carrying the rain state
+// over like Reload.
+func (h *Handler) RefreshCities() {
+	for {
+		interval := h.Config().CitiesRefresh
+		if interval <= 0 {
+			// check again later, a reload may turn it on
+			interval = time.Minute
+		}
+		h.clock.Sleep(interval)
+
+		cfg := h.Config()
+		if !remoteList(cfg.CitiesFile) || cfg.CitiesRefresh <= 0 {
+			continue
+		}
+		cities, changed, err := h.remoteCities.load(cfg.CitiesFile)
+		if err != nil {
+			log.Printf("Refreshing the cities from %s failed: %s", cfg.CitiesFile, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		checkCoverage(cfg.CitiesFile, cities, cfg)
+
+		h.m.Lock()
+		if h.config.CitiesFile != cfg.CitiesFile {
+			// reloaded in the meantime
+			h.m.Unlock()
+			continue
+		}
+		if err := checkSetChannels(cfg.Notify, cities, h.Sets); err != nil {
+			h.m.Unlock()
+			log.Printf("Refreshing the cities from %s failed: %s", cfg.CitiesFile, err)
+			continue
+		}
+		h.CitiesWithRain = carryRainState(cities, h.Cities)
+		h.Cities = cities
+		h.republish()
+		h.m.Unlock()
+		log.Printf("City list refreshed from %s, %d cities", cfg.CitiesFile, len(cities))
+	}
+}
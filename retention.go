@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RetentionConfig struct {
+	// Keep is how long frames stay on local disk.
+	Keep time.Duration `yaml:"keep"`
+	// MaxBytes caps the local archive, oldest frames go first. 0 means
+	// no limit.
+	MaxBytes int64 `yaml:"maxBytes"`
+	// S3 receives expired frames before they are deleted locally.
+	S3 S3Config `yaml:"s3"`
+}
+
+// Retention removes expired frames from the stores, offloading them to S3
+// first when configured. The stores share the MaxBytes of the archive.
+type Retention struct {
+	m   sync.Mutex
+	cfg RetentionConfig
+}
+
+func (r *Retention) Configure(cfg RetentionConfig) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.cfg = cfg
+}
+
+func (r *Retention) Apply(now time.Time, stores ...Store) error {
+	r.m.Lock()
+	cfg := r.cfg
+	r.m.Unlock()
+
+	// the frames of all stores, oldest first
+	type storedFrame struct {
+		StoredFrame
+		store Store
+	}
+	var frames []storedFrame
+	var total int64
+	for _, store := range stores {
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, f := range list {
+			frames = append(frames, storedFrame{f, store})
+			total += f.Size
+		}
+	}
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Time.Before(frames[j].Time) })
+
+	for _, f := range frames {
+		store := f.store
+		expired := cfg.Keep > 0 && now.Sub(f.Saved) >= cfg.Keep
+		overBudget := cfg.MaxBytes > 0 && total > cfg.MaxBytes
+		if !expired && !overBudget {
+			continue
+		}
+
+		if cfg.S3.Bucket != "" {
+			png, err := store.Load(f.Time)
+			if err != nil {
+				return err
+			}
+			key := fmt.Sprintf("%sradar_a_mesta_%s.png", cfg.S3.Prefix, f.Time.Format(frameTimeFormat))
+			if named, ok := store.(interface{ fileName(time.Time) string }); ok {
+				key = cfg.S3.Prefix + named.fileName(f.Time)
+			}
+			if err := cfg.S3.Put(key, png, "image/png"); err != nil {
+				// keep it locally and try again on the next pass
+				log.Printf("Cannot archive frame %s to S3: %s", f.Time.Format(frameTimeFormat), err)
+				continue
+			}
+		}
+
+		log.Printf("Deleting old frame %s", f.Time.Format(frameTimeFormat))
+		if err := store.Delete(f.Time); err != nil {
+			return err
+		}
+		total -= f.Size
+	}
+
+	return nil
+}
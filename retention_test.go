@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ledtesting "meteoradar/internal/testing"
+)
+
+func TestRetentionAcrossStores(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := ledtesting.NewClock(start)
+	store, uploads := ledtesting.NewStore(clock), ledtesting.NewStore(clock)
+	frame := make([]byte, 100)
+	// frames of the source and uploads in turn, 100 bytes each
+	for i := 0; i < 6; i++ {
+		s := store
+		if i%2 == 1 {
+			s = uploads
+		}
+		if err := s.Save(start.Add(time.Duration(i)*time.Minute), frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var r Retention
+	r.Configure(RetentionConfig{MaxBytes: 300})
+	if err := r.Apply(clock.Now(), store, uploads); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		kept := store.Has(at) || uploads.Has(at)
+		if kept != (i >= 3) {
+			t.Errorf("frame %d kept %v, want only the newest 300 bytes", i, kept)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NotifyConfig struct {
+	Channels map[string]ChannelConfig `yaml:"channels"`
+	Rules    []RuleConfig             `yaml:"rules"`
+}
+
+// RuleConfig matches cities by name or ID (all cities when empty), a
+// minimum intensity or probable hail, an optional trend and an optional
+// daily time window in local time.
+type RuleConfig struct {
+	Name         string        `yaml:"name"`
+	Cities       []string      `yaml:"cities"`
+	MinIntensity Intensity     `yaml:"minIntensity"`
+	Hail         bool          `yaml:"hail"`
+	Trend        Trend         `yaml:"trend"`
+	From         string        `yaml:"from"`
+	To           string        `yaml:"to"`
+	Channel      string        `yaml:"channel"`
+	Cooldown     time.Duration `yaml:"cooldown"`
+}
+
+type rule struct {
+	RuleConfig
+	from, to time.Duration
+	notifier Notifier
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (r *rule) matchesCity(city *City) bool {
+	if len(r.Cities) == 0 {
+		return true
+	}
+	for _, c := range r.Cities {
+		if strings.EqualFold(c, city.Name) || c == strconv.Itoa(city.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) inWindow(t time.Time) bool {
+	if r.From == "" && r.To == "" {
+		return true
+	}
+	return inClockWindow(t, r.from, r.to)
+}
+
+// inClockWindow reports whether the local time of t is in [from, to).
+func inClockWindow(t time.Time, from, to time.Duration) bool {
+	t = t.Local()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if from <= to {
+		return clock >= from && clock < to
+	}
+	// window over midnight, e.g. 22:00-06:00
+	return clock >= from || clock < to
+}
+
+// NotifyPrefs are the notification preferences of a city, the optional
+// last column of the city file, e.g.
+// "channels=parents,console min=moderate quiet=21:00-07:00".
+type NotifyPrefs struct {
+	// Channels receive the notifications of the city instead of the
+	// channel of the rule.
+	Channels []string
+	// MinIntensity raises the minimum intensity of the rules.
+	MinIntensity Intensity
+	// no notifications from quietFrom to quietTo, local time
+	quiet              bool
+	quietFrom, quietTo time.Duration
+}
+
+func parseNotifyPrefs(s string) (*NotifyPrefs, error) {
+	p := &NotifyPrefs{}
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("notification preference %q is not key=value", field)
+		}
+		var err error
+		switch key {
+		case "channels":
+			p.Channels = strings.Split(value, ",")
+		case "min":
+			p.MinIntensity, err = parseIntensity(value)
+		case "quiet":
+			from, to, ok := strings.Cut(value, "-")
+			if !ok {
+				return nil, fmt.Errorf("quiet hours %q are not from-to", value)
+			}
+			if p.quietFrom, err = parseClock(from); err == nil {
+				p.quietTo, err = parseClock(to)
+			}
+			p.quiet = true
+		default:
+			return nil, fmt.Errorf("unknown notification preference %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// quietAt reports whether t falls into the quiet hours.
+func (p *NotifyPrefs) quietAt(t time.Time) bool {
+	return p != nil && p.quiet && inClockWindow(t, p.quietFrom, p.quietTo)
+}
+
+// checkSetChannels checks the cities and refuses preferences in the sets:
+// the rules only notify of the cities of the main list.
+func checkSetChannels(cfg NotifyConfig, cities []*City, sets map[string]*CitySet) error {
+	if err := checkChannels(cfg, cities); err != nil {
+		return err
+	}
+	for name, set := range sets {
+		for _, city := range set.Cities {
+			if city.Notify != nil {
+				return fmt.Errorf("city set %s: city %s: notification preferences only apply to the main city list", name, city.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkChannels fails for cities sending to channels that do not exist.
+func checkChannels(cfg NotifyConfig, cities []*City) error {
+	for _, city := range cities {
+		if city.Notify == nil {
+			continue
+		}
+		for _, ch := range city.Notify.Channels {
+			if _, ok := cfg.Channels[ch]; !ok {
+				return fmt.Errorf("city %s: unknown notification channel %q", city.Name, ch)
+			}
+		}
+	}
+	return nil
+}
+
+type ruleKey struct {
+	rule string
+	city int
+}
+
+// Rules evaluates the notification rules on every frame. A rule fires once
+// when a city starts matching and again only after it stopped matching and
+// the rule's cooldown has passed.
+type Rules struct {
+	m     sync.Mutex
+	rules []*rule
+	// notifiers by channel name, for cities with their own channels
+	notifiers map[string]Notifier
+	active    map[ruleKey]bool
+	sent      map[ruleKey]time.Time
+}
+
+func (rs *Rules) Configure(cfg NotifyConfig) error {
+	notifiers := map[string]Notifier{}
+	for name, ch := range cfg.Channels {
+		n, err := newNotifier(ch)
+		if err != nil {
+			return fmt.Errorf("channel %s: %w", name, err)
+		}
+		notifiers[name] = n
+	}
+
+	var rules []*rule
+	for i, rc := range cfg.Rules {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		r := &rule{RuleConfig: rc, notifier: notifiers[rc.Channel]}
+		if r.notifier == nil {
+			return fmt.Errorf("rule %s: unknown channel %q", rc.Name, rc.Channel)
+		}
+		switch rc.Trend {
+		case "", TrendSteady, TrendIntensifying, TrendWeakening:
+		default:
+			return fmt.Errorf("rule %s: unknown trend %q", rc.Name, rc.Trend)
+		}
+		if rc.From != "" || rc.To != "" {
+			var err error
+			if r.from, err = parseClock(rc.From); err != nil {
+				return fmt.Errorf("rule %s: %w", rc.Name, err)
+			}
+			if r.to, err = parseClock(rc.To); err != nil {
+				return fmt.Errorf("rule %s: %w", rc.Name, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.rules = rules
+	rs.notifiers = notifiers
+	if rs.active == nil {
+		rs.active = map[ruleKey]bool{}
+		rs.sent = map[ruleKey]time.Time{}
+	}
+	return nil
+}
+
+func (rs *Rules) Name() string {
+	return "notify"
+}
+
+// Send evaluates the rules on the update. Notifications are delivered in
+// the background, a failed one is logged and not retried.
+func (rs *Rules) Send(u *Update) error {
+	rs.Evaluate(u)
+	return nil
+}
+
+func (rs *Rules) Evaluate(u *Update) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	now, cities := u.Now, u.Cities
+
+	for _, r := range rs.rules {
+		for i := range cities {
+			city := &cities[i]
+			if !r.matchesCity(city) {
+				continue
+			}
+
+			key := ruleKey{r.Name, city.ID}
+			minIntensity := r.MinIntensity
+			if city.Notify != nil {
+				minIntensity = max(minIntensity, city.Notify.MinIntensity)
+			}
+			match := city.Intensity > IntensityNone && city.Intensity >= minIntensity && r.inWindow(now)
+			if r.Hail {
+				match = city.Hail && r.inWindow(now)
+			}
+			if city.Notify.quietAt(now) {
+				match = false
+			}
+			if r.Trend != "" && city.Trend != r.Trend {
+				match = false
+			}
+			wasActive := rs.active[key]
+			rs.active[key] = match
+			if !match || wasActive {
+				continue
+			}
+			if last, ok := rs.sent[key]; ok && now.Sub(last) < r.Cooldown {
+				continue
+			}
+
+			rs.sent[key] = now
+			n := Notification{
+				Rule:    r.Name,
+				Frame:   u.Frame,
+				City:    *city,
+				Message: fmt.Sprintf("%s rain in %s (%.0f dBZ)", city.Intensity, city.Name, city.DBZ),
+			}
+			if city.Trend != TrendSteady && city.Trend != "" {
+				n.Message = fmt.Sprintf("%s rain in %s (%.0f dBZ, %s)", city.Intensity, city.Name, city.DBZ, city.Trend)
+			}
+			if r.Hail {
+				n.Message = fmt.Sprintf("hail likely in %s (%.0f dBZ)", city.Name, city.DBZ)
+			}
+			n.radar = u.Radar
+			if u.Simulated {
+				n.Simulated = true
+				n.Message = "[simulated] " + n.Message
+			}
+			notifiers := []Notifier{r.notifier}
+			if city.Notify != nil && len(city.Notify.Channels) > 0 {
+				notifiers = notifiers[:0]
+				for _, ch := range city.Notify.Channels {
+					if n, ok := rs.notifiers[ch]; ok {
+						notifiers = append(notifiers, n)
+					}
+				}
+			}
+			for _, notifier := range notifiers {
+				go func(notifier Notifier) {
+					if err := notifier.Notify(n); err != nil {
+						log.Printf("Notification %s for %s failed: %s", n.Rule, n.City.Name, err)
+					}
+				}(notifier)
+			}
+		}
+	}
+}
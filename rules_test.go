@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSetChannels(t *testing.T) {
+	cfg := NotifyConfig{Channels: map[string]ChannelConfig{"parents": {}}}
+	prefs := func(s string) *NotifyPrefs {
+		p, err := parseNotifyPrefs(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tests := []struct {
+		name   string
+		main   *NotifyPrefs
+		set    *NotifyPrefs
+		errors string
+	}{
+		{name: "no preferences"},
+		{name: "main list", main: prefs("channels=parents quiet=21:00-07:00")},
+		{name: "unknown channel", main: prefs("channels=neighbours"), errors: "unknown notification channel"},
+		{name: "set", set: prefs("min=moderate"), errors: "only apply to the main city list"},
+	}
+	for _, tt := range tests {
+		p, b := praha, brno
+		p.Notify, b.Notify = tt.main, tt.set
+		err := checkSetChannels(cfg, []*City{&p}, map[string]*CitySet{"south": {Name: "south", Cities: []*City{&b}}})
+		if tt.errors == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if tt.errors != "" && (err == nil || !strings.Contains(err.Error(), tt.errors)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.errors)
+		}
+	}
+}
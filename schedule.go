@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type ScheduleConfig struct {
+	// Align polls right after frames are due instead of every interval.
+	Align bool `yaml:"align"`
+	// Delay after the frame time when a frame is due, 0 uses the typical
+	// delay of the source.
+	Delay time.Duration `yaml:"delay"`
+	// Retry is how often a late frame is polled for, doubling up to the
+	// interval.
+	Retry time.Duration `yaml:"retry"`
+}
+
+// BackgroundLoop processes frames as the schedule says.
+func (h *Handler) BackgroundLoop() {
+	var retry time.Duration
+	backfilled := false
+	for {
+		if h.leader.Leading() {
+			if !backfilled {
+				h.Backfill(h.Config().Backfill.Frames)
+				backfilled = true
+			}
+			log.Println("Starting background loop")
+			h.ProcessFrame()
+		}
+
+		now := h.clock.Now()
+		next := h.schedule(now, &retry)
+		h.m.Lock()
+		h.nextPoll = next
+		h.m.Unlock()
+		h.clock.Sleep(next.Sub(now))
+	}
+}
+
+// nextPollTime is nil until the loop has scheduled a poll. Must be called
+// with h.m held.
+func (h *Handler) nextPollTime() *time.Time {
+	if h.nextPoll.IsZero() {
+		return nil
+	}
+	t := h.nextPoll.UTC()
+	return &t
+}
+
+// schedule returns when to poll next: once the current frame is in, just
+// after the next one is due, or the first after dryInterval while the
+// country is dry, and with a growing backoff while it is late.
+// retry carries the backoff between calls.
+func (h *Handler) schedule(now time.Time, retry *time.Duration) time.Time {
+	cfg := h.Config()
+	if !cfg.Schedule.Align {
+		return now.Add(h.dryWait(cfg, cfg.Interval))
+	}
+
+	source, _ := h.pollSource(cfg, nil)
+	delay := cfg.Schedule.Delay
+	if delay <= 0 {
+		delay = source.PublishDelay()
+	}
+	frameTime := source.FrameTime(now)
+
+	switch due := frameTime.Add(delay); {
+	case h.store.Has(frameTime):
+		*retry = 0
+		return frameTime.Add(h.dryWait(cfg, source.Cadence())).Add(delay)
+	case now.Before(due):
+		*retry = 0
+		return due
+	case *retry == 0:
+		*retry = cfg.Schedule.Retry
+	default:
+		*retry = min(2**retry, max(cfg.Interval, cfg.Schedule.Retry))
+	}
+	return now.Add(*retry)
+}
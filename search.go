@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldName lowercases s and strips its diacritics, Plzeň becoming plzen.
+func foldName(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(s)) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// matchScore ranks how well the folded name matches the folded query,
+// lower is better: the whole name, its start, the start of a word, any
+// part, then a start with typos, one per four letters of the query.
+func matchScore(name, query string) (int, bool) {
+	switch {
+	case name == query:
+		return 0, true
+	case strings.HasPrefix(name, query):
+		return 1, true
+	case strings.Contains(" "+strings.Join(strings.FieldsFunc(name, isNameSeparator), " "), " "+query):
+		return 2, true
+	case strings.Contains(name, query):
+		return 3, true
+	}
+
+	q := []rune(query)
+	allowed := len(q) / 4
+	if allowed == 0 {
+		return 0, false
+	}
+	best := allowed + 1
+	for _, word := range append([]string{name}, strings.FieldsFunc(name, isNameSeparator)...) {
+		w := []rune(word)
+		// the query may be a prefix with a letter more or less
+		for n := max(len(q)-allowed, 1); n <= min(len(q)+allowed, len(w)); n++ {
+			best = min(best, editDistance(q, w[:n]))
+		}
+	}
+	if best > allowed {
+		return 0, false
+	}
+	return 4 + best, true
+}
+
+func isNameSeparator(r rune) bool {
+	return r == ' ' || r == '-' || r == '.' || r == ','
+}
+
+// searchCities returns the cities matching query, best first and by name
+// within the same rank.
+func searchCities(cities []*City, query string, limit int) []*City {
+	query = foldName(strings.TrimSpace(query))
+	type match struct {
+		city  *City
+		score int
+	}
+	var matches []match
+	for _, city := range cities {
+		if score, ok := matchScore(foldName(city.Name), query); ok {
+			matches = append(matches, match{city, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+		return matches[i].city.Name < matches[j].city.Name
+	})
+
+	out := []*City{}
+	for _, m := range matches[:min(limit, len(matches))] {
+		out = append(out, m.city)
+	}
+	return out
+}
+
+// HandleSearch finds cities by name for autocomplete, ignoring case and
+// diacritics and forgiving typos: ?q=plzen finds Plzeň. ?set= searches a
+// city set instead, ?limit= caps the results, 10 by default.
+func (h *Handler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := q.Get("q")
+	if strings.TrimSpace(query) == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+
+	cities := h.Snapshot.Cities
+	if name := q.Get("set"); name != "" {
+		set, ok := h.Sets[name]
+		if !ok {
+			http.Error(w, "unknown city set", http.StatusNotFound)
+			return
+		}
+		cities = set.Cities
+	}
+	h.serveJSON(w, r, searchCities(cities, query, limit))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// simulationSource is the data source while a simulation overrides the
+// radar, so outputs and clients can tell.
+const simulationSource = "simulation"
+
+// simulateRequest sets the state of cities for a while, the unlisted ones
+// are dry.
+type simulateRequest struct {
+	Minutes int             `json:"minutes"`
+	Cities  []simulatedCity `json:"cities"`
+}
+
+// simulatedCity picks a city by ID or name and gives it a reflectivity,
+// or the middle of an intensity class.
+type simulatedCity struct {
+	ID        *int       `json:"id"`
+	Name      string     `json:"name"`
+	DBZ       float64    `json:"dbz"`
+	Intensity *Intensity `json:"intensity"`
+}
+
+func (c simulatedCity) matches(city *City) bool {
+	if c.ID != nil {
+		return *c.ID == city.ID
+	}
+	return strings.EqualFold(c.Name, city.Name)
+}
+
+var intensityDBZ = map[Intensity]float64{
+	IntensityLight:    16,
+	IntensityModerate: 32,
+	IntensityHeavy:    44,
+	IntensitySevere:   56,
+}
+
+func (c simulatedCity) state() RainState {
+	dbz := c.DBZ
+	if c.Intensity != nil {
+		dbz = intensityDBZ[*c.Intensity]
+	}
+	col := dbzColor(dbz)
+	if col.A == 0 {
+		return RainState{}
+	}
+	dbz = 4 * math.Floor(dbz/4)
+	return RainState{R: col.R, G: col.G, B: col.B, DBZ: dbz, Intensity: intensityOf(dbz)}
+}
+
+// simulation keeps the real state to restore once it ends.
+type simulation struct {
+	until time.Time
+
+	snapshot *Snapshot
+	radarOK  time.Time
+	cities   map[simulatedKey]savedCity
+}
+
+// simulatedKey finds a city by set and ID, cities may be reloaded while
+// a simulation runs.
+type simulatedKey struct {
+	set string
+	id  int
+}
+
+type savedCity struct {
+	state   RainState
+	rain    rainTally
+	trend   trendHistory
+	samples frameSamples
+}
+
+// startSimulation saves the real state unless a simulation already runs.
+// Must be called with h.m held.
+func (h *Handler) startSimulation(until time.Time) {
+	if h.simulation != nil {
+		h.simulation.until = until
+		return
+	}
+	s := &simulation{
+		until:    until,
+		snapshot: h.Snapshot,
+		radarOK:  h.radarOK,
+		cities:   map[simulatedKey]savedCity{},
+	}
+	h.eachCity(func(set string, city *City) {
+		s.cities[simulatedKey{set, city.ID}] = savedCity{city.RainState, city.rain, city.trend, city.samples}
+	})
+	h.simulation = s
+}
+
+// eachCity calls fn for the cities and those of every set. Must be called
+// with h.m held.
+func (h *Handler) eachCity(fn func(set string, city *City)) {
+	for _, city := range h.Cities {
+		fn("", city)
+	}
+	for name, set := range h.Sets {
+		for _, city := range set.Cities {
+			fn(name, city)
+		}
+	}
+}
+
+// simulating reports whether a simulation overrides the radar, restoring
+// the real state once it has expired.
+func (h *Handler) simulating() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.simulation == nil {
+		return false
+	}
+	if h.clock.Now().Before(h.simulation.until) {
+		return true
+	}
+	h.endSimulation()
+	return false
+}
+
+// endSimulation restores the real state and hands it to the outputs,
+// the transitions back to it marked simulated like the ones into the
+// simulation. Must be called with h.m held.
+func (h *Handler) endSimulation() {
+	s := h.simulation
+	h.simulation = nil
+	log.Println("Simulation ended, restoring radar data")
+
+	h.radarOK = s.radarOK
+
+	saved := map[*City]savedCity{}
+	h.eachCity(func(set string, city *City) {
+		saved[city] = s.cities[simulatedKey{set, city.ID}]
+	})
+	// the saved states were filtered already
+	transitions := h.updateCities(s.snapshot.FrameTime, nil, func(city *City) bool {
+		c := saved[city]
+		city.RainState, city.rain, city.trend, city.samples = c.state, c.rain, c.trend, c.samples
+		return city.Raining()
+	})
+	h.publish(*s.snapshot)
+	u := h.update(s.snapshot.FrameTime, nil, transitions)
+	u.markSimulated()
+	h.send(context.Background(), u)
+}
+
+// HandleSimulate overrides the radar for ?minutes= (10 by default) with
+// the cities of a JSON simulateRequest or with a frame image of the
+// radar source, to test LEDs and notification rules on a sunny day.
+func (h *Handler) HandleSimulate(w http.ResponseWriter, r *http.Request) {
+	minutes := 10
+	if v := r.URL.Query().Get("minutes"); v != "" {
+		var err error
+		if minutes, err = strconv.Atoi(v); err != nil || minutes <= 0 {
+			http.Error(w, fmt.Sprintf("invalid minutes %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := h.clock.Now()
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "image/") {
+		source, _ := newSource(h.Config(), h.fetcher)
+		frame, err := source.Decode(now, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.m.Lock()
+		h.startSimulation(now.Add(time.Duration(minutes) * time.Minute))
+		h.m.Unlock()
+		h.Apply(r.Context(), simulationSource, frame)
+	} else {
+		var req simulateRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Minutes > 0 {
+			minutes = req.Minutes
+		}
+
+		eval := func(city *City) bool {
+			city.RainState = RainState{}
+			for _, c := range req.Cities {
+				if c.matches(city) {
+					city.RainState = c.state()
+				}
+			}
+			return city.Raining()
+		}
+		filters := h.filterCities(now, eval)
+
+		h.m.Lock()
+		h.startSimulation(now.Add(time.Duration(minutes) * time.Minute))
+		snap := *h.Snapshot
+		snap.FrameTime, snap.Cells, snap.DataSource = now, nil, simulationSource
+		transitions := h.updateCities(now, filters, eval)
+		h.publish(snap)
+		h.dispatch(r.Context(), now, nil, transitions)
+		h.m.Unlock()
+	}
+
+	log.Printf("Simulating for %d minutes", minutes)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEndSimulation restores the radar data before the simulation
+// expires.
+func (h *Handler) HandleEndSimulation(w http.ResponseWriter, r *http.Request) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.simulation != nil {
+		h.endSimulation()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ledtesting "meteoradar/internal/testing"
+)
+
+func TestEndSimulation(t *testing.T) {
+	posted := make(chan TransitionEvent, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e TransitionEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		posted <- e
+	}))
+	defer srv.Close()
+
+	now := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	cfg := defaultConfig()
+	cfg.Outputs.Webhooks = []WebhookConfig{{URL: srv.URL, PerTransition: true}}
+	h := NewHandler("", cfg)
+	h.clock = ledtesting.NewClock(now)
+	h.dispatcher.Configure(h.outputs(cfg), cfg.Outputs.Retry)
+	city := praha
+	city.Coverage = true
+	city.samples.add(now, 1, 2, 3, "none")
+	h.Cities = []*City{&city}
+	h.Snapshot = &Snapshot{FrameTime: now, DataSource: "chmi"}
+	samples := city.samples
+
+	receive := func(raining bool) {
+		t.Helper()
+		select {
+		case e := <-posted:
+			if e.Raining != raining || !e.Simulated {
+				t.Errorf("got a transition to raining %v, simulated %v, want raining %v, simulated", e.Raining, e.Simulated, raining)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no transition to raining %v", raining)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.HandleSimulate(w, httptest.NewRequest("POST", "/admin/simulate", strings.NewReader(`{"cities": [{"id": 1, "dbz": 40}]}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("simulate: %d %s", w.Code, w.Body)
+	}
+	receive(true)
+
+	w = httptest.NewRecorder()
+	h.HandleEndSimulation(w, httptest.NewRequest("DELETE", "/admin/simulate", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("end simulation: %d %s", w.Code, w.Body)
+	}
+	// the rain ending with the simulation is no real event either
+	receive(false)
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if h.DataSource != "chmi" || city.Raining() {
+		t.Errorf("restored %s, raining %v, want chmi and dry", h.DataSource, city.Raining())
+	}
+	if city.samples != samples {
+		t.Errorf("restored samples %+v, want %+v", city.samples, samples)
+	}
+}
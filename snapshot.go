@@ -0,0 +1,76 @@
+package main
+
+import (
+	"image"
+	"time"
+)
+
+// Snapshot is the radar data of one frame as the API serves it, the
+// cities, the image and what they came from. A published snapshot is
+// never changed: the loop builds the next one, encoding its image without
+// holding h.m, and swaps it in, so readers never see the cities of one
+// frame with the image of another.
+type Snapshot struct {
+	// ID numbers the snapshots since the start, every frame, fallback
+	// update, simulation and city reload gets a new one. It is served as
+	// X-Frame-ID and frameId.
+	ID        uint64
+	FrameTime time.Time
+	Frame     *Frame
+	Image     []byte
+	// Annotated is one of the two bitmaps of h.buffers, drawn over again
+	// two frames later.
+	Annotated *image.NRGBA
+	Cells     []*Cell
+	// Stats is the rain histogram of the country in Frame.
+	Stats      *RainStats
+	DataSource string
+	// Cities and CitiesWithRain are copies of the main city list as the
+	// frame left it, unlike h.Cities which the next frame updates.
+	Cities         []*City
+	CitiesWithRain []*City
+	// pollSeq is the city update the copies were made after
+	pollSeq uint64
+}
+
+// snapshotCities copies the cities and the raining ones among them.
+func snapshotCities(cities, raining []*City) ([]*City, []*City) {
+	copies := make([]City, len(cities))
+	all := make([]*City, len(cities))
+	byCity := make(map[*City]*City, len(cities))
+	for i, city := range cities {
+		copies[i] = *city
+		all[i] = &copies[i]
+		byCity[city] = all[i]
+	}
+	wet := make([]*City, 0, len(raining))
+	for _, city := range raining {
+		if c, ok := byCity[city]; ok {
+			wet = append(wet, c)
+		}
+	}
+	return all, wet
+}
+
+// publish numbers s, copies the cities into it and swaps it in, waking
+// the long polls and streams once the cities were updated. Must be called
+// with h.m held.
+func (h *Handler) publish(s Snapshot) {
+	h.snapshots++
+	s.ID = h.snapshots
+	s.Cities, s.CitiesWithRain = snapshotCities(h.Cities, h.CitiesWithRain)
+	s.pollSeq = h.pollSeq
+	updated := s.pollSeq != h.Snapshot.pollSeq
+	h.Snapshot = &s
+
+	if updated {
+		close(h.pollWake)
+		h.pollWake = make(chan struct{})
+	}
+}
+
+// republish publishes the frame of the current snapshot again with the
+// cities as they are now. Must be called with h.m held.
+func (h *Handler) republish() {
+	h.publish(*h.Snapshot)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Projection maps geographic coordinates to pixel coordinates of a frame.
+type Projection interface {
+	Pixel(lat, lon float64) (x, y int)
+	// Location returns the coordinates of the pixel center.
+	Location(x, y int) (lat, lon float64)
+}
+
+// Frame is a decoded radar image. Precipitation is encoded in the CHMI
+// color scale regardless of the source; black or transparent means dry.
+type Frame struct {
+	Time       time.Time
+	Image      *image.NRGBA
+	Projection Projection
+	// EchoTop is the echo top frame on the same grid, only downloaded
+	// for hail detection.
+	EchoTop *Frame
+}
+
+// Source is a national radar composite.
+type Source interface {
+	Name() string
+	// FrameTime returns the time of the newest frame expected at now.
+	FrameTime(now time.Time) time.Time
+	// Cadence is the time between frames, PublishDelay how long after
+	// its frame time a frame usually becomes available.
+	Cadence() time.Duration
+	PublishDelay() time.Duration
+	// URL is where the frame at t is published.
+	URL(t time.Time) string
+	Fetch(t time.Time) (*Frame, error)
+	// Decode reads a frame in the native format of the source.
+	Decode(t time.Time, content []byte) (*Frame, error)
+}
+
+func newSource(cfg *Config, fetcher Fetcher) (Source, error) {
+	switch cfg.Source {
+	case "", "chmi":
+		product, err := cfg.CHMI.product()
+		if err != nil {
+			return nil, err
+		}
+		return chmiSource{fetcher, product}, nil
+	case "dwd":
+		return dwdSource{fetcher}, nil
+	case "composite":
+		return newCompositeSource(cfg, fetcher)
+	}
+	if product, ok, err := nationalProduct(cfg, cfg.Source); ok {
+		return nationalSource{chmiSource{fetcher, product}, cfg.Source}, err
+	}
+	return nil, fmt.Errorf("unknown radar source %q", cfg.Source)
+}
+
+// offsetProjection shifts another projection by the origin of a crop.
+type offsetProjection struct {
+	Projection
+	dx, dy int
+}
+
+func (p offsetProjection) Pixel(lat, lon float64) (int, int) {
+	x, y := p.Projection.Pixel(lat, lon)
+	return x - p.dx, y - p.dy
+}
+
+func (p offsetProjection) Location(x, y int) (float64, float64) {
+	return p.Projection.Location(x+p.dx, y+p.dy)
+}
+
+// Crop returns the part of the frame covering box.
+func (f *Frame) Crop(box BBox) *Frame {
+	x0, y0 := f.Projection.Pixel(box.North, box.West)
+	x1, y1 := f.Projection.Pixel(box.South, box.East)
+	// the other corners matter for non-rectangular projections
+	x2, y2 := f.Projection.Pixel(box.North, box.East)
+	x3, y3 := f.Projection.Pixel(box.South, box.West)
+
+	rect := image.Rect(min(x0, x1, x2, x3), min(y0, y1, y2, y3), max(x0, x1, x2, x3)+1, max(y0, y1, y2, y3)+1)
+	rect = rect.Intersect(f.Image.Bounds())
+
+	cropped := &Frame{
+		Time:       f.Time,
+		Image:      imaging.Crop(f.Image, rect),
+		Projection: offsetProjection{f.Projection, rect.Min.X, rect.Min.Y},
+	}
+	if f.EchoTop != nil {
+		cropped.EchoTop = f.EchoTop.Crop(box)
+	}
+	return cropped
+}
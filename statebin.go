@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+)
+
+// stateMagic starts every /state.bin blob, the last byte is the version
+// of the layout, bumped on any change to it.
+var stateMagic = [4]byte{'L', 'R', 'S', 1}
+
+// encodeState lays the cities out for microcontrollers reading them with
+// fixed offsets, all integers big endian:
+//
+//	0   4  magic "LRS" and the layout version, 1
+//	4   4  frame time in Unix seconds, 0 before the first frame
+//	8   2  city count n
+//	10  6n per city: ID uint16, intensity uint8 (0 none to 4 severe), R, G, B
+//
+// Cities with IDs above 65535 do not fit and are left out.
+func encodeState(frame int64, cities []*City) []byte {
+	var fit []*City
+	for _, city := range cities {
+		if city.ID >= 0 && city.ID <= math.MaxUint16 {
+			fit = append(fit, city)
+		}
+	}
+	be := binary.BigEndian
+	buf := make([]byte, 0, 10+6*len(fit))
+	buf = append(buf, stateMagic[:]...)
+	buf = be.AppendUint32(buf, uint32(max(frame, 0)))
+	buf = be.AppendUint16(buf, uint16(len(fit)))
+	for _, city := range fit {
+		buf = be.AppendUint16(buf, uint16(city.ID))
+		buf = append(buf, uint8(city.Intensity), city.R, city.G, city.B)
+	}
+	return buf
+}
+
+// HandleState serves the cities as a compact binary blob for devices that
+// cannot parse JSON, see encodeState. min and region filter them as for
+// /cities.
+func (h *Handler) HandleState(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+	cities, _ := h.tenantCities(r)
+	cities, err := filterCities(r, cities)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var frame int64
+	if !h.FrameTime.IsZero() {
+		frame = h.FrameTime.Unix()
+	}
+	h.serveFrame(w, r, "application/octet-stream", encodeState(frame, cities))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"net/http"
+	"time"
+)
+
+// summaryShare is the share of the area the summary reflectivity is
+// reached over, so a single pixel does not make the whole country stormy.
+const summaryShare = 0.01
+
+// dbzBin counts the pixels of one class of the CHMI legend, MinDBZ up to 4
+// dBZ more.
+type dbzBin struct {
+	MinDBZ float64 `json:"minDbz"`
+	Pixels int     `json:"pixels"`
+}
+
+// RainHistogram is how much of an area a frame shows rain over.
+type RainHistogram struct {
+	// Pixels are the pixels of the frame in the area, Wet those of them
+	// with an echo.
+	Pixels      int               `json:"pixels"`
+	Wet         int               `json:"wet"`
+	WetShare    float64           `json:"wetShare"`
+	Intensities map[Intensity]int `json:"intensities"`
+	DBZ         []dbzBin          `json:"dbz"`
+	MaxDBZ      float64           `json:"maxDbz"`
+	// SummaryDBZ is the reflectivity reached over at least 1% of the
+	// area, Summary its intensity: how stormy it is overall.
+	SummaryDBZ float64   `json:"summaryDbz"`
+	Summary    Intensity `json:"summary"`
+
+	bins []int
+}
+
+func newRainHistogram() *RainHistogram {
+	s := &RainHistogram{Intensities: map[Intensity]int{}, bins: make([]int, len(chmiPalette))}
+	for i := IntensityNone; i <= IntensitySevere; i++ {
+		s.Intensities[i] = 0
+	}
+	return s
+}
+
+// add counts a pixel of reflectivity dbz, NaN for none.
+func (s *RainHistogram) add(dbz float64) {
+	s.Pixels++
+	if math.IsNaN(dbz) {
+		s.Intensities[IntensityNone]++
+		return
+	}
+	s.Wet++
+	s.Intensities[intensityOf(dbz)]++
+	s.MaxDBZ = max(s.MaxDBZ, dbz)
+	s.bins[max(0, min(int(dbz/4)-1, len(s.bins)-1))]++
+}
+
+// finish derives the classes, shares and summary from the counted pixels.
+func (s *RainHistogram) finish() {
+	s.DBZ = make([]dbzBin, len(s.bins))
+	for i, n := range s.bins {
+		s.DBZ[i] = dbzBin{MinDBZ: float64(4 * (i + 1)), Pixels: n}
+	}
+	if s.Pixels > 0 {
+		s.WetShare = math.Round(float64(s.Wet)/float64(s.Pixels)*1000) / 1000
+		// from the strongest class down until 1% of the area is reached
+		reached := 0
+		for i := len(s.bins) - 1; i >= 0; i-- {
+			reached += s.bins[i]
+			if float64(reached) >= summaryShare*float64(s.Pixels) {
+				s.SummaryDBZ = s.DBZ[i].MinDBZ
+				break
+			}
+		}
+	}
+	s.Summary = intensityOf(s.SummaryDBZ)
+}
+
+// RainStats is how much of the area of the source a frame shows rain
+// over: the country for chmi, what the radar covers for the others.
+type RainStats struct {
+	Frame time.Time `json:"frame"`
+	RainHistogram
+	// Regions are the histograms of the pixels near the cities of each
+	// region, served with the cities of the regions.
+	Regions map[string]*RainHistogram `json:"-"`
+}
+
+// rainStats builds the histogram of the pixels of field marked in area.
+func rainStats(frame *Frame, field *Field, area []bool) *RainStats {
+	s := &RainStats{Frame: frame.Time, RainHistogram: *newRainHistogram()}
+	for y := 0; y < field.Height; y++ {
+		for x := 0; x < field.Width; x++ {
+			if area[y*field.Width+x] {
+				s.add(float64(field.At(x, y)))
+			}
+		}
+	}
+	s.finish()
+	return s
+}
+
+// regionHistograms builds the histogram of every region over the pixels
+// of field assigned to it, by index into names.
+func regionHistograms(field *Field, regions []int, names []string) map[string]*RainHistogram {
+	histograms := make([]*RainHistogram, len(names))
+	for i := range names {
+		histograms[i] = newRainHistogram()
+	}
+	for i, r := range regions {
+		if r >= 0 {
+			histograms[r].add(float64(field.At(i%field.Width, i/field.Width)))
+		}
+	}
+	byName := make(map[string]*RainHistogram, len(names))
+	for i, name := range names {
+		histograms[i].finish()
+		byName[name] = histograms[i]
+	}
+	return byName
+}
+
+// summaryColor is the legend color of the summary reflectivity, dark
+// while the area is dry.
+func (s *RainHistogram) summaryColor() color.NRGBA {
+	c := dbzColor(s.SummaryDBZ)
+	c.A = 255
+	return c
+}
+
+// RegionStats counts the cities of a region by the intensity of their
+// rain, Area the pixels around them.
+type RegionStats struct {
+	Cities      int               `json:"cities"`
+	Raining     int               `json:"raining"`
+	Intensities map[Intensity]int `json:"intensities"`
+	MaxDBZ      float64           `json:"maxDbz"`
+	Area        *RainHistogram    `json:"area,omitempty"`
+}
+
+func regionStats(cities []*City, areas map[string]*RainHistogram) map[string]*RegionStats {
+	regions := map[string]*RegionStats{}
+	for _, city := range cities {
+		if city.Region == "" {
+			continue
+		}
+		r := regions[city.Region]
+		if r == nil {
+			r = &RegionStats{Intensities: map[Intensity]int{}}
+			regions[city.Region] = r
+		}
+		r.Cities++
+		r.Area = areas[city.Region]
+		r.Intensities[city.Intensity]++
+		if city.Raining() {
+			r.Raining++
+			r.MaxDBZ = max(r.MaxDBZ, city.DBZ)
+		}
+	}
+	return regions
+}
+
+type statsResponse struct {
+	FrameID uint64 `json:"frameId"`
+	*RainStats
+	Regions map[string]*RegionStats `json:"regions"`
+}
+
+// HandleStats serves the histogram of the rain over the area of the
+// source in the last frame, and the cities and pixels by region.
+func (h *Handler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+	if h.Stats == nil {
+		http.Error(w, "no radar frame yet", http.StatusServiceUnavailable)
+		return
+	}
+	h.serveJSON(w, r, statsResponse{FrameID: h.Snapshot.ID, RainStats: h.Stats, Regions: regionStats(h.Snapshot.Cities, h.Stats.Regions)})
+}
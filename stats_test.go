@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestRainStatsArea(t *testing.T) {
+	const width, height = 598, 378
+	proj := lonLatProjection{lon0, lat0, lon1, lat1, width, height}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, dbzColor(30))
+		}
+	}
+	frame := &Frame{Image: img, Projection: proj}
+	field := newField(img)
+	whole := BBox{North: lat0, West: lon0, South: lat1, East: lon1}
+
+	tests := []struct {
+		name  string
+		setup func(cfg *Config)
+		// inside reports whether the count is below the whole frame
+		inside bool
+	}{
+		{name: "chmi takes the country", inside: true},
+		{name: "composite takes its sources", setup: func(cfg *Config) {
+			cfg.Source = "composite"
+			cfg.Composite.Sources = []CompositeSourceConfig{{Source: "chmi", BBox: whole}}
+		}},
+		{name: "crop", inside: true, setup: func(cfg *Config) {
+			cfg.Source = "composite"
+			cfg.Composite.Sources = []CompositeSourceConfig{{Source: "chmi", BBox: whole}}
+			cfg.Crop = BBox{North: 50.5, West: 13, South: 49, East: 17}
+		}},
+		{name: "mask areas", inside: true, setup: func(cfg *Config) {
+			cfg.Source = "composite"
+			cfg.Composite.Sources = []CompositeSourceConfig{{Source: "chmi", BBox: whole}}
+			cfg.Mask.Areas = []MaskArea{{X: 0, Y: 0, Width: 10, Height: 10}}
+		}},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		if tt.setup != nil {
+			tt.setup(cfg)
+		}
+		var buffers frameBuffers
+		s := rainStats(frame, field, buffers.statsArea(frame, cfg))
+		if s.Pixels == 0 || s.Wet != s.Pixels {
+			t.Errorf("%s: %d of %d pixels wet, want all", tt.name, s.Wet, s.Pixels)
+		}
+		if got := s.Pixels < width*height; got != tt.inside {
+			t.Errorf("%s: %d of %d pixels counted", tt.name, s.Pixels, width*height)
+		}
+		if tt.name == "mask areas" && s.Pixels != width*height-100 {
+			t.Errorf("%s: %d pixels counted, want %d", tt.name, s.Pixels, width*height-100)
+		}
+	}
+}
+
+func TestRegionHistograms(t *testing.T) {
+	const width, height = 598, 378
+	proj := lonLatProjection{lon0, lat0, lon1, lat1, width, height}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	// rain over the west half, Praha in it and Brno out
+	for y := 0; y < height; y++ {
+		for x := 0; x < width/2; x++ {
+			img.SetNRGBA(x, y, dbzColor(30))
+		}
+	}
+	frame := &Frame{Image: img, Projection: proj}
+	field := newField(img)
+	pha, jhm := praha, brno
+	pha.Region, jhm.Region = "PHA", "JHM"
+	cities := []*City{&pha, &jhm, {ID: 3, Name: "Nowhere", Lat: 49.5, Lon: 15}}
+
+	var buffers frameBuffers
+	area := buffers.statsArea(frame, defaultConfig())
+	regions, names := buffers.regionPixels(frame, area, cities)
+	areas := regionHistograms(field, regions, names)
+	if len(areas) != 2 {
+		t.Fatalf("%d regions, want PHA and JHM", len(areas))
+	}
+	if a := areas["PHA"]; a.Pixels == 0 || a.Wet != a.Pixels {
+		t.Errorf("PHA: %d of %d pixels wet, want all", a.Wet, a.Pixels)
+	}
+	if a := areas["JHM"]; a.Pixels == 0 || a.Wet != 0 {
+		t.Errorf("JHM: %d of %d pixels wet, want none", a.Wet, a.Pixels)
+	}
+	if s := regionStats(cities, areas); s["PHA"].Cities != 1 || s["PHA"].Area != areas["PHA"] {
+		t.Errorf("PHA stats %+v do not carry the area", s["PHA"])
+	}
+}
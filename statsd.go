@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type StatsDConfig struct {
+	// Address of a StatsD server, or of a Graphite plaintext listener with
+	// the graphite protocol; empty disables the output.
+	Address string `yaml:"address"`
+	// Protocol is statsd (UDP) or graphite (TCP).
+	Protocol string `yaml:"protocol"`
+	// Prefix starts every metric name.
+	Prefix string `yaml:"prefix"`
+}
+
+func (c StatsDConfig) validate() error {
+	if c.Protocol != "statsd" && c.Protocol != "graphite" {
+		return fmt.Errorf("unknown statsd protocol %q, use statsd or graphite", c.Protocol)
+	}
+	return nil
+}
+
+// statsdPacket keeps UDP datagrams within a common MTU.
+const statsdPacket = 1432
+
+// metricName turns a city name such as Děčín into decin, usable as one
+// segment of a metric path.
+func metricName(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range foldName(s) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			underscore = false
+			b.WriteRune(r)
+		default:
+			underscore = true
+		}
+	}
+	return b.String()
+}
+
+// StatsD sends the rain state of every city as gauges, e.g.
+// ledradar.city.brno.dbz, and the time the pipeline steps take, to StatsD
+// or Graphite.
+type StatsD struct {
+	m    sync.Mutex
+	cfg  StatsDConfig
+	conn net.Conn
+}
+
+func (s *StatsD) Configure(cfg StatsDConfig) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if cfg == s.cfg {
+		return
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.cfg = cfg
+	if cfg.Address != "" {
+		log.Printf("Sending metrics to %s %s", cfg.Protocol, cfg.Address)
+	}
+}
+
+func (s *StatsD) Name() string {
+	return "statsd"
+}
+
+// metric formats one value in the protocol of the output.
+func (s *StatsD) metric(name string, value float64, kind string, now time.Time) string {
+	if s.cfg.Prefix != "" {
+		name = s.cfg.Prefix + "." + name
+	}
+	if s.cfg.Protocol == "graphite" {
+		return fmt.Sprintf("%s %g %d\n", name, value, now.Unix())
+	}
+	return fmt.Sprintf("%s:%g|%s\n", name, value, kind)
+}
+
+// write sends the metrics, connecting first if needed; a failed
+// connection is dropped and made again on the next write.
+func (s *StatsD) write(metrics []string) error {
+	if s.conn == nil {
+		network := "udp"
+		if s.cfg.Protocol == "graphite" {
+			network = "tcp"
+		}
+		conn, err := net.DialTimeout(network, s.cfg.Address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	var err error
+	for _, m := range metrics {
+		// StatsD takes one datagram per packet, Graphite a stream
+		if s.cfg.Protocol == "statsd" && buf.Len()+len(m) > statsdPacket {
+			err = errors.Join(err, flush())
+		}
+		buf.WriteString(m)
+	}
+	if err = errors.Join(err, flush()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *StatsD) Send(u *Update) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cfg.Address == "" {
+		return nil
+	}
+
+	var metrics []string
+	raining := 0
+	for _, city := range u.Cities {
+		name := "city." + metricName(city.Name)
+		wet := 0.0
+		if city.Raining() {
+			wet = 1
+			raining++
+		}
+		metrics = append(metrics,
+			s.metric(name+".dbz", city.DBZ, "g", u.Now),
+			s.metric(name+".intensity", float64(city.Intensity), "g", u.Now),
+			s.metric(name+".raining", wet, "g", u.Now),
+			s.metric(name+".strikes", float64(city.Strikes10Min), "g", u.Now),
+		)
+	}
+	metrics = append(metrics,
+		s.metric("raining", float64(raining), "g", u.Now),
+		s.metric("frame.age", u.Now.Sub(u.Frame).Seconds(), "g", u.Now),
+	)
+	return s.write(metrics)
+}
+
+// Timing reports d as the duration of a pipeline step.
+func (s *StatsD) Timing(step string, d time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cfg.Address == "" {
+		return
+	}
+	ms := float64(d.Microseconds()) / 1000
+	if err := s.write([]string{s.metric("timing."+step, ms, "ms", time.Now())}); err != nil {
+		log.Printf("statsd: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FrameReport is how the processing of a frame went.
+type FrameReport struct {
+	Frame time.Time `json:"frame"`
+	// FrameID is the snapshot the frame was published as.
+	FrameID uint64    `json:"frameId,omitempty"`
+	Source  string    `json:"source"`
+	Started time.Time `json:"started"`
+	// DurationMs is the whole run, StagesMs the download, decode, detect
+	// and save stages in it. Echo tops add to download and decode.
+	DurationMs float64            `json:"durationMs"`
+	StagesMs   map[string]float64 `json:"stagesMs"`
+	Cities     int                `json:"cities"`
+	Raining    int                `json:"raining"`
+	// Error is why the frame was not processed.
+	Error   string                   `json:"error,omitempty"`
+	Outputs map[string]*OutputReport `json:"outputs"`
+}
+
+// OutputReport is how the update of a frame went to an output.
+type OutputReport struct {
+	// State is queued, sent, failed or dropped when the output fell
+	// behind.
+	State      string  `json:"state"`
+	Attempts   int     `json:"attempts,omitempty"`
+	DurationMs float64 `json:"durationMs,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// frameReport collects the report of a frame while it is processed and
+// its outputs deliver it.
+type frameReport struct {
+	m      sync.Mutex
+	report FrameReport
+	done   bool
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// stage adds d to step, until the run is done.
+func (r *frameReport) stage(step string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.done {
+		r.report.StagesMs[step] += milliseconds(d)
+	}
+}
+
+func (r *frameReport) evaluated(cities, raining int) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.report.Cities, r.report.Raining = cities, raining
+}
+
+func (r *frameReport) published(id uint64) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.report.FrameID = id
+}
+
+func (r *frameReport) output(name string, o OutputReport) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.report.Outputs[name] = &o
+}
+
+// finish ends the run at now, err is why the frame was skipped.
+func (r *frameReport) finish(now time.Time, err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.report.DurationMs = milliseconds(now.Sub(r.report.Started))
+	if err != nil {
+		r.report.Error = err.Error()
+	}
+	r.done = true
+}
+
+func (r *frameReport) snapshot() *FrameReport {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s := r.report
+	s.StagesMs = maps.Clone(s.StagesMs)
+	s.Outputs = map[string]*OutputReport{}
+	for name, o := range r.report.Outputs {
+		c := *o
+		s.Outputs[name] = &c
+	}
+	return &s
+}
+
+// frameReports keeps the report of the last frame the loop processed.
+type frameReports struct {
+	m    sync.Mutex
+	last *frameReport
+}
+
+func (f *frameReports) begin(source string, frame, started time.Time) *frameReport {
+	r := &frameReport{report: FrameReport{
+		Frame:    frame,
+		Source:   source,
+		Started:  started,
+		StagesMs: map[string]float64{},
+		Outputs:  map[string]*OutputReport{},
+	}}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.last = r
+	return r
+}
+
+// current is the report of the frame being processed, nil between runs.
+func (f *frameReports) current() *frameReport {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.last == nil {
+		return nil
+	}
+	f.last.m.Lock()
+	defer f.last.m.Unlock()
+	if f.last.done {
+		return nil
+	}
+	return f.last
+}
+
+func (f *frameReports) latest() *FrameReport {
+	f.m.Lock()
+	last := f.last
+	f.m.Unlock()
+	if last == nil {
+		return nil
+	}
+	return last.snapshot()
+}
+
+// since reports the time a stage of the frame took to StatsD and the
+// frame report.
+func (h *Handler) since(step string, start time.Time) {
+	d := h.clock.Now().Sub(start)
+	h.statsd.Timing(step, d)
+	h.reports.current().stage(step, d)
+}
+
+type statusResponse struct {
+	LastFrame *FrameReport `json:"lastFrame"`
+	NextRun   *time.Time   `json:"nextRun"`
+	// DryRun is set when the outputs only log what they would send.
+	DryRun bool `json:"dryRun"`
+	// Polling is the adaptive poll mode: normal, near or dry.
+	Polling pollMode `json:"polling"`
+}
+
+// HandleStatus serves the report of the last frame processed and when the
+// loop runs next.
+func (h *Handler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	h.m.RLock()
+	next := h.nextPollTime()
+	h.m.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statusResponse{LastFrame: h.reports.latest(), NextRun: next, DryRun: h.dryRun, Polling: h.adaptive.Mode()})
+}
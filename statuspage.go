@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Health levels, from best to worst.
+const (
+	healthGreen = "green"
+	healthAmber = "amber"
+	healthRed   = "red"
+)
+
+func worseHealth(a, b string) string {
+	rank := map[string]int{healthGreen: 0, healthAmber: 1, healthRed: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// HealthCheck is how one part of the service is doing.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Level  string `json:"level"`
+	Detail string `json:"detail"`
+}
+
+// HealthSummary tells at a glance whether the map can be trusted: the
+// worst level of the feed, the age of the frame and the outputs.
+type HealthSummary struct {
+	Level   string     `json:"level"`
+	Message string     `json:"message"`
+	Checked time.Time  `json:"checked"`
+	Frame   *time.Time `json:"frame"`
+	// FrameAgeSeconds is how old the shown frame is, 0 before the first.
+	FrameAgeSeconds int           `json:"frameAgeSeconds"`
+	Feed            HealthCheck   `json:"feed"`
+	Age             HealthCheck   `json:"age"`
+	Outputs         []HealthCheck `json:"outputs"`
+}
+
+// ageText is d for people, in minutes or hours and minutes.
+func ageText(d time.Duration) string {
+	m := int(d.Round(time.Minute).Minutes())
+	switch {
+	case m < 1:
+		return "less than a minute"
+	case m < 60:
+		return fmt.Sprintf("%d min", m)
+	}
+	return fmt.Sprintf("%d h %d min", m/60, m%60)
+}
+
+// health grades the feed by the failed downloads in a row, the
+// frame by staleAfter and staleLimit, red past twice staleAfter without a
+// limit, and the outputs by how the last frame went to them.
+func (h *Handler) health() HealthSummary {
+	h.m.RLock()
+	age, stale, expired := h.staleness()
+	frame, source, cfg := h.FrameTime, h.DataSource, h.config
+	h.m.RUnlock()
+	report := h.reports.latest()
+	s := HealthSummary{Checked: h.clock.Now(), Outputs: []HealthCheck{}}
+
+	s.Feed = HealthCheck{Name: "feed", Level: healthGreen, Detail: "the radar images download fine"}
+	switch {
+	case cfg.Redis.Replica:
+		s.Feed.Detail = "following the frames of the leading instance"
+	case h.breaker.State() == breakerOpen:
+		s.Feed.Level, s.Feed.Detail = healthRed, "the radar images keep failing to download, paused until they recover"
+	case h.breaker.State() == breakerHalfOpen:
+		s.Feed.Level, s.Feed.Detail = healthAmber, "trying the radar images again after failures"
+	case h.breaker.ConsecutiveFailures() > 0:
+		s.Feed.Level, s.Feed.Detail = healthAmber, "the last download failed"
+		if report != nil && report.Error != "" {
+			s.Feed.Detail += ": " + report.Error
+		}
+	}
+	if source != "" {
+		s.Feed.Detail += " (" + source + ")"
+	}
+
+	s.Age = HealthCheck{Name: "age", Level: healthGreen}
+	if frame.IsZero() {
+		s.Age.Level, s.Age.Detail = healthRed, "no radar frame yet"
+	} else {
+		s.Frame = &frame
+		s.FrameAgeSeconds = int(age.Seconds())
+		s.Age.Detail = "the map shows radar from " + ageText(age) + " ago"
+		if expired || cfg.StaleLimit == 0 && age > 2*cfg.StaleAfter {
+			s.Age.Level = healthRed
+		} else if stale {
+			s.Age.Level = healthAmber
+		}
+	}
+
+	if report != nil {
+		for name, o := range report.Outputs {
+			c := HealthCheck{Name: name}
+			switch o.State {
+			case "sent":
+				c.Level, c.Detail = healthGreen, "got the last frame"
+				if o.Attempts > 1 {
+					c.Level, c.Detail = healthAmber, fmt.Sprintf("got the last frame after %d attempts", o.Attempts)
+				}
+			case "queued":
+				c.Level, c.Detail = healthAmber, "sending the last frame"
+			case "dropped":
+				c.Level, c.Detail = healthRed, "fell behind and skipped the last frame"
+			default:
+				c.Level, c.Detail = healthRed, "failed: "+o.Error
+			}
+			s.Outputs = append(s.Outputs, c)
+		}
+		sort.Slice(s.Outputs, func(i, j int) bool { return s.Outputs[i].Name < s.Outputs[j].Name })
+	}
+
+	s.Level = worseHealth(s.Feed.Level, s.Age.Level)
+	for _, c := range s.Outputs {
+		s.Level = worseHealth(s.Level, c.Level)
+	}
+	s.Message = map[string]string{
+		healthGreen: "The map is up to date.",
+		healthAmber: "The map works, but something needs a look.",
+		healthRed:   "The map cannot be trusted right now.",
+	}[s.Level]
+	return s
+}
+
+// healthStatus is the response code of the status page, 503 when it is
+// red so uptime monitors alert on it.
+func healthStatus(s HealthSummary) int {
+	if s.Level == healthRed {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// HandleHealthJSON serves the health summary as JSON, the twin of
+// /status.html.
+func (h *Handler) HandleHealthJSON(w http.ResponseWriter, r *http.Request) {
+	s := h.health()
+	body, err := json.Marshal(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(healthStatus(s))
+	if r.Method != http.MethodHead {
+		w.Write(append(body, '\n'))
+	}
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>LED radar: {{.Level}}</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.5em; }
+ul { list-style: none; padding: 0; }
+li { margin: .6em 0; }
+.dot { display: inline-block; width: .9em; height: .9em; border-radius: 50%; margin-right: .5em; vertical-align: -.1em; }
+.green { background: #2e9e44; } .amber { background: #e8a317; } .red { background: #d12f2f; }
+.detail { color: #555; }
+small { color: #888; }
+</style>
+</head>
+<body>
+<h1><span class="dot {{.Level}}"></span>{{.Message}}</h1>
+<ul>
+<li><span class="dot {{.Age.Level}}"></span>Radar <span class="detail">{{.Age.Detail}}</span></li>
+<li><span class="dot {{.Feed.Level}}"></span>Feed <span class="detail">{{.Feed.Detail}}</span></li>
+{{- range .Outputs}}
+<li><span class="dot {{.Level}}"></span>{{.Name}} <span class="detail">{{.Detail}}</span></li>
+{{- end}}
+</ul>
+<small>Checked {{.Checked.Local.Format "2006-01-02 15:04:05"}}, refreshes every minute.</small>
+</body>
+</html>
+`))
+
+// HandleStatusPage serves the health summary as a page for people to see
+// whether the map is right, green, amber or red, refreshing every minute.
+// It answers 503 when red, as does /status.json.
+func (h *Handler) HandleStatusPage(w http.ResponseWriter, r *http.Request) {
+	s := h.health()
+	var b bytes.Buffer
+	if err := statusPage.Execute(&b, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(healthStatus(s))
+	if r.Method != http.MethodHead {
+		w.Write(b.Bytes())
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamKeepalive is how often an idle event stream sends a comment, so
+// proxies do not close it between frames.
+const streamKeepalive = 30 * time.Second
+
+// HandleEvents streams a frame event with all the cities of the main list
+// as server-sent events, the current state first and then after every
+// update.
+func (h *Handler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		h.m.RLock()
+		wake := h.pollWake
+		var event *FrameEvent
+		if snap := h.Snapshot; !snap.FrameTime.IsZero() {
+			event = &FrameEvent{Frame: snap.FrameTime, FrameID: snap.ID, Cities: make([]City, len(snap.Cities)), Simulated: snap.DataSource == simulationSource}
+			for i, city := range snap.Cities {
+				event.Cities[i] = *city
+			}
+		}
+		h.m.RUnlock()
+
+		if event != nil {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: frame\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+	wait:
+		for {
+			select {
+			case <-wake:
+				break wait
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
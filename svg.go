@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// renderSVG draws the Czech outline with a dot per city in its radar
+// color, width pixels wide. Dry cities are hollow.
+func renderSVG(cities []*City, width int, labels bool) []byte {
+	box := czechBBox
+	// equirectangular, stretched so distances look right at mid latitude
+	kx := math.Cos(radians((box.North + box.South) / 2))
+	scale := float64(width) / ((box.East - box.West) * kx)
+	height := int(math.Ceil((box.North - box.South) * scale))
+	point := func(lat, lon float64) (float64, float64) {
+		return (lon - box.West) * kx * scale, (box.North - lat) * scale
+	}
+	r := float64(width) / 160
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", width, height, width, height)
+
+	b.WriteString(`<polygon fill="#f4f4f4" stroke="#333" stroke-width="1.5" stroke-linejoin="round" points="`)
+	for i, p := range czechBorder {
+		x, y := point(p[1], p[0])
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%.1f,%.1f", x, y)
+	}
+	b.WriteString(`"/>` + "\n")
+
+	for _, city := range cities {
+		x, y := point(city.Lat, city.Lon)
+		style := `fill="none" stroke="#999"`
+		if city.Raining() {
+			style = fmt.Sprintf(`fill="#%02x%02x%02x" stroke="#333"`, city.R, city.G, city.B)
+		}
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="%.1f" %s><title>`, x, y, r, style)
+		xml.EscapeText(&b, []byte(city.Name))
+		b.WriteString("</title></circle>\n")
+
+		if labels {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" font-family="sans-serif" font-size="%.1f" fill="#333">`, x+r*1.5, y+r/2, r*2)
+			xml.EscapeText(&b, []byte(city.Name))
+			b.WriteString("</text>\n")
+		}
+	}
+
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// HandleMapSVG serves the cities on a vector map of the country.
+// width sets the size in pixels, labels=true|false adds city names.
+func (h *Handler) HandleMapSVG(w http.ResponseWriter, r *http.Request) {
+	width := 800
+	if v := r.URL.Query().Get("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 16 || n > 8192 {
+			http.Error(w, "width must be between 16 and 8192", http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+	if !h.writeStaleness(w) {
+		return
+	}
+
+	labels := h.config.Image.Labels
+	if v := r.URL.Query().Get("labels"); v != "" {
+		var err error
+		if labels, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid labels", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-svg-%d-%t"`, h.FrameTime.Unix(), width, labels))
+	h.serveFrame(w, r, "image/svg+xml", renderSVG(h.Snapshot.Cities, width, labels))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+type SystemdConfig struct {
+	// Grace is how long a poll may run late before the watchdog stops
+	// being pinged and systemd restarts the service.
+	Grace time.Duration `yaml:"grace"`
+}
+
+// sdNotify sends a state such as READY=1 to systemd, it does nothing
+// unless the service runs with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is the WatchdogSec systemd expects pings within, 0
+// when the watchdog is off or meant for another process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings systemd at half its interval as long as the background
+// loop, if this instance runs one, polls on schedule. A download or frame
+// that hangs for longer than grace past the scheduled poll stops the
+// pings, so systemd restarts the service; a radar outage does not, the
+// loop keeps polling through it.
+func (h *Handler) Watchdog(grace time.Duration, loop bool) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("Pinging the systemd watchdog every %s", interval/2)
+
+	started := h.clock.Now()
+	for range time.Tick(interval / 2) {
+		h.m.RLock()
+		due := h.nextPoll
+		h.m.RUnlock()
+		if due.IsZero() {
+			due = started
+		}
+		if late := h.clock.Now().Sub(due); loop && late > grace {
+			log.Printf("Background loop is %s late, not pinging the watchdog", late.Round(time.Second))
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("systemd: %s", err)
+		}
+	}
+}
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// activationListeners returns the sockets systemd passed with a .socket
+// unit, none without socket activation.
+func activationListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// keep them from children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var lns []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd")
+		if f == nil {
+			return nil, errors.New("systemd socket is not open")
+		}
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// listen returns the sockets passed by systemd or listens on addrs.
+func listen(addrs ListenAddrs) ([]net.Listener, error) {
+	lns, err := activationListeners()
+	if lns != nil || err != nil {
+		for _, ln := range lns {
+			log.Printf("Serving on socket %s from systemd", ln.Addr())
+		}
+		return lns, err
+	}
+	for _, addr := range addrs {
+		ln, err := listenAddr(addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		log.Printf("Serving on %s", ln.Addr())
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type APIConfig struct {
+	// Tokens lock the public endpoints: with any configured, requests need
+	// one as "Authorization: Bearer <token>" or ?token=.
+	Tokens []APIToken `yaml:"tokens"`
+}
+
+// APIToken lets one client in, such as the LED map of a friend.
+type APIToken struct {
+	Token string `yaml:"token"`
+	// Name tells the clients apart in the logs.
+	Name string `yaml:"name"`
+	// Set binds the token to a city set of sets: /, /cities, /poll and
+	// /state.bin serve its cities, /cities/search and /nearest search them
+	// and the endpoints of all cities are closed. Empty sees everything.
+	Set string `yaml:"set"`
+	// RateLimit is how many requests a minute the token may make, in
+	// bursts of as many; 0 is unlimited.
+	RateLimit int `yaml:"rateLimit"`
+}
+
+func (c APIConfig) validate(sets map[string]string) error {
+	seen := map[string]bool{}
+	for _, t := range c.Tokens {
+		if t.Token == "" {
+			return errors.New("api token must not be empty")
+		}
+		if seen[t.Token] {
+			return fmt.Errorf("api token %s is given twice", t.Name)
+		}
+		seen[t.Token] = true
+		if _, ok := sets[t.Set]; t.Set != "" && !ok {
+			return fmt.Errorf("api token %s: unknown city set %q", t.Name, t.Set)
+		}
+		if t.RateLimit < 0 {
+			return fmt.Errorf("api token %s: rateLimit must not be negative", t.Name)
+		}
+	}
+	return nil
+}
+
+// setPaths are what tokens bound to a city set may call besides their
+// /sets/{name}.
+var setPaths = []string{"/", "/cities", "/cities/search", "/nearest", "/poll", "/state.bin", "/matrix", "/status", "/status.html", "/status.json"}
+
+// adminPath tells the endpoints of adminRoutes, guarded by the admin
+// token instead.
+func adminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/pprof/") || path == "/frames" || path == "/cities/geocode"
+}
+
+type tokenKey struct{}
+
+// requestToken is the token the request came with, nil without tokens.
+func requestToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(tokenKey{}).(*APIToken)
+	return t
+}
+
+// Tenants lets requests with a token of the current config through within
+// its rate limit and keeps tokens bound to a city set to its cities.
+func (h *Handler) Tenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens := h.Config().API.Tokens
+		if len(tokens) == 0 || r.Method == http.MethodOptions || adminPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			given = r.URL.Query().Get("token")
+		}
+		i := slices.IndexFunc(tokens, func(t APIToken) bool {
+			return subtle.ConstantTimeCompare([]byte(given), []byte(t.Token)) == 1
+		})
+		if given == "" || i < 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ledradar"`)
+			http.Error(w, "api token required", http.StatusUnauthorized)
+			return
+		}
+		token := &tokens[i]
+
+		if wait, ok := h.tenants.allow(token, h.clock.Now()); !ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		if token.Set != "" {
+			if !slices.Contains(setPaths, r.URL.Path) && r.URL.Path != "/sets/"+token.Set {
+				http.Error(w, "not available for tokens bound to a city set", http.StatusForbidden)
+				return
+			}
+			// the search endpoints take the set as ?set=
+			q := r.URL.Query()
+			q.Set("set", token.Set)
+			r.URL.RawQuery = q.Encode()
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	})
+}
+
+// tenantCities are the cities and the raining ones the request may see.
+// Must be called with h.m held.
+func (h *Handler) tenantCities(r *http.Request) ([]*City, []*City) {
+	t := requestToken(r)
+	if t == nil || t.Set == "" {
+		return h.Snapshot.Cities, h.Snapshot.CitiesWithRain
+	}
+	set, ok := h.Sets[t.Set]
+	if !ok {
+		return []*City{}, []*City{}
+	}
+	return set.Cities, set.CitiesWithRain
+}
+
+// Tenants keeps the rate limits of the tokens.
+type Tenants struct {
+	m       sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	requests float64
+	last     time.Time
+}
+
+// allow takes a request from the bucket of t, refilled at its rate limit,
+// or tells how long until the next one is allowed.
+func (ts *Tenants) allow(t *APIToken, now time.Time) (time.Duration, bool) {
+	if t.RateLimit == 0 {
+		return 0, true
+	}
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	if ts.buckets == nil {
+		ts.buckets = map[string]*tokenBucket{}
+	}
+	limit := float64(t.RateLimit)
+	b, ok := ts.buckets[t.Token]
+	if !ok {
+		b = &tokenBucket{requests: limit, last: now}
+		ts.buckets[t.Token] = b
+	}
+	b.requests = math.Min(limit, b.requests+now.Sub(b.last).Minutes()*limit)
+	b.last = now
+	if b.requests < 1 {
+		return time.Duration((1 - b.requests) / limit * float64(time.Minute)), false
+	}
+	b.requests--
+	return 0, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ledtesting "meteoradar/internal/testing"
+)
+
+func TestAdminPath(t *testing.T) {
+	tests := map[string]bool{
+		"/admin/reload":         true,
+		"/admin/":               true,
+		"/debug/pprof/heap":     true,
+		"/frames":               true,
+		"/cities/geocode":       true,
+		"/admin":                false,
+		"/frames/20240601.1230": false,
+		"/cities":               false,
+		"/cities/search":        false,
+		"/debug/cities":         false,
+		"/":                     false,
+	}
+	for path, want := range tests {
+		if got := adminPath(path); got != want {
+			t.Errorf("adminPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.API.Tokens = []APIToken{
+		{Token: "open", Name: "open"},
+		{Token: "brno", Name: "brno", Set: "brno"},
+		{Token: "slow", Name: "slow", RateLimit: 1},
+	}
+	h := NewHandler("", cfg)
+	h.clock = ledtesting.NewClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	var seen *http.Request
+	handler := h.Tenants(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		bearer string
+		status int
+		// set is the ?set= the request reaches the handler with
+		set string
+	}{
+		{name: "no token", target: "/cities", status: http.StatusUnauthorized},
+		{name: "unknown token", target: "/cities", bearer: "nope", status: http.StatusUnauthorized},
+		{name: "bearer", target: "/cities", bearer: "open", status: http.StatusOK},
+		{name: "query", target: "/cities?token=open", status: http.StatusOK},
+		{name: "bearer wins over query", target: "/cities?token=open", bearer: "nope", status: http.StatusUnauthorized},
+		{name: "preflight", method: http.MethodOptions, target: "/cities", status: http.StatusOK},
+		{name: "admin endpoints have their own token", target: "/admin/reload", status: http.StatusOK},
+		{name: "geocode is an admin endpoint", target: "/cities/geocode", status: http.StatusOK},
+		{name: "unbound token sees everything", target: "/debug/cities", bearer: "open", status: http.StatusOK},
+		{name: "set token on a set path", target: "/cities", bearer: "brno", status: http.StatusOK, set: "brno"},
+		{name: "set token cannot pick another set", target: "/cities/search?set=praha&q=x", bearer: "brno", status: http.StatusOK, set: "brno"},
+		{name: "set token on its set", target: "/sets/brno", bearer: "brno", status: http.StatusOK, set: "brno"},
+		{name: "set token on another set", target: "/sets/praha", bearer: "brno", status: http.StatusForbidden},
+		{name: "set token on all cities", target: "/debug/cities", bearer: "brno", status: http.StatusForbidden},
+		{name: "set token on the status", target: "/status", bearer: "brno", status: http.StatusOK, set: "brno"},
+		{name: "set token on the status page", target: "/status.json", bearer: "brno", status: http.StatusOK, set: "brno"},
+		{name: "rate limit", target: "/cities", bearer: "slow", status: http.StatusOK},
+		{name: "rate limit exceeded", target: "/cities", bearer: "slow", status: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		seen = nil
+		method := tt.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		r := httptest.NewRequest(method, tt.target, nil)
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if tt.status != http.StatusOK {
+			if w.Code != tt.status || seen != nil {
+				t.Errorf("%s: got %d, passed on %v, want %d", tt.name, w.Code, seen != nil, tt.status)
+			}
+			continue
+		}
+		if seen == nil {
+			t.Errorf("%s: got %d, want it passed on", tt.name, w.Code)
+			continue
+		}
+		if got := seen.URL.Query().Get("set"); got != tt.set {
+			t.Errorf("%s: set %q, want %q", tt.name, got, tt.set)
+		}
+		token := requestToken(seen)
+		if tt.bearer != "" && (token == nil || token.Token != tt.bearer) {
+			t.Errorf("%s: request token %v, want %s", tt.name, token, tt.bearer)
+		}
+	}
+}
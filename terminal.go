@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// terminalWidth is the width of the terminal in $COLUMNS, 80 when unset.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
+
+// rgbBlock is an upper half block in the foreground color over the
+// background color, two pixels in one character cell.
+func rgbBlock(top, bottom [3]uint8) string {
+	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀",
+		top[0], top[1], top[2], bottom[0], bottom[1], bottom[2])
+}
+
+// pixelRGB is the color at x, y over black, as on the LEDs.
+func pixelRGB(img *image.NRGBA, x, y int) [3]uint8 {
+	i := img.PixOffset(x, y)
+	a := uint16(img.Pix[i+3])
+	return [3]uint8{
+		uint8(uint16(img.Pix[i]) * a / 255),
+		uint8(uint16(img.Pix[i+1]) * a / 255),
+		uint8(uint16(img.Pix[i+2]) * a / 255),
+	}
+}
+
+// renderTerminal draws img width characters wide with truecolor half
+// blocks, followed by the cities and their rain state.
+func renderTerminal(w io.Writer, img *image.NRGBA, width int, cities []*City) error {
+	small := imaging.Resize(img, width, 0, imaging.Box)
+	bw := bufio.NewWriter(w)
+	bounds := small.Bounds()
+	for y := 0; y < bounds.Dy(); y += 2 {
+		for x := 0; x < bounds.Dx(); x++ {
+			bottom := [3]uint8{}
+			if y+1 < bounds.Dy() {
+				bottom = pixelRGB(small, x, y+1)
+			}
+			bw.WriteString(rgbBlock(pixelRGB(small, x, y), bottom))
+		}
+		bw.WriteString("\x1b[0m\n")
+	}
+
+	bw.WriteString("\n")
+	for _, city := range cities {
+		if !city.Raining() {
+			fmt.Fprintf(bw, "  %s %s\n", rgbText(96, 96, 96, "□"), city.Name)
+			continue
+		}
+		fmt.Fprintf(bw, "  %s %s: %s, %.0f dBZ", rgbText(city.R, city.G, city.B, "■"), city.Name, city.Intensity, city.DBZ)
+		if city.Trend != "" && city.Trend != TrendSteady {
+			fmt.Fprintf(bw, ", %s", city.Trend)
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
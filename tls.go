@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type TLSConfig struct {
+	// Cert and Key are PEM files, used unless Autocert hosts are set.
+	Cert     string         `yaml:"cert"`
+	Key      string         `yaml:"key"`
+	Autocert AutocertConfig `yaml:"autocert"`
+	// Redirect is a plain HTTP address redirecting to HTTPS, e.g. ":80".
+	// Autocert also answers its HTTP challenges there.
+	Redirect string `yaml:"redirect"`
+}
+
+// AutocertConfig gets certificates for Hosts from Let's Encrypt, caching
+// them in CacheDir.
+type AutocertConfig struct {
+	Hosts    []string `yaml:"hosts"`
+	CacheDir string   `yaml:"cacheDir"`
+	Email    string   `yaml:"email"`
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.Cert != "" || len(c.Autocert.Hosts) > 0
+}
+
+// redirectHTTPS sends clients to the same URL on https, on port.
+func redirectHTTPS(port string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
+
+// listenAndServe serves handler on the addresses of cfg.Listen, or the
+// sockets passed by systemd, over TLS when configured. systemd is told
+// once it listens.
+func listenAndServe(cfg *Config, handler http.Handler) error {
+	srv := &http.Server{Handler: handler}
+	lns, err := listen(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("systemd: %s", err)
+	}
+	if !cfg.TLS.enabled() {
+		return serveAll(lns, srv.Serve)
+	}
+
+	redirect := http.Handler(redirectHTTPS(cfg.Listen.port()))
+	cert, key := cfg.TLS.Cert, cfg.TLS.Key
+	if hosts := cfg.TLS.Autocert.Hosts; len(hosts) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(cfg.TLS.Autocert.CacheDir),
+			Email:      cfg.TLS.Autocert.Email,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+		cert, key = "", ""
+	} else {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if cfg.TLS.Redirect != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.TLS.Redirect, redirect))
+		}()
+	}
+
+	return serveAll(lns, func(ln net.Listener) error {
+		return srv.ServeTLS(ln, cert, key)
+	})
+}
+
+// serveAll runs serve on every listener until the first one fails.
+func serveAll(lns []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() { errs <- serve(ln) }()
+	}
+	return <-errs
+}
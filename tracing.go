@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig exports OpenTelemetry spans of the frame pipeline and the
+// HTTP handlers over OTLP/HTTP.
+type TracingConfig struct {
+	// Endpoint is the collector, e.g. localhost:4318, empty disables
+	// tracing.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over plain HTTP.
+	Insecure bool `yaml:"insecure"`
+	// Headers are added to every export, such as an API key.
+	Headers map[string]string `yaml:"headers"`
+	// Service is reported as service.name.
+	Service string `yaml:"service"`
+	// SampleRatio of the traces kept, 1 keeps all.
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+func (c TracingConfig) enabled() bool {
+	return c.Endpoint != ""
+}
+
+// tracer records the spans of ledradar, it does nothing until
+// setupTracing installs an exporter.
+var tracer = otel.Tracer("meteoradar")
+
+// setupTracing installs the global tracer provider and returns a function
+// flushing the remaining spans.
+func setupTracing(cfg TracingConfig) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.Service),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+// Trace starts a span for every request, named after the matched route
+// by nameRoutes.
+func Trace(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http")
+}
+
+// nameRoutes names the request span after the route template, so that
+// /willrain/{cityId} is one operation. Used as mux middleware, which runs
+// once the route is matched.
+func nameRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + tpl)
+				span.SetAttributes(semconv.HTTPRoute(tpl))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// frameAttributes describe the frame a span works on.
+func frameAttributes(source string, frameTime time.Time) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("radar.source", source),
+		attribute.String("radar.frame", frameTime.Format(frameTimeFormat)),
+	)
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fetch downloads the frame of source at t and decodes it, in spans of
+// their own.
+func (h *Handler) fetch(ctx context.Context, source Source, t time.Time) (*Frame, error) {
+	if c, ok := source.(compositeSource); ok {
+		return h.fetchComposite(ctx, c, t)
+	}
+	_, span := tracer.Start(ctx, "download", frameAttributes(source.Name(), t))
+	start := h.clock.Now()
+	content, err := h.fetcher.Fetch(source.URL(t))
+	h.since("download", start)
+	span.SetAttributes(attribute.Int("radar.bytes", len(content)))
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span = tracer.Start(ctx, "decode")
+	start = h.clock.Now()
+	frame, err := source.Decode(t, content)
+	if err != nil {
+		err = invalidFrame("%s", err)
+	} else {
+		err = h.validateFrame(source, t, content, frame)
+	}
+	h.since("decode", start)
+	endSpan(span, err)
+	return frame, err
+}
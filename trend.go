@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type TrendConfig struct {
+	// Window is how far back frames are compared.
+	Window time.Duration `yaml:"window"`
+	// MinChange is how many dBZ the reflectivity has to rise or fall over
+	// the window to count as intensifying or weakening.
+	MinChange float64 `yaml:"minChange"`
+}
+
+func (c TrendConfig) validate() error {
+	if c.Window <= 0 {
+		return fmt.Errorf("trend window must be positive")
+	}
+	if c.MinChange <= 0 {
+		return fmt.Errorf("trend minChange must be positive")
+	}
+	return nil
+}
+
+// Trend tells an arriving storm from a departing one.
+type Trend string
+
+const (
+	TrendSteady       Trend = "steady"
+	TrendIntensifying Trend = "intensifying"
+	TrendWeakening    Trend = "weakening"
+)
+
+type trendSample struct {
+	frame time.Time
+	dbz   float64
+}
+
+// trendHistory keeps the reflectivity of a city over the trend window,
+// dry frames counting as 0 dBZ.
+type trendHistory struct {
+	samples []trendSample
+}
+
+// add records the reflectivity in s for frame and reports the trend in s.
+// The samples are copied, not updated in place, so a saved history stays
+// as it was.
+func (t *trendHistory) add(s *RainState, frame time.Time, cfg TrendConfig) {
+	samples := make([]trendSample, 0, len(t.samples)+1)
+	for _, sample := range t.samples {
+		if sample.frame.After(frame.Add(-cfg.Window)) && sample.frame.Before(frame) {
+			samples = append(samples, sample)
+		}
+	}
+	t.samples = append(samples, trendSample{frame, s.DBZ})
+
+	s.Trend = TrendSteady
+	switch change := t.change(); {
+	case change >= cfg.MinChange:
+		s.Trend = TrendIntensifying
+	case change <= -cfg.MinChange:
+		s.Trend = TrendWeakening
+	}
+}
+
+// change is the rise of the least-squares line through the samples from
+// the first to the last, so a single noisy frame does not flip the trend.
+func (t *trendHistory) change() float64 {
+	n := float64(len(t.samples))
+	if n < 2 {
+		return 0
+	}
+	first := t.samples[0].frame
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range t.samples {
+		x := s.frame.Sub(first).Minutes()
+		sumX += x
+		sumY += s.dbz
+		sumXY += x * s.dbz
+		sumXX += x * x
+	}
+	d := n*sumXX - sumX*sumX
+	if d == 0 {
+		return 0
+	}
+	slope := (n*sumXY - sumX*sumY) / d
+	return slope * t.samples[len(t.samples)-1].frame.Sub(first).Minutes()
+}
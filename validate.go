@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+)
+
+type ValidateConfig struct {
+	// MaxCoverage is the share of the image echoes may cover, a frame
+	// with more is taken for one painted over by a broken renderer; 0
+	// disables the check.
+	MaxCoverage float64 `yaml:"maxCoverage"`
+	// Timestamp rejects files stamped before the frame they were fetched
+	// for, a stale copy served under the new name: the RADOLAN header,
+	// the PNG tIME chunk when there is one.
+	Timestamp bool `yaml:"timestamp"`
+	// TimestampArea is where the time is printed into the image, in
+	// pixels of the downloaded image. A frame showing the same pixels
+	// there as the last good one of another time is a stale copy too.
+	TimestampArea MaskArea `yaml:"timestampArea"`
+}
+
+func (c ValidateConfig) validate() error {
+	if c.MaxCoverage < 0 || c.MaxCoverage > 1 {
+		return fmt.Errorf("validate maxCoverage must be in [0, 1]")
+	}
+	return nil
+}
+
+// errInvalidFrame wraps the reasons validateFrame rejects a frame for.
+var errInvalidFrame = errors.New("invalid frame")
+
+func invalidFrame(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errInvalidFrame, fmt.Sprintf(format, args...))
+}
+
+// sizedSource is a source whose images always have the same size.
+type sizedSource interface {
+	frameSize() (width, height int)
+}
+
+// stampedSource is a source whose files carry the time they were made
+// for or at, ok is false for files without one.
+type stampedSource interface {
+	embeddedTime(content []byte) (t time.Time, ok bool, err error)
+}
+
+// frameStamps keeps the timestamp area of the last good frame of every
+// source.
+type frameStamps struct {
+	m    sync.Mutex
+	last map[string]frameStamp
+}
+
+type frameStamp struct {
+	t      time.Time
+	pixels []byte
+}
+
+// areaPixels copies the pixels of img in r.
+func areaPixels(img *image.NRGBA, r image.Rectangle) []byte {
+	r = r.Intersect(img.Bounds())
+	var pixels []byte
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		pixels = append(pixels, img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]...)
+	}
+	return pixels
+}
+
+// stale reports whether pixels equal the area of the last good frame of
+// key at another time than t.
+func (s *frameStamps) stale(key string, t time.Time, pixels []byte) (time.Time, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	last, ok := s.last[key]
+	return last.t, ok && !last.t.Equal(t) && bytes.Equal(last.pixels, pixels)
+}
+
+func (s *frameStamps) record(key string, t time.Time, pixels []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.last == nil {
+		s.last = map[string]frameStamp{}
+	}
+	s.last[key] = frameStamp{t, pixels}
+}
+
+// validateFrame checks a downloaded and decoded frame before it replaces
+// the last good one.
+func (h *Handler) validateFrame(source Source, t time.Time, content []byte, frame *Frame) error {
+	cfg := h.Config().Validate
+	if bytes.HasPrefix(content, pngSignature) {
+		if _, err := pngChunks(content); err != nil {
+			return invalidFrame("%s", err)
+		}
+	}
+
+	b := frame.Image.Bounds()
+	if b.Empty() {
+		return invalidFrame("empty image")
+	}
+	if s, ok := source.(sizedSource); ok {
+		if w, h := s.frameSize(); w > 0 && h > 0 && (b.Dx() != w || b.Dy() != h) {
+			return invalidFrame("image is %dx%d, expected %dx%d", b.Dx(), b.Dy(), w, h)
+		}
+	}
+
+	if s, ok := source.(stampedSource); ok && cfg.Timestamp {
+		stamp, ok, err := s.embeddedTime(content)
+		if err != nil {
+			return invalidFrame("%s", err)
+		}
+		if ok && stamp.Before(t) {
+			return invalidFrame("file is stamped %s, before the frame time", stamp.Format(time.RFC3339))
+		}
+	}
+
+	// products of a source differ in their URLs
+	key := source.URL(time.Time{})
+	var stamp []byte
+	if area := cfg.TimestampArea.rect(); cfg.Timestamp && !area.Empty() {
+		stamp = areaPixels(frame.Image, area)
+		if last, stale := h.stamps.stale(key, t, stamp); stale {
+			return invalidFrame("printed time unchanged since the frame of %s", last.Format(frameTimeFormat))
+		}
+	}
+
+	if cfg.MaxCoverage > 0 {
+		if c := coverage(frame); c > cfg.MaxCoverage {
+			return invalidFrame("echoes cover %.0f%% of the image", 100*c)
+		}
+	}
+
+	if stamp != nil {
+		h.stamps.record(key, t, stamp)
+	}
+	return nil
+}
+
+// coverage is the share of the pixels of a frame with echoes.
+func coverage(frame *Frame) float64 {
+	img := frame.Image
+	b := img.Bounds()
+	echoes := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			if row[i+3] != 0 && (row[i] != 0 || row[i+1] != 0 || row[i+2] != 0) {
+				echoes++
+			}
+		}
+	}
+	return float64(echoes) / float64(b.Dx()*b.Dy())
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunks indexes the chunks of a PNG by type, failing for files cut
+// off before the IEND chunk.
+func pngChunks(content []byte) (map[string][]byte, error) {
+	chunks := map[string][]byte{}
+	rest := content[len(pngSignature):]
+	for len(rest) >= 12 {
+		n := int(binary.BigEndian.Uint32(rest))
+		typ := string(rest[4:8])
+		if n < 0 || len(rest) < 12+n {
+			break
+		}
+		chunks[typ] = rest[8 : 8+n]
+		if typ == "IEND" {
+			return chunks, nil
+		}
+		rest = rest[12+n:]
+	}
+	return nil, fmt.Errorf("truncated png")
+}
+
+// pngTime reads the tIME chunk of a PNG, the UTC time it was last
+// modified.
+func pngTime(content []byte) (time.Time, bool, error) {
+	if !bytes.HasPrefix(content, pngSignature) {
+		return time.Time{}, false, nil
+	}
+	chunks, err := pngChunks(content)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	c, ok := chunks["tIME"]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	if len(c) != 7 {
+		return time.Time{}, false, fmt.Errorf("png tIME chunk has %d bytes", len(c))
+	}
+	year := int(binary.BigEndian.Uint16(c))
+	return time.Date(year, time.Month(c[2]), int(c[3]), int(c[4]), int(c[5]), int(c[6]), 0, time.UTC), true, nil
+}
+
+func (s chmiSource) frameSize() (int, int) {
+	return s.product.Width, s.product.Height
+}
+
+func (chmiSource) embeddedTime(content []byte) (time.Time, bool, error) {
+	return pngTime(content)
+}
+
+func (dwdSource) frameSize() (int, int) {
+	return radolanSize, radolanSize
+}
+
+// embeddedTime reads the frame time of the RADOLAN header, RW followed
+// by DDhhmm, the station 10000 and MMYY.
+func (dwdSource) embeddedTime(content []byte) (time.Time, bool, error) {
+	header := make([]byte, 17)
+	if _, err := io.ReadFull(bzip2.NewReader(bytes.NewReader(content)), header); err != nil {
+		return time.Time{}, false, fmt.Errorf("radolan: %w", err)
+	}
+	t, err := time.Parse("021504", string(header[2:8]))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("radolan: invalid header time %q", header[2:8])
+	}
+	month, err := time.Parse("0106", string(header[13:17]))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("radolan: invalid header date %q", header[13:17])
+	}
+	return time.Date(month.Year(), month.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC), true, nil
+}
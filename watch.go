@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// sparkBlocks draw the reflectivity history, from dry to 60 dBZ and more.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+func sparkline(history []float64) string {
+	var b strings.Builder
+	for _, dbz := range history {
+		if dbz <= 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		i := int(dbz / 60 * float64(len(sparkBlocks)-1))
+		b.WriteRune(sparkBlocks[max(0, min(i, len(sparkBlocks)-1))])
+	}
+	return b.String()
+}
+
+// streamEvents reads the frame events of GET /events into send until ctx
+// is done, reconnecting after errors.
+func streamEvents(ctx context.Context, url string, send func(tea.Msg)) {
+	for ctx.Err() == nil {
+		err := readEvents(ctx, url, send)
+		if ctx.Err() != nil {
+			return
+		}
+		send(watchError{err})
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func readEvents(ctx context.Context, url string, send func(tea.Msg)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+	send(watchError{nil})
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "frame" {
+				var e FrameEvent
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					return err
+				}
+				send(e)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// watchError reports the stream failing, or working again when nil.
+type watchError struct{ err error }
+
+type watchTick time.Time
+
+type watchCity struct {
+	City
+	history []float64
+}
+
+// watchModel is the state of the watch terminal UI.
+type watchModel struct {
+	url       string
+	keep      int
+	frame     time.Time
+	simulated bool
+	cities    map[int]*watchCity
+	err       error
+	height    int
+}
+
+func (m *watchModel) Init() tea.Cmd {
+	return watchTickCmd()
+}
+
+func watchTickCmd() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return watchTick(t) })
+}
+
+func (m *watchModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return m, tea.Quit
+		}
+	case tea.WindowSizeMsg:
+		m.height = msg.Height
+	case watchTick:
+		return m, watchTickCmd()
+	case watchError:
+		m.err = msg.err
+	case FrameEvent:
+		// the current frame is sent again after reconnecting
+		next := msg.Frame.After(m.frame)
+		m.frame, m.simulated = msg.Frame, msg.Simulated
+		for _, city := range msg.Cities {
+			c, ok := m.cities[city.ID]
+			if !ok {
+				c = &watchCity{}
+				m.cities[city.ID] = c
+			}
+			c.City = city
+			if next || !ok {
+				c.history = append(c.history, max(city.DBZ, 0))
+				if len(c.history) > m.keep {
+					c.history = c.history[len(c.history)-m.keep:]
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *watchModel) View() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ledradar %s", m.url)
+	if !m.frame.IsZero() {
+		fmt.Fprintf(&b, "  frame %s, %s old", m.frame.Local().Format("15:04"), time.Since(m.frame).Truncate(time.Second))
+	}
+	if m.simulated {
+		b.WriteString("  simulated")
+	}
+	b.WriteString("\n")
+	if m.err != nil {
+		fmt.Fprintf(&b, "%s, reconnecting\n", m.err)
+	}
+	b.WriteString("\n")
+
+	cities := make([]*watchCity, 0, len(m.cities))
+	for _, c := range m.cities {
+		cities = append(cities, c)
+	}
+	sort.Slice(cities, func(i, j int) bool {
+		a, b := cities[i], cities[j]
+		if a.Intensity != b.Intensity {
+			return a.Intensity > b.Intensity
+		}
+		if a.DBZ != b.DBZ {
+			return a.DBZ > b.DBZ
+		}
+		return a.Name < b.Name
+	})
+
+	rows := len(cities)
+	if m.height > 0 {
+		// header, blank line, status and the key help
+		rows = max(0, min(rows, m.height-5))
+	}
+	for _, c := range cities[:rows] {
+		marker := rgbText(96, 96, 96, "□")
+		if c.Raining() {
+			marker = rgbText(c.R, c.G, c.B, "■")
+		}
+		trend := ""
+		if c.Trend != TrendSteady {
+			trend = string(c.Trend)
+		}
+		fmt.Fprintf(&b, "%s %-24s %-9s %5.1f dBZ %-12s %s\n", marker, c.Name, c.Intensity, c.DBZ, trend, sparkline(c.history))
+	}
+	if rows < len(cities) {
+		fmt.Fprintf(&b, "… %d more\n", len(cities)-rows)
+	}
+	b.WriteString("\nq to quit")
+	return b.String()
+}
+
+// watchURL is the event stream of a local instance serving cfg.
+func watchURL(cfg *Config) string {
+	scheme := "http"
+	if cfg.TLS.enabled() {
+		scheme = "https"
+	}
+	port := cfg.Listen.port()
+	return fmt.Sprintf("%s://%s/events", scheme, net.JoinHostPort("localhost", port))
+}
+
+func watchCommand(args []string) error {
+	fs, configPath := commandFlags("watch", "[url]")
+	keep := fs.Int("history", 24, "number of frames in the history of a city")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	url := fs.Arg(0)
+	if url == "" {
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		url = watchURL(cfg)
+	} else if !strings.HasSuffix(url, "/events") {
+		url = strings.TrimSuffix(url, "/") + "/events"
+	}
+
+	m := &watchModel{url: url, keep: max(*keep, 1), cities: map[int]*watchCity{}}
+	p := tea.NewProgram(m, tea.WithAltScreen())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go streamEvents(ctx, url, p.Send)
+	_, err := p.Run()
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WindConfig struct {
+	// URL of the Open-Meteo forecast API, empty disables the wind
+	// nowcast.
+	URL string `yaml:"url"`
+	// Model is an Open-Meteo weather model such as icon_d2, empty lets
+	// Open-Meteo pick the best one for the area.
+	Model string `yaml:"model"`
+	// Level is the pressure level in hPa whose wind steers the showers.
+	Level int `yaml:"level"`
+	// Grid is the number of wind points along each side of the frame.
+	Grid int `yaml:"grid"`
+	// Refresh is how often the winds are downloaded.
+	Refresh time.Duration `yaml:"refresh"`
+	// Horizon is how far ahead the precipitation is advected, in steps
+	// of Step; echoes of at least MinDBZ count as rain arriving.
+	Horizon time.Duration `yaml:"horizon"`
+	Step    time.Duration `yaml:"step"`
+	MinDBZ  float64       `yaml:"minDbz"`
+}
+
+func (c WindConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	switch {
+	case c.Level <= 0:
+		return fmt.Errorf("wind level must be a pressure in hPa")
+	case c.Grid < 2 || c.Grid > 10:
+		return fmt.Errorf("wind grid must be 2 to 10 points")
+	case c.Refresh <= 0:
+		return fmt.Errorf("wind refresh must be positive")
+	case c.Step <= 0 || c.Horizon < c.Step:
+		return fmt.Errorf("wind step must be positive and at most the horizon")
+	}
+	return nil
+}
+
+// windPoint is the wind at a grid point, U towards the east and V towards
+// the north in km/h.
+type windPoint struct {
+	lat, lon float64
+	u, v     float64
+}
+
+// Wind keeps the steering winds over the radar area from Open-Meteo.
+type Wind struct {
+	m       sync.Mutex
+	cfg     WindConfig
+	points  []windPoint
+	fetched time.Time
+}
+
+func (w *Wind) Configure(cfg WindConfig) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if cfg != w.cfg {
+		w.points, w.fetched = nil, time.Time{}
+	}
+	w.cfg = cfg
+}
+
+// frameBBox is the area a frame covers, from its corners.
+func frameBBox(frame *Frame) BBox {
+	b := frame.Image.Bounds()
+	box := BBox{North: -90, West: 180, South: 90, East: -180}
+	for _, p := range [][2]int{{b.Min.X, b.Min.Y}, {b.Max.X - 1, b.Min.Y}, {b.Min.X, b.Max.Y - 1}, {b.Max.X - 1, b.Max.Y - 1}} {
+		lat, lon := frame.Projection.Location(p[0], p[1])
+		box.North, box.South = math.Max(box.North, lat), math.Min(box.South, lat)
+		box.West, box.East = math.Min(box.West, lon), math.Max(box.East, lon)
+	}
+	return box
+}
+
+// Refresh downloads the winds over the area of frame once they are older
+// than the refresh interval. Failures keep the previous winds.
+func (w *Wind) Refresh(fetcher Fetcher, frame *Frame, now time.Time) {
+	w.m.Lock()
+	cfg, fetched := w.cfg, w.fetched
+	w.m.Unlock()
+	if cfg.URL == "" || now.Sub(fetched) < cfg.Refresh {
+		return
+	}
+
+	box := frameBBox(frame)
+	points, err := fetchWinds(fetcher, cfg, box, now)
+	if err != nil {
+		log.Printf("Cannot get the winds: %s", err)
+		return
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.points, w.fetched = points, now
+	log.Printf("Wind at %d hPa: %s over the center of the radar", cfg.Level, windText(w.at((box.North+box.South)/2, (box.West+box.East)/2)))
+}
+
+type openMeteoHourly struct {
+	Hourly map[string][]float64 `json:"hourly"`
+}
+
+// fetchWinds asks Open-Meteo for the wind at the level on a grid over
+// box, for the hour closest to now.
+func fetchWinds(fetcher Fetcher, cfg WindConfig, box BBox, now time.Time) ([]windPoint, error) {
+	var points []windPoint
+	var lats, lons []string
+	for i := 0; i < cfg.Grid; i++ {
+		for j := 0; j < cfg.Grid; j++ {
+			p := windPoint{
+				lat: box.South + (box.North-box.South)*float64(i)/float64(cfg.Grid-1),
+				lon: box.West + (box.East-box.West)*float64(j)/float64(cfg.Grid-1),
+			}
+			points = append(points, p)
+			lats = append(lats, fmt.Sprintf("%.4f", p.lat))
+			lons = append(lons, fmt.Sprintf("%.4f", p.lon))
+		}
+	}
+
+	speed := fmt.Sprintf("wind_speed_%dhPa", cfg.Level)
+	direction := fmt.Sprintf("wind_direction_%dhPa", cfg.Level)
+	q := url.Values{
+		"latitude":        {strings.Join(lats, ",")},
+		"longitude":       {strings.Join(lons, ",")},
+		"hourly":          {speed + "," + direction},
+		"wind_speed_unit": {"kmh"},
+		"timeformat":      {"unixtime"},
+		"past_hours":      {"1"},
+		"forecast_hours":  {"2"},
+	}
+	if cfg.Model != "" {
+		q.Set("models", cfg.Model)
+	}
+	// Open-Meteo wants the commas unescaped
+	body, err := fetcher.Fetch(cfg.URL + "?" + strings.ReplaceAll(q.Encode(), "%2C", ","))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []openMeteoHourly
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, err
+	}
+	if len(results) != len(points) {
+		return nil, fmt.Errorf("open-meteo returned %d locations, expected %d", len(results), len(points))
+	}
+	for i, r := range results {
+		times, speeds, directions := r.Hourly["time"], r.Hourly[speed], r.Hourly[direction]
+		if len(times) == 0 || len(speeds) != len(times) || len(directions) != len(times) {
+			return nil, fmt.Errorf("open-meteo returned no %s", speed)
+		}
+		best := 0
+		for k, t := range times {
+			if math.Abs(t-float64(now.Unix())) < math.Abs(times[best]-float64(now.Unix())) {
+				best = k
+			}
+		}
+		// the direction is where the wind blows from
+		s, d := speeds[best], radians(directions[best])
+		points[i].u, points[i].v = -s*math.Sin(d), -s*math.Cos(d)
+	}
+	return points, nil
+}
+
+// at interpolates the wind at a position by inverse distance weighting.
+// Must be called with w.m held.
+func (w *Wind) at(lat, lon float64) (float64, float64) {
+	var u, v, total float64
+	for _, p := range w.points {
+		d := distanceKm(lat, lon, p.lat, p.lon)
+		if d < 1 {
+			return p.u, p.v
+		}
+		weight := 1 / (d * d)
+		u += weight * p.u
+		v += weight * p.v
+		total += weight
+	}
+	return u / total, v / total
+}
+
+// Arrival follows the wind upstream from the city and returns when the
+// first echo found there reaches it, the semi-Lagrangian advection of the
+// frame, or false if none does within the horizon.
+func (w *Wind) Arrival(field *Field, proj Projection, lat, lon float64) (time.Duration, bool) {
+	return w.upstream(field, proj, lat, lon, true)
+}
+
+// End is when the rain over the city stops, the first time the air
+// arriving there carries no echo, or false if it rains all the horizon.
+func (w *Wind) End(field *Field, proj Projection, lat, lon float64) (time.Duration, bool) {
+	return w.upstream(field, proj, lat, lon, false)
+}
+
+// upstream steps upstream from lat, lon and returns the first lead time
+// at which the echoes, or the lack of them, reaching it match wet.
+func (w *Wind) upstream(field *Field, proj Projection, lat, lon float64, wet bool) (time.Duration, bool) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.cfg.URL == "" || len(w.points) == 0 {
+		return 0, false
+	}
+
+	step := w.cfg.Step.Hours()
+	for t := w.cfg.Step; t <= w.cfg.Horizon; t += w.cfg.Step {
+		u, v := w.at(lat, lon)
+		lat -= degrees(v * step / earthRadius)
+		lon -= degrees(u * step / (earthRadius * math.Cos(radians(lat))))
+
+		x, y := proj.Pixel(lat, lon)
+		echo := false
+		for dy := -1; dy <= 1 && !echo; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				if dbz := field.At(x+dx, y+dy); !math.IsNaN(float64(dbz)) && float64(dbz) >= w.cfg.MinDBZ {
+					echo = true
+					break
+				}
+			}
+		}
+		if echo == wet {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// windText describes a wind for the log, e.g. "25 km/h from 240°".
+func windText(u, v float64) string {
+	from := math.Mod(degrees(math.Atan2(-u, -v))+360, 360)
+	return fmt.Sprintf("%.0f km/h from %.0f°", math.Hypot(u, v), from)
+}